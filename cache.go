@@ -0,0 +1,450 @@
+package fastdns
+
+import (
+	"context"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache implements a sharded DNS response cache which stores raw wire responses.
+// It can be placed in front of a Client via Client.Cache or serve as a Handler.
+type Cache struct {
+	// Client is the upstream client which ServeDNS forwards cache misses to.
+	Client *Client
+
+	// MaxEntries limits the number of responses held by the cache, the least
+	// recently used entries are evicted first.
+	// If not set, use 65536 as default.
+	MaxEntries int
+
+	// MinTTL raises the lifetime of positive responses which have smaller TTLs.
+	MinTTL uint32
+
+	// MaxTTL caps the lifetime of positive responses.
+	// If not set, use 86400 as default.
+	MaxTTL uint32
+
+	// MaxNegativeTTL caps the lifetime of NXDOMAIN/NODATA responses, see RFC 2308.
+	// If not set, use 3600 as default.
+	MaxNegativeTTL uint32
+
+	// MaxStaleAge enables serve-stale per RFC 8767, expired responses are answered
+	// with StaleTTL while being refreshed in the background, up to MaxStaleAge
+	// after expiration.
+	MaxStaleAge time.Duration
+
+	// StaleTTL specifies the TTL of stale answers.
+	// If not set, use 30 as default.
+	StaleTTL uint32
+
+	// PrefetchHits enables prefetching, responses which were hit at least
+	// PrefetchHits times are refreshed in the background shortly before expiration.
+	PrefetchHits int
+
+	// PrefetchPercentage specifies how much of the original TTL must remain
+	// before a popular response is prefetched.
+	// If not set, use 10 as default.
+	PrefetchPercentage int
+
+	// Stats specifies an optional CacheStats counting the lookups, refreshes and
+	// evictions of the cache.
+	Stats CacheStats
+
+	once   sync.Once
+	seed   maphash.Seed
+	shards [cacheShardCount]cacheShard
+}
+
+const cacheShardCount = 64
+
+// CacheEvent is an event of a Cache counted by CacheStats.
+type CacheEvent byte
+
+const (
+	CacheHit     CacheEvent = 1 // a lookup is answered by a fresh response
+	CacheStale   CacheEvent = 2 // a lookup is answered by a stale response
+	CacheMiss    CacheEvent = 3 // a lookup finds no response
+	CacheRefresh CacheEvent = 4 // a stale or popular response is fetched again
+	CacheEvict   CacheEvent = 5 // a response is evicted to make room
+)
+
+// String returns the canonical text form of the CacheEvent value.
+func (e CacheEvent) String() string {
+	switch e {
+	case CacheHit:
+		return "hit"
+	case CacheStale:
+		return "stale"
+	case CacheMiss:
+		return "miss"
+	case CacheRefresh:
+		return "refresh"
+	case CacheEvict:
+		return "evict"
+	}
+	return ""
+}
+
+type cacheShard struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	// head is the sentinel of the LRU list, head.next is the most recently used.
+	head cacheEntry
+	max  int
+}
+
+type cacheEntry struct {
+	key     string
+	domain  string
+	raw     []byte
+	ttls    []uint16 // offsets of the TTL fields in raw
+	ttl     uint32
+	hits    int
+	stored  time.Time
+	expires time.Time
+	// refresh is the unix nano time before which no background refresh is issued.
+	refresh atomic.Int64
+
+	prev, next *cacheEntry
+}
+
+// init allocates the shards on first use.
+func (c *Cache) init() {
+	c.once.Do(func() {
+		if c.MaxEntries <= 0 {
+			c.MaxEntries = 65536
+		}
+		if c.MaxTTL == 0 {
+			c.MaxTTL = 86400
+		}
+		if c.MaxNegativeTTL == 0 {
+			c.MaxNegativeTTL = 3600
+		}
+		if c.StaleTTL == 0 {
+			c.StaleTTL = 30
+		}
+		if c.PrefetchPercentage == 0 {
+			c.PrefetchPercentage = 10
+		}
+		c.seed = maphash.MakeSeed()
+		for i := range c.shards {
+			s := &c.shards[i]
+			s.entries = make(map[string]*cacheEntry)
+			s.head.prev, s.head.next = &s.head, &s.head
+			s.max = max(c.MaxEntries/cacheShardCount, 1)
+		}
+	})
+}
+
+// appendCacheKey appends the lowercased question name, type and class of msg to dst.
+func appendCacheKey(dst []byte, msg *Message) []byte {
+	for _, b := range msg.Question.Name {
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		dst = append(dst, b)
+	}
+	return append(dst,
+		byte(msg.Question.Type>>8), byte(msg.Question.Type),
+		byte(msg.Question.Class>>8), byte(msg.Question.Class),
+	)
+}
+
+// shard returns the shard owning key.
+func (c *Cache) shard(key string) *cacheShard {
+	return &c.shards[maphash.String(c.seed, key)%cacheShardCount]
+}
+
+// Get fills resp with the cached response of req, it rewrites the ID and
+// decrements the TTLs by the time elapsed since the response was stored, and
+// appends an OPT record without options if req has one.
+func (c *Cache) Get(req, resp *Message) bool {
+	return c.get(req, resp, c.Client)
+}
+
+// get looks up req and refreshes stale or popular entries through client.
+func (c *Cache) get(req, resp *Message, client *Client) bool {
+	c.init()
+
+	var buf [264]byte
+	key := appendCacheKey(buf[:0], req)
+
+	s := c.shard(b2s(key))
+	now := time.Now()
+
+	s.mu.Lock()
+	e := s.entries[b2s(key)]
+	if e == nil {
+		s.mu.Unlock()
+		c.update(CacheMiss)
+		return false
+	}
+	stale := !now.Before(e.expires)
+	if stale && (c.MaxStaleAge <= 0 || now.Sub(e.expires) > c.MaxStaleAge) {
+		s.remove(e)
+		s.mu.Unlock()
+		c.update(CacheMiss)
+		return false
+	}
+	s.moveToFront(e)
+	e.hits++
+	prefetch := !stale && c.PrefetchHits > 0 && e.hits >= c.PrefetchHits &&
+		e.expires.Sub(now) < time.Duration(e.ttl)*time.Second*time.Duration(c.PrefetchPercentage)/100
+	resp.Raw = append(resp.Raw[:0], e.raw...)
+	stored, ttls := e.stored, e.ttls
+	s.mu.Unlock()
+
+	if stale {
+		c.update(CacheStale)
+	} else {
+		c.update(CacheHit)
+	}
+
+	if (stale || prefetch) && client != nil {
+		c.refresh(e, client, now)
+	}
+
+	elapsed := uint32(now.Sub(stored) / time.Second)
+	for _, i := range ttls {
+		ttl := uint32(resp.Raw[i])<<24 | uint32(resp.Raw[i+1])<<16 | uint32(resp.Raw[i+2])<<8 | uint32(resp.Raw[i+3])
+		switch {
+		case stale:
+			// RFC 8767: stale answers are returned with a short TTL.
+			ttl = c.StaleTTL
+		case ttl > elapsed:
+			ttl -= elapsed
+		default:
+			ttl = 0
+		}
+		resp.Raw[i], resp.Raw[i+1], resp.Raw[i+2], resp.Raw[i+3] = byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl)
+	}
+
+	// ID
+	resp.Raw[0], resp.Raw[1] = byte(req.Header.ID>>8), byte(req.Header.ID)
+	// keep the letter case of the question name, E.g. DNS 0x20 encoding.
+	copy(resp.Raw[12:], req.Question.Name)
+
+	// the OPT record is rebuilt from req, the stored one belongs to another client.
+	if opt, do, _ := requestDO(req); opt {
+		arcount := int(resp.Raw[10])<<8 | int(resp.Raw[11]) + 1
+		resp.Raw[10], resp.Raw[11] = byte(arcount>>8), byte(arcount)
+		resp.Raw = appendOPT(resp.Raw, 0)
+		if do {
+			resp.Raw[len(resp.Raw)-4] |= 0x80
+		}
+	}
+
+	return ParseMessage(resp, resp.Raw, false) == nil
+}
+
+// cacheRefreshInterval is the minimum interval between two refreshes of an entry,
+// it is the failure recheck timer of RFC 8767.
+const cacheRefreshInterval = 30 * time.Second
+
+// refresh fetches the response of e again in the background through client.
+func (c *Cache) refresh(e *cacheEntry, client *Client, now time.Time) {
+	next := e.refresh.Load()
+	if now.UnixNano() < next || !e.refresh.CompareAndSwap(next, now.Add(cacheRefreshInterval).UnixNano()) {
+		return
+	}
+	c.update(CacheRefresh)
+
+	// the stored question is the lowercased name, type and class.
+	typ := Type(e.key[len(e.key)-4])<<8 | Type(e.key[len(e.key)-3])
+	class := Class(e.key[len(e.key)-2])<<8 | Class(e.key[len(e.key)-1])
+
+	upstream := client.upstream()
+
+	go func() {
+		req, resp := AcquireMessage(), AcquireMessage()
+		defer ReleaseMessage(resp)
+		defer ReleaseMessage(req)
+
+		req.SetRequestQuestion(e.domain, typ, class)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cacheRefreshInterval)
+		defer cancel()
+
+		if upstream.Exchange(ctx, req, resp) == nil {
+			c.Set(resp)
+		}
+	}()
+}
+
+// Set stores resp in the cache if it is cacheable, without its OPT record which
+// carries the options of the client, E.g. COOKIE and ECS.
+func (c *Cache) Set(resp *Message) {
+	c.init()
+
+	ttl, ok := c.ttl(resp)
+	if !ok {
+		return
+	}
+
+	e := &cacheEntry{
+		key:    string(appendCacheKey(make([]byte, 0, len(resp.Question.Name)+4), resp)),
+		domain: string(resp.Domain),
+		raw:    append([]byte(nil), resp.Raw...),
+		ttl:    ttl,
+		stored: time.Now(),
+	}
+	e.expires = e.stored.Add(time.Duration(ttl) * time.Second)
+
+	opt, end := -1, -1
+	records := resp.Records()
+	for records.Next() {
+		r := records.Item()
+		data := cap(resp.Raw) - cap(r.Data)
+		if r.Type == TypeOPT {
+			// the root name, TYPE, CLASS, TTL and RDLENGTH are in front of RDATA.
+			opt, end = data-11, data+len(r.Data)
+			continue
+		}
+		// TTL, RDLENGTH are in front of RDATA
+		e.ttls = append(e.ttls, uint16(data-6))
+	}
+	if records.Err() != nil {
+		return
+	}
+	if opt >= 0 {
+		if resp.Raw[opt] != 0 {
+			return
+		}
+		e.raw = append(e.raw[:opt], resp.Raw[end:]...)
+		arcount := int(e.raw[10])<<8 | int(e.raw[11]) - 1
+		e.raw[10], e.raw[11] = byte(arcount>>8), byte(arcount)
+		for i, j := range e.ttls {
+			if int(j) > opt {
+				e.ttls[i] -= uint16(end - opt)
+			}
+		}
+	}
+
+	s := c.shard(e.key)
+
+	s.mu.Lock()
+	if old := s.entries[e.key]; old != nil {
+		s.remove(old)
+	}
+	s.entries[e.key] = e
+	s.pushFront(e)
+	evicted := 0
+	for len(s.entries) > s.max {
+		s.remove(s.head.prev)
+		evicted++
+	}
+	s.mu.Unlock()
+
+	for ; evicted > 0; evicted-- {
+		c.update(CacheEvict)
+	}
+}
+
+// ttl computes the cache lifetime of resp and reports whether it is cacheable.
+func (c *Cache) ttl(resp *Message) (ttl uint32, ok bool) {
+	if resp.Header.Flags.QR() == 0 || resp.Header.Flags.TC() != 0 || resp.Header.QDCount != 1 {
+		return
+	}
+
+	rcode := resp.Header.Flags.Rcode()
+	if rcode != RcodeNoError && rcode != RcodeNXDomain {
+		return
+	}
+
+	ttl = c.MaxTTL
+	negative := rcode == RcodeNXDomain || resp.Header.ANCount == 0
+
+	records := resp.Records()
+	for i := 0; records.Next(); i++ {
+		r := records.Item()
+		switch {
+		case i < int(resp.Header.ANCount):
+			ttl = min(ttl, r.TTL)
+		case negative && r.Type == TypeSOA && len(r.Data) >= 20:
+			// RFC 2308: the TTL of negative answers is the minimum of the SOA TTL and SOA MINIMUM.
+			minimum := uint32(r.Data[len(r.Data)-4])<<24 | uint32(r.Data[len(r.Data)-3])<<16 | uint32(r.Data[len(r.Data)-2])<<8 | uint32(r.Data[len(r.Data)-1])
+			ttl = min(ttl, c.MaxNegativeTTL, r.TTL, minimum)
+			ok = true
+		}
+	}
+	if records.Err() != nil {
+		return 0, false
+	}
+
+	if negative {
+		// RFC 2308: negative answers without SOA should not be cached.
+		return ttl, ok && ttl > 0
+	}
+
+	ttl = max(ttl, c.MinTTL)
+
+	return ttl, ttl > 0
+}
+
+// Len returns the number of cached responses.
+func (c *Cache) Len() (n int) {
+	c.init()
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += len(s.entries)
+		s.mu.Unlock()
+	}
+	return
+}
+
+// update counts the event in Stats.
+func (c *Cache) update(event CacheEvent) {
+	if c.Stats != nil {
+		c.Stats.UpdateCacheStats(event)
+	}
+}
+
+// ServeDNS answers req from the cache and forwards misses to Client.
+func (c *Cache) ServeDNS(rw ResponseWriter, req *Message) {
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+
+	if c.Get(req, resp) {
+		_, _ = rw.Write(resp.Raw)
+		return
+	}
+
+	if c.Client == nil {
+		Error(rw, req, RcodeServFail)
+		return
+	}
+
+	err := c.Client.Exchange(context.Background(), req, resp)
+	if err != nil {
+		Error(rw, req, RcodeServFail)
+		return
+	}
+	if c.Client.Cache != c {
+		c.Set(resp)
+	}
+
+	_, _ = rw.Write(resp.Raw)
+}
+
+// pushFront inserts e as the most recently used entry.
+func (s *cacheShard) pushFront(e *cacheEntry) {
+	e.prev, e.next = &s.head, s.head.next
+	s.head.next.prev = e
+	s.head.next = e
+}
+
+// moveToFront marks e as the most recently used entry.
+func (s *cacheShard) moveToFront(e *cacheEntry) {
+	e.prev.next, e.next.prev = e.next, e.prev
+	s.pushFront(e)
+}
+
+// remove unlinks e from the shard.
+func (s *cacheShard) remove(e *cacheEntry) {
+	e.prev.next, e.next.prev = e.next, e.prev
+	e.prev, e.next = nil, nil
+	delete(s.entries, e.key)
+}
@@ -0,0 +1,377 @@
+package fastdns
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// mockCacheResponse builds a NOERROR response for domain with a single A record.
+func mockCacheResponse(domain string, ttl uint32) *Message {
+	msg := AcquireMessage()
+	msg.SetRequestQuestion(domain, TypeA, ClassINET)
+	msg.SetResponseHeader(RcodeNoError, 1)
+	msg.AppendHOST1(ttl, netip.AddrFrom4([4]byte{1, 2, 3, 4}))
+	if err := ParseMessage(msg, msg.Raw, false); err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// TestCacheGetSet verifies ID rewriting and in-place TTL decrements on hit.
+func TestCacheGetSet(t *testing.T) {
+	cache := &Cache{}
+
+	resp := mockCacheResponse("example.org", 300)
+	defer ReleaseMessage(resp)
+	cache.Set(resp)
+
+	req, got := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(got)
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion("ExAmple.ORG", TypeA, ClassINET)
+
+	// pretend the entry was stored 100 seconds ago
+	for i := range cache.shards {
+		for _, e := range cache.shards[i].entries {
+			e.stored = e.stored.Add(-100 * time.Second)
+		}
+	}
+
+	if !cache.Get(req, got) {
+		t.Fatalf("cache.Get(%s) shall hit", req.Domain)
+	}
+	if got.Header.ID != req.Header.ID {
+		t.Errorf("cache.Get(%s) shall rewrite id to %d, got %d", req.Domain, req.Header.ID, got.Header.ID)
+	}
+	if string(got.Domain) != "ExAmple.ORG" {
+		t.Errorf("cache.Get(%s) shall keep question case, got %s", req.Domain, got.Domain)
+	}
+	records := got.Records()
+	for records.Next() {
+		if r := records.Item(); r.TTL != 200 {
+			t.Errorf("cache.Get(%s) shall decrement ttl to 200, got %d", req.Domain, r.TTL)
+		}
+	}
+
+	req.SetRequestQuestion("example.org", TypeAAAA, ClassINET)
+	if cache.Get(req, got) {
+		t.Errorf("cache.Get(%s, %s) shall miss", req.Domain, req.Question.Type)
+	}
+}
+
+// TestCacheNegative caches NXDOMAIN with the SOA minimum per RFC 2308.
+func TestCacheNegative(t *testing.T) {
+	cache := &Cache{}
+
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+
+	resp.SetRequestQuestion("nxdomain.example.org", TypeA, ClassINET)
+	resp.SetResponseHeader(RcodeNoError, 0)
+	resp.AppendSOA(3600, net.NS{Host: "ns1.example.org"}, net.NS{Host: "admin.example.org"}, 1, 7200, 900, 86400, 60)
+	resp.Raw[3] |= byte(RcodeNXDomain)
+	resp.Raw[9] = 1 // NSCOUNT
+	if err := ParseMessage(resp, resp.Raw, false); err != nil {
+		t.Fatalf("ParseMessage error: %+v", err)
+	}
+
+	cache.Set(resp)
+
+	if ttl, ok := cache.ttl(resp); !ok || ttl != 60 {
+		t.Errorf("cache.ttl(NXDOMAIN) shall be 60, got %d %v", ttl, ok)
+	}
+
+	req, got := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(got)
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion("nxdomain.example.org", TypeA, ClassINET)
+	if !cache.Get(req, got) {
+		t.Fatalf("cache.Get(%s) shall hit", req.Domain)
+	}
+	if rcode := got.Header.Flags.Rcode(); rcode != RcodeNXDomain {
+		t.Errorf("cache.Get(%s) shall return NXDOMAIN, got %s", req.Domain, rcode)
+	}
+
+	// NXDOMAIN at the end of a CNAME chain keeps the smaller TTL of the chain
+	resp.SetRequestQuestion("alias.example.org", TypeA, ClassINET)
+	resp.SetResponseHeader(RcodeNoError, 1)
+	resp.AppendCNAME(30, []string{"nxdomain.example.org"}, nil)
+	resp.AppendSOA(3600, net.NS{Host: "ns1.example.org"}, net.NS{Host: "admin.example.org"}, 1, 7200, 900, 86400, 60)
+	resp.Raw[3] |= byte(RcodeNXDomain)
+	resp.Raw[9] = 1 // NSCOUNT
+	if err := ParseMessage(resp, resp.Raw, false); err != nil {
+		t.Fatalf("ParseMessage error: %+v", err)
+	}
+	if ttl, ok := cache.ttl(resp); !ok || ttl != 30 {
+		t.Errorf("cache.ttl(NXDOMAIN with CNAME) shall be 30, got %d %v", ttl, ok)
+	}
+
+	// NODATA without SOA is not cacheable
+	resp.SetRequestQuestion("nodata.example.org", TypeA, ClassINET)
+	resp.SetResponseHeader(RcodeNoError, 0)
+	if _, ok := cache.ttl(resp); ok {
+		t.Errorf("cache.ttl(NODATA without SOA) shall not be cacheable")
+	}
+}
+
+// TestCacheOPT stores the responses without their OPT records, and rebuilds the
+// OPT record from the request.
+func TestCacheOPT(t *testing.T) {
+	cache := &Cache{}
+
+	resp := mockCacheResponse("example.org", 300)
+	defer ReleaseMessage(resp)
+	roa, _ := resp.OptionsAppender()
+	roa.AppendCookie("0123456789abcdef")
+	if err := ParseMessage(resp, resp.Raw, false); err != nil {
+		t.Fatalf("ParseMessage error: %+v", err)
+	}
+	cache.Set(resp)
+
+	req, got := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(got)
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	if !cache.Get(req, got) {
+		t.Fatalf("cache.Get(%s) shall hit", req.Domain)
+	}
+	if got.Header.ARCount != 0 || got.Header.ANCount != 1 || len(got.Raw) != len(resp.Raw)-11-20 {
+		t.Errorf("cache.Get(%s) without OPT got %x", req.Domain, got.Raw)
+	}
+
+	// DO
+	qoa, _ := req.OptionsAppender()
+	qoa.init()
+	req.Raw[len(req.Raw)-4] |= 0x80
+	if err := ParseMessage(req, req.Raw, false); err != nil {
+		t.Fatalf("ParseMessage error: %+v", err)
+	}
+	if !cache.Get(req, got) {
+		t.Fatalf("cache.Get(%s) with OPT shall hit", req.Domain)
+	}
+	// an OPT record with DO and no options
+	opt := appendOPT(nil, 0)
+	opt[7] |= 0x80
+	if got.Header.ARCount != 1 || !bytes.HasSuffix(got.Raw, opt) {
+		t.Errorf("cache.Get(%s) with OPT got %x", req.Domain, got.Raw)
+	}
+	records := got.Records()
+	for records.Next() {
+		if r := records.Item(); r.Type == TypeA && r.TTL != 300 {
+			t.Errorf("cache.Get(%s) shall keep ttl 300, got %d", req.Domain, r.TTL)
+		}
+	}
+}
+
+// TestCacheEviction bounds the number of entries.
+func TestCacheEviction(t *testing.T) {
+	cache := &Cache{MaxEntries: cacheShardCount}
+
+	for i := 0; i < 1000; i++ {
+		resp := mockCacheResponse("host"+strconv.Itoa(i)+".example.org", 300)
+		cache.Set(resp)
+		ReleaseMessage(resp)
+	}
+
+	if n := cache.Len(); n > cacheShardCount {
+		t.Errorf("cache.Len() shall not exceed %d, got %d", cacheShardCount, n)
+	}
+}
+
+// TestCacheClient serves repeated lookups from the cache.
+func TestCacheClient(t *testing.T) {
+	handler := &mockRetryHandler{}
+
+	client := &Client{
+		Addr:    serveTestHandler(t, handler),
+		Timeout: time.Second,
+		Cache:   &Cache{},
+	}
+
+	for i := 0; i < 3; i++ {
+		ips, err := client.LookupNetIP(context.Background(), "ip4", "example.org")
+		if err != nil || len(ips) != 1 {
+			t.Fatalf("LookupNetIP return ips: %+v error: %+v", ips, err)
+		}
+	}
+
+	if n := handler.count.Load(); n != 1 {
+		t.Errorf("handler shall be called once, got %d", n)
+	}
+}
+
+// BenchmarkCacheGet measures the cache hit path.
+func BenchmarkCacheGet(b *testing.B) {
+	cache := &Cache{}
+
+	resp := mockCacheResponse("example.org", 300)
+	defer ReleaseMessage(resp)
+	cache.Set(resp)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req, got := AcquireMessage(), AcquireMessage()
+		req.SetRequestQuestion("example.org", TypeA, ClassINET)
+		for pb.Next() {
+			if !cache.Get(req, got) {
+				b.Errorf("cache.Get(%s) shall hit", req.Domain)
+			}
+		}
+	})
+}
+
+// waitHandlerCount polls until handler was called n times or the deadline is reached.
+func waitHandlerCount(handler *mockRetryHandler, n int32) int32 {
+	for i := 0; i < 100 && handler.count.Load() < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return handler.count.Load()
+}
+
+// TestCacheServeStale answers expired entries with StaleTTL and refreshes them.
+func TestCacheServeStale(t *testing.T) {
+	handler := &mockRetryHandler{}
+
+	cache := &Cache{
+		Client:      &Client{Addr: serveTestHandler(t, handler), Timeout: time.Second},
+		MaxStaleAge: time.Hour,
+	}
+
+	resp := mockCacheResponse("example.org", 300)
+	defer ReleaseMessage(resp)
+	cache.Set(resp)
+
+	// pretend the entry expired 10 seconds ago
+	for i := range cache.shards {
+		for _, e := range cache.shards[i].entries {
+			e.stored = e.stored.Add(-310 * time.Second)
+			e.expires = e.expires.Add(-310 * time.Second)
+		}
+	}
+
+	req, got := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(got)
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	if !cache.Get(req, got) {
+		t.Fatalf("cache.Get(%s) shall serve stale answer", req.Domain)
+	}
+	records := got.Records()
+	for records.Next() {
+		if r := records.Item(); r.TTL != 30 {
+			t.Errorf("cache.Get(%s) shall return stale ttl 30, got %d", req.Domain, r.TTL)
+		}
+	}
+
+	if n := waitHandlerCount(handler, 1); n != 1 {
+		t.Fatalf("stale entry shall be refreshed once, got %d", n)
+	}
+	for i := 0; i < 100; i++ {
+		if cache.Get(req, got) && got.Header.ANCount == 1 {
+			records := got.Records()
+			if records.Next() && records.Item().TTL == 600 {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := handler.count.Load(); n != 1 {
+		t.Errorf("refreshed entry shall not be refreshed again, got %d", n)
+	}
+}
+
+// TestCachePrefetch refreshes popular entries shortly before expiration.
+func TestCachePrefetch(t *testing.T) {
+	handler := &mockRetryHandler{}
+
+	cache := &Cache{
+		Client:       &Client{Addr: serveTestHandler(t, handler), Timeout: time.Second},
+		PrefetchHits: 2,
+	}
+
+	resp := mockCacheResponse("example.org", 300)
+	defer ReleaseMessage(resp)
+	cache.Set(resp)
+
+	// pretend the entry expires in 10 seconds
+	for i := range cache.shards {
+		for _, e := range cache.shards[i].entries {
+			e.stored = e.stored.Add(-290 * time.Second)
+			e.expires = e.expires.Add(-290 * time.Second)
+		}
+	}
+
+	req, got := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(got)
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	if !cache.Get(req, got) {
+		t.Fatalf("cache.Get(%s) shall hit", req.Domain)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := handler.count.Load(); n != 0 {
+		t.Fatalf("unpopular entry shall not be prefetched, got %d", n)
+	}
+
+	if !cache.Get(req, got) {
+		t.Fatalf("cache.Get(%s) shall hit", req.Domain)
+	}
+	if n := waitHandlerCount(handler, 1); n != 1 {
+		t.Errorf("popular entry shall be prefetched, got %d", n)
+	}
+}
+
+// TestCacheRefreshResolv refreshes entries through the name servers of resolv.conf.
+func TestCacheRefreshResolv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte("nameserver 192.0.2.53\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &mockRetryHandler{}
+	cache := &Cache{
+		Client: &Client{
+			Dialer:  &mockMapDialer{addrs: map[string]string{"192.0.2.53:53": serveTestHandler(t, handler)}},
+			Resolv:  &ResolvConf{Path: path},
+			Timeout: time.Second,
+		},
+		MaxStaleAge: time.Hour,
+	}
+
+	resp := mockCacheResponse("example.org", 300)
+	defer ReleaseMessage(resp)
+	cache.Set(resp)
+
+	// pretend the entry expired 10 seconds ago
+	for i := range cache.shards {
+		for _, e := range cache.shards[i].entries {
+			e.stored = e.stored.Add(-310 * time.Second)
+			e.expires = e.expires.Add(-310 * time.Second)
+		}
+	}
+
+	req, got := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(got)
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	if !cache.Get(req, got) {
+		t.Fatalf("cache.Get(%s) shall serve stale answer", req.Domain)
+	}
+	if n := waitHandlerCount(handler, 1); n != 1 {
+		t.Errorf("stale entry shall be refreshed through resolv.conf, got %d", n)
+	}
+}
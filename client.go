@@ -1,9 +1,11 @@
 package fastdns
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -25,81 +27,279 @@ type Client struct {
 	// Dialer allows for customizing the way connections are established.
 	// If set, Addr and Timeout will be ignore.
 	Dialer Dialer
+
+	// Retry specifies the retry policy of Exchange.
+	// If nil, a single attempt is made.
+	Retry *RetryPolicy
+
+	// Cache specifies an optional response cache consulted before the network.
+	// Queries carrying a client subnet bypass the cache.
+	Cache *Cache
+
+	// Resolv specifies an optional resolv.conf(5) source, its name servers are used
+	// instead of Addr and its search list applies to the Lookup methods.
+	Resolv *ResolvConf
+
+	// Hosts specifies an optional hosts(5) source consulted before the network.
+	Hosts *Hosts
+
+	// AddrOrder specifies the order of addresses returned by LookupNetIP for network "ip".
+	AddrOrder AddrOrder
+
+	// Validator enables the DNSSEC validation of responses, the queries carry the
+	// DO and CD bits, a secure response has the AD bit set and a bogus response
+	// fails with a DNSSECError. See WithDNSSECStatus for the status of a lookup.
+	Validator *DNSSECValidator
+
+	// SingleFlight coalesces concurrent identical queries, only one of them is
+	// sent upstream and all callers receive a copy of its response.
+	SingleFlight bool
+
+	// Stats specifies an optional UpstreamStats recording the exchanges with the
+	// upstream servers.
+	Stats UpstreamStats
+
+	// Dnstap specifies an optional Dnstap logging the exchanges with the upstream
+	// servers as FORWARDER_QUERY and FORWARDER_RESPONSE messages.
+	Dnstap *Dnstap
+
+	flightsMu sync.Mutex
+	flights   map[string]*clientFlight
 }
 
 // Exchange executes a DNS transaction and unmarshals the response into resp.
 func (c *Client) Exchange(ctx context.Context, req, resp *Message) (err error) {
-	err = c.exchange(ctx, req, resp)
-	// if err != nil && os.IsTimeout(err) {
-	// 	err = c.exchange(req, resp)
-	// }
-	return err
-}
+	options, _ := ctx.Value(clientOptionsContextKey).(*clientOptionsContextValue)
 
-// exchange performs the transport-level DNS round trip with the configured dialer.
-func (c *Client) exchange(ctx context.Context, req, resp *Message) error {
-	var err error
-	var conn net.Conn
+	cache := c.Cache
+	if cache != nil && options != nil && options.prefix.IsValid() {
+		cache = nil
+	}
+	if cache != nil && cache.get(req, resp, c) {
+		return c.validate(ctx, resp)
+	}
 
-	if c.Dialer != nil {
-		conn, err = c.Dialer.DialContext(ctx, "udp", c.Addr)
+	if c.SingleFlight {
+		err = c.exchangeShared(ctx, req, resp, options)
 	} else {
-		conn, err = net.Dial("udp", c.Addr)
+		err = c.exchangeOnce(ctx, req, resp, options)
 	}
-	if err != nil {
-		return err
+
+	if err == nil && cache != nil {
+		cache.Set(resp)
 	}
 
-	if c.Timeout > 0 {
-		err = conn.SetDeadline(time.Now().Add(c.Timeout))
-		if err != nil && err != errors.ErrUnsupported {
-			return err
+	if err == nil {
+		err = c.validate(ctx, resp)
+	}
+
+	return err
+}
+
+// upstream returns a Client sending the queries to the upstream servers of c,
+// without the cache, the hosts and the coalescing of c.
+func (c *Client) upstream() *Client {
+	return &Client{
+		Addr:    c.Addr,
+		Timeout: c.Timeout,
+		Dialer:  c.Dialer,
+		Retry:   c.Retry,
+		Resolv:  c.Resolv,
+		Stats:   c.Stats,
+		Dnstap:  c.Dnstap,
+	}
+}
+
+// exchangeOnce appends the context options to req and runs the transaction.
+func (c *Client) exchangeOnce(ctx context.Context, req, resp *Message, options *clientOptionsContextValue) error {
+	timeout, retry, edns0 := c.Timeout, c.Retry, false
+	if c.Resolv != nil {
+		conf := c.Resolv.Config()
+		if timeout == 0 {
+			timeout = conf.Timeout
 		}
-		defer conn.SetDeadline(time.Time{}) // nolint:errcheck
+		if retry == nil {
+			retry = conf.retry
+		}
+		edns0 = conf.EDNS0
 	}
 
-	if options, ok := ctx.Value(clientOptionsContextKey).(*clientOptionsContextValue); ok {
+	dnssec := c.Validator != nil
+	if options != nil || edns0 || dnssec {
 		roa, err := req.OptionsAppender()
 		if err != nil {
 			return err
 		}
-		if options.prefix.IsValid() {
-			roa.AppendSubnet(options.prefix)
+		if options != nil {
+			if options.prefix.IsValid() {
+				roa.AppendSubnet(options.prefix)
+			}
+			if options.cookie != "" {
+				roa.AppendCookie(options.cookie)
+			}
+			if options.nsid {
+				roa.AppendNSID("")
+			}
+			if options.dau != "" {
+				roa.AppendDAU([]DNSSECAlgorithm(options.dau))
+			}
+			if options.dhu != "" {
+				roa.AppendDHU([]byte(options.dhu))
+			}
+			if options.n3u != "" {
+				roa.AppendN3U([]byte(options.n3u))
+			}
+			if options.expire {
+				roa.AppendExpire(0)
+			}
+			if options.keepalive {
+				roa.AppendKeepalive(0)
+			}
+			if options.tagged {
+				roa.AppendClientTag(options.tag)
+			}
+			if options.padding != 0 {
+				roa.AppendPadding(options.padding)
+			}
 		}
-		if options.cookie != "" {
-			roa.AppendCookie(options.cookie)
+		if (edns0 || dnssec) && roa.offset == 0 {
+			roa.init()
 		}
-		if options.padding != 0 {
-			roa.AppendPadding(options.padding)
+		if dnssec {
+			// DO
+			req.Raw[roa.offset-2] |= 0b10000000
+			// CD, it is restored after the exchange and cleared from the echo of
+			// resp, so that a reused message does not disable the upstream
+			// validation of the other queries.
+			flags := req.Header.Flags
+			defer func() {
+				req.Header.Flags = flags
+				req.Raw[3] = byte(flags)
+				if flags&0b0000000000010000 == 0 && len(resp.Raw) > 3 {
+					resp.Header.Flags &^= 0b0000000000010000
+					resp.Raw[3] &^= 0b00010000
+				}
+			}()
+			req.Header.Flags |= 0b0000000000010000
+			req.Raw[3] |= 0b00010000
 		}
 	}
 
-	_, err = conn.Write(req.Raw)
-	if err != nil {
-		return err
+	if retry == nil {
+		return c.exchange(ctx, req, resp, timeout, 0)
 	}
 
-	resp.Raw = resp.Raw[:cap(resp.Raw)]
-	n, err := conn.Read(resp.Raw)
+	return retry.exchange(ctx, c, req, resp, timeout)
+}
+
+// exchange performs the transport-level DNS round trip with the configured dialer,
+// attempt counts the previous attempts of the query.
+func (c *Client) exchange(ctx context.Context, req, resp *Message, timeout time.Duration, attempt int) (err error) {
+	var conn net.Conn
+
+	addr := c.Addr
+	if c.Resolv != nil {
+		addr = c.Resolv.nameserver(attempt)
+	}
+	if server, ok := ctx.Value(clientServerContextKey).(string); ok {
+		addr = server
+	}
+
+	if c.Stats != nil {
+		start := time.Now()
+		defer func() {
+			c.Stats.UpdateUpstreamStats(addr, resp, time.Since(start), err)
+		}()
+	}
+
+	if c.Dialer != nil {
+		conn, err = c.Dialer.DialContext(ctx, "udp", addr)
+	} else {
+		conn, err = net.Dial("udp", addr)
+	}
 	if err != nil {
 		return err
 	}
 
-	resp.Raw = resp.Raw[:n]
-	err = ParseMessage(resp, resp.Raw, false)
+	defer func() {
+		// a late reply of a failed exchange must not answer the next query on
+		// a pooled conn, the dialer replaces the closed conn.
+		if err != nil || c.Dialer == nil {
+			_ = conn.Close()
+		}
+		if d, _ := c.Dialer.(interface {
+			Put(c net.Conn)
+		}); d != nil {
+			d.Put(conn)
+		}
+	}()
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	if !deadline.IsZero() {
+		err = conn.SetDeadline(deadline)
+		if err != nil && err != errors.ErrUnsupported {
+			return err
+		}
+		defer conn.SetDeadline(time.Time{}) // nolint:errcheck
+	}
+
+	_, err = conn.Write(req.Raw)
 	if err != nil {
 		return err
 	}
 
-	if d, _ := c.Dialer.(interface {
-		Put(c net.Conn)
-	}); d != nil {
-		d.Put(conn)
+	var queryTime time.Time
+	if c.Dnstap != nil {
+		queryTime = time.Now()
+		protocol, local, remote := dnstapConnAddrs(conn)
+		c.Dnstap.log(dnstapForwarderQuery, protocol, local, remote, queryTime, req.Raw, time.Time{}, nil)
 	}
 
-	if c.Dialer == nil {
-		_ = conn.Close()
+	// the replies of the other queries are skipped.
+	for i := 0; ; i++ {
+		resp.Raw = resp.Raw[:cap(resp.Raw)]
+		var n int
+		n, err = conn.Read(resp.Raw)
+		if err != nil {
+			return err
+		}
+
+		resp.Raw = resp.Raw[:n]
+		if c.Dnstap != nil {
+			protocol, local, remote := dnstapConnAddrs(conn)
+			c.Dnstap.log(dnstapForwarderResponse, protocol, local, remote, queryTime, nil, time.Now(), resp.Raw)
+		}
+		err = ParseMessage(resp, resp.Raw, false)
+		if err != nil {
+			return err
+		}
+		if matchResponse(req, resp) {
+			return nil
+		}
+		if i == maxSkippedReplies {
+			err = ErrInvalidAnswer
+			return err
+		}
 	}
+}
+
+// maxSkippedReplies limits the replies of the other queries read by an exchange.
+const maxSkippedReplies = 8
 
-	return nil
+// matchResponse reports whether resp answers the query of req by its ID and question.
+func matchResponse(req, resp *Message) bool {
+	if len(req.Raw) < 2 || len(resp.Raw) < 2 || req.Raw[0] != resp.Raw[0] || req.Raw[1] != resp.Raw[1] {
+		return false
+	}
+	if len(req.Question.Name) == 0 {
+		return true
+	}
+	return resp.Question.Type == req.Question.Type && resp.Question.Class == req.Question.Class &&
+		bytes.EqualFold(resp.Question.Name, req.Question.Name)
 }
@@ -0,0 +1,185 @@
+package fastdns
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// AddrOrder specifies how LookupNetIP orders the addresses of network "ip".
+type AddrOrder byte
+
+const (
+	// AddrOrderNone returns IPv4 addresses followed by IPv6 addresses.
+	AddrOrderNone AddrOrder = iota
+	// AddrOrderRFC6724 sorts addresses by the destination address selection of RFC 6724.
+	AddrOrderRFC6724
+	// AddrOrderInterleave alternates IPv6 and IPv4 addresses as RFC 8305 section 4.
+	AddrOrderInterleave
+)
+
+// orderAddrs merges ip4 and ip6 addresses into dst with the given order.
+func orderAddrs(dst, ip4, ip6 []netip.Addr, order AddrOrder) []netip.Addr {
+	n := len(dst)
+	switch order {
+	case AddrOrderInterleave:
+		for i := 0; i < len(ip4) || i < len(ip6); i++ {
+			if i < len(ip6) {
+				dst = append(dst, ip6[i])
+			}
+			if i < len(ip4) {
+				dst = append(dst, ip4[i])
+			}
+		}
+	case AddrOrderRFC6724:
+		dst = append(append(dst, ip6...), ip4...)
+		sortByRFC6724(dst[n:])
+	default:
+		dst = append(append(dst, ip4...), ip6...)
+	}
+	return dst
+}
+
+// sortByRFC6724 sorts addrs by the rules of RFC 6724 section 6 which do not
+// need information beyond the source address chosen by the kernel.
+// See https://github.com/golang/go/blob/master/src/net/addrselect.go
+func sortByRFC6724(addrs []netip.Addr) {
+	if len(addrs) < 2 {
+		return
+	}
+
+	type selection struct {
+		dst, src netip.Addr
+		dpolicy  policyEntry
+		spolicy  policyEntry
+	}
+
+	s := make([]selection, len(addrs))
+	for i, addr := range addrs {
+		s[i].dst = addr
+		s[i].dpolicy = classifyPolicy(addr)
+		// connecting an UDP socket sends no packet, but reveals the source address.
+		if conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: addr.AsSlice(), Port: 9}); err == nil {
+			s[i].src = conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+			s[i].spolicy = classifyPolicy(s[i].src)
+			_ = conn.Close()
+		}
+	}
+
+	slices.SortStableFunc(s, func(a, b selection) int {
+		// Rule 1: Avoid unusable destinations.
+		if a.src.IsValid() != b.src.IsValid() {
+			if a.src.IsValid() {
+				return -1
+			}
+			return 1
+		}
+		if !a.src.IsValid() {
+			return 0
+		}
+
+		// Rule 2: Prefer matching scope.
+		if as, bs := scope(a.dst) == scope(a.src), scope(b.dst) == scope(b.src); as != bs {
+			if as {
+				return -1
+			}
+			return 1
+		}
+
+		// Rule 5: Prefer matching label.
+		if al, bl := a.dpolicy.label == a.spolicy.label, b.dpolicy.label == b.spolicy.label; al != bl {
+			if al {
+				return -1
+			}
+			return 1
+		}
+
+		// Rule 6: Prefer higher precedence.
+		if a.dpolicy.precedence != b.dpolicy.precedence {
+			return int(b.dpolicy.precedence) - int(a.dpolicy.precedence)
+		}
+
+		// Rule 8: Prefer smaller scope.
+		if as, bs := scope(a.dst), scope(b.dst); as != bs {
+			return int(as) - int(bs)
+		}
+
+		// Rule 9: Use longest matching prefix, only for IPv6 as RFC 6724 errata.
+		if a.dst.Is6() && b.dst.Is6() {
+			return commonPrefixLen(b.src, b.dst) - commonPrefixLen(a.src, a.dst)
+		}
+
+		// Rule 10: Otherwise, leave the order unchanged.
+		return 0
+	})
+
+	for i := range s {
+		addrs[i] = s[i].dst
+	}
+}
+
+type policyEntry struct {
+	prefix     netip.Prefix
+	precedence uint8
+	label      uint8
+}
+
+// rfc6724policyTable is the default policy table of RFC 6724 section 2.1,
+// sorted by descending prefix length.
+var rfc6724policyTable = []policyEntry{
+	{netip.MustParsePrefix("::1/128"), 50, 0},
+	{netip.MustParsePrefix("::ffff:0:0/96"), 35, 4},
+	{netip.MustParsePrefix("::/96"), 1, 3},
+	{netip.MustParsePrefix("2001::/32"), 5, 5},
+	{netip.MustParsePrefix("2002::/16"), 30, 2},
+	{netip.MustParsePrefix("3ffe::/16"), 1, 12},
+	{netip.MustParsePrefix("fec0::/10"), 1, 11},
+	{netip.MustParsePrefix("fc00::/7"), 3, 13},
+	{netip.MustParsePrefix("::/0"), 40, 1},
+}
+
+// classifyPolicy returns the policy table entry matching addr.
+func classifyPolicy(addr netip.Addr) policyEntry {
+	if addr.Is4() {
+		addr = netip.AddrFrom16(addr.As16())
+	}
+	for _, e := range rfc6724policyTable {
+		if e.prefix.Contains(addr) {
+			return e
+		}
+	}
+	return policyEntry{}
+}
+
+// scope returns the RFC 6724 scope of addr.
+func scope(addr netip.Addr) uint8 {
+	switch {
+	case addr.IsLoopback(), addr.IsLinkLocalUnicast():
+		return 0x2
+	case addr.Is6() && addr.IsMulticast():
+		return addr.As16()[1] & 0xf
+	case addr.Is6() && addr.As16()[0] == 0xfe && addr.As16()[1]&0xc0 == 0xc0:
+		// site-local
+		return 0x5
+	}
+	return 0xe
+}
+
+// commonPrefixLen reports the number of leading bits shared by a and b.
+func commonPrefixLen(a, b netip.Addr) (n int) {
+	x, y := a.As16(), b.As16()
+	for i := 0; i < 8; i++ {
+		// only the 64-bit prefix is compared, see RFC 6724 section 2.2.
+		c := x[i] ^ y[i]
+		if c == 0 {
+			n += 8
+			continue
+		}
+		for c&0x80 == 0 {
+			n++
+			c <<= 1
+		}
+		break
+	}
+	return
+}
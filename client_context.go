@@ -17,9 +17,17 @@ func (key *clientContextKey) String() string {
 var clientOptionsContextKey any = &clientContextKey{"client-options"}
 
 type clientOptionsContextValue struct {
-	prefix  netip.Prefix
-	cookie  string
-	padding uint16
+	prefix    netip.Prefix
+	cookie    string
+	padding   uint16
+	nsid      bool
+	expire    bool
+	keepalive bool
+	tagged    bool
+	tag       uint16
+	dau       string
+	dhu       string
+	n3u       string
 }
 
 func withClientOptions(ctx context.Context) (clientOptionsContextValue, bool) {
@@ -58,3 +66,94 @@ func WithClientPadding(ctx context.Context, padding uint16) context.Context {
 	v.padding = padding
 	return context.WithValue(ctx, clientOptionsContextKey, &v)
 }
+
+// WithClientNSID returns a context requesting the name server identifier.
+func WithClientNSID(ctx context.Context) context.Context {
+	v, ok := withClientOptions(ctx)
+	if ok && v.nsid {
+		return ctx
+	}
+	v.nsid = true
+	return context.WithValue(ctx, clientOptionsContextKey, &v)
+}
+
+// WithClientExpire returns a context requesting the zone expire timer.
+func WithClientExpire(ctx context.Context) context.Context {
+	v, ok := withClientOptions(ctx)
+	if ok && v.expire {
+		return ctx
+	}
+	v.expire = true
+	return context.WithValue(ctx, clientOptionsContextKey, &v)
+}
+
+// WithClientKeepalive returns a context requesting the idle timeout of the connection.
+func WithClientKeepalive(ctx context.Context) context.Context {
+	v, ok := withClientOptions(ctx)
+	if ok && v.keepalive {
+		return ctx
+	}
+	v.keepalive = true
+	return context.WithValue(ctx, clientOptionsContextKey, &v)
+}
+
+// WithClientTag returns a context carrying the edns-client-tag value.
+func WithClientTag(ctx context.Context, tag uint16) context.Context {
+	v, ok := withClientOptions(ctx)
+	if ok && v.tagged && v.tag == tag {
+		return ctx
+	}
+	v.tagged, v.tag = true, tag
+	return context.WithValue(ctx, clientOptionsContextKey, &v)
+}
+
+// WithClientDAU returns a context signaling the DNSSEC algorithms understood by the client.
+func WithClientDAU(ctx context.Context, algorithms []DNSSECAlgorithm) context.Context {
+	dau := make([]byte, len(algorithms))
+	for i, alg := range algorithms {
+		dau[i] = byte(alg)
+	}
+	v, ok := withClientOptions(ctx)
+	if ok && v.dau == string(dau) {
+		return ctx
+	}
+	v.dau = string(dau)
+	return context.WithValue(ctx, clientOptionsContextKey, &v)
+}
+
+// WithClientDHU returns a context signaling the DS hash algorithms understood by the client.
+func WithClientDHU(ctx context.Context, algorithms []byte) context.Context {
+	v, ok := withClientOptions(ctx)
+	if ok && v.dhu == string(algorithms) {
+		return ctx
+	}
+	v.dhu = string(algorithms)
+	return context.WithValue(ctx, clientOptionsContextKey, &v)
+}
+
+// WithClientN3U returns a context signaling the NSEC3 hash algorithms understood by the client.
+func WithClientN3U(ctx context.Context, algorithms []byte) context.Context {
+	v, ok := withClientOptions(ctx)
+	if ok && v.n3u == string(algorithms) {
+		return ctx
+	}
+	v.n3u = string(algorithms)
+	return context.WithValue(ctx, clientOptionsContextKey, &v)
+}
+
+var clientDNSSECStatusContextKey any = &clientContextKey{"client-dnssec-status"}
+
+// WithDNSSECStatus returns a context in which a Client with a Validator stores the
+// weakest DNSSEC status of the responses it exchanges into status, E.g. a lookup
+// of both A and AAAA records is secure only if both responses are secure.
+func WithDNSSECStatus(ctx context.Context, status *DNSSECStatus) context.Context {
+	return context.WithValue(ctx, clientDNSSECStatusContextKey, status)
+}
+
+// clientDNSSECFetchContextKey marks the queries of the validator itself, their
+// responses are validated by the validator instead of Exchange.
+var clientDNSSECFetchContextKey any = &clientContextKey{"client-dnssec-fetch"}
+
+// clientServerContextKey carries the name server address of a query which
+// replaces Addr and Resolv, it is used by the iterative queries of Recursor.
+var clientServerContextKey any = &clientContextKey{"client-server"}
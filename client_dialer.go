@@ -3,16 +3,19 @@ package fastdns
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
-	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
-	"unsafe"
 )
 
 // UDPDialer is a custom dialer for creating UDP connections.
@@ -62,8 +65,14 @@ func (d *UDPDialer) get() (_ net.Conn, err error) {
 	return c, nil
 }
 
-// Put returns the UDP connection to the pool for reuse.
+// Put returns the UDP connection to the pool for reuse, a closed connection
+// is replaced by a new one.
 func (d *UDPDialer) Put(conn net.Conn) {
+	if err := conn.SetReadDeadline(time.Time{}); errors.Is(err, net.ErrClosed) {
+		if c, err := net.DialUDP("udp", nil, d.Addr); err == nil {
+			conn = c
+		}
+	}
 	d.conns <- conn
 }
 
@@ -146,6 +155,9 @@ func (c *tcpConn) Write(b []byte) (int, error) {
 	c.buffer = append(c.buffer[:0], byte(n>>8), byte(n&0xFF))
 	c.buffer = append(c.buffer, b...)
 	_, err := c.Conn.Write(c.buffer)
+	if err != nil {
+		c.reset()
+	}
 	return n, err
 }
 
@@ -154,16 +166,40 @@ func (c *tcpConn) Read(b []byte) (n int, err error) {
 	c.buffer = c.buffer[:cap(c.buffer)]
 	n, err = c.Conn.Read(c.buffer)
 	if err != nil {
+		c.reset()
 		return
 	}
 	m := int(c.buffer[0])<<8 | int(c.buffer[1])
 	if m+2 != n {
+		c.reset()
 		return 0, ErrInvalidAnswer
 	}
 	copy(b, c.buffer[2:n])
 	return n - 2, nil
 }
 
+// SetDeadline sets the deadline of the underlying connection if it is established.
+func (c *tcpConn) SetDeadline(t time.Time) error {
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+// Close closes the underlying connection, the next write redials.
+func (c *tcpConn) Close() error {
+	c.reset()
+	return nil
+}
+
+// reset closes the broken underlying connection so that the next write redials.
+func (c *tcpConn) reset() {
+	if c.Conn != nil {
+		_ = c.Conn.Close()
+		c.Conn = nil
+	}
+}
+
 // HTTPDialer is a custom dialer for creating HTTP connections.
 // It allows sending HTTP requests with a specified endpoint, user agent, and transport configuration.
 type HTTPDialer struct {
@@ -179,8 +215,31 @@ type HTTPDialer struct {
 	// It can be customized for specific needs, E.g. User-Agent.
 	Header http.Header
 
-	once sync.Once
-	pool sync.Pool
+	// UseGET specifies whether to send queries by the GET method of RFC 8484
+	// with the base64url encoded dns parameter, which HTTP caches can store.
+	UseGET bool
+
+	// Bootstrap specifies the addresses of the Endpoint host, so that the dialer
+	// works without the system resolver. It is ignored if Transport is set.
+	Bootstrap []netip.Addr
+
+	// MaxCacheEntries limits the number of responses kept according to their
+	// Cache-Control max-age.
+	// If not set, use 1024 as default.
+	MaxCacheEntries int
+
+	once      sync.Once
+	pool      sync.Pool
+	transport http.RoundTripper
+	cacheMu   sync.Mutex
+	cache     map[string]*httpCacheEntry
+}
+
+type httpCacheEntry struct {
+	raw     []byte
+	stored  time.Time
+	expires time.Time
+	age     uint32
 }
 
 // DialContext returns an HTTP connection wrapper for DNS-over-HTTPS queries.
@@ -188,10 +247,21 @@ func (d *HTTPDialer) DialContext(ctx context.Context, network, addr string) (net
 	d.once.Do(func() {
 		if d.Header == nil {
 			d.Header = http.Header{
+				"accept":       []string{"application/dns-message"},
 				"content-type": []string{"application/dns-message"},
 				"user-agent":   []string{"fastdns/1.0"},
 			}
 		}
+		if d.MaxCacheEntries == 0 {
+			d.MaxCacheEntries = 1024
+		}
+		d.transport = d.Transport
+		if d.transport == nil && len(d.Bootstrap) != 0 {
+			d.transport = d.bootstrapTransport()
+		}
+		if d.transport == nil {
+			d.transport = http.DefaultTransport
+		}
 		d.pool = sync.Pool{
 			New: func() any {
 				return &httpConn{
@@ -217,9 +287,148 @@ func (d *HTTPDialer) DialContext(ctx context.Context, network, addr string) (net
 	return c, nil
 }
 
+// bootstrapTransport returns a transport which connects to the Endpoint host by the Bootstrap addresses.
+func (d *HTTPDialer) bootstrapTransport() http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host != d.Endpoint.Hostname() {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		var errs []error
+		for _, ip := range d.Bootstrap {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	return tr
+}
+
+// load copies the fresh cached response of query to dst.
+func (d *HTTPDialer) load(dst []byte, query []byte, now time.Time) ([]byte, bool) {
+	d.cacheMu.Lock()
+	e := d.cache[b2s(query)]
+	d.cacheMu.Unlock()
+
+	if e == nil || !now.Before(e.expires) {
+		return dst, false
+	}
+
+	dst = append(dst[:0], e.raw...)
+	decrementTTLs(dst, e.age+uint32(now.Sub(e.stored)/time.Second))
+
+	return dst, true
+}
+
+// store keeps the response of query until its Cache-Control max-age expires.
+func (d *HTTPDialer) store(query, raw []byte, header http.Header, now time.Time) {
+	maxAge, ok := parseMaxAge(header.Get("cache-control"))
+	if !ok {
+		return
+	}
+	age, _ := strconv.ParseUint(header.Get("age"), 10, 32)
+	if uint64(maxAge) <= age {
+		return
+	}
+
+	e := &httpCacheEntry{
+		raw:     append([]byte(nil), raw...),
+		stored:  now,
+		expires: now.Add(time.Duration(uint64(maxAge)-age) * time.Second),
+		age:     uint32(age),
+	}
+
+	d.cacheMu.Lock()
+	defer d.cacheMu.Unlock()
+
+	if d.cache == nil {
+		d.cache = make(map[string]*httpCacheEntry)
+	}
+	if len(d.cache) >= d.MaxCacheEntries {
+		for k, v := range d.cache {
+			if !now.Before(v.expires) {
+				delete(d.cache, k)
+			}
+		}
+		for k := range d.cache {
+			if len(d.cache) < d.MaxCacheEntries {
+				break
+			}
+			delete(d.cache, k)
+		}
+	}
+	d.cache[string(query)] = e
+}
+
+// parseMaxAge returns the max-age directive of a Cache-Control header value,
+// it fails if any directive forbids storing the response.
+func parseMaxAge(s string) (maxAge uint32, ok bool) {
+	for s != "" {
+		var directive string
+		directive, s, _ = strings.Cut(s, ",")
+		key, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(key) {
+		case "no-store", "no-cache", "private":
+			return 0, false
+		case "max-age":
+			n, err := strconv.ParseUint(strings.Trim(value, `"`), 10, 32)
+			if err != nil {
+				return 0, false
+			}
+			maxAge, ok = uint32(n), n > 0
+		}
+	}
+	return
+}
+
+// decrementTTLs subtracts age from the TTLs of the records in the raw response.
+func decrementTTLs(raw []byte, age uint32) {
+	if age == 0 {
+		return
+	}
+
+	msg := AcquireMessage()
+	buf := msg.Raw
+	defer func() {
+		// do not leak raw into the message pool.
+		msg.Raw = buf
+		ReleaseMessage(msg)
+	}()
+
+	msg.Raw = raw
+	if ParseMessage(msg, msg.Raw, false) != nil {
+		return
+	}
+
+	records := msg.Records()
+	for records.Next() {
+		r := records.Item()
+		if r.Type == TypeOPT {
+			continue
+		}
+		// TTL is followed by RDLENGTH before RDATA.
+		i := cap(raw) - cap(r.Data) - 6
+		ttl := binary.BigEndian.Uint32(raw[i:])
+		binary.BigEndian.PutUint32(raw[i:], ttl-min(ttl, age))
+	}
+}
+
 // Put releases the HTTP connection wrapper back to the pool.
 func (d *HTTPDialer) Put(conn net.Conn) {
 	if c, _ := conn.(*httpConn); c != nil {
+		// do not keep the caller's context alive in the pool.
+		c.ctx = nil
+		c.bound = nil
 		d.pool.Put(c)
 	}
 }
@@ -228,8 +437,11 @@ type httpConn struct {
 	dialer *HTTPDialer
 	ctx    context.Context
 	req    *http.Request
+	bound  *http.Request
+	url    url.URL
 	reader *bufferreader
 	writer *bufferwriter
+	query  []byte
 	resp   []byte
 }
 
@@ -252,32 +464,75 @@ func (c *httpConn) Read(b []byte) (n int, err error) {
 
 // Write issues the DNS-over-HTTPS request and stores the response body for reads.
 func (c *httpConn) Write(b []byte) (n int, err error) {
-	var tr = c.dialer.Transport
-	if tr == nil {
-		tr = http.DefaultTransport
+	if len(b) < 12 {
+		return 0, ErrInvalidHeader
 	}
 
-	c.reader.B = b
-	c.req.Body = c.reader
-	c.req.ContentLength = int64(len(b))
+	d := c.dialer
 
-	// c.req.ctx = c.ctx
-	*(*context.Context)(unsafe.Pointer(uintptr(unsafe.Pointer(c.req)) + httpctxoffset)) = c.ctx
+	// use the DNS ID 0 for HTTP caches, see RFC 8484 section 4.1.
+	c.query = append(append(c.query[:0], 0, 0), b[2:]...)
+
+	now := time.Now()
+	var hit bool
+	if c.writer.B, hit = d.load(c.writer.B, c.query, now); hit {
+		c.writer.B[0], c.writer.B[1] = b[0], b[1]
+		c.resp = c.writer.B
+		return len(b), nil
+	}
+
+	// the pooled request carries no context which means context.Background,
+	// otherwise it is bound to the caller's context by WithContext, whose shallow
+	// copy is kept until the conn is put back.
+	req := c.req
+	if c.ctx != context.Background() {
+		if c.bound == nil || c.bound.Context() != c.ctx {
+			c.bound = c.req.WithContext(c.ctx)
+		}
+		req = c.bound
+	}
 
-	resp, err := tr.RoundTrip(c.req)
+	c.writer.B = c.writer.B[:0]
+	if d.UseGET {
+		c.url = *d.Endpoint
+		query := "dns=" + base64.RawURLEncoding.EncodeToString(c.query)
+		if c.url.RawQuery != "" {
+			query = c.url.RawQuery + "&" + query
+		}
+		c.url.RawQuery = query
+		req.Method = http.MethodGet
+		req.URL = &c.url
+		req.Body = nil
+		req.ContentLength = 0
+	} else {
+		c.reader.B = c.query
+		req.Method = http.MethodPost
+		req.URL = d.Endpoint
+		req.Body = c.reader
+		req.ContentLength = int64(len(c.query))
+	}
+
+	resp, err := d.transport.RoundTrip(req)
 	if err != nil {
-		return 0, fmt.Errorf("fastdns: roundtrip %s error: %w", c.dialer.Endpoint, err)
+		return 0, fmt.Errorf("fastdns: roundtrip %s error: %w", d.Endpoint, err)
 	}
 	defer resp.Body.Close() // nolint:errcheck
 
+	// the body may come without Content-Length, E.g. chunked or HTTP/2 responses.
 	_, err = io.Copy(c.writer, resp.Body)
 	if err != nil {
-		return 0, fmt.Errorf("fastdns: read from %s error: %w", c.dialer.Endpoint, err)
+		return 0, fmt.Errorf("fastdns: read from %s error: %w", d.Endpoint, err)
 	}
-	if resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 {
-		return 0, fmt.Errorf("fastdns: read from %s error: %s: %s", c.dialer.Endpoint, resp.Status, c.writer.B)
+	if resp.StatusCode != http.StatusOK || len(c.writer.B) < 12 {
+		return 0, fmt.Errorf("fastdns: read from %s error: %s: %s", d.Endpoint, resp.Status, c.writer.B)
 	}
 
+	d.store(c.query, c.writer.B, resp.Header, now)
+	if age, _ := strconv.ParseUint(resp.Header.Get("age"), 10, 32); age != 0 {
+		decrementTTLs(c.writer.B, uint32(age))
+	}
+
+	c.writer.B[0], c.writer.B[1] = b[0], b[1]
 	c.resp = c.writer.B
 	return len(b), nil
 }
@@ -312,18 +567,6 @@ func (c *httpConn) SetWriteDeadline(t time.Time) error {
 	return errors.ErrUnsupported
 }
 
-var httpctxoffset = func() uintptr {
-	var req http.Request
-	v := reflect.TypeOf(req)
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Field(i)
-		if field.Name == "ctx" {
-			return field.Offset
-		}
-	}
-	panic("unsupported go version, please upgrade fastdns")
-}()
-
 type bufferwriter struct {
 	B []byte
 }
@@ -0,0 +1,1011 @@
+package fastdns
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNSSECStatus is the DNSSEC validation status of a response, see RFC 4035 section 4.3.
+type DNSSECStatus uint32
+
+const (
+	// DNSSECIndeterminate is the status of a response which is not validated.
+	DNSSECIndeterminate DNSSECStatus = iota
+	// DNSSECSecure is the status of a response signed along a chain of trust from a trust anchor.
+	DNSSECSecure
+	// DNSSECInsecure is the status of a response of a zone which is proven unsigned.
+	DNSSECInsecure
+	// DNSSECBogus is the status of a response which fails the validation.
+	DNSSECBogus
+)
+
+// String returns the name of the status.
+func (s DNSSECStatus) String() string {
+	switch s {
+	case DNSSECIndeterminate:
+		return "indeterminate"
+	case DNSSECSecure:
+		return "secure"
+	case DNSSECInsecure:
+		return "insecure"
+	case DNSSECBogus:
+		return "bogus"
+	}
+	return ""
+}
+
+// update raises s to status if status is weaker.
+func (s *DNSSECStatus) update(status DNSSECStatus) {
+	for {
+		old := atomic.LoadUint32((*uint32)(s))
+		if DNSSECStatus(old) >= status || atomic.CompareAndSwapUint32((*uint32)(s), old, uint32(status)) {
+			return
+		}
+	}
+}
+
+// ErrDNSSECBogus is matched by the DNSSECError of a bogus response.
+var ErrDNSSECBogus = errors.New("fastdns: dnssec bogus")
+
+// DNSSECError is returned by Client.Exchange for a response failing the DNSSEC validation.
+type DNSSECError struct {
+	// Name is the owner name of the records failing the validation.
+	Name string
+	// Type is the type of the records failing the validation.
+	Type Type
+	// Reason describes the failure.
+	Reason string
+}
+
+// Error returns the description of the failure.
+func (e *DNSSECError) Error() string {
+	return "fastdns: dnssec bogus " + e.Name + " " + e.Type.String() + ": " + e.Reason
+}
+
+// Is reports whether target is ErrDNSSECBogus.
+func (e *DNSSECError) Is(target error) bool {
+	return target == ErrDNSSECBogus
+}
+
+// bogus returns the DNSSECError of the records of the wire name and typ.
+func bogus(name []byte, typ Type, reason string) error {
+	domain := "."
+	if len(name) > 1 {
+		var b []byte
+		for i := 0; i < len(name) && name[i] != 0; i += int(name[i]) + 1 {
+			b = append(append(b, name[i+1:min(i+1+int(name[i]), len(name))]...), '.')
+		}
+		domain = string(b)
+	}
+	return &DNSSECError{Name: domain, Type: typ, Reason: reason}
+}
+
+// TrustAnchor is a DS record of a zone which is trusted without validation.
+type TrustAnchor struct {
+	// Zone specifies the owner of the DS record, E.g. "." for the root zone.
+	Zone string
+
+	// DS specifies the RDATA of the DS record, that is the key tag, algorithm,
+	// digest type and digest of a key signing key of Zone.
+	DS []byte
+}
+
+// rootTrustAnchors are the DS records of the root zone KSK-2017 and KSK-2024,
+// see https://data.iana.org/root-anchors/root-anchors.xml.
+var rootTrustAnchors = []TrustAnchor{
+	{".", trustAnchorDS(20326, DNSSECAlgorithmRSASHA256, "e06d44b80b8f1d39a95c0b0d7c65d08458e880409bbc683457104237c7f8ec8d")},
+	{".", trustAnchorDS(38696, DNSSECAlgorithmRSASHA256, "683d2d0acb8c9b712a1948b27f741219298d0a450d612c483af444a4c0fb2b16")},
+}
+
+// trustAnchorDS returns the DS RDATA with the SHA-256 digest in hex.
+func trustAnchorDS(tag uint16, algorithm DNSSECAlgorithm, digest string) []byte {
+	ds, _ := hex.AppendDecode([]byte{byte(tag >> 8), byte(tag), byte(algorithm), 2}, []byte(digest))
+	return ds
+}
+
+// DNSSECValidator validates the responses of a Client like a security-aware stub
+// resolver of RFC 4035 section 4.9. It fetches the DS and DNSKEY records from the
+// trust anchors down to the signer of each RRset through the same Client, verifies
+// the RSA, ECDSA and Ed25519 signatures, and checks the NSEC and NSEC3 records
+// of negative responses.
+type DNSSECValidator struct {
+	// TrustAnchors specifies the DS records of the trusted keys.
+	// If not set, use the root zone KSK-2017 and KSK-2024 as default.
+	TrustAnchors []TrustAnchor
+
+	// MaxCacheTTL caps the lifetime of the cached keys and delegations.
+	// If not set, use 1 hour as default.
+	MaxCacheTTL time.Duration
+
+	// MaxCacheEntries limits the number of cached names.
+	// If not set, use 4096 as default.
+	MaxCacheEntries int
+
+	once    sync.Once
+	anchors map[string][][]byte
+	zonesMu sync.Mutex
+	zones   map[string]*dnssecZone
+}
+
+// dnssecZone is the closest zone enclosing a name, with its validated keys
+// unless it is insecure.
+type dnssecZone struct {
+	name     []byte
+	keys     []dnssecRR
+	insecure bool
+	expires  time.Time
+}
+
+// init fills the defaults and indexes the trust anchors.
+func (v *DNSSECValidator) init() {
+	if v.MaxCacheTTL == 0 {
+		v.MaxCacheTTL = time.Hour
+	}
+	if v.MaxCacheEntries == 0 {
+		v.MaxCacheEntries = 4096
+	}
+	anchors := v.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = rootTrustAnchors
+	}
+	v.anchors = make(map[string][][]byte)
+	for _, a := range anchors {
+		zone := string(encodeZone(a.Zone))
+		v.anchors[zone] = append(v.anchors[zone], a.DS)
+	}
+	v.zones = make(map[string]*dnssecZone)
+}
+
+// validate runs the validation of resp for the Client unless the context is of a validator query.
+func (c *Client) validate(ctx context.Context, resp *Message) error {
+	if c.Validator == nil || ctx.Value(clientDNSSECFetchContextKey) != nil {
+		return nil
+	}
+
+	status, err := c.Validator.validate(ctx, c, resp)
+	if s, _ := ctx.Value(clientDNSSECStatusContextKey).(*DNSSECStatus); s != nil {
+		s.update(status)
+	}
+
+	return err
+}
+
+// validate validates resp, sets its AD bit if it is secure and returns a DNSSECError if it is bogus.
+func (v *DNSSECValidator) validate(ctx context.Context, c *Client, resp *Message) (DNSSECStatus, error) {
+	v.once.Do(v.init)
+
+	// AD
+	resp.Header.Flags &^= 0b0000000000100000
+	resp.Raw[3] &^= 0b00100000
+
+	rcode := resp.Header.Flags.Rcode()
+	if rcode != RcodeNoError && rcode != RcodeNXDomain || resp.Header.Flags.TC() != 0 {
+		return DNSSECIndeterminate, nil
+	}
+
+	qname := appendLowerName(nil, resp.Question.Name)
+	qtype := resp.Question.Type
+
+	rrs, counts, err := parseDNSSECRRs(nil, resp.Raw)
+	if err != nil {
+		return DNSSECBogus, bogus(qname, qtype, "malformed response: "+err.Error())
+	}
+	answers := rrs[:counts[0]]
+	authority := rrs[counts[0] : counts[0]+counts[1]]
+
+	now := time.Now()
+	status := DNSSECSecure
+	type wildcard struct {
+		zone   *dnssecZone
+		owner  []byte
+		labels uint8
+	}
+	var wildcards []wildcard
+
+	for _, rrset := range groupRRsets(answers) {
+		s, z, labels, err := v.verify(ctx, c, rrset, answers, now)
+		if err != nil {
+			return s, err
+		}
+		status = max(status, s)
+		if s == DNSSECSecure && labels < countLabels(rrset[0].name) {
+			wildcards = append(wildcards, wildcard{z, rrset[0].name, labels})
+		}
+	}
+
+	// the records proving a denial, the referrals are not signed.
+	for _, rrset := range groupRRsets(authority) {
+		if typ := rrset[0].typ; typ != TypeSOA && typ != TypeDS {
+			continue
+		}
+		s, _, _, err := v.verify(ctx, c, rrset, authority, now)
+		if err != nil {
+			return s, err
+		}
+		status = max(status, s)
+	}
+
+	// follow the CNAME chain to the name of the answer.
+	target := qname
+	for i := 0; i < 16 && qtype != TypeCNAME; i++ {
+		next := target
+		for _, rr := range answers {
+			if rr.typ == TypeCNAME && bytes.Equal(rr.name, target) {
+				next = appendLowerName(nil, rr.rdata)
+				break
+			}
+		}
+		if bytes.Equal(next, target) {
+			break
+		}
+		target = next
+	}
+
+	positive := false
+	for _, rr := range answers {
+		if bytes.Equal(rr.name, target) && (rr.typ == qtype || qtype == TypeANY && rr.typ != TypeRRSIG) {
+			positive = true
+			break
+		}
+	}
+
+	if !positive || rcode == RcodeNXDomain {
+		z, err := v.zone(ctx, c, target, now)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if z.insecure {
+			status = max(status, DNSSECInsecure)
+		} else {
+			switch denial := deny(z, target, qtype, authority, now); {
+			case denial == denialOptOut:
+				status = max(status, DNSSECInsecure)
+			case denial == denialNXDomain:
+			case denial != denialNone && rcode == RcodeNoError:
+			default:
+				return DNSSECBogus, bogus(target, qtype, "missing denial of existence")
+			}
+		}
+	}
+
+	for _, w := range wildcards {
+		if !noCloser(w.zone, w.owner, w.labels, authority, now) {
+			return DNSSECBogus, bogus(w.owner, qtype, "missing denial of a closer match than the wildcard")
+		}
+	}
+
+	if status == DNSSECSecure {
+		// AD
+		resp.Header.Flags |= 0b0000000000100000
+		resp.Raw[3] |= 0b00100000
+	}
+
+	return status, nil
+}
+
+// verify verifies rrset by its RRSIGs in section and returns its status, the
+// zone of the signer and the labels field of the valid RRSIG.
+func (v *DNSSECValidator) verify(ctx context.Context, c *Client, rrset, section []dnssecRR, now time.Time) (DNSSECStatus, *dnssecZone, uint8, error) {
+	owner, typ := rrset[0].name, rrset[0].typ
+
+	var signer []byte
+	for _, rr := range section {
+		if rr.typ == TypeRRSIG && bytes.Equal(rr.name, owner) && len(rr.rdata) > 18 && Type(binary.BigEndian.Uint16(rr.rdata)) == typ {
+			signer, _, _ = appendName(nil, rr.rdata, 18, true)
+			break
+		}
+	}
+
+	if signer == nil {
+		z, err := v.zone(ctx, c, owner, now)
+		switch {
+		case err != nil:
+			return DNSSECBogus, nil, 0, err
+		case z.insecure:
+			return DNSSECInsecure, z, 0, nil
+		}
+		return DNSSECBogus, nil, 0, bogus(owner, typ, "missing signature")
+	}
+
+	if !isSubdomain(owner, signer) {
+		return DNSSECBogus, nil, 0, bogus(owner, typ, "signer is not an ancestor")
+	}
+
+	z, err := v.zone(ctx, c, signer, now)
+	switch {
+	case err != nil:
+		return DNSSECBogus, nil, 0, err
+	case z.insecure:
+		return DNSSECInsecure, z, 0, nil
+	case !bytes.Equal(z.name, signer):
+		return DNSSECBogus, nil, 0, bogus(owner, typ, "signer is not a zone apex")
+	}
+
+	labels, err := verifyRRset(z.name, z.keys, rrset, section, now)
+	if err != nil {
+		return DNSSECBogus, nil, 0, bogus(owner, typ, err.Error())
+	}
+
+	return DNSSECSecure, z, labels, nil
+}
+
+// zone returns the closest zone enclosing the wire name, walking down the
+// delegations from the trust anchors.
+func (v *DNSSECValidator) zone(ctx context.Context, c *Client, name []byte, now time.Time) (*dnssecZone, error) {
+	if z := v.load(name, now); z != nil {
+		return z, nil
+	}
+
+	var z *dnssecZone
+	var err error
+	if ds, ok := v.anchors[string(name)]; ok {
+		z, err = v.keys(ctx, c, name, ds, now)
+	} else if len(name) <= 1 {
+		// no trust anchor encloses the name.
+		z = &dnssecZone{name: name, insecure: true, expires: now.Add(v.MaxCacheTTL)}
+	} else if z, err = v.zone(ctx, c, name[name[0]+1:], now); err == nil && !z.insecure {
+		z, err = v.delegation(ctx, c, z, name, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v.store(name, z)
+	return z, nil
+}
+
+// load returns the cached zone of name.
+func (v *DNSSECValidator) load(name []byte, now time.Time) *dnssecZone {
+	v.zonesMu.Lock()
+	defer v.zonesMu.Unlock()
+
+	if z := v.zones[b2s(name)]; z != nil && now.Before(z.expires) {
+		return z
+	}
+	return nil
+}
+
+// store caches the zone of name.
+func (v *DNSSECValidator) store(name []byte, z *dnssecZone) {
+	v.zonesMu.Lock()
+	defer v.zonesMu.Unlock()
+
+	if len(v.zones) >= v.MaxCacheEntries {
+		for k := range v.zones {
+			if len(v.zones) < v.MaxCacheEntries {
+				break
+			}
+			delete(v.zones, k)
+		}
+	}
+	v.zones[string(name)] = z
+}
+
+// delegation returns the zone of name, which is parent unless the DS records
+// of parent prove a delegation to name.
+func (v *DNSSECValidator) delegation(ctx context.Context, c *Client, parent *dnssecZone, name []byte, now time.Time) (*dnssecZone, error) {
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+
+	if err := v.query(ctx, c, name, TypeDS, resp); err != nil {
+		return nil, err
+	}
+	if rcode := resp.Header.Flags.Rcode(); rcode != RcodeNoError && rcode != RcodeNXDomain {
+		return nil, bogus(name, TypeDS, "unexpected response code "+strconv.Itoa(int(rcode)))
+	}
+
+	rrs, counts, err := parseDNSSECRRs(nil, resp.Raw)
+	if err != nil {
+		return nil, bogus(name, TypeDS, "malformed response: "+err.Error())
+	}
+	answers := rrs[:counts[0]]
+	authority := rrs[counts[0] : counts[0]+counts[1]]
+
+	for _, rrset := range groupRRsets(answers) {
+		if !bytes.Equal(rrset[0].name, name) || rrset[0].typ != TypeDS && rrset[0].typ != TypeCNAME {
+			continue
+		}
+		if _, err := verifyRRset(parent.name, parent.keys, rrset, answers, now); err != nil {
+			return nil, bogus(name, rrset[0].typ, err.Error())
+		}
+		if rrset[0].typ == TypeCNAME {
+			// an alias is not a zone cut.
+			return parent, nil
+		}
+		ds := make([][]byte, 0, len(rrset))
+		for _, rr := range rrset {
+			ds = append(ds, rr.rdata)
+		}
+		return v.keys(ctx, c, name, ds, now)
+	}
+
+	switch deny(parent, name, TypeDS, authority, now) {
+	case denialDelegation, denialOptOut:
+		return &dnssecZone{name: name, insecure: true, expires: now.Add(v.MaxCacheTTL)}, nil
+	case denialNXDomain, denialNoData:
+		return parent, nil
+	}
+
+	return nil, bogus(name, TypeDS, "missing denial of existence")
+}
+
+// keys returns the zone of name with the DNSKEY records validated by the DS rdatas.
+func (v *DNSSECValidator) keys(ctx context.Context, c *Client, name []byte, ds [][]byte, now time.Time) (*dnssecZone, error) {
+	supported := false
+	for _, d := range ds {
+		if len(d) > 4 && supportedAlgorithm(DNSSECAlgorithm(d[2])) && digestHash(d[3]) != 0 {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		// treat the zone as unsigned, see RFC 4035 section 5.2.
+		return &dnssecZone{name: name, insecure: true, expires: now.Add(v.MaxCacheTTL)}, nil
+	}
+
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+
+	if err := v.query(ctx, c, name, TypeDNSKEY, resp); err != nil {
+		return nil, err
+	}
+
+	rrs, counts, err := parseDNSSECRRs(nil, resp.Raw)
+	if err != nil {
+		return nil, bogus(name, TypeDNSKEY, "malformed response: "+err.Error())
+	}
+	answers := rrs[:counts[0]]
+
+	var dnskeys, trusted []dnssecRR
+	ttl := uint32(v.MaxCacheTTL / time.Second)
+	for _, rr := range answers {
+		if rr.typ != TypeDNSKEY || !bytes.Equal(rr.name, name) || len(rr.rdata) < 4 {
+			continue
+		}
+		dnskeys = append(dnskeys, rr)
+		ttl = min(ttl, rr.ttl)
+		for _, d := range ds {
+			if matchDS(name, rr.rdata, d) {
+				trusted = append(trusted, rr)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, bogus(name, TypeDNSKEY, "no key matches the DS records")
+	}
+
+	if _, err := verifyRRset(name, trusted, dnskeys, answers, now); err != nil {
+		return nil, bogus(name, TypeDNSKEY, err.Error())
+	}
+
+	return &dnssecZone{name: name, keys: dnskeys, expires: now.Add(time.Duration(ttl) * time.Second)}, nil
+}
+
+// query exchanges the query of the wire name and typ through c, the response is not validated.
+func (v *DNSSECValidator) query(ctx context.Context, c *Client, name []byte, typ Type, resp *Message) error {
+	req := AcquireMessage()
+	defer func() {
+		// clear CD of the pooled req.
+		req.Header.Flags &^= 0b0000000000010000
+		if len(req.Raw) > 3 {
+			req.Raw[3] &^= 0b00010000
+		}
+		ReleaseMessage(req)
+	}()
+
+	// RD
+	if err := req.setQuery(name, typ, 0b0000000100000000); err != nil {
+		return err
+	}
+
+	return c.Exchange(context.WithValue(ctx, clientDNSSECFetchContextKey, true), req, resp)
+}
+
+// groupRRsets returns the RRsets of rrs except the RRSIG and OPT records.
+func groupRRsets(rrs []dnssecRR) (rrsets [][]dnssecRR) {
+	done := make([]bool, len(rrs))
+	for i := range rrs {
+		if done[i] || rrs[i].typ == TypeRRSIG || rrs[i].typ == TypeOPT {
+			continue
+		}
+		rrset := []dnssecRR{rrs[i]}
+		for j := i + 1; j < len(rrs); j++ {
+			if !done[j] && rrs[j].typ == rrs[i].typ && rrs[j].class == rrs[i].class && bytes.Equal(rrs[j].name, rrs[i].name) {
+				rrset = append(rrset, rrs[j])
+				done[j] = true
+			}
+		}
+		rrsets = append(rrsets, rrset)
+	}
+	return
+}
+
+// verifyRRset verifies rrset by one of its RRSIGs in section made by a key of
+// the zone, and returns the labels field of the valid RRSIG.
+func verifyRRset(zone []byte, keys, rrset, section []dnssecRR, now time.Time) (uint8, error) {
+	canonical, err := canonicalRRset(rrset)
+	if err != nil {
+		return 0, err
+	}
+
+	owner, typ := rrset[0].name, rrset[0].typ
+	t := uint32(now.Unix())
+	err = errors.New("no valid signature")
+
+	var data []byte
+	for _, sig := range section {
+		if sig.typ != TypeRRSIG || sig.class != rrset[0].class || !bytes.Equal(sig.name, owner) ||
+			len(sig.rdata) <= 18 || Type(binary.BigEndian.Uint16(sig.rdata)) != typ {
+			continue
+		}
+		signer, end, e := appendName(nil, sig.rdata, 18, true)
+		if e != nil || !bytes.Equal(signer, zone) {
+			continue
+		}
+
+		algorithm, labels := DNSSECAlgorithm(sig.rdata[2]), sig.rdata[3]
+		expiration, inception := binary.BigEndian.Uint32(sig.rdata[8:]), binary.BigEndian.Uint32(sig.rdata[12:])
+		if int32(t-inception) < 0 || int32(expiration-t) < 0 {
+			// serial number arithmetic, see RFC 4034 section 3.1.5.
+			err = errors.New("signature is expired or not yet valid")
+			continue
+		}
+
+		// the owner of a wildcard expansion is signed as the wildcard, see RFC 4035 section 5.3.2.
+		name := owner
+		if n := countLabels(owner); labels > n {
+			continue
+		} else if labels < n {
+			for countLabels(name) > labels {
+				name = name[name[0]+1:]
+			}
+			name = append([]byte{1, '*'}, name...)
+		}
+		for i := range canonical {
+			canonical[i].name = name
+		}
+
+		header := append(sig.rdata[:18:18], signer...)
+		data = appendSignedData(data[:0], header, canonical, binary.BigEndian.Uint32(sig.rdata[4:]))
+		tag := binary.BigEndian.Uint16(sig.rdata[16:])
+		for _, key := range keys {
+			// the zone flag and protocol 3
+			if len(key.rdata) < 4 || key.rdata[0]&0x01 == 0 || key.rdata[2] != 3 ||
+				DNSSECAlgorithm(key.rdata[3]) != algorithm || keyTag(key.rdata) != tag {
+				continue
+			}
+			if e := verifySignature(algorithm, key.rdata[4:], data, sig.rdata[end:]); e == nil {
+				return labels, nil
+			}
+			err = errors.New("invalid signature")
+		}
+	}
+
+	return 0, err
+}
+
+// supportedAlgorithm reports whether signatures of the algorithm can be verified.
+func supportedAlgorithm(algorithm DNSSECAlgorithm) bool {
+	switch algorithm {
+	case DNSSECAlgorithmRSASHA1, DNSSECAlgorithmRSASHA1NSEC3, DNSSECAlgorithmRSASHA256, DNSSECAlgorithmRSASHA512,
+		DNSSECAlgorithmECDSAP256SHA256, DNSSECAlgorithmECDSAP384SHA384, DNSSECAlgorithmED25519:
+		return true
+	}
+	return false
+}
+
+// verifySignature verifies the signature of data by the public key in the DNSKEY wire format.
+func verifySignature(algorithm DNSSECAlgorithm, pub, data, sig []byte) error {
+	switch algorithm {
+	case DNSSECAlgorithmRSASHA1, DNSSECAlgorithmRSASHA1NSEC3, DNSSECAlgorithmRSASHA256, DNSSECAlgorithmRSASHA512:
+		key, err := parseRSAPublicKey(pub)
+		if err != nil {
+			return err
+		}
+		hash := crypto.SHA1
+		switch algorithm {
+		case DNSSECAlgorithmRSASHA256:
+			hash = crypto.SHA256
+		case DNSSECAlgorithmRSASHA512:
+			hash = crypto.SHA512
+		}
+		h := hash.New()
+		h.Write(data)
+		return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig)
+	case DNSSECAlgorithmECDSAP256SHA256, DNSSECAlgorithmECDSAP384SHA384:
+		curve, size, digest := elliptic.P256(), 32, func(b []byte) []byte { h := sha256.Sum256(b); return h[:] }
+		if algorithm == DNSSECAlgorithmECDSAP384SHA384 {
+			curve, size, digest = elliptic.P384(), 48, func(b []byte) []byte { h := sha512.Sum384(b); return h[:] }
+		}
+		if len(pub) != 2*size || len(sig) != 2*size {
+			return ErrInvalidAnswer
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(pub[:size]),
+			Y:     new(big.Int).SetBytes(pub[size:]),
+		}
+		if !ecdsa.Verify(key, digest(data), new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+			return rsa.ErrVerification
+		}
+		return nil
+	case DNSSECAlgorithmED25519:
+		if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, data, sig) {
+			return rsa.ErrVerification
+		}
+		return nil
+	}
+	return ErrUnsupportedAlgorithm
+}
+
+// parseRSAPublicKey parses the RSA public key in the DNSKEY wire format of RFC 3110 section 2.
+func parseRSAPublicKey(pub []byte) (*rsa.PublicKey, error) {
+	if len(pub) < 3 {
+		return nil, ErrInvalidAnswer
+	}
+	n, pub := int(pub[0]), pub[1:]
+	if n == 0 {
+		n, pub = int(pub[0])<<8|int(pub[1]), pub[2:]
+	}
+	if n == 0 || n > 4 || len(pub) <= n {
+		return nil, ErrInvalidAnswer
+	}
+	var e int
+	for _, b := range pub[:n] {
+		e = e<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(pub[n:]), E: e}, nil
+}
+
+// digestHash returns the hash of the DS digest type, or 0 if unsupported.
+func digestHash(digestType byte) crypto.Hash {
+	switch digestType {
+	case 1:
+		return crypto.SHA1
+	case 2:
+		return crypto.SHA256
+	case 4:
+		return crypto.SHA384
+	}
+	return 0
+}
+
+// matchDS reports whether the DS rdata is the digest of the DNSKEY rdata owned by name.
+func matchDS(name, rdata, ds []byte) bool {
+	if len(ds) <= 4 {
+		return false
+	}
+	hash := digestHash(ds[3])
+	if hash == 0 || binary.BigEndian.Uint16(ds) != keyTag(rdata) || ds[2] != rdata[3] {
+		return false
+	}
+	h := hash.New()
+	h.Write(name)
+	h.Write(rdata)
+	return bytes.Equal(h.Sum(nil), ds[4:])
+}
+
+// dnssecDenial is what the NSEC or NSEC3 records of a response prove.
+type dnssecDenial int
+
+const (
+	// denialNone proves nothing.
+	denialNone dnssecDenial = iota
+	// denialNXDomain proves that the name does not exist.
+	denialNXDomain
+	// denialNoData proves that the name exists without the type.
+	denialNoData
+	// denialDelegation proves that the name is a delegation without DS records.
+	denialDelegation
+	// denialOptOut proves that the name may be an unsigned delegation of an NSEC3 opt-out span.
+	denialOptOut
+)
+
+// deny returns what the NSEC or NSEC3 records of z in authority prove about name and typ.
+func deny(z *dnssecZone, name []byte, typ Type, authority []dnssecRR, now time.Time) dnssecDenial {
+	nsecs, nsec3s := verifiedDenials(z, authority, now)
+
+	if len(nsecs) != 0 {
+		// RFC 4035 section 5.4
+		for _, rr := range nsecs {
+			if bytes.Equal(rr.name, name) {
+				_, end, _ := appendName(nil, rr.rdata, 0, true)
+				return denyTypes(rr.rdata[end:], typ)
+			}
+		}
+		var encloser []byte
+		for _, rr := range nsecs {
+			next, _, _ := appendName(nil, rr.rdata, 0, true)
+			if coversName(rr.name, next, name) {
+				encloser = commonAncestor(name, rr.name)
+				if e := commonAncestor(name, next); len(e) > len(encloser) {
+					encloser = e
+				}
+				break
+			}
+		}
+		if encloser == nil {
+			return denialNone
+		}
+		wildcard := append([]byte{1, '*'}, encloser...)
+		for _, rr := range nsecs {
+			next, end, _ := appendName(nil, rr.rdata, 0, true)
+			switch {
+			case bytes.Equal(rr.name, wildcard):
+				return denyTypes(rr.rdata[end:], typ)
+			case coversName(rr.name, next, wildcard):
+				return denialNXDomain
+			}
+		}
+		return denialNone
+	}
+
+	if len(nsec3s) != 0 {
+		// RFC 5155 section 8
+		spans, ok := parseNSEC3(z.name, nsec3s)
+		if !ok {
+			return denialOptOut
+		}
+		if s := spans.match(name); s != nil {
+			return denyTypes(s.bitmap, typ)
+		}
+		for nc := name; len(nc) > len(z.name); nc = nc[nc[0]+1:] {
+			encloser := nc[nc[0]+1:]
+			if spans.match(encloser) == nil {
+				continue
+			}
+			s := spans.cover(nc)
+			switch {
+			case s == nil:
+				return denialNone
+			case s.flags&0x01 != 0:
+				return denialOptOut
+			}
+			wildcard := append([]byte{1, '*'}, encloser...)
+			if spans.cover(wildcard) != nil {
+				return denialNXDomain
+			}
+			if w := spans.match(wildcard); w != nil {
+				return denyTypes(w.bitmap, typ)
+			}
+			return denialNone
+		}
+	}
+
+	return denialNone
+}
+
+// noCloser reports whether the NSEC or NSEC3 records of z in authority prove
+// that no closer name than the wildcard of labels matches owner.
+func noCloser(z *dnssecZone, owner []byte, labels uint8, authority []dnssecRR, now time.Time) bool {
+	nsecs, nsec3s := verifiedDenials(z, authority, now)
+
+	for _, rr := range nsecs {
+		next, _, _ := appendName(nil, rr.rdata, 0, true)
+		if coversName(rr.name, next, owner) {
+			return true
+		}
+	}
+
+	if spans, ok := parseNSEC3(z.name, nsec3s); ok && len(spans.spans) != 0 {
+		// the next closer name of the wildcard, see RFC 5155 section 8.8.
+		nc := owner
+		for countLabels(nc) > labels+1 {
+			nc = nc[nc[0]+1:]
+		}
+		return spans.cover(nc) != nil
+	}
+
+	return false
+}
+
+// verifiedDenials returns the NSEC and NSEC3 records of z in authority whose signatures are valid.
+func verifiedDenials(z *dnssecZone, authority []dnssecRR, now time.Time) (nsecs, nsec3s []dnssecRR) {
+	for _, rrset := range groupRRsets(authority) {
+		typ := rrset[0].typ
+		if typ != TypeNSEC && typ != TypeNSEC3 || !isSubdomain(rrset[0].name, z.name) {
+			continue
+		}
+		if _, err := verifyRRset(z.name, z.keys, rrset, authority, now); err != nil {
+			continue
+		}
+		if typ == TypeNSEC {
+			nsecs = append(nsecs, rrset...)
+		} else {
+			nsec3s = append(nsec3s, rrset...)
+		}
+	}
+	return
+}
+
+// denyTypes returns what the type bit maps of a matching NSEC or NSEC3 record prove about typ.
+func denyTypes(bitmap []byte, typ Type) dnssecDenial {
+	switch {
+	case hasType(bitmap, TypeNXNAME):
+		// the compact denial of RFC 9824.
+		return denialNXDomain
+	case hasType(bitmap, typ) || hasType(bitmap, TypeCNAME):
+		return denialNone
+	case hasType(bitmap, TypeNS) && !hasType(bitmap, TypeSOA):
+		// the parent side of a delegation only proves the absence of DS.
+		if typ == TypeDS {
+			return denialDelegation
+		}
+		return denialNone
+	}
+	return denialNoData
+}
+
+// hasType reports whether the NSEC type bit maps contain typ.
+func hasType(bitmap []byte, typ Type) bool {
+	window, bit := byte(typ>>8), byte(typ)
+	for len(bitmap) >= 2 {
+		length := int(bitmap[1])
+		if len(bitmap) < 2+length {
+			return false
+		}
+		if bitmap[0] == window {
+			return int(bit/8) < length && bitmap[2+bit/8]&(0x80>>(bit%8)) != 0
+		}
+		bitmap = bitmap[2+length:]
+	}
+	return false
+}
+
+// compareNames compares the wire names in the canonical order of RFC 4034 section 6.1.
+func compareNames(a, b []byte) int {
+	var la, lb [128]int
+	x, y := labelOffsets(la[:0], a), labelOffsets(lb[:0], b)
+	for i, j := len(x)-1, len(y)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := bytes.Compare(a[x[i]+1:x[i]+1+int(a[x[i]])], b[y[j]+1:y[j]+1+int(b[y[j]])]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(x), len(y))
+}
+
+// labelOffsets appends the offsets of the labels of the wire name to dst.
+func labelOffsets(dst []int, name []byte) []int {
+	for i := 0; i < len(name) && name[i] != 0 && i+1+int(name[i]) <= len(name); i += int(name[i]) + 1 {
+		dst = append(dst, i)
+	}
+	return dst
+}
+
+// commonAncestor returns the longest common ancestor of the wire names as a suffix of a.
+func commonAncestor(a, b []byte) []byte {
+	var la, lb [128]int
+	x, y := labelOffsets(la[:0], a), labelOffsets(lb[:0], b)
+	i, j := len(x)-1, len(y)-1
+	for ; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if !bytes.Equal(a[x[i]:x[i]+1+int(a[x[i]])], b[y[j]:y[j]+1+int(b[y[j]])]) {
+			break
+		}
+	}
+	if i+1 < len(x) {
+		return a[x[i+1]:]
+	}
+	return a[len(a)-1:]
+}
+
+// coversName reports whether name falls between the owner and next names of an NSEC record.
+func coversName(owner, next, name []byte) bool {
+	if compareNames(owner, name) >= 0 {
+		return false
+	}
+	// the last NSEC record of a zone wraps around to the apex.
+	return compareNames(name, next) < 0 || compareNames(next, owner) <= 0
+}
+
+// nsec3Encoding is the base32hex encoding of the hashed owner names.
+var nsec3Encoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+// nsec3Span is the span of hashed owner names of an NSEC3 record.
+type nsec3Span struct {
+	owner  []byte
+	next   []byte
+	flags  byte
+	bitmap []byte
+}
+
+// nsec3Spans are the NSEC3 records of a zone with their hash parameters.
+type nsec3Spans struct {
+	spans      []nsec3Span
+	salt       []byte
+	iterations uint16
+}
+
+// parseNSEC3 parses the NSEC3 records of the zone, it reports false for the
+// parameters which are unsupported or treated as insecure by RFC 9276 section 3.2.
+func parseNSEC3(zone []byte, rrs []dnssecRR) (s nsec3Spans, ok bool) {
+	set := false
+	for _, rr := range rrs {
+		rdata := rr.rdata
+		if len(rdata) < 5 || len(rdata) < 6+int(rdata[4]) {
+			continue
+		}
+		saltLen := int(rdata[4])
+		salt, iterations := rdata[5:5+saltLen], binary.BigEndian.Uint16(rdata[2:])
+		hashLen := int(rdata[5+saltLen])
+		if len(rdata) < 6+saltLen+hashLen || rr.name[0] == 0 || !bytes.Equal(rr.name[1+int(rr.name[0]):], zone) {
+			continue
+		}
+		if !set {
+			if rdata[0] != 1 || iterations > 150 {
+				return s, false
+			}
+			s.salt, s.iterations, set = salt, iterations, true
+		} else if iterations != s.iterations || !bytes.Equal(salt, s.salt) {
+			continue
+		}
+		owner, err := nsec3Encoding.DecodeString(string(rr.name[1 : 1+int(rr.name[0])]))
+		if err != nil {
+			continue
+		}
+		s.spans = append(s.spans, nsec3Span{
+			owner:  owner,
+			next:   rdata[6+saltLen : 6+saltLen+hashLen],
+			flags:  rdata[1],
+			bitmap: rdata[6+saltLen+hashLen:],
+		})
+	}
+	return s, true
+}
+
+// match returns the NSEC3 record matching the wire name.
+func (s *nsec3Spans) match(name []byte) *nsec3Span {
+	h := nsec3Hash(name, s.salt, s.iterations)
+	for i := range s.spans {
+		if bytes.Equal(s.spans[i].owner, h) {
+			return &s.spans[i]
+		}
+	}
+	return nil
+}
+
+// cover returns the NSEC3 record covering the wire name.
+func (s *nsec3Spans) cover(name []byte) *nsec3Span {
+	h := nsec3Hash(name, s.salt, s.iterations)
+	for i := range s.spans {
+		owner, next := s.spans[i].owner, s.spans[i].next
+		if bytes.Compare(owner, h) < 0 && (bytes.Compare(h, next) < 0 || bytes.Compare(next, owner) <= 0) ||
+			bytes.Compare(next, owner) <= 0 && bytes.Compare(h, next) < 0 {
+			return &s.spans[i]
+		}
+	}
+	return nil
+}
+
+// nsec3Hash returns the SHA-1 hash of the canonical wire name, see RFC 5155 section 5.
+func nsec3Hash(name, salt []byte, iterations uint16) []byte {
+	h := sha1.New()
+	h.Write(name)
+	h.Write(salt)
+	sum := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(sum)
+		h.Write(salt)
+		sum = h.Sum(sum[:0])
+	}
+	return sum
+}
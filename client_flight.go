@@ -0,0 +1,132 @@
+package fastdns
+
+import (
+	"context"
+	"time"
+)
+
+// clientFlightTimeout bounds a shared transaction unless its leading caller
+// waits longer.
+var clientFlightTimeout = 10 * time.Second
+
+// clientFlight is an in-flight transaction shared by concurrent identical queries.
+type clientFlight struct {
+	done chan struct{}
+	raw  []byte
+	err  error
+}
+
+// appendFlightKey appends the question of req, the name server overriding the
+// upstream servers and the EDNS options which may change the answer to dst.
+func appendFlightKey(dst []byte, req *Message, server string, options *clientOptionsContextValue) []byte {
+	dst = appendCacheKey(dst, req)
+	if server != "" {
+		dst = append(append(dst, '@'), server...)
+	}
+	// the OPT record of req carries the DO bit, the cookie and the other options.
+	if req.Header.ARCount != 0 {
+		records := req.Records()
+		for records.Next() {
+			if record := records.Item(); record.Type == TypeOPT {
+				dst = append(dst, '#',
+					byte(record.Class>>8), byte(record.Class),
+					byte(record.TTL>>24), byte(record.TTL>>16), byte(record.TTL>>8), byte(record.TTL),
+				)
+				dst = append(dst, record.Data...)
+			}
+		}
+	}
+	if options == nil {
+		return dst
+	}
+	if options.prefix.IsValid() {
+		dst = options.prefix.Masked().AppendTo(append(dst, '/'))
+	}
+	var flags byte
+	for i, b := range []bool{options.nsid, options.expire, options.keepalive, options.tagged} {
+		if b {
+			flags |= 1 << i
+		}
+	}
+	dst = append(dst, '+', flags, byte(options.tag>>8), byte(options.tag))
+	for _, s := range []string{options.cookie, options.dau, options.dhu, options.n3u} {
+		dst = append(append(dst, byte(len(s))), s...)
+	}
+	return dst
+}
+
+// exchangeShared runs the transaction of req once for all concurrent identical callers.
+// The upstream query is detached from the caller's context, so a cancelled caller
+// does not fail the others waiting on the same flight, and bounded by the later of
+// the caller's deadline and clientFlightTimeout.
+func (c *Client) exchangeShared(ctx context.Context, req, resp *Message, options *clientOptionsContextValue) error {
+	var buf [300]byte
+	server, _ := ctx.Value(clientServerContextKey).(string)
+	key := appendFlightKey(buf[:0], req, server, options)
+
+	c.flightsMu.Lock()
+	f := c.flights[b2s(key)]
+	if f == nil {
+		// copy req because the caller may return before the flight lands.
+		freq := AcquireMessage()
+		if err := ParseMessage(freq, req.Raw, true); err != nil {
+			c.flightsMu.Unlock()
+			ReleaseMessage(freq)
+			return err
+		}
+		if c.flights == nil {
+			c.flights = make(map[string]*clientFlight)
+		}
+		f = &clientFlight{done: make(chan struct{})}
+		k := string(key)
+		c.flights[k] = f
+		deadline := time.Now().Add(clientFlightTimeout)
+		if d, ok := ctx.Deadline(); ok && d.After(deadline) {
+			deadline = d
+		}
+		fctx, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+		go func() {
+			defer cancel()
+			c.fly(fctx, k, f, freq, options)
+		}()
+	}
+	c.flightsMu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if f.err != nil {
+		return f.err
+	}
+
+	resp.Raw = append(resp.Raw[:0], f.raw...)
+	// ID
+	resp.Raw[0], resp.Raw[1] = byte(req.Header.ID>>8), byte(req.Header.ID)
+	// keep the letter case of the question name.
+	if len(resp.Raw) >= 12+len(req.Question.Name) {
+		copy(resp.Raw[12:], req.Question.Name)
+	}
+
+	return ParseMessage(resp, resp.Raw, false)
+}
+
+// fly performs the shared transaction of req and wakes up all waiters of f.
+func (c *Client) fly(ctx context.Context, key string, f *clientFlight, req *Message, options *clientOptionsContextValue) {
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+	defer ReleaseMessage(req)
+
+	f.err = c.exchangeOnce(ctx, req, resp, options)
+	if f.err == nil {
+		f.raw = append([]byte(nil), resp.Raw...)
+	}
+
+	c.flightsMu.Lock()
+	delete(c.flights, key)
+	c.flightsMu.Unlock()
+
+	close(f.done)
+}
@@ -0,0 +1,105 @@
+package fastdns
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Hosts resolves names from a hosts(5) file and reloads it when the file changes.
+type Hosts struct {
+	// Path specifies the location of the file.
+	// If not set, use /etc/hosts as default.
+	Path string
+
+	// CheckInterval specifies how often the file is checked for changes.
+	// If not set, use 5 seconds as default.
+	CheckInterval time.Duration
+
+	watcher fileWatcher
+	table   atomic.Pointer[hostsTable]
+}
+
+type hostsTable struct {
+	// addrs maps lowercased names to their addresses.
+	addrs map[string][]netip.Addr
+	// names maps addresses to their names.
+	names map[netip.Addr][]string
+}
+
+// parseHosts parses the content of a hosts(5) file.
+func parseHosts(data []byte) *hostsTable {
+	t := &hostsTable{
+		addrs: make(map[string][]netip.Addr),
+		names: make(map[netip.Addr][]string),
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			t.addrs[name] = append(t.addrs[name], addr)
+			t.names[addr] = append(t.names[addr], name)
+		}
+	}
+
+	return t
+}
+
+// load returns the current table, reloading the file if it changed.
+func (h *Hosts) load() *hostsTable {
+	path := h.Path
+	if path == "" {
+		path = "/etc/hosts"
+	}
+
+	t := h.table.Load()
+	if data, changed := h.watcher.check(path, h.CheckInterval, t == nil); changed {
+		t = parseHosts(data)
+		h.table.Store(t)
+	}
+
+	return t
+}
+
+// AppendLookupNetIP appends the addresses of host of the type specified by network to dst.
+// The network must be one of "ip", "ip4" or "ip6".
+func (h *Hosts) AppendLookupNetIP(dst []netip.Addr, network, host string) []netip.Addr {
+	t := h.load()
+
+	addrs, ok := t.addrs[strings.TrimSuffix(host, ".")]
+	if !ok {
+		addrs = t.addrs[strings.ToLower(strings.TrimSuffix(host, "."))]
+	}
+
+	for _, addr := range addrs {
+		switch {
+		case network == "ip4" && !addr.Is4(), network == "ip6" && !addr.Is6():
+			continue
+		}
+		dst = append(dst, addr)
+	}
+
+	return dst
+}
+
+// LookupAddr returns the names of addr.
+func (h *Hosts) LookupAddr(addr netip.Addr) []string {
+	return h.load().names[addr.Unmap()]
+}
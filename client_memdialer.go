@@ -0,0 +1,213 @@
+package fastdns
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemDialer is a Dialer which routes the queries of a Client to a Handler in
+// memory, so tests run without sockets. It can simulate latency, packet loss,
+// truncation and timeouts of a real network.
+type MemDialer struct {
+	// Handler serves the queries.
+	Handler Handler
+
+	// Latency specifies the delay before a response is delivered.
+	Latency time.Duration
+
+	// Jitter specifies the maximum random delay added to Latency.
+	Jitter time.Duration
+
+	// LossRate specifies the probability in [0, 1] that a query is lost,
+	// the Client then waits until its deadline as with a real network.
+	LossRate float64
+
+	// Seed seeds the random source of Jitter and LossRate, the same seed
+	// replays the same sequence of delays and losses.
+	Seed uint64
+
+	// MaxSize truncates the responses larger than it to the question with TC set,
+	// E.g. 512 for plain UDP.
+	// If not set, responses are not truncated.
+	MaxSize int
+
+	// Laddr specifies the server address seen by Handler.
+	// If not set, use 127.0.0.1:53 as default.
+	Laddr netip.AddrPort
+
+	// Raddr specifies the client address seen by Handler.
+	// If not set, use 127.0.0.1:5353 as default.
+	Raddr netip.AddrPort
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// DialContext returns an in-memory connection to Handler.
+func (d *MemDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return &memConn{dialer: d, ctx: ctx, network: network}, nil
+}
+
+// Put closes the in-memory connection.
+func (d *MemDialer) Put(conn net.Conn) {
+	_ = conn.Close()
+}
+
+// roll returns whether the query is lost and its delay.
+func (d *MemDialer) roll() (lost bool, delay time.Duration) {
+	delay = d.Latency
+	if d.LossRate <= 0 && d.Jitter <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.rand == nil {
+		d.rand = rand.New(rand.NewPCG(d.Seed, d.Seed))
+	}
+	if d.LossRate > 0 {
+		lost = d.rand.Float64() < d.LossRate
+	}
+	if d.Jitter > 0 {
+		delay += time.Duration(d.rand.Int64N(int64(d.Jitter) + 1))
+	}
+	return
+}
+
+// serve runs Handler for the query in b and returns the response.
+func (d *MemDialer) serve(b []byte) []byte {
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+
+	rw := &MemResponseWriter{
+		Laddr: d.Laddr,
+		Raddr: d.Raddr,
+	}
+	if !rw.Laddr.IsValid() {
+		rw.Laddr = netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 53)
+	}
+	if !rw.Raddr.IsValid() {
+		rw.Raddr = netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 5353)
+	}
+
+	req.Raw = append(req.Raw[:0], b...)
+	if err := ParseMessage(req, req.Raw, false); err != nil {
+		req.SetResponseHeader(RcodeFormErr, 0)
+		_, _ = rw.Write(req.Raw)
+		return rw.Data
+	}
+
+	d.Handler.ServeDNS(rw, req)
+
+	if d.MaxSize > 0 && len(rw.Data) > d.MaxSize {
+		qlen := 12 + len(req.Question.Name) + 4
+		if len(rw.Data) >= qlen {
+			// TC
+			rw.Data[2] |= 0b00000010
+			// ANCOUNT, NSCOUNT, ARCOUNT
+			clear(rw.Data[6:12])
+			rw.Data = rw.Data[:qlen]
+		}
+	}
+
+	return rw.Data
+}
+
+// memConn is a datagram connection of MemDialer, each Write is served by Handler
+// in its own goroutine and the response is delivered to the following Read.
+type memConn struct {
+	dialer   *MemDialer
+	ctx      context.Context
+	network  string
+	deadline time.Time
+	resp     chan []byte
+}
+
+// Write sends the query in b to Handler.
+func (c *memConn) Write(b []byte) (int, error) {
+	lost, delay := c.dialer.roll()
+
+	c.resp = make(chan []byte, 1)
+	if lost {
+		return len(b), nil
+	}
+
+	query := append([]byte(nil), b...)
+	go func(ch chan<- []byte) {
+		start := time.Now()
+		data := c.dialer.serve(query)
+		if len(data) == 0 {
+			// the handler did not answer.
+			return
+		}
+		if d := delay - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+		ch <- data
+	}(c.resp)
+
+	return len(b), nil
+}
+
+// Read waits for the response of the last query until the deadline.
+func (c *memConn) Read(b []byte) (int, error) {
+	if c.resp == nil {
+		return 0, &net.OpError{Op: "read", Net: c.network, Err: os.ErrDeadlineExceeded}
+	}
+
+	var timeout <-chan time.Time
+	if !c.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(c.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case data := <-c.resp:
+		c.resp = nil
+		return copy(b, data), nil
+	case <-timeout:
+		return 0, &net.OpError{Op: "read", Net: c.network, Err: os.ErrDeadlineExceeded}
+	case <-c.ctx.Done():
+		return 0, &net.OpError{Op: "read", Net: c.network, Err: c.ctx.Err()}
+	}
+}
+
+// Close abandons the pending response.
+func (c *memConn) Close() error {
+	c.resp = nil
+	return nil
+}
+
+// LocalAddr returns the client address seen by Handler.
+func (c *memConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.dialer.Raddr)
+}
+
+// RemoteAddr returns the server address seen by Handler.
+func (c *memConn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.dialer.Laddr)
+}
+
+// SetDeadline sets the deadline of Read.
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// SetReadDeadline sets the deadline of Read.
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// SetWriteDeadline is a no-op because Write never blocks.
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,217 @@
+package fastdns
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Resolver returns a net.Resolver which sends its queries through c, so the
+// libraries using net.Resolver benefit from the dialers and cache of c.
+// Note that the Go resolver still applies /etc/hosts and the search list of
+// /etc/resolv.conf, but the name servers there are replaced by c.
+func (c *Client) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn := resolverConn{client: c, ctx: ctx, network: network, address: address}
+			if strings.HasPrefix(network, "udp") {
+				return &resolverPacketConn{conn}, nil
+			}
+			conn.stream = true
+			return &conn, nil
+		},
+	}
+}
+
+// DialContext connects to the address on the named network, resolving the host
+// of address through c. It is suitable for http.Transport.DialContext.
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+
+	if _, err := netip.ParseAddr(host); err == nil || host == "" {
+		return d.DialContext(ctx, network, address)
+	}
+
+	var ipnet string
+	switch network {
+	case "tcp", "udp":
+		ipnet = "ip"
+	case "tcp4", "udp4":
+		ipnet = "ip4"
+	case "tcp6", "udp6":
+		ipnet = "ip6"
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	ips, err := c.LookupNetIP(ctx, ipnet, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if len(ips) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}}
+	}
+
+	var errs []error
+	for _, ip := range ips {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// resolverConn is a net.Conn answering the queries written by the Go resolver
+// with Client.Exchange. The stream form uses the 2-byte length prefix of TCP.
+type resolverConn struct {
+	client   *Client
+	ctx      context.Context
+	network  string
+	address  string
+	stream   bool
+	deadline time.Time
+	qlen     int
+	buf      []byte
+}
+
+// Write exchanges the query in b and keeps the response for Read.
+func (c *resolverConn) Write(b []byte) (int, error) {
+	payload := b
+	if c.stream {
+		if len(b) < 2 || int(b[0])<<8|int(b[1]) != len(b)-2 {
+			return 0, ErrInvalidHeader
+		}
+		payload = b[2:]
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(resp)
+	defer ReleaseMessage(req)
+
+	if err := ParseMessage(req, payload, true); err != nil {
+		return 0, err
+	}
+
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	if err := c.client.Exchange(ctx, req, resp); err != nil {
+		return 0, err
+	}
+
+	c.qlen = 12 + len(req.Question.Name) + 4
+	c.buf = c.buf[:0]
+	if c.stream {
+		c.buf = append(c.buf, byte(len(resp.Raw)>>8), byte(len(resp.Raw)))
+	}
+	c.buf = append(c.buf, resp.Raw...)
+
+	return len(b), nil
+}
+
+// Read returns the pending response, a datagram which does not fit in b is
+// truncated to its question with TC set so that the Go resolver retries over TCP.
+func (c *resolverConn) Read(b []byte) (n int, err error) {
+	if len(c.buf) == 0 {
+		return 0, io.EOF
+	}
+
+	if c.stream {
+		n = copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+
+	if len(c.buf) > len(b) && len(b) >= c.qlen && len(c.buf) >= c.qlen {
+		// TC
+		c.buf[2] |= 0b00000010
+		// ANCOUNT, NSCOUNT, ARCOUNT
+		clear(c.buf[6:12])
+		c.buf = c.buf[:c.qlen]
+	}
+
+	n = copy(b, c.buf)
+	c.buf = c.buf[:0]
+	return n, nil
+}
+
+// Close discards the pending response.
+func (c *resolverConn) Close() error {
+	c.buf = nil
+	return nil
+}
+
+// LocalAddr returns the address of the resolver side.
+func (c *resolverConn) LocalAddr() net.Addr {
+	return resolverAddr{c.network, "fastdns"}
+}
+
+// RemoteAddr returns the name server address requested by the Go resolver.
+func (c *resolverConn) RemoteAddr() net.Addr {
+	return resolverAddr{c.network, c.address}
+}
+
+// SetDeadline sets the deadline of the following exchanges.
+func (c *resolverConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// SetReadDeadline is a no-op because Read never blocks.
+func (c *resolverConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of the following exchanges.
+func (c *resolverConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// resolverPacketConn is the datagram form of resolverConn, the Go resolver
+// checks for net.PacketConn to choose between UDP and TCP framing.
+type resolverPacketConn struct {
+	resolverConn
+}
+
+// ReadFrom reads a response like Read.
+func (c *resolverPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+// WriteTo writes a query like Write, addr is ignored.
+func (c *resolverPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+type resolverAddr struct {
+	network string
+	address string
+}
+
+// Network returns the network name of the address.
+func (a resolverAddr) Network() string { return a.network }
+
+// String returns the address in string form.
+func (a resolverAddr) String() string { return a.address }
@@ -0,0 +1,232 @@
+package fastdns
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResolvConfig represents the settings of a resolv.conf(5) file.
+type ResolvConfig struct {
+	// Nameservers lists the addresses of name servers in host:port form.
+	Nameservers []string
+
+	// Search lists the domains used to expand relative names.
+	Search []string
+
+	// Ndots is the number of dots a name must have to be tried as absolute first.
+	Ndots int
+
+	// Timeout is the time to wait for a response from a name server.
+	Timeout time.Duration
+
+	// Attempts is the number of attempts of a query.
+	Attempts int
+
+	// Rotate reports whether to round robin among the name servers.
+	Rotate bool
+
+	// EDNS0 reports whether to send an EDNS0 OPT record in queries.
+	EDNS0 bool
+
+	retry *RetryPolicy
+}
+
+// ParseResolvConfig parses the content of a resolv.conf(5) file.
+func ParseResolvConfig(data []byte) *ResolvConfig {
+	conf := &ResolvConfig{
+		Ndots:    1,
+		Timeout:  5 * time.Second,
+		Attempts: 2,
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if addr, err := netip.ParseAddr(fields[1]); err == nil {
+				conf.Nameservers = append(conf.Nameservers, net.JoinHostPort(addr.String(), "53"))
+			}
+		case "domain":
+			conf.Search = []string{strings.TrimSuffix(fields[1], ".")}
+		case "search":
+			conf.Search = conf.Search[:0]
+			for _, s := range fields[1:] {
+				if s = strings.TrimSuffix(s, "."); s != "" {
+					conf.Search = append(conf.Search, s)
+				}
+			}
+		case "options":
+			for _, s := range fields[1:] {
+				key, value, _ := strings.Cut(s, ":")
+				n, _ := strconv.Atoi(value)
+				switch key {
+				case "ndots":
+					conf.Ndots = min(max(n, 0), 15)
+				case "timeout":
+					if n >= 1 {
+						conf.Timeout = time.Duration(min(n, 30)) * time.Second
+					}
+				case "attempts":
+					if n >= 1 {
+						conf.Attempts = min(n, 5)
+					}
+				case "rotate":
+					conf.Rotate = true
+				case "edns0":
+					conf.EDNS0 = true
+				}
+			}
+		}
+	}
+
+	if len(conf.Nameservers) == 0 {
+		conf.Nameservers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+
+	conf.retry = &RetryPolicy{
+		MaxAttempts: conf.Attempts,
+		Rcodes:      []Rcode{RcodeServFail, RcodeRefused},
+	}
+
+	return conf
+}
+
+// SearchNames returns the names to query for host in order, expanding
+// relative names with the search list as resolv.conf(5) describes.
+func (conf *ResolvConfig) SearchNames(host string) []string {
+	if strings.HasSuffix(host, ".") || len(conf.Search) == 0 {
+		return []string{strings.TrimSuffix(host, ".")}
+	}
+
+	names := make([]string, 0, len(conf.Search)+1)
+	absolute := strings.Count(host, ".") >= conf.Ndots
+	if absolute {
+		names = append(names, host)
+	}
+	for _, suffix := range conf.Search {
+		names = append(names, host+"."+suffix)
+	}
+	if !absolute {
+		names = append(names, host)
+	}
+	return names
+}
+
+// ResolvConf loads the resolver configuration from a resolv.conf(5) file and
+// reloads it when the file changes.
+type ResolvConf struct {
+	// Path specifies the location of the file.
+	// If not set, use /etc/resolv.conf as default.
+	Path string
+
+	// CheckInterval specifies how often the file is checked for changes.
+	// If not set, use 5 seconds as default.
+	CheckInterval time.Duration
+
+	watcher fileWatcher
+	config  atomic.Pointer[ResolvConfig]
+	next    atomic.Uint32
+}
+
+// Config returns the current configuration, reloading the file if it changed.
+func (r *ResolvConf) Config() *ResolvConfig {
+	path := r.Path
+	if path == "" {
+		path = "/etc/resolv.conf"
+	}
+
+	conf := r.config.Load()
+	if data, changed := r.watcher.check(path, r.CheckInterval, conf == nil); changed {
+		conf = ParseResolvConfig(data)
+		r.config.Store(conf)
+	}
+
+	return conf
+}
+
+// nameserver returns the name server for the attempt of the next query, the
+// retries of a query fail over to the next name servers.
+func (r *ResolvConf) nameserver(attempt int) string {
+	conf := r.Config()
+	if !conf.Rotate {
+		return conf.Nameservers[attempt%len(conf.Nameservers)]
+	}
+	return conf.Nameservers[int(r.next.Add(1))%len(conf.Nameservers)]
+}
+
+// NewSystemClient returns a Client which honors the host's resolver settings
+// in /etc/resolv.conf and resolves names in /etc/hosts before the network.
+func NewSystemClient() (*Client, error) {
+	resolv := &ResolvConf{Path: "/etc/resolv.conf"}
+	if _, err := os.Stat(resolv.Path); err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		Resolv: resolv,
+		Hosts:  &Hosts{Path: "/etc/hosts"},
+	}, nil
+}
+
+// fileWatcher reads a file again when its size or modification time changes.
+type fileWatcher struct {
+	mu      sync.Mutex
+	checked atomic.Int64
+	modTime time.Time
+	size    int64
+}
+
+// check reads path if it changed since the last check, it stats the file at
+// most once per interval unless force is set.
+func (w *fileWatcher) check(path string, interval time.Duration, force bool) (data []byte, changed bool) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	now := time.Now().UnixNano()
+	if last := w.checked.Load(); !force && (now-last < int64(interval) || !w.checked.CompareAndSwap(last, now)) {
+		return nil, false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.checked.Store(now)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		// treat a missing file as empty, E.g. no /etc/resolv.conf in containers.
+		if force || !w.modTime.IsZero() {
+			w.modTime, w.size = time.Time{}, 0
+			return nil, true
+		}
+		return nil, false
+	}
+	if !force && fi.ModTime().Equal(w.modTime) && fi.Size() == w.size {
+		return nil, false
+	}
+
+	data, err = os.ReadFile(path)
+	if err != nil {
+		return nil, force
+	}
+	w.modTime, w.size = fi.ModTime(), fi.Size()
+
+	return data, true
+}
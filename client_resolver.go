@@ -4,6 +4,7 @@ import (
 	"cmp"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
@@ -16,19 +17,32 @@ func (c *Client) AppendLookupNetIP(dst []netip.Addr, ctx context.Context, networ
 	defer ReleaseMessage(resp)
 	defer ReleaseMessage(req)
 
+	if c.Hosts != nil {
+		n := len(dst)
+		if dst = c.Hosts.AppendLookupNetIP(dst, network, host); len(dst) > n {
+			return dst, nil
+		}
+	}
+
 	var typ Type
 
 	switch network {
 	case "ip":
-		dst, err = c.AppendLookupNetIP(dst, ctx, "ip4", host)
-		if err != nil {
-			return
-		}
-		dst, err = c.AppendLookupNetIP(dst, ctx, "ip6", host)
-		if err != nil {
-			return
+		var ip4, ip6 []netip.Addr
+		var err4, err6 error
+		c.LookupNetIPFunc(ctx, host, func(network string, ips []netip.Addr, err error) bool {
+			if network == "ip4" {
+				ip4, err4 = ips, err
+			} else {
+				ip6, err6 = ips, err
+			}
+			return true
+		})
+		if len(ip4) == 0 && len(ip6) == 0 && (err4 != nil || err6 != nil) {
+			return dst, errors.Join(err4, err6)
 		}
-		return dst, nil
+		// partial success, one of the families may have failed.
+		return orderAddrs(dst, ip4, ip6, c.AddrOrder), nil
 	case "ip4":
 		typ = TypeA
 	case "ip6":
@@ -37,9 +51,7 @@ func (c *Client) AppendLookupNetIP(dst []netip.Addr, ctx context.Context, networ
 		return nil, ErrInvalidQuestion
 	}
 
-	req.SetRequestQuestion(host, typ, ClassINET)
-
-	err = c.Exchange(ctx, req, resp)
+	err = c.query(ctx, req, resp, host, typ)
 	if err != nil {
 		return nil, err
 	}
@@ -73,6 +85,57 @@ func (c *Client) AppendLookupNetIP(dst []netip.Addr, ctx context.Context, networ
 	return dst, err
 }
 
+// query exchanges the question of host and typ, expanding host with the search
+// list of c.Resolv until a name has answers.
+func (c *Client) query(ctx context.Context, req, resp *Message, host string, typ Type) (err error) {
+	if c.Resolv == nil {
+		req.SetRequestQuestion(host, typ, ClassINET)
+		return c.Exchange(ctx, req, resp)
+	}
+
+	for _, name := range c.Resolv.Config().SearchNames(host) {
+		req.SetRequestQuestion(name, typ, ClassINET)
+		err = c.Exchange(ctx, req, resp)
+		if err == nil && resp.Header.Flags.Rcode() == RcodeNoError && resp.Header.ANCount != 0 {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	return
+}
+
+// LookupNetIPFunc looks up the IPv4 and IPv6 addresses of host concurrently and calls fn
+// with the result of each family as soon as it arrives, E.g. for Happy Eyeballs dialing.
+// fn is never called concurrently, if it returns false the remaining lookup is abandoned.
+func (c *Client) LookupNetIPFunc(ctx context.Context, host string, fn func(network string, ips []netip.Addr, err error) bool) {
+	type result struct {
+		network string
+		ips     []netip.Addr
+		err     error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan result, 2)
+	for _, network := range [...]string{"ip6", "ip4"} {
+		go func(network string) {
+			ips, err := c.AppendLookupNetIP(nil, ctx, network, host)
+			ch <- result{network, ips, err}
+		}(network)
+	}
+
+	for i := 0; i < 2; i++ {
+		r := <-ch
+		if !fn(r.network, r.ips, r.err) {
+			return
+		}
+	}
+}
+
 // LookupNetIP looks up host using the local resolver. It returns a slice of that host's IP addresses of the type specified by network. The network must be one of "ip", "ip4" or "ip6".
 func (c *Client) LookupNetIP(ctx context.Context, network, host string) (ips []netip.Addr, err error) {
 	return c.AppendLookupNetIP(ips, ctx, network, host)
@@ -84,9 +147,7 @@ func (c *Client) LookupCNAME(ctx context.Context, host string) (cname string, er
 	defer ReleaseMessage(resp)
 	defer ReleaseMessage(req)
 
-	req.SetRequestQuestion(host, TypeCNAME, ClassINET)
-
-	err = c.Exchange(ctx, req, resp)
+	err = c.query(ctx, req, resp, host, TypeCNAME)
 	if err != nil {
 		return
 	}
@@ -120,9 +181,7 @@ func (c *Client) LookupNS(ctx context.Context, name string) (ns []*net.NS, err e
 	defer ReleaseMessage(resp)
 	defer ReleaseMessage(req)
 
-	req.SetRequestQuestion(name, TypeNS, ClassINET)
-
-	err = c.Exchange(ctx, req, resp)
+	err = c.query(ctx, req, resp, name, TypeNS)
 	if err != nil {
 		return
 	}
@@ -171,6 +230,12 @@ func (c *Client) LookupPTR(ctx context.Context, ip string) (ptr string, err erro
 		addr = addr.Unmap()
 	}
 
+	if c.Hosts != nil {
+		if names := c.Hosts.LookupAddr(addr); len(names) != 0 {
+			return names[0], nil
+		}
+	}
+
 	var qname string
 	if addr.Is4() {
 		v := addr.As4()
@@ -221,9 +286,7 @@ func (c *Client) LookupTXT(ctx context.Context, host string) (txt []string, err
 	defer ReleaseMessage(resp)
 	defer ReleaseMessage(req)
 
-	req.SetRequestQuestion(host, TypeTXT, ClassINET)
-
-	err = c.Exchange(ctx, req, resp)
+	err = c.query(ctx, req, resp, host, TypeTXT)
 	if err != nil {
 		return
 	}
@@ -255,9 +318,7 @@ func (c *Client) LookupMX(ctx context.Context, host string) (mx []*net.MX, err e
 	defer ReleaseMessage(resp)
 	defer ReleaseMessage(req)
 
-	req.SetRequestQuestion(host, TypeMX, ClassINET)
-
-	err = c.Exchange(ctx, req, resp)
+	err = c.query(ctx, req, resp, host, TypeMX)
 	if err != nil {
 		return
 	}
@@ -291,9 +352,7 @@ func (c *Client) LookupHTTPS(ctx context.Context, host string) (https []NetHTTPS
 	defer ReleaseMessage(resp)
 	defer ReleaseMessage(req)
 
-	req.SetRequestQuestion(host, TypeHTTPS, ClassINET)
-
-	err = c.Exchange(ctx, req, resp)
+	err = c.query(ctx, req, resp, host, TypeHTTPS)
 	if err != nil {
 		return
 	}
@@ -367,9 +426,7 @@ func (c *Client) LookupSRV(ctx context.Context, service, proto, name string) (ta
 	defer ReleaseMessage(resp)
 	defer ReleaseMessage(req)
 
-	req.SetRequestQuestion(target, TypeSRV, ClassINET)
-
-	err = c.Exchange(ctx, req, resp)
+	err = c.query(ctx, req, resp, target, TypeSRV)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,172 @@
+package fastdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy specifies how Client.Exchange retries a failed transaction.
+type RetryPolicy struct {
+	// MaxAttempts limits the number of attempts including the first one.
+	// If not set, use 3 as default.
+	MaxAttempts int
+
+	// AttemptTimeout specifies the maximum duration of a single attempt.
+	// The context deadline still bounds the whole exchange.
+	// If not set, use Client.Timeout.
+	AttemptTimeout time.Duration
+
+	// Backoff specifies the base delay before the second attempt, it doubles
+	// for each further attempt and a random jitter is applied.
+	// If not set, attempts are retried immediately.
+	Backoff time.Duration
+
+	// MaxBackoff caps the delay between attempts.
+	// If not set, use 1 second as default.
+	MaxBackoff time.Duration
+
+	// Rcodes specifies the response codes which trigger a retry,
+	// E.g. RcodeServFail and RcodeRefused.
+	Rcodes []Rcode
+}
+
+// ExchangeAttempt records the outcome of a single attempt.
+type ExchangeAttempt struct {
+	// Err is the error of the attempt, nil if a response was received.
+	Err error
+
+	// Rcode is the response code of the attempt if a response was received.
+	Rcode Rcode
+
+	// Duration is the time spent by the attempt.
+	Duration time.Duration
+}
+
+// ExchangeError is returned by Client.Exchange when the attempts failed, or an
+// error or the context stopped the retries.
+type ExchangeError struct {
+	Attempts []ExchangeAttempt
+}
+
+// Error returns the summary of all attempts.
+func (e *ExchangeError) Error() string {
+	b := []byte("fastdns: exchange failed after ")
+	b = strconv.AppendInt(b, int64(len(e.Attempts)), 10)
+	b = append(b, " attempts"...)
+	for i, a := range e.Attempts {
+		b = append(b, "; #"...)
+		b = strconv.AppendInt(b, int64(i+1), 10)
+		b = append(b, ' ')
+		if a.Err != nil {
+			b = append(b, a.Err.Error()...)
+		} else {
+			b = append(b, a.Rcode.String()...)
+		}
+	}
+	return string(b)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *ExchangeError) Unwrap() error {
+	if len(e.Attempts) == 0 {
+		return nil
+	}
+	return e.Attempts[len(e.Attempts)-1].Err
+}
+
+// exchange runs the attempts of a transaction following the policy.
+func (p *RetryPolicy) exchange(ctx context.Context, c *Client, req, resp *Message, timeout time.Duration) error {
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+
+	if p.AttemptTimeout != 0 {
+		timeout = p.AttemptTimeout
+	}
+
+	var e ExchangeError
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if err := p.sleep(ctx, i); err != nil {
+				e.Attempts = append(e.Attempts, ExchangeAttempt{Err: err})
+				return &e
+			}
+		}
+
+		start := time.Now()
+		err := c.exchange(ctx, req, resp, timeout, i)
+		attempt := ExchangeAttempt{Err: err, Duration: time.Since(start)}
+		if err == nil {
+			attempt.Rcode = resp.Header.Flags.Rcode()
+		} else if cerr := ctx.Err(); cerr != nil && !errors.Is(err, cerr) {
+			// the attempt may fail by its own deadline after ctx is done.
+			attempt.Err = fmt.Errorf("%w: %w", err, cerr)
+		}
+		e.Attempts = append(e.Attempts, attempt)
+
+		if !p.retryable(ctx, err, attempt.Rcode) {
+			if err != nil {
+				return &e
+			}
+			return nil
+		}
+	}
+
+	if last := e.Attempts[len(e.Attempts)-1]; last.Err == nil {
+		// the last response is still a valid answer to the caller.
+		return nil
+	}
+
+	return &e
+}
+
+// retryable reports whether an attempt with err or rcode deserves another try.
+func (p *RetryPolicy) retryable(ctx context.Context, err error, rcode Rcode) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err == nil {
+		return slices.Contains(p.Rcodes, rcode)
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return true
+	}
+	return errors.Is(err, ErrInvalidHeader) || errors.Is(err, ErrInvalidQuestion) || errors.Is(err, ErrInvalidAnswer)
+}
+
+// sleep waits the backoff delay before the n-th retry or until ctx is done.
+func (p *RetryPolicy) sleep(ctx context.Context, n int) error {
+	if p.Backoff <= 0 {
+		return ctx.Err()
+	}
+
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Second
+	}
+
+	delay := p.Backoff << (n - 1)
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+	// equal jitter, see https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+	delay = delay/2 + rand.N(delay/2+1)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
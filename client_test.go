@@ -3,31 +3,61 @@ package fastdns
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
 )
 
-// TestClientContext ensures the HTTP request context pointer patching works.
+// mockContextTransport records the context value of key in the HTTP requests.
+type mockContextTransport struct {
+	key   any
+	value any
+}
+
+// RoundTrip records the context value and fails the request.
+func (tr *mockContextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr.value = req.Context().Value(tr.key)
+	return nil, errors.New("mock transport")
+}
+
+// TestClientContext ensures the HTTP request carries the context of the exchange.
 func TestClientContext(t *testing.T) {
 	key, value := struct{ key string }{key: "a"}, "b"
 
-	ctx := context.WithValue(context.Background(), key, value)
-	req, _ := http.NewRequest(http.MethodGet, "https://1.1.1.1/dns-query", nil)
+	tr := &mockContextTransport{key: key}
+	client := &Client{
+		Dialer: &HTTPDialer{
+			Endpoint:  &url.URL{Scheme: "https", Host: "1.1.1.1", Path: "/dns-query"},
+			Transport: tr,
+		},
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(resp)
+	defer ReleaseMessage(req)
 
-	*(*context.Context)(unsafe.Pointer(uintptr(unsafe.Pointer(req)) + httpctxoffset)) = ctx
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	_ = client.Exchange(context.WithValue(context.Background(), key, value), req, resp)
 
-	got, _ := req.Context().Value(key).(string)
+	got, _ := tr.value.(string)
 	want := value
 	if got != want {
-		t.Errorf("set http request context inplace failed, got=%s, want=%s", got, want)
+		t.Errorf("http request context mismatch, got=%s, want=%s", got, want)
 	}
 }
 
@@ -429,3 +459,938 @@ func BenchmarkResolverFastdnsHTTP(b *testing.B) {
 		}
 	})
 }
+
+type mockRetryHandler struct {
+	fails int32
+	count atomic.Int32
+}
+
+// ServeDNS fails the first requests with SERVFAIL and then answers a host record.
+func (h *mockRetryHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	if h.count.Add(1) <= h.fails {
+		req.SetResponseHeader(RcodeNoError, 0)
+		req.Raw[3] |= byte(RcodeServFail)
+		_, _ = rw.Write(req.Raw)
+		return
+	}
+	req.SetResponseHeader(RcodeNoError, 1)
+	req.AppendHOST1(600, netip.AddrFrom4([4]byte{1, 1, 1, 1}))
+	_, _ = rw.Write(req.Raw)
+}
+
+type mockSilentHandler struct{}
+
+// ServeDNS never replies to the request.
+func (h *mockSilentHandler) ServeDNS(rw ResponseWriter, req *Message) {}
+
+// serveTestHandler starts a local UDP server with handler and returns its address.
+func serveTestHandler(t *testing.T, handler Handler) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp error: %+v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		_ = (&Server{Handler: handler, MaxProcs: 1}).Serve(conn)
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// TestClientExchangeRetryRcode retries the exchange on configured response codes.
+func TestClientExchangeRetryRcode(t *testing.T) {
+	handler := &mockRetryHandler{fails: 2}
+
+	client := &Client{
+		Addr:    serveTestHandler(t, handler),
+		Timeout: time.Second,
+		Retry: &RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     time.Millisecond,
+			Rcodes:      []Rcode{RcodeServFail, RcodeRefused},
+		},
+	}
+
+	ips, err := client.LookupNetIP(context.Background(), "ip4", "example.org")
+	if err != nil {
+		t.Fatalf("LookupNetIP return error: %+v", err)
+	}
+	if len(ips) != 1 || ips[0] != netip.AddrFrom4([4]byte{1, 1, 1, 1}) {
+		t.Errorf("LookupNetIP return mismatched reply: %+v", ips)
+	}
+	if n := handler.count.Load(); n != 3 {
+		t.Errorf("handler shall be called 3 times, got %d", n)
+	}
+}
+
+// TestClientExchangeRetryTimeout records every timed out attempt in ExchangeError.
+func TestClientExchangeRetryTimeout(t *testing.T) {
+	client := &Client{
+		Addr: serveTestHandler(t, &mockSilentHandler{}),
+		Retry: &RetryPolicy{
+			MaxAttempts:    2,
+			AttemptTimeout: 50 * time.Millisecond,
+		},
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(resp)
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+	err := client.Exchange(context.Background(), req, resp)
+
+	var e *ExchangeError
+	if !errors.As(err, &e) {
+		t.Fatalf("Exchange shall return ExchangeError, got %+v", err)
+	}
+	if len(e.Attempts) != 2 {
+		t.Errorf("ExchangeError shall record 2 attempts, got %+v", e.Attempts)
+	}
+	if !os.IsTimeout(e.Attempts[0].Err) {
+		t.Errorf("ExchangeError attempt shall be timeout, got %+v", e.Attempts[0].Err)
+	}
+}
+
+// TestClientExchangeRetryCancel records the attempts before the context is
+// canceled during the second attempt.
+func TestClientExchangeRetryCancel(t *testing.T) {
+	client := &Client{
+		Addr: serveTestHandler(t, &mockSilentHandler{}),
+		Retry: &RetryPolicy{
+			MaxAttempts:    3,
+			AttemptTimeout: 100 * time.Millisecond,
+		},
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(resp)
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(150*time.Millisecond, cancel)
+	defer timer.Stop()
+
+	err := client.Exchange(ctx, req, resp)
+
+	var e *ExchangeError
+	if !errors.As(err, &e) {
+		t.Fatalf("Exchange shall return ExchangeError, got %+v", err)
+	}
+	if len(e.Attempts) != 2 {
+		t.Fatalf("ExchangeError shall record 2 attempts, got %+v", e.Attempts)
+	}
+	if !os.IsTimeout(e.Attempts[0].Err) || errors.Is(e.Attempts[0].Err, context.Canceled) {
+		t.Errorf("ExchangeError first attempt shall be timeout, got %+v", e.Attempts[0].Err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ExchangeError shall unwrap to context.Canceled, got %+v", err)
+	}
+}
+
+type mockSlowHandler struct {
+	mockRetryHandler
+	delay time.Duration
+}
+
+// ServeDNS answers a host record after a delay.
+func (h *mockSlowHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	time.Sleep(h.delay)
+	h.mockRetryHandler.ServeDNS(rw, req)
+}
+
+// TestClientSingleFlight coalesces concurrent identical lookups into one query.
+func TestClientSingleFlight(t *testing.T) {
+	handler := &mockSlowHandler{delay: 100 * time.Millisecond}
+
+	client := &Client{
+		Addr:         serveTestHandler(t, handler),
+		Timeout:      time.Second,
+		SingleFlight: true,
+	}
+
+	// the leading caller gives up early, the others shall still be answered.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := context.Background()
+			if i == 0 {
+				c = ctx
+			} else {
+				time.Sleep(time.Millisecond)
+			}
+			_, errs[i] = client.LookupNetIP(c, "ip4", "example.org")
+		}(i)
+	}
+	wg.Wait()
+
+	if !errors.Is(errs[0], context.DeadlineExceeded) {
+		t.Errorf("leading lookup shall be cancelled, got %+v", errs[0])
+	}
+	for _, err := range errs[1:] {
+		if err != nil {
+			t.Errorf("coalesced lookup return error: %+v", err)
+		}
+	}
+	if n := handler.count.Load(); n != 1 {
+		t.Errorf("handler shall be called once, got %d", n)
+	}
+
+	// a different client subnet is a different flight.
+	subnet := netip.MustParsePrefix("1.2.3.0/24")
+	for _, c := range []context.Context{context.Background(), WithClientSubnet(context.Background(), subnet)} {
+		if _, err := client.LookupNetIP(c, "ip4", "example.org"); err != nil {
+			t.Errorf("lookup return error: %+v", err)
+		}
+	}
+	if n := handler.count.Load(); n != 3 {
+		t.Errorf("handler shall be called 3 times, got %d", n)
+	}
+}
+
+// TestClientFlightKey tells apart the queries whose EDNS options differ.
+func TestClientFlightKey(t *testing.T) {
+	newRequest := func(edns func(a *MessageOptionsAppender)) *Message {
+		req := AcquireMessage()
+		req.SetRequestQuestion("example.org", TypeA, ClassINET)
+		if edns != nil {
+			a, _ := req.OptionsAppender()
+			edns(&a)
+		}
+		return req
+	}
+
+	requests := []*Message{
+		newRequest(nil),
+		newRequest(func(a *MessageOptionsAppender) { a.AppendNSID("") }),
+		newRequest(func(a *MessageOptionsAppender) {
+			a.AppendNSID("")
+			a.msg.Raw[a.offset-2] |= 0x80 // DO
+		}),
+		newRequest(func(a *MessageOptionsAppender) { a.AppendCookie("01234567") }),
+		newRequest(func(a *MessageOptionsAppender) { a.AppendCookie("76543210") }),
+	}
+	keys := make(map[string]int)
+	for i, req := range requests {
+		key := string(appendFlightKey(nil, req, "", nil))
+		if j, ok := keys[key]; ok {
+			t.Errorf("requests %d and %d share the flight key %x", j, i, key)
+		}
+		keys[key] = i
+		ReleaseMessage(req)
+	}
+
+	a, b := newRequest(nil), newRequest(nil)
+	defer ReleaseMessage(a)
+	defer ReleaseMessage(b)
+	if string(appendFlightKey(nil, a, "", nil)) != string(appendFlightKey(nil, b, "", nil)) {
+		t.Errorf("identical requests have different flight keys")
+	}
+
+	// the queries to the name servers overriding the upstream servers.
+	keys = make(map[string]int)
+	for i, server := range []string{"", "192.0.2.1:53", "192.0.2.2:53"} {
+		key := string(appendFlightKey(nil, a, server, nil))
+		if j, ok := keys[key]; ok {
+			t.Errorf("servers %d and %d share the flight key %x", j, i, key)
+		}
+		keys[key] = i
+	}
+
+	// the context options are sent along with the query as well.
+	ctx := context.Background()
+	contexts := []context.Context{
+		ctx,
+		WithClientNSID(ctx),
+		WithClientExpire(ctx),
+		WithClientKeepalive(ctx),
+		WithClientTag(ctx, 1),
+		WithClientTag(ctx, 2),
+		WithClientCookie(ctx, "01234567"),
+		WithClientDAU(ctx, []DNSSECAlgorithm{DNSSECAlgorithmED25519}),
+		WithClientDHU(ctx, []byte{2}),
+		WithClientN3U(ctx, []byte{1}),
+		WithClientSubnet(ctx, netip.MustParsePrefix("1.2.3.0/24")),
+	}
+	keys = make(map[string]int)
+	for i, c := range contexts {
+		options, _ := withClientOptions(c)
+		key := string(appendFlightKey(nil, a, "", &options))
+		if j, ok := keys[key]; ok {
+			t.Errorf("contexts %d and %d share the flight key %x", j, i, key)
+		}
+		keys[key] = i
+	}
+}
+
+type mockDualHandler struct {
+	failAAAA  bool
+	delayAAAA time.Duration
+}
+
+// ServeDNS answers two A or AAAA records, or fails the AAAA query if requested.
+func (h *mockDualHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	var ips []netip.Addr
+	switch req.Question.Type {
+	case TypeA:
+		ips = []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")}
+	case TypeAAAA:
+		time.Sleep(h.delayAAAA)
+		if h.failAAAA {
+			Error(rw, req, RcodeServFail)
+			return
+		}
+		ips = []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")}
+	}
+	req.SetResponseHeader(RcodeNoError, uint16(len(ips)))
+	req.AppendHOST(300, ips)
+	_, _ = rw.Write(req.Raw)
+}
+
+// TestClientLookupNetIPDual resolves both families concurrently with ordering and partial success.
+func TestClientLookupNetIPDual(t *testing.T) {
+	client := &Client{
+		Addr:      serveTestHandler(t, &mockDualHandler{}),
+		Timeout:   time.Second,
+		AddrOrder: AddrOrderInterleave,
+	}
+
+	ips, err := client.LookupNetIP(context.Background(), "ip", "example.org")
+	if err != nil {
+		t.Fatalf("LookupNetIP return error: %+v", err)
+	}
+	if got, want := fmt.Sprint(ips), "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2]"; got != want {
+		t.Errorf("LookupNetIP shall interleave addresses, got %s want %s", got, want)
+	}
+
+	client = &Client{
+		Addr:    serveTestHandler(t, &mockDualHandler{failAAAA: true}),
+		Timeout: time.Second,
+	}
+
+	ips, err = client.LookupNetIP(context.Background(), "ip", "example.org")
+	if err != nil {
+		t.Fatalf("LookupNetIP shall return partial success, got error: %+v", err)
+	}
+	if got, want := fmt.Sprint(ips), "[192.0.2.1 192.0.2.2]"; got != want {
+		t.Errorf("LookupNetIP shall return ipv4 addresses, got %s want %s", got, want)
+	}
+}
+
+// TestClientLookupNetIPFunc yields the first family as soon as it arrives.
+func TestClientLookupNetIPFunc(t *testing.T) {
+	client := &Client{
+		Addr:    serveTestHandler(t, &mockDualHandler{delayAAAA: 200 * time.Millisecond}),
+		Timeout: time.Second,
+	}
+
+	var networks []string
+	start := time.Now()
+	client.LookupNetIPFunc(context.Background(), "example.org", func(network string, ips []netip.Addr, err error) bool {
+		if err != nil || len(ips) != 2 {
+			t.Errorf("LookupNetIPFunc(%s) return ips: %+v error: %+v", network, ips, err)
+		}
+		networks = append(networks, network)
+		return false
+	})
+
+	if fmt.Sprint(networks) != "[ip4]" {
+		t.Errorf("LookupNetIPFunc shall yield ip4 only, got %+v", networks)
+	}
+	if d := time.Since(start); d >= 200*time.Millisecond {
+		t.Errorf("LookupNetIPFunc shall not wait for ip6, took %s", d)
+	}
+}
+
+// TestClientSortByRFC6724 prefers the IPv6 loopback over the IPv4 loopback.
+func TestClientSortByRFC6724(t *testing.T) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv6loopback, Port: 9})
+	if err != nil {
+		t.Skipf("ipv6 loopback is unavailable: %+v", err)
+	}
+	_ = conn.Close()
+
+	addrs := []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")}
+	sortByRFC6724(addrs)
+	if addrs[0] != netip.IPv6Loopback() {
+		t.Errorf("sortByRFC6724 shall prefer ::1, got %+v", addrs)
+	}
+}
+
+// TestParseResolvConfig parses resolv.conf directives and expands search names.
+func TestParseResolvConfig(t *testing.T) {
+	conf := ParseResolvConfig([]byte(`
+# comment
+nameserver 192.0.2.53
+nameserver 2001:db8::53 ; comment
+nameserver invalid
+search corp.example. example.org
+options ndots:2 timeout:3 attempts:4 rotate edns0
+`))
+
+	if got, want := fmt.Sprint(conf.Nameservers), "[192.0.2.53:53 [2001:db8::53]:53]"; got != want {
+		t.Errorf("Nameservers got %s want %s", got, want)
+	}
+	if conf.Ndots != 2 || conf.Timeout != 3*time.Second || conf.Attempts != 4 || !conf.Rotate || !conf.EDNS0 {
+		t.Errorf("options mismatch: %+v", conf)
+	}
+
+	cases := []struct {
+		Host  string
+		Names string
+	}{
+		{"www", "[www.corp.example www.example.org www]"},
+		{"a.b.c", "[a.b.c a.b.c.corp.example a.b.c.example.org]"},
+		{"www.", "[www]"},
+	}
+	for _, c := range cases {
+		if got := fmt.Sprint(conf.SearchNames(c.Host)); got != c.Names {
+			t.Errorf("SearchNames(%#v) got %s want %s", c.Host, got, c.Names)
+		}
+	}
+
+	conf = ParseResolvConfig(nil)
+	if got, want := fmt.Sprint(conf.Nameservers), "[127.0.0.1:53 [::1]:53]"; got != want {
+		t.Errorf("default Nameservers got %s want %s", got, want)
+	}
+	if conf.Ndots != 1 || conf.Timeout != 5*time.Second || conf.Attempts != 2 {
+		t.Errorf("default options mismatch: %+v", conf)
+	}
+}
+
+// TestHosts resolves names from a hosts file and reloads it on changes.
+func TestHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("127.0.0.1 localhost Local.Example # comment\n::1 localhost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := &Hosts{Path: path, CheckInterval: time.Nanosecond}
+
+	if got, want := fmt.Sprint(hosts.AppendLookupNetIP(nil, "ip", "localhost")), "[127.0.0.1 ::1]"; got != want {
+		t.Errorf("AppendLookupNetIP got %s want %s", got, want)
+	}
+	if got, want := fmt.Sprint(hosts.AppendLookupNetIP(nil, "ip6", "LOCAL.example.")), "[]"; got != want {
+		t.Errorf("AppendLookupNetIP got %s want %s", got, want)
+	}
+	if got, want := fmt.Sprint(hosts.LookupAddr(netip.MustParseAddr("127.0.0.1"))), "[localhost local.example]"; got != want {
+		t.Errorf("LookupAddr got %s want %s", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte("192.0.2.1 localhost other.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time differs on coarse file systems.
+	_ = os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+
+	if got, want := fmt.Sprint(hosts.AppendLookupNetIP(nil, "ip", "other.example")), "[192.0.2.1]"; got != want {
+		t.Errorf("AppendLookupNetIP after reload got %s want %s", got, want)
+	}
+}
+
+// mockSearchHandler answers A queries of name only and NXDOMAIN otherwise.
+type mockSearchHandler struct {
+	name string
+}
+
+// ServeDNS answers the configured name with 192.0.2.1.
+func (h *mockSearchHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	if req.Domain == nil || string(req.Domain) != h.name {
+		Error(rw, req, RcodeNXDomain)
+		return
+	}
+	req.SetResponseHeader(RcodeNoError, 1)
+	req.AppendHOST(300, []netip.Addr{netip.MustParseAddr("192.0.2.1")})
+	_, _ = rw.Write(req.Raw)
+}
+
+// TestClientResolvConf expands relative names with the search list and consults hosts first.
+func TestClientResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "resolv.conf"), []byte("search corp.example\noptions timeout:1 attempts:1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "hosts"), []byte("192.0.2.9 db\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", serveTestHandler(t, &mockSearchHandler{name: "www.corp.example"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &Client{
+		Dialer: &UDPDialer{Addr: addr},
+		Resolv: &ResolvConf{Path: filepath.Join(dir, "resolv.conf")},
+		Hosts:  &Hosts{Path: filepath.Join(dir, "hosts")},
+	}
+
+	ips, err := client.LookupNetIP(context.Background(), "ip4", "www")
+	if err != nil {
+		t.Fatalf("LookupNetIP return error: %+v", err)
+	}
+	if got, want := fmt.Sprint(ips), "[192.0.2.1]"; got != want {
+		t.Errorf("LookupNetIP got %s want %s", got, want)
+	}
+
+	ips, err = client.LookupNetIP(context.Background(), "ip", "db")
+	if err != nil {
+		t.Fatalf("LookupNetIP return error: %+v", err)
+	}
+	if got, want := fmt.Sprint(ips), "[192.0.2.9]"; got != want {
+		t.Errorf("LookupNetIP from hosts got %s want %s", got, want)
+	}
+
+	if _, err = client.LookupNetIP(context.Background(), "ip4", "nothing"); err == nil {
+		t.Errorf("LookupNetIP of unknown name shall return error")
+	}
+}
+
+// TestClientResolvConfFailover retries a query on the next name server.
+func TestClientResolvConfFailover(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "resolv.conf"), []byte("nameserver 192.0.2.1\nnameserver 192.0.2.2\noptions attempts:2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &Client{
+		Dialer: &mockMapDialer{addrs: map[string]string{
+			"192.0.2.1:53": serveTestHandler(t, &mockSilentHandler{}),
+			"192.0.2.2:53": serveTestHandler(t, &mockSearchHandler{name: "www.example.org"}),
+		}},
+		Resolv:  &ResolvConf{Path: filepath.Join(dir, "resolv.conf")},
+		Timeout: 100 * time.Millisecond,
+	}
+
+	for i := 0; i < 2; i++ {
+		ips, err := client.LookupNetIP(context.Background(), "ip4", "www.example.org.")
+		if err != nil {
+			t.Fatalf("LookupNetIP return error: %+v", err)
+		}
+		if got, want := fmt.Sprint(ips), "[192.0.2.1]"; got != want {
+			t.Errorf("LookupNetIP got %s want %s", got, want)
+		}
+	}
+}
+
+// mockManyHandler answers A queries with n copies of ip and AAAA queries with no records.
+type mockManyHandler struct {
+	ip netip.Addr
+	n  int
+}
+
+// ServeDNS answers the query of any name.
+func (h *mockManyHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	var ips []netip.Addr
+	if req.Question.Type == TypeA {
+		for i := 0; i < h.n; i++ {
+			ips = append(ips, h.ip)
+		}
+	}
+	req.SetResponseHeader(RcodeNoError, uint16(len(ips)))
+	req.AppendHOST(300, ips)
+	_, _ = rw.Write(req.Raw)
+}
+
+// TestClientResolver resolves through net.Resolver and truncates datagrams exceeding the read buffer.
+func TestClientResolver(t *testing.T) {
+	for _, n := range []int{2, 60} {
+		client := &Client{
+			Addr:    serveTestHandler(t, &mockManyHandler{ip: netip.MustParseAddr("192.0.2.1"), n: n}),
+			Timeout: time.Second,
+		}
+
+		ips, err := client.Resolver().LookupNetIP(context.Background(), "ip4", "example.org.")
+		if err != nil {
+			t.Fatalf("net.Resolver LookupNetIP return error: %+v", err)
+		}
+		if len(ips) != n || ips[0] != netip.MustParseAddr("192.0.2.1") {
+			t.Errorf("net.Resolver LookupNetIP got %d addresses %v want %d", len(ips), ips[0], n)
+		}
+
+		conn, err := client.Resolver().Dial(context.Background(), "udp", "127.0.0.53:53")
+		if err != nil {
+			t.Fatalf("net.Resolver Dial return error: %+v", err)
+		}
+		if _, ok := conn.(net.PacketConn); !ok {
+			t.Fatalf("net.Resolver Dial udp shall return a net.PacketConn")
+		}
+
+		req := AcquireMessage()
+		req.SetRequestQuestion("example.org", TypeA, ClassINET)
+		if _, err := conn.Write(req.Raw); err != nil {
+			t.Fatalf("resolver conn write error: %+v", err)
+		}
+		ReleaseMessage(req)
+
+		b := make([]byte, 512)
+		m, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("resolver conn read error: %+v", err)
+		}
+		resp := AcquireMessage()
+		if err := ParseMessage(resp, b[:m], false); err != nil {
+			t.Fatalf("parse resolver conn response error: %+v", err)
+		}
+		if tc := resp.Header.Flags.TC() != 0; tc != (n == 60) {
+			t.Errorf("resolver conn response TC=%v for %d answers, ANCount=%d", tc, n, resp.Header.ANCount)
+		}
+		ReleaseMessage(resp)
+	}
+}
+
+// TestClientDialContext dials an address whose host is resolved by Client.
+func TestClientDialContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			_, _ = conn.Write([]byte("hello"))
+			_ = conn.Close()
+		}
+	}()
+
+	client := &Client{
+		Addr:    serveTestHandler(t, &mockManyHandler{ip: netip.MustParseAddr("127.0.0.1"), n: 1}),
+		Timeout: time.Second,
+	}
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn, err := client.DialContext(context.Background(), "tcp", net.JoinHostPort("example.org", port))
+	if err != nil {
+		t.Fatalf("DialContext return error: %+v", err)
+	}
+	defer conn.Close()
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Errorf("DialContext read %q error: %+v", b, err)
+	}
+}
+
+// TestMemDialer exchanges with a Handler in memory with simulated network conditions.
+func TestMemDialer(t *testing.T) {
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(resp)
+	defer ReleaseMessage(req)
+
+	client := &Client{
+		Timeout: time.Second,
+		Dialer: &MemDialer{
+			Handler: &mockManyHandler{ip: netip.MustParseAddr("192.0.2.1"), n: 2},
+			Latency: 20 * time.Millisecond,
+		},
+	}
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	start := time.Now()
+	if err := client.Exchange(context.Background(), req, resp); err != nil {
+		t.Fatalf("MemDialer exchange error: %+v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("MemDialer exchange shall be delayed by latency, elapsed %s", elapsed)
+	}
+	if resp.Header.ANCount != 2 || resp.Header.Flags.TC() != 0 {
+		t.Errorf("MemDialer response ANCount=%d TC=%d", resp.Header.ANCount, resp.Header.Flags.TC())
+	}
+
+	client.Dialer = &MemDialer{
+		Handler: &mockManyHandler{ip: netip.MustParseAddr("192.0.2.1"), n: 40},
+		MaxSize: 512,
+	}
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	if err := client.Exchange(context.Background(), req, resp); err != nil {
+		t.Fatalf("MemDialer exchange error: %+v", err)
+	}
+	if resp.Header.ANCount != 0 || resp.Header.Flags.TC() == 0 {
+		t.Errorf("MemDialer shall truncate response, ANCount=%d TC=%d", resp.Header.ANCount, resp.Header.Flags.TC())
+	}
+
+	client.Timeout = 20 * time.Millisecond
+	client.Dialer = &MemDialer{Handler: &mockSilentHandler{}}
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	err := client.Exchange(context.Background(), req, resp)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("MemDialer exchange shall time out, got %+v", err)
+	}
+
+	// the same seed replays the same losses.
+	var losses [2]int
+	for i := range losses {
+		client.Dialer = &MemDialer{
+			Handler:  &mockManyHandler{ip: netip.MustParseAddr("192.0.2.1"), n: 1},
+			LossRate: 0.5,
+			Seed:     uint64(42),
+		}
+		for j := 0; j < 10; j++ {
+			req.SetRequestQuestion("example.org", TypeA, ClassINET)
+			if client.Exchange(context.Background(), req, resp) != nil {
+				losses[i]++
+			}
+		}
+	}
+	if losses[0] == 0 || losses[0] == 10 || losses[0] != losses[1] {
+		t.Errorf("MemDialer losses shall be deterministic, got %v", losses)
+	}
+}
+
+// TestHTTPDialerGET queries a local DoH endpoint by GET through bootstrap addresses and caches by max-age.
+func TestHTTPDialerGET(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(payload) < 12 || payload[0] != 0 || payload[1] != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		rw := &MemResponseWriter{}
+		req := AcquireMessage()
+		defer ReleaseMessage(req)
+		req.Raw = append(req.Raw[:0], payload...)
+		if err := ParseMessage(req, req.Raw, false); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		(&mockManyHandler{ip: netip.MustParseAddr("192.0.2.1"), n: 1}).ServeDNS(rw, req)
+		w.Header().Set("content-type", "application/dns-message")
+		w.Header().Set("cache-control", "max-age=300")
+		w.Header().Set("age", "100")
+		// flush before writing so that the response is chunked without Content-Length.
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(rw.Data)
+	}))
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	client := &Client{
+		Timeout: time.Second,
+		Dialer: &HTTPDialer{
+			Endpoint:  &url.URL{Scheme: "http", Host: net.JoinHostPort("doh.invalid", port), Path: "/dns-query"},
+			UseGET:    true,
+			Bootstrap: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+		},
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(resp)
+	defer ReleaseMessage(req)
+
+	for i := 0; i < 2; i++ {
+		req.SetRequestQuestion("example.org", TypeA, ClassINET)
+		if err := client.Exchange(context.Background(), req, resp); err != nil {
+			t.Fatalf("HTTPDialer GET exchange error: %+v", err)
+		}
+		if resp.Header.ID != req.Header.ID || resp.Header.ANCount != 1 {
+			t.Errorf("HTTPDialer GET response ID=%d want %d, ANCount=%d", resp.Header.ID, req.Header.ID, resp.Header.ANCount)
+		}
+		records := resp.Records()
+		for records.Next() {
+			if ttl := records.Item().TTL; ttl != 200 {
+				t.Errorf("HTTPDialer GET response TTL shall be decremented by age, got %d", ttl)
+			}
+		}
+	}
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("HTTPDialer shall serve the second query from max-age cache, got %d requests", n)
+	}
+}
+
+// BenchmarkHTTPDialer measures a DoH exchange against a local endpoint.
+func BenchmarkHTTPDialer(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		req := AcquireMessage()
+		defer ReleaseMessage(req)
+		if ParseMessage(req, payload, true) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		req.SetResponseHeader(RcodeNoError, 1)
+		req.AppendHOST(300, []netip.Addr{netip.MustParseAddr("192.0.2.1")})
+		w.Header().Set("content-type", "application/dns-message")
+		_, _ = w.Write(req.Raw)
+	}))
+	defer server.Close()
+
+	endpoint, _ := url.Parse(server.URL + "/dns-query")
+	client := &Client{
+		Timeout: time.Second,
+		Dialer:  &HTTPDialer{Endpoint: endpoint},
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(resp)
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+	// the contexts of the exchanges, NewContext creates a context per exchange.
+	contexts := []struct {
+		name string
+		ctx  func(i int) context.Context
+	}{
+		{"Background", func(int) context.Context { return context.Background() }},
+		{"WithValue", func() func(int) context.Context {
+			ctx := context.WithValue(context.Background(), struct{}{}, "value")
+			return func(int) context.Context { return ctx }
+		}()},
+		{"NewContext", func(i int) context.Context { return context.WithValue(context.Background(), struct{}{}, i) }},
+	}
+
+	for _, c := range contexts {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := client.Exchange(c.ctx(i), req, resp); err != nil {
+					b.Fatalf("HTTPDialer exchange error: %+v", err)
+				}
+			}
+		})
+	}
+
+	// the previous implementation patched the context into the pooled request.
+	offset := func() uintptr {
+		field, _ := reflect.TypeOf(http.Request{}).FieldByName("ctx")
+		return field.Offset
+	}()
+	for _, c := range contexts {
+		b.Run("Previous/"+c.name, func(b *testing.B) {
+			hreq := &http.Request{
+				Method: http.MethodPost,
+				URL:    endpoint,
+				Host:   endpoint.Host,
+				Header: http.Header{"content-type": []string{"application/dns-message"}},
+			}
+			reader, writer := new(bufferreader), new(bufferwriter)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				reader.B = req.Raw
+				hreq.Body = reader
+				hreq.ContentLength = int64(len(req.Raw))
+				*(*context.Context)(unsafe.Pointer(uintptr(unsafe.Pointer(hreq)) + offset)) = c.ctx(i)
+				r, err := http.DefaultTransport.RoundTrip(hreq)
+				if err != nil {
+					b.Fatalf("RoundTrip() error: %+v", err)
+				}
+				writer.B = writer.B[:0]
+				_, err = io.Copy(writer, r.Body)
+				_ = r.Body.Close()
+				if err == nil {
+					err = ParseMessage(resp, writer.B, false)
+				}
+				if err != nil {
+					b.Fatalf("read response error: %+v", err)
+				}
+			}
+		})
+	}
+}
+
+// mockStaleHandler answers the first query late, and the other queries with a
+// reply of another query before their own.
+type mockStaleHandler struct {
+	mockRetryHandler
+	delay time.Duration
+	calls atomic.Int32
+}
+
+// ServeDNS answers req late or after a reply with another ID.
+func (h *mockStaleHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	if h.calls.Add(1) == 1 {
+		time.Sleep(h.delay)
+	} else {
+		other := &MemResponseWriter{}
+		h.mockRetryHandler.ServeDNS(other, req)
+		other.Data[0] ^= 0xff
+		_, _ = rw.Write(other.Data)
+	}
+	h.mockRetryHandler.ServeDNS(rw, req)
+}
+
+// TestClientExchangeStaleReply ignores the late reply of a timed out query on a
+// pooled conn and the replies of other queries.
+func TestClientExchangeStaleReply(t *testing.T) {
+	addr := serveTestHandler(t, &mockStaleHandler{delay: 100 * time.Millisecond})
+	udpAddr, _ := net.ResolveUDPAddr("udp", addr)
+
+	client := &Client{
+		Addr:    addr,
+		Timeout: 50 * time.Millisecond,
+		Dialer:  &UDPDialer{Addr: udpAddr, MaxConns: 1},
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+
+	req.SetRequestQuestion("late.example.org", TypeA, ClassINET)
+	if err := client.Exchange(context.Background(), req, resp); err == nil {
+		t.Fatalf("client.Exchange() of the late reply returns no error")
+	}
+	// the late reply arrives.
+	time.Sleep(150 * time.Millisecond)
+
+	client.Timeout = time.Second
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+	if err := client.Exchange(context.Background(), req, resp); err != nil {
+		t.Fatalf("client.Exchange() error: %+v", err)
+	}
+	if resp.Header.ID != req.Header.ID || string(resp.Domain) != "www.example.org" {
+		t.Errorf("client.Exchange() got the reply of id=%d domain=%s, want id=%d domain=www.example.org", resp.Header.ID, resp.Domain, req.Header.ID)
+	}
+}
+
+// TestClientSingleFlightLost lands a flight whose reply is lost without a Client.Timeout.
+func TestClientSingleFlightLost(t *testing.T) {
+	timeout := clientFlightTimeout
+	clientFlightTimeout = 50 * time.Millisecond
+	defer func() { clientFlightTimeout = timeout }()
+
+	client := &Client{
+		Addr:         serveTestHandler(t, &mockSilentHandler{}),
+		SingleFlight: true,
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("lost.example.org", TypeA, ClassINET)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := client.Exchange(ctx, req, resp); err == nil {
+		t.Fatalf("client.Exchange() of a lost reply returns no error")
+	}
+
+	for i := 0; i < 50; i++ {
+		client.flightsMu.Lock()
+		n := len(client.flights)
+		client.flightsMu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("the flight of a lost reply never lands")
+}
@@ -57,6 +57,9 @@ func main() {
 		}
 		roa.AppendSubnet(prefix)
 	}
+	if _, ok := opt("nsid", options); ok {
+		roa.AppendNSID("")
+	}
 	if s, ok := opt("padding", options); ok {
 		length, err := strconv.Atoi(s)
 		if err != nil {
@@ -212,7 +215,37 @@ func cmd(req, resp *fastdns.Message, server string, start, end time.Time) {
 		flags, resp.Header.QDCount, resp.Header.ANCount, resp.Header.NSCount, resp.Header.ARCount)
 
 	fmt.Printf("\n")
-	if req.Header.ARCount > 0 {
+	if options, ok := edns(resp); ok {
+		fmt.Printf(";; OPT PSEUDOSECTION:\n")
+		var flags string
+		if options.Flags&0x8000 != 0 {
+			flags = " do"
+		}
+		fmt.Printf("; EDNS: version: %d, flags:%s; udp: %d\n", options.Version, flags, options.UDPSize)
+		for options.Next() {
+			option := options.Item()
+			switch option.Code {
+			case fastdns.OptionCodeEDE:
+				code, text, err := option.AsExtendedError()
+				if err != nil {
+					continue
+				}
+				fmt.Printf("; EDE: %d (%s)", code, code)
+				if text != "" {
+					fmt.Printf(": (%s)", text)
+				}
+				fmt.Printf("\n")
+			case fastdns.OptionCodeNSID:
+				fmt.Printf("; NSID: %x (\"%s\")\n", option.Data, option.Data)
+			case fastdns.OptionCodeECS:
+				if prefix, err := option.AsSubnet(); err == nil {
+					fmt.Printf("; CLIENT-SUBNET: %s\n", prefix)
+				}
+			case fastdns.OptionCodeCOOKIE:
+				fmt.Printf("; COOKIE: %x\n", option.Data)
+			}
+		}
+	} else if req.Header.ARCount > 0 {
 		fmt.Printf(";; OPT PSEUDOSECTION:\n")
 		fmt.Printf("; EDNS: version: 0, flags:; udp: 1232\n")
 	}
@@ -359,6 +392,18 @@ func cmd(req, resp *fastdns.Message, server string, start, end time.Time) {
 	fmt.Printf("\n")
 }
 
+// edns returns the options of the OPT record in the response.
+func edns(resp *fastdns.Message) (fastdns.MessageOptions, bool) {
+	records := resp.Records()
+	for records.Next() {
+		if r := records.Item(); r.Type == fastdns.TypeOPT {
+			options, err := r.AsOptions()
+			return options, err == nil
+		}
+	}
+	return fastdns.MessageOptions{}, false
+}
+
 func decodename(resp *fastdns.Message, name []byte) string {
 	data, err := resp.DecodeName(nil, name)
 	if err != nil {
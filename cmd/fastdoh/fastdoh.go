@@ -109,7 +109,11 @@ func (h *DoHHandler) HandlerDoH(ctx *fasthttp.RequestCtx) {
 		fastdns.Error(rw, req, fastdns.RcodeFormErr)
 	} else {
 		h.DNSHandler.ServeDNS(rw, req)
-		if h.DoHStats != nil {
+		if stats, ok := h.DoHStats.(fastdns.ResponseStats); ok {
+			var resp fastdns.ResponseInfo
+			resp.Parse(rw.Data)
+			stats.UpdateResponseStats(rw.Raddr, req, resp, time.Since(start))
+		} else if h.DoHStats != nil {
 			h.DoHStats.UpdateStats(rw.Raddr, req, time.Since(start))
 		}
 	}
@@ -0,0 +1,560 @@
+package fastdns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+// DNSSECAlgorithm is a DNSSEC algorithm number, see RFC 8624.
+type DNSSECAlgorithm uint8
+
+// DNSSEC algorithm numbers.
+const (
+	DNSSECAlgorithmRSASHA1         DNSSECAlgorithm = 5
+	DNSSECAlgorithmRSASHA1NSEC3    DNSSECAlgorithm = 7
+	DNSSECAlgorithmRSASHA256       DNSSECAlgorithm = 8
+	DNSSECAlgorithmRSASHA512       DNSSECAlgorithm = 10
+	DNSSECAlgorithmECDSAP256SHA256 DNSSECAlgorithm = 13
+	DNSSECAlgorithmECDSAP384SHA384 DNSSECAlgorithm = 14
+	DNSSECAlgorithmED25519         DNSSECAlgorithm = 15
+)
+
+// String returns the mnemonic of the algorithm.
+func (a DNSSECAlgorithm) String() string {
+	switch a {
+	case DNSSECAlgorithmRSASHA1:
+		return "RSASHA1"
+	case DNSSECAlgorithmRSASHA1NSEC3:
+		return "RSASHA1-NSEC3-SHA1"
+	case DNSSECAlgorithmRSASHA256:
+		return "RSASHA256"
+	case DNSSECAlgorithmRSASHA512:
+		return "RSASHA512"
+	case DNSSECAlgorithmECDSAP256SHA256:
+		return "ECDSAP256SHA256"
+	case DNSSECAlgorithmECDSAP384SHA384:
+		return "ECDSAP384SHA384"
+	case DNSSECAlgorithmED25519:
+		return "ED25519"
+	}
+	return ""
+}
+
+// DNSKEY flags.
+const (
+	DNSKEYFlagZone uint16 = 0x0100
+	DNSKEYFlagSEP  uint16 = 0x0001
+)
+
+var (
+	// ErrUnsupportedAlgorithm is returned for a DNSSEC algorithm which is not implemented.
+	ErrUnsupportedAlgorithm = errors.New("fastdns: unsupported dnssec algorithm")
+)
+
+// DNSKey is a DNSSEC signing key.
+type DNSKey struct {
+	flags      uint16
+	algorithm  DNSSECAlgorithm
+	privateKey crypto.Signer
+	rdata      []byte
+	keyTag     uint16
+}
+
+// NewDNSKey returns a DNSKey of the private key, which must be an ECDSA P-256
+// or an Ed25519 key. The flags is 257 for a key signing key and 256 otherwise.
+func NewDNSKey(flags uint16, privateKey crypto.Signer) (*DNSKey, error) {
+	k := &DNSKey{flags: flags, privateKey: privateKey}
+
+	var public []byte
+	switch priv := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		if priv.Curve != elliptic.P256() {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		pub, err := priv.PublicKey.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		// strip the uncompressed point prefix 0x04, see RFC 6605 section 4.
+		k.algorithm, public = DNSSECAlgorithmECDSAP256SHA256, pub.Bytes()[1:]
+	case ed25519.PrivateKey:
+		k.algorithm, public = DNSSECAlgorithmED25519, priv.Public().(ed25519.PublicKey)
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	k.rdata = append([]byte{
+		// FLAGS
+		byte(flags >> 8), byte(flags),
+		// PROTOCOL
+		3,
+		// ALGORITHM
+		byte(k.algorithm),
+	}, public...)
+	k.keyTag = keyTag(k.rdata)
+
+	return k, nil
+}
+
+// GenerateDNSKey generates a DNSKey with the algorithm.
+func GenerateDNSKey(flags uint16, algorithm DNSSECAlgorithm) (*DNSKey, error) {
+	var priv crypto.Signer
+	var err error
+	switch algorithm {
+	case DNSSECAlgorithmECDSAP256SHA256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case DNSSECAlgorithmED25519:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = ErrUnsupportedAlgorithm
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewDNSKey(flags, priv)
+}
+
+// Flags returns the flags of the key.
+func (k *DNSKey) Flags() uint16 {
+	return k.flags
+}
+
+// Algorithm returns the algorithm of the key.
+func (k *DNSKey) Algorithm() DNSSECAlgorithm {
+	return k.algorithm
+}
+
+// KeyTag returns the key tag of the key, see RFC 4034 appendix B.
+func (k *DNSKey) KeyTag() uint16 {
+	return k.keyTag
+}
+
+// PublicKey returns the public key in the wire format of DNSKEY records.
+func (k *DNSKey) PublicKey() []byte {
+	return k.rdata[4:]
+}
+
+// AppendDS appends the SHA-256 digest of the key owned by zone to dst, it is
+// the RDATA of the DS record which the parent zone publishes.
+func (k *DNSKey) AppendDS(dst []byte, zone string) []byte {
+	return appendDS(dst, encodeZone(zone), k.rdata)
+}
+
+// sign signs data with the key.
+func (k *DNSKey) sign(data []byte) ([]byte, error) {
+	switch k.algorithm {
+	case DNSSECAlgorithmECDSAP256SHA256:
+		hash := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, k.privateKey.(*ecdsa.PrivateKey), hash[:])
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	case DNSSECAlgorithmED25519:
+		return ed25519.Sign(k.privateKey.(ed25519.PrivateKey), data), nil
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// AppendDNSKEY appends the DNSKEY records of keys to msg.
+func (msg *Message) AppendDNSKEY(ttl uint32, keys []*DNSKey) {
+	for _, k := range keys {
+		msg.Raw = append(append(msg.Raw,
+			// NAME
+			0xc0, 0x0c,
+			// TYPE
+			0x00, byte(TypeDNSKEY),
+			// CLASS
+			byte(msg.Question.Class>>8), byte(msg.Question.Class),
+			// TTL
+			byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl),
+			// RDLENGTH
+			byte(len(k.rdata)>>8), byte(len(k.rdata)),
+			// RDATA
+		), k.rdata...)
+	}
+}
+
+// AppendDS appends the SHA-256 DS records of keys to msg, the keys belong to the zone of the question.
+func (msg *Message) AppendDS(ttl uint32, keys []*DNSKey) {
+	owner := appendLowerName(nil, msg.Question.Name)
+	for _, k := range keys {
+		ds := appendDS(nil, owner, k.rdata)
+		msg.Raw = append(append(msg.Raw,
+			// NAME
+			0xc0, 0x0c,
+			// TYPE
+			0x00, byte(TypeDS),
+			// CLASS
+			byte(msg.Question.Class>>8), byte(msg.Question.Class),
+			// TTL
+			byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl),
+			// RDLENGTH
+			byte(len(ds)>>8), byte(len(ds)),
+			// RDATA
+		), ds...)
+	}
+}
+
+// appendDS appends the SHA-256 DS RDATA of the DNSKEY RDATA owned by name to dst.
+func appendDS(dst []byte, name, rdata []byte) []byte {
+	h := sha256.New()
+	h.Write(name)
+	h.Write(rdata)
+	tag := keyTag(rdata)
+	dst = append(dst,
+		// KEY TAG
+		byte(tag>>8), byte(tag),
+		// ALGORITHM
+		rdata[3],
+		// DIGEST TYPE: SHA-256
+		2,
+	)
+	return h.Sum(dst)
+}
+
+// keyTag computes the key tag of the DNSKEY RDATA, see RFC 4034 appendix B.
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+// dnssecRR is a resource record with uncompressed names, the owner name is in
+// the canonical wire form of RFC 4034 section 6.2.
+type dnssecRR struct {
+	name  []byte
+	typ   Type
+	class Class
+	ttl   uint32
+	rdata []byte
+}
+
+// parseDNSSECRRs appends the resource records of the message in raw to dst and
+// returns the number of records of the answer, authority and additional sections.
+func parseDNSSECRRs(dst []dnssecRR, raw []byte) (_ []dnssecRR, counts [3]int, err error) {
+	if len(raw) < 12 {
+		return dst, counts, ErrInvalidHeader
+	}
+
+	offset := 12
+	for i := binary.BigEndian.Uint16(raw[4:]); i > 0; i-- {
+		if offset, err = skipName(raw, offset); err != nil {
+			return dst, counts, err
+		}
+		offset += 4
+	}
+
+	for section := 0; section < 3; section++ {
+		for i := binary.BigEndian.Uint16(raw[6+2*section:]); i > 0; i-- {
+			var rr dnssecRR
+			rr.name, offset, err = appendName(nil, raw, offset, true)
+			if err != nil {
+				return dst, counts, err
+			}
+			if offset+10 > len(raw) {
+				return dst, counts, ErrInvalidAnswer
+			}
+			rr.typ = Type(binary.BigEndian.Uint16(raw[offset:]))
+			rr.class = Class(binary.BigEndian.Uint16(raw[offset+2:]))
+			rr.ttl = binary.BigEndian.Uint32(raw[offset+4:])
+			length := int(binary.BigEndian.Uint16(raw[offset+8:]))
+			offset += 10
+			if offset+length > len(raw) {
+				return dst, counts, ErrInvalidAnswer
+			}
+			rr.rdata, err = appendRDATA(nil, raw, offset, length, rr.typ, false)
+			if err != nil {
+				return dst, counts, err
+			}
+			offset += length
+			dst = append(dst, rr)
+			counts[section]++
+		}
+	}
+
+	return dst, counts, nil
+}
+
+// appendRR appends the wire format of rr to dst.
+func appendRR(dst []byte, rr *dnssecRR) []byte {
+	dst = append(dst, rr.name...)
+	return append(append(dst,
+		// TYPE
+		byte(rr.typ>>8), byte(rr.typ),
+		// CLASS
+		byte(rr.class>>8), byte(rr.class),
+		// TTL
+		byte(rr.ttl>>24), byte(rr.ttl>>16), byte(rr.ttl>>8), byte(rr.ttl),
+		// RDLENGTH
+		byte(len(rr.rdata)>>8), byte(len(rr.rdata)),
+		// RDATA
+	), rr.rdata...)
+}
+
+// skipName returns the offset after the name at offset of raw.
+func skipName(raw []byte, offset int) (int, error) {
+	for offset < len(raw) {
+		b := int(raw[offset])
+		switch {
+		case b == 0:
+			return offset + 1, nil
+		case b&0b11000000 == 0b11000000:
+			return offset + 2, nil
+		default:
+			offset += b + 1
+		}
+	}
+	return offset, ErrInvalidName
+}
+
+// appendName appends the uncompressed wire form of the name at offset of raw to dst,
+// lowercased if lower is set. It returns the offset after the name in raw.
+func appendName(dst, raw []byte, offset int, lower bool) ([]byte, int, error) {
+	next, hops := -1, 0
+	for offset < len(raw) {
+		b := int(raw[offset])
+		switch {
+		case b == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return append(dst, 0), next, nil
+		case b&0b11000000 == 0b11000000:
+			if offset+1 >= len(raw) || hops > 64 {
+				return dst, offset, ErrInvalidName
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset, hops = (b&0b00111111)<<8|int(raw[offset+1]), hops+1
+		case b&0b11000000 != 0 || offset+b >= len(raw):
+			return dst, offset, ErrInvalidName
+		default:
+			n := len(dst)
+			dst = append(dst, raw[offset:offset+b+1]...)
+			if lower {
+				lowerASCII(dst[n+1:])
+			}
+			offset += b + 1
+		}
+	}
+	return dst, offset, ErrInvalidName
+}
+
+// appendRDATA appends the RDATA at offset of raw to dst with its names
+// uncompressed, and lowercased as RFC 4034 section 6.2 if lower is set.
+func appendRDATA(dst, raw []byte, offset, length int, typ Type, lower bool) (_ []byte, err error) {
+	end := offset + length
+	name := func(n int) {
+		if err == nil {
+			dst, offset, err = appendName(dst, raw[:end], offset+n, lower)
+		}
+	}
+
+	n := len(dst)
+	switch typ {
+	case TypeNS, TypeMD, TypeMF, TypeCNAME, TypeMB, TypeMG, TypeMR, TypePTR, TypeDNAME:
+		name(0)
+	case TypeMX, TypeAFSDB, TypeRT, TypeKX:
+		dst = append(dst, raw[offset:min(offset+2, end)]...)
+		name(2)
+	case TypeSRV:
+		dst = append(dst, raw[offset:min(offset+6, end)]...)
+		name(6)
+	case TypeSOA, TypeMINFO, TypeRP:
+		name(0)
+		name(0)
+	case TypeRRSIG:
+		dst = append(dst, raw[offset:min(offset+18, end)]...)
+		name(18)
+	case TypeNSEC:
+		// the next domain name is not lowercased, see RFC 6840 section 5.1.
+		lowered := lower
+		lower = false
+		name(0)
+		lower = lowered
+	}
+	if err != nil {
+		return dst[:n], err
+	}
+
+	if offset < end {
+		dst = append(dst, raw[offset:end]...)
+	}
+
+	return dst, nil
+}
+
+// appendLowerName appends the lowercased copy of the wire name to dst.
+func appendLowerName(dst, name []byte) []byte {
+	n := len(dst)
+	dst = append(dst, name...)
+	for i := n; i < len(dst) && dst[i] != 0; i += int(dst[i]) + 1 {
+		lowerASCII(dst[i+1 : min(i+1+int(dst[i]), len(dst))])
+	}
+	return dst
+}
+
+// lowerASCII lowercases the ASCII letters of b in place.
+func lowerASCII(b []byte) {
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+}
+
+// canonicalDomain returns the lowercased domain without the trailing dot.
+func canonicalDomain(domain string) string {
+	b := []byte(domain)
+	lowerASCII(b)
+	if n := len(b); n > 0 && b[n-1] == '.' {
+		b = b[:n-1]
+	}
+	return string(b)
+}
+
+// encodeZone returns the canonical wire name of the zone, E.g. "\x00" for ".".
+func encodeZone(zone string) []byte {
+	if zone = canonicalDomain(zone); zone == "" {
+		return []byte{0}
+	}
+	return EncodeDomain(nil, zone)
+}
+
+// countLabels returns the number of labels of the wire name for the RRSIG
+// labels field, which excludes the root and a leading wildcard label.
+func countLabels(name []byte) (n uint8) {
+	for i := 0; i < len(name) && name[i] != 0; i += int(name[i]) + 1 {
+		if i == 0 && name[0] == 1 && len(name) > 1 && name[1] == '*' {
+			continue
+		}
+		n++
+	}
+	return
+}
+
+// isSubdomain reports whether the wire name equals or is below the wire zone, both in canonical form.
+func isSubdomain(name, zone []byte) bool {
+	if len(name) < len(zone) || !bytes.Equal(name[len(name)-len(zone):], zone) {
+		return false
+	}
+	// the suffix must start at a label boundary.
+	for i := 0; i < len(name); i += int(name[i]) + 1 {
+		if i == len(name)-len(zone) {
+			return true
+		}
+		if name[i] == 0 {
+			break
+		}
+	}
+	return false
+}
+
+// appendTypeBitmap appends the NSEC type bit maps of the sorted types to dst, see RFC 4034 section 4.1.2.
+func appendTypeBitmap(dst []byte, types []Type) []byte {
+	for i := 0; i < len(types); {
+		window := byte(types[i] >> 8)
+		var bitmap [32]byte
+		length := 0
+		for ; i < len(types) && byte(types[i]>>8) == window; i++ {
+			b := byte(types[i])
+			bitmap[b/8] |= 0x80 >> (b % 8)
+			length = int(b/8) + 1
+		}
+		dst = append(append(dst, window, byte(length)), bitmap[:length]...)
+	}
+	return dst
+}
+
+// appendSignedData appends the data covered by an RRSIG to dst, which is the
+// RRSIG RDATA without signature followed by the canonical RRset, see RFC 4034 section 3.1.8.1.
+// The rdatas of rrset must be canonical.
+func appendSignedData(dst, rrsig []byte, rrset []dnssecRR, ttl uint32) []byte {
+	dst = append(dst, rrsig...)
+
+	rdatas := make([][]byte, 0, len(rrset))
+	for i := range rrset {
+		rdatas = append(rdatas, rrset[i].rdata)
+	}
+	slices.SortFunc(rdatas, bytes.Compare)
+	rdatas = slices.CompactFunc(rdatas, bytes.Equal)
+
+	for _, rdata := range rdatas {
+		rr := dnssecRR{name: rrset[0].name, typ: rrset[0].typ, class: rrset[0].class, ttl: ttl, rdata: rdata}
+		dst = appendRR(dst, &rr)
+	}
+
+	return dst
+}
+
+// appendRRSIGHeader appends the RRSIG RDATA fields before the signature to dst.
+func appendRRSIGHeader(dst []byte, rr *dnssecRR, k *DNSKey, signer []byte, inception, expiration uint32) []byte {
+	dst = append(dst,
+		// TYPE COVERED
+		byte(rr.typ>>8), byte(rr.typ),
+		// ALGORITHM
+		byte(k.algorithm),
+		// LABELS
+		countLabels(rr.name),
+		// ORIGINAL TTL
+		byte(rr.ttl>>24), byte(rr.ttl>>16), byte(rr.ttl>>8), byte(rr.ttl),
+		// SIGNATURE EXPIRATION
+		byte(expiration>>24), byte(expiration>>16), byte(expiration>>8), byte(expiration),
+		// SIGNATURE INCEPTION
+		byte(inception>>24), byte(inception>>16), byte(inception>>8), byte(inception),
+		// KEY TAG
+		byte(k.keyTag>>8), byte(k.keyTag),
+	)
+	// SIGNER'S NAME
+	return append(dst, signer...)
+}
+
+// canonicalRRset returns a copy of rrset with canonical rdatas.
+func canonicalRRset(rrset []dnssecRR) ([]dnssecRR, error) {
+	out := make([]dnssecRR, len(rrset))
+	for i, rr := range rrset {
+		rdata, err := appendRDATA(nil, rr.rdata, 0, len(rr.rdata), rr.typ, true)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = rr
+		out[i].rdata = rdata
+	}
+	return out, nil
+}
+
+// signRRset returns the RRSIG RDATA of the rrset signed by k for the zone signer.
+func signRRset(rrset []dnssecRR, k *DNSKey, signer []byte, inception, expiration uint32) ([]byte, error) {
+	canonical, err := canonicalRRset(rrset)
+	if err != nil {
+		return nil, err
+	}
+
+	rrsig := appendRRSIGHeader(nil, &rrset[0], k, signer, inception, expiration)
+	sig, err := k.sign(appendSignedData(nil, rrsig, canonical, rrset[0].ttl))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(rrsig, sig...), nil
+}
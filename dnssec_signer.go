@@ -0,0 +1,493 @@
+package fastdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ZoneSigner is a Handler which signs the responses of Handler for Zone on the fly
+// when the request has the DO bit, and answers the DNSKEY queries of Zone itself.
+// Nonexistent names and types are denied by the compact NSEC records of RFC 9824,
+// so that negative answers with an SOA in the authority section are recommended.
+type ZoneSigner struct {
+	// Handler answers the queries before signing.
+	Handler Handler
+
+	// Zone specifies the apex of the signed zone, E.g. "example.org".
+	Zone string
+
+	// Keys specifies the keys of the zone. The keys with the SEP flag sign the
+	// DNSKEY RRset and the other keys sign the rest, unless all keys are alike.
+	Keys []*DNSKey
+
+	// DNSKEYTTL specifies the TTL of DNSKEY records, also of NSEC records
+	// when the response carries no SOA.
+	// If not set, use 3600 as default.
+	DNSKEYTTL uint32
+
+	// Validity specifies the validity period of signatures, a signature is
+	// cached and renewed after half of it.
+	// If not set, use 24 hours as default.
+	Validity time.Duration
+
+	// MaxCacheEntries limits the number of cached signatures.
+	// If not set, use 65536 as default.
+	MaxCacheEntries int
+
+	// Types specifies an optional function returning the types present at the
+	// lowercase name of Zone, which the NSEC record of a NODATA response lists.
+	// If not set, the common types are probed by querying Handler, and cached
+	// by the name for the TTL of the NSEC record.
+	Types func(name string) []Type
+
+	once    sync.Once
+	zone    []byte
+	ksks    []*DNSKey
+	zsks    []*DNSKey
+	cacheMu sync.Mutex
+	cache   map[string]*signatureCacheEntry
+	probed  map[string]*probedTypesEntry
+}
+
+type signatureCacheEntry struct {
+	rrsig   []byte
+	refresh time.Time
+}
+
+type probedTypesEntry struct {
+	types   []Type
+	expires time.Time
+}
+
+// init fills the defaults and splits the keys by their roles.
+func (s *ZoneSigner) init() {
+	if s.DNSKEYTTL == 0 {
+		s.DNSKEYTTL = 3600
+	}
+	if s.Validity == 0 {
+		s.Validity = 24 * time.Hour
+	}
+	if s.MaxCacheEntries == 0 {
+		s.MaxCacheEntries = 65536
+	}
+	s.zone = encodeZone(s.Zone)
+	for _, k := range s.Keys {
+		if k.flags&DNSKEYFlagSEP != 0 {
+			s.ksks = append(s.ksks, k)
+		} else {
+			s.zsks = append(s.zsks, k)
+		}
+	}
+	if len(s.ksks) == 0 {
+		s.ksks = s.zsks
+	}
+	if len(s.zsks) == 0 {
+		s.zsks = s.ksks
+	}
+	s.cache = make(map[string]*signatureCacheEntry)
+	s.probed = make(map[string]*probedTypesEntry)
+}
+
+// ServeDNS answers req with the response of Handler, signed if req has the DO bit.
+func (s *ZoneSigner) ServeDNS(rw ResponseWriter, req *Message) {
+	s.once.Do(s.init)
+
+	var buf [256]byte
+	qname := appendLowerName(buf[:0], req.Question.Name)
+	if !isSubdomain(qname, s.zone) {
+		s.Handler.ServeDNS(rw, req)
+		return
+	}
+
+	_, do, size := requestDO(req)
+	dnskey := req.Question.Type == TypeDNSKEY && bytes.Equal(qname, s.zone)
+	if !do && !dnskey {
+		s.Handler.ServeDNS(rw, req)
+		return
+	}
+
+	resp, out := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(out)
+	defer ReleaseMessage(resp)
+
+	mw := &MemResponseWriter{
+		Data:  resp.Raw[:0],
+		Raddr: rw.RemoteAddr(),
+		Laddr: rw.LocalAddr(),
+	}
+	if dnskey {
+		req.SetResponseHeader(RcodeNoError, uint16(len(s.Keys)))
+		// AA
+		req.Header.Flags |= 0b0000010000000000
+		req.Raw[2] |= 0b00000100
+		req.AppendDNSKEY(s.DNSKEYTTL, s.Keys)
+		_, _ = mw.Write(req.Raw)
+	} else {
+		s.Handler.ServeDNS(mw, req)
+	}
+	resp.Raw = mw.Data
+
+	if !do || len(resp.Raw) < 12 {
+		_, _ = rw.Write(resp.Raw)
+		return
+	}
+
+	var err error
+	out.Raw, err = s.sign(out.Raw[:0], req, resp.Raw, qname, size, time.Now())
+	if err != nil {
+		_, _ = rw.Write(resp.Raw)
+		return
+	}
+
+	_, _ = rw.Write(out.Raw)
+}
+
+// requestDO reports whether req has an OPT record, and returns its DO bit and
+// UDP payload size.
+func requestDO(req *Message) (opt, do bool, size int) {
+	size = 512
+	raw := req.Raw
+	offset := 12 + len(req.Question.Name) + 4
+	for i := int(req.Header.ANCount) + int(req.Header.NSCount) + int(req.Header.ARCount); i > 0; i-- {
+		var err error
+		if offset, err = skipName(raw, offset); err != nil || offset+10 > len(raw) {
+			break
+		}
+		if Type(binary.BigEndian.Uint16(raw[offset:])) == TypeOPT {
+			opt = true
+			size = max(size, int(binary.BigEndian.Uint16(raw[offset+2:])))
+			// the DO bit is the most significant bit of the flags in TTL.
+			do = raw[offset+6]&0x80 != 0
+			break
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(raw[offset+8:]))
+	}
+	return
+}
+
+// sign appends the signed form of the response in raw to dst.
+func (s *ZoneSigner) sign(dst []byte, req *Message, raw []byte, qname []byte, size int, now time.Time) ([]byte, error) {
+	flags := Flags(binary.BigEndian.Uint16(raw[2:]))
+	rcode := flags.Rcode()
+	if rcode != RcodeNoError && rcode != RcodeNXDomain {
+		return append(dst, raw...), nil
+	}
+
+	rrs, counts, err := parseDNSSECRRs(nil, raw)
+	if err != nil {
+		return dst, err
+	}
+
+	answers := rrs[:counts[0]]
+	authority := rrs[counts[0] : counts[0]+counts[1]]
+	additional := slices.DeleteFunc(rrs[counts[0]+counts[1]:], func(rr dnssecRR) bool {
+		return rr.typ == TypeOPT
+	})
+
+	switch {
+	case rcode == RcodeNXDomain || len(answers) == 0 && !hasDelegation(authority, s.zone):
+		// deny the name or the type by a compact NSEC record, see RFC 9824.
+		var soa []dnssecRR
+		for _, rr := range rrs[:counts[0]+counts[1]] {
+			if rr.typ == TypeSOA && len(rr.rdata) >= 20 {
+				soa = append(soa, rr)
+				break
+			}
+		}
+		ttl := s.DNSKEYTTL
+		if len(soa) != 0 {
+			ttl = min(soa[0].ttl, binary.BigEndian.Uint32(soa[0].rdata[len(soa[0].rdata)-4:]))
+		}
+		types := []Type{TypeRRSIG, TypeNSEC}
+		if rcode == RcodeNXDomain {
+			types = append(types, TypeNXNAME)
+		} else {
+			// the types present at qname except the queried type, see RFC 9824 section 3.2.
+			types = append(types, s.types(req, qname, ttl, now)...)
+			if bytes.Equal(qname, s.zone) {
+				types = append(types, TypeNS, TypeSOA, TypeDNSKEY)
+			}
+			types = slices.DeleteFunc(types, func(t Type) bool { return t == req.Question.Type })
+		}
+		slices.Sort(types)
+		types = slices.Compact(types)
+		answers = nil
+		authority = append(soa, compactNSEC(qname, req.Question.Class, ttl, types))
+		rcode = RcodeNoError
+	case len(answers) == 0:
+		// prove the absence of DS at the delegation unless the handler gave it.
+		var cut []byte
+		for _, rr := range authority {
+			if rr.typ == TypeDS {
+				cut = nil
+				break
+			}
+			if rr.typ == TypeNS && !bytes.Equal(rr.name, s.zone) {
+				cut = rr.name
+			}
+		}
+		if cut != nil {
+			authority = append(authority, compactNSEC(cut, req.Question.Class, s.DNSKEYTTL, []Type{TypeNS, TypeRRSIG, TypeNSEC}))
+		}
+	}
+
+	// ID
+	dst = append(dst, raw[0], raw[1])
+	// Flags, clear AD and set RCODE
+	flags = flags&^0b0000000000101111 | Flags(rcode)
+	dst = append(dst, byte(flags>>8), byte(flags))
+	// QDCOUNT, ANCOUNT, NSCOUNT, ARCOUNT
+	dst = append(dst, 0, 1, 0, 0, 0, 0, 0, 0)
+	// QUESTION
+	dst = append(dst, req.Question.Name...)
+	dst = append(dst, byte(req.Question.Type>>8), byte(req.Question.Type), byte(req.Question.Class>>8), byte(req.Question.Class))
+
+	var n [3]int
+	if dst, n[0], err = s.appendSection(dst, answers, qname, true, now); err != nil {
+		return dst, err
+	}
+	if dst, n[1], err = s.appendSection(dst, authority, qname, true, now); err != nil {
+		return dst, err
+	}
+	if dst, n[2], err = s.appendSection(dst, additional, qname, false, now); err != nil {
+		return dst, err
+	}
+
+	// OPT with the DO bit
+	dst = append(dst,
+		0x00,       // Name
+		0x00, 0x29, // OPT
+		byte(MaxUDPSize>>8), byte(MaxUDPSize), // UDP payload size
+		0x00,       // Extended RCODE
+		0x00,       // EDNS0 version
+		0x80, 0x00, // DO
+		0x00, 0x00, // Data Length
+	)
+	n[2]++
+
+	if len(dst) > size {
+		// TC, keep the question and OPT only.
+		opt := len(dst) - 11
+		qend := 12 + len(req.Question.Name) + 4
+		dst = append(dst[:qend], dst[opt:]...)
+		dst[2] |= 0b00000010
+		n = [3]int{0, 0, 1}
+	}
+
+	for i, c := range n {
+		binary.BigEndian.PutUint16(dst[6+2*i:], uint16(c))
+	}
+
+	return dst, nil
+}
+
+// signerProbeTypes is the types probed at a name when ZoneSigner.Types is not set.
+var signerProbeTypes = []Type{
+	TypeA, TypeNS, TypeCNAME, TypeSOA, TypePTR, TypeMX, TypeTXT, TypeAAAA,
+	TypeSRV, TypeNAPTR, TypeDS, TypeSSHFP, TypeTLSA, TypeSVCB, TypeHTTPS, TypeCAA,
+}
+
+// types returns the types present at qname, the name of req. The probed types
+// are cached for ttl, so that a name is probed once whatever types are queried.
+func (s *ZoneSigner) types(req *Message, qname []byte, ttl uint32, now time.Time) (types []Type) {
+	name := strings.ToLower(string(req.Domain))
+	if s.Types != nil {
+		return s.Types(name)
+	}
+
+	s.cacheMu.Lock()
+	e := s.probed[b2s(qname)]
+	s.cacheMu.Unlock()
+	if e != nil && now.Before(e.expires) {
+		return e.types
+	}
+
+	probe := AcquireMessage()
+	defer ReleaseMessage(probe)
+
+	var data []byte
+	var rrs []dnssecRR
+	for _, typ := range signerProbeTypes {
+		probe.SetRequestQuestion(name, typ, req.Question.Class)
+		mw := &MemResponseWriter{Data: data[:0]}
+		s.Handler.ServeDNS(mw, probe)
+		data = mw.Data
+		if len(data) < 12 || Rcode(data[3]&0b1111) != RcodeNoError {
+			continue
+		}
+		var counts [3]int
+		var err error
+		if rrs, counts, err = parseDNSSECRRs(rrs[:0], data); err != nil {
+			continue
+		}
+		if slices.ContainsFunc(rrs[:counts[0]], func(rr dnssecRR) bool {
+			return rr.typ == typ && bytes.Equal(rr.name, qname)
+		}) {
+			types = append(types, typ)
+		}
+	}
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	if len(s.probed) >= s.MaxCacheEntries {
+		for pk, v := range s.probed {
+			if len(s.probed) < s.MaxCacheEntries && now.Before(v.expires) {
+				break
+			}
+			delete(s.probed, pk)
+		}
+	}
+	s.probed[string(qname)] = &probedTypesEntry{types: types, expires: now.Add(time.Duration(ttl) * time.Second)}
+
+	return types
+}
+
+// appendSection appends the RRsets of rrs to dst, followed by their RRSIGs if sign is set.
+func (s *ZoneSigner) appendSection(dst []byte, rrs []dnssecRR, qname []byte, sign bool, now time.Time) (_ []byte, count int, err error) {
+	done := make([]bool, len(rrs))
+	for i := range rrs {
+		if done[i] {
+			continue
+		}
+
+		// collect the RRset of rrs[i] with the smallest TTL of its records.
+		rrset := make([]dnssecRR, 0, 1)
+		for j := i; j < len(rrs); j++ {
+			if !done[j] && rrs[j].typ == rrs[i].typ && rrs[j].class == rrs[i].class && bytes.Equal(rrs[j].name, rrs[i].name) {
+				done[j] = true
+				rrset = append(rrset, rrs[j])
+				rrset[0].ttl = min(rrset[0].ttl, rrs[j].ttl)
+			}
+		}
+		for j := range rrset {
+			rrset[j].ttl = rrset[0].ttl
+		}
+
+		for j := range rrset {
+			dst = appendOwnerRR(dst, &rrset[j], qname)
+			count++
+		}
+
+		if !sign || !s.signable(&rrset[0]) {
+			continue
+		}
+
+		keys := s.zsks
+		if rrset[0].typ == TypeDNSKEY {
+			keys = s.ksks
+		}
+		for _, k := range keys {
+			rrsig, err := s.signature(rrset, k, now)
+			if err != nil {
+				return dst, count, err
+			}
+			rr := dnssecRR{name: rrset[0].name, typ: TypeRRSIG, class: rrset[0].class, ttl: rrset[0].ttl, rdata: rrsig}
+			dst = appendOwnerRR(dst, &rr, qname)
+			count++
+		}
+	}
+
+	return dst, count, nil
+}
+
+// signable reports whether the RRset of rr is authoritative data of the zone.
+func (s *ZoneSigner) signable(rr *dnssecRR) bool {
+	switch {
+	case rr.typ == TypeRRSIG || rr.typ == TypeOPT:
+		return false
+	case rr.typ == TypeNS && !bytes.Equal(rr.name, s.zone):
+		// delegations are not signed, see RFC 4035 section 2.2.
+		return false
+	}
+	return isSubdomain(rr.name, s.zone)
+}
+
+// signature returns the RRSIG RDATA of rrset by k, from the cache if it is fresh.
+func (s *ZoneSigner) signature(rrset []dnssecRR, k *DNSKey, now time.Time) ([]byte, error) {
+	canonical, err := canonicalRRset(rrset)
+	if err != nil {
+		return nil, err
+	}
+
+	rr := &canonical[0]
+	key := append(make([]byte, 0, 256),
+		byte(k.keyTag>>8), byte(k.keyTag),
+		byte(rr.typ>>8), byte(rr.typ),
+		byte(rr.class>>8), byte(rr.class),
+		byte(rr.ttl>>24), byte(rr.ttl>>16), byte(rr.ttl>>8), byte(rr.ttl),
+	)
+	key = appendSignedData(append(key, rr.name...), nil, canonical, rr.ttl)
+
+	s.cacheMu.Lock()
+	e := s.cache[b2s(key)]
+	s.cacheMu.Unlock()
+	if e != nil && now.Before(e.refresh) {
+		return e.rrsig, nil
+	}
+
+	// allow the clock skew of validators.
+	inception := uint32(now.Add(-time.Hour).Unix())
+	expiration := uint32(now.Add(s.Validity).Unix())
+
+	rrsig := appendRRSIGHeader(nil, rr, k, s.zone, inception, expiration)
+	sig, err := k.sign(appendSignedData(nil, rrsig, canonical, rr.ttl))
+	if err != nil {
+		return nil, err
+	}
+	rrsig = append(rrsig, sig...)
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	if len(s.cache) >= s.MaxCacheEntries {
+		for ck, v := range s.cache {
+			if len(s.cache) < s.MaxCacheEntries && now.Before(v.refresh) {
+				break
+			}
+			delete(s.cache, ck)
+		}
+	}
+	s.cache[string(key)] = &signatureCacheEntry{rrsig: rrsig, refresh: now.Add(s.Validity / 2)}
+
+	return rrsig, nil
+}
+
+// hasDelegation reports whether the authority section is a referral to a child zone.
+func hasDelegation(authority []dnssecRR, zone []byte) bool {
+	for _, rr := range authority {
+		if rr.typ == TypeNS && !bytes.Equal(rr.name, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// compactNSEC returns the NSEC record of name whose next name is \000.name, see RFC 9824 section 3.
+func compactNSEC(name []byte, class Class, ttl uint32, types []Type) dnssecRR {
+	rdata := append([]byte{1, 0}, name...)
+	return dnssecRR{
+		name:  name,
+		typ:   TypeNSEC,
+		class: class,
+		ttl:   ttl,
+		rdata: appendTypeBitmap(rdata, types),
+	}
+}
+
+// questionNamePointer is the compression pointer to the question name.
+var questionNamePointer = []byte{0xc0, 0x0c}
+
+// appendOwnerRR appends rr to dst, compressing its owner name if it is the question name.
+func appendOwnerRR(dst []byte, rr *dnssecRR, qname []byte) []byte {
+	if !bytes.Equal(rr.name, qname) {
+		return appendRR(dst, rr)
+	}
+	name := rr.name
+	rr.name = questionNamePointer
+	dst = appendRR(dst, rr)
+	rr.name = name
+	return dst
+}
@@ -0,0 +1,558 @@
+package fastdns
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDNSKeyED25519 checks the key tag, DS and signature against the example 1 of RFC 8080 section 6.
+func TestDNSKeyED25519(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString("ODIyNjAzODQ2MjgwODAxMjI2NDUxOTAyMDQxNDIyNjI=")
+	key, err := NewDNSKey(257, ed25519.NewKeyFromSeed(seed))
+	if err != nil {
+		t.Fatalf("NewDNSKey return error: %+v", err)
+	}
+
+	if got, want := base64.StdEncoding.EncodeToString(key.PublicKey()), "l02Woi0iS8Aa25FQkUd9RMzZHJpBoRQwAQEX1SxZJA4="; got != want {
+		t.Errorf("PublicKey got %s want %s", got, want)
+	}
+	if got, want := key.KeyTag(), uint16(3613); got != want {
+		t.Errorf("KeyTag got %d want %d", got, want)
+	}
+	if got, want := hex.EncodeToString(key.AppendDS(nil, "Example.com.")[4:]), "3aa5ab37efce57f737fc1627013fee07bdf241bd10f3b1964ab55c78e79a304b"; got != want {
+		t.Errorf("AppendDS got %s want %s", got, want)
+	}
+
+	owner := EncodeDomain(nil, "example.com")
+	rrset := []dnssecRR{{
+		name:  owner,
+		typ:   TypeMX,
+		class: ClassINET,
+		ttl:   3600,
+		rdata: EncodeDomain([]byte{0, 10}, "mail.example.com"),
+	}}
+	rrsig, err := signRRset(rrset, key, owner, 1438207200, 1440021600)
+	if err != nil {
+		t.Fatalf("signRRset return error: %+v", err)
+	}
+	if got, want := base64.StdEncoding.EncodeToString(rrsig[18+len(owner):]), "oL9krJun7xfBOIWcGHi7mag5/hdZrKWw15jPGrHpjQeRAvTdszaPD+QLs3fx8A4M3e23mRZ9VrbpMngwcrqNAg=="; got != want {
+		t.Errorf("signRRset got %s want %s", got, want)
+	}
+}
+
+// mockZoneHandler answers www.example.org A and NXDOMAIN for other names with an SOA.
+type mockZoneHandler struct {
+	calls atomic.Int32
+}
+
+// ServeDNS answers the queries of the example.org zone.
+func (h *mockZoneHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	h.calls.Add(1)
+	switch {
+	case strings.EqualFold(string(req.Domain), "www.example.org"):
+		if req.Question.Type != TypeA {
+			req.SetResponseHeader(RcodeNoError, 0)
+			break
+		}
+		req.SetResponseHeader(RcodeNoError, 2)
+		req.AppendHOST(300, []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")})
+		_, _ = rw.Write(req.Raw)
+		return
+	default:
+		req.SetResponseHeader(RcodeNoError, 0)
+		req.Header.Flags |= Flags(RcodeNXDomain)
+		req.Raw[3] |= byte(RcodeNXDomain)
+	}
+	appendMockAuthority(req, "example.org", TypeSOA)
+	_, _ = rw.Write(req.Raw)
+}
+
+// appendMockAuthority appends an SOA or NS record of zone to the authority section of req.
+func appendMockAuthority(req *Message, zone string, typ Type) {
+	req.Header.NSCount = 1
+	req.Raw[9] = 1
+	req.Raw = append(req.Raw, encodeZone(zone)...)
+	req.Raw = append(req.Raw, 0x00, byte(typ), 0x00, 0x01, 0, 0, 0x0e, 0x10)
+	rdata := EncodeDomain(nil, strings.TrimSuffix("ns1."+zone, "."))
+	if typ == TypeSOA {
+		rdata = EncodeDomain(rdata, strings.TrimSuffix("admin."+zone, "."))
+		rdata = binary.BigEndian.AppendUint32(rdata, 1)
+		rdata = binary.BigEndian.AppendUint32(rdata, 7200)
+		rdata = binary.BigEndian.AppendUint32(rdata, 3600)
+		rdata = binary.BigEndian.AppendUint32(rdata, 86400)
+		rdata = binary.BigEndian.AppendUint32(rdata, 300)
+	}
+	req.Raw = binary.BigEndian.AppendUint16(req.Raw, uint16(len(rdata)))
+	req.Raw = append(req.Raw, rdata...)
+}
+
+// serveSigner serves a query of name and typ with the DO bit through the signer and parses the response.
+func serveSigner(t *testing.T, signer *ZoneSigner, name string, typ Type, do bool) ([]dnssecRR, [3]int, Flags) {
+	t.Helper()
+
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion(name, typ, ClassINET)
+	if do {
+		roa, _ := req.OptionsAppender()
+		roa.init()
+		req.Raw[len(req.Raw)-4] |= 0x80
+	}
+	if err := ParseMessage(req, req.Raw, false); err != nil {
+		t.Fatalf("ParseMessage return error: %+v", err)
+	}
+
+	rw := &MemResponseWriter{}
+	signer.ServeDNS(rw, req)
+
+	rrs, counts, err := parseDNSSECRRs(nil, rw.Data)
+	if err != nil {
+		t.Fatalf("parse signed response of %s error: %+v", name, err)
+	}
+	return rrs, counts, Flags(binary.BigEndian.Uint16(rw.Data[2:]))
+}
+
+// verifyRRSIG verifies the ECDSA P-256 RRSIG of rrset by key.
+func verifyRRSIG(t *testing.T, key *DNSKey, rrset []dnssecRR, rrsig dnssecRR) {
+	t.Helper()
+
+	signer := 18 + len(EncodeDomain(nil, "example.org"))
+	canonical, err := canonicalRRset(rrset)
+	if err != nil {
+		t.Fatalf("canonicalRRset return error: %+v", err)
+	}
+	if got, want := binary.BigEndian.Uint16(rrsig.rdata[16:]), key.KeyTag(); got != want {
+		t.Errorf("RRSIG key tag got %d want %d", got, want)
+	}
+	hash := sha256.Sum256(appendSignedData(nil, rrsig.rdata[:signer], canonical, binary.BigEndian.Uint32(rrsig.rdata[4:])))
+	pub := &ecdsa.PublicKey{
+		Curve: key.privateKey.(*ecdsa.PrivateKey).Curve,
+		X:     new(big.Int).SetBytes(key.PublicKey()[:32]),
+		Y:     new(big.Int).SetBytes(key.PublicKey()[32:]),
+	}
+	sig := rrsig.rdata[signer:]
+	if !ecdsa.Verify(pub, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Errorf("RRSIG of %s %s does not verify", rrset[0].name, rrset[0].typ)
+	}
+}
+
+// TestZoneSigner signs positive answers, DNSKEY answers and compact denials.
+func TestZoneSigner(t *testing.T) {
+	ksk, err := GenerateDNSKey(257, DNSSECAlgorithmECDSAP256SHA256)
+	if err != nil {
+		t.Fatalf("GenerateDNSKey return error: %+v", err)
+	}
+	zsk, err := GenerateDNSKey(256, DNSSECAlgorithmECDSAP256SHA256)
+	if err != nil {
+		t.Fatalf("GenerateDNSKey return error: %+v", err)
+	}
+
+	handler := &mockZoneHandler{}
+	signer := &ZoneSigner{
+		Handler: handler,
+		Zone:    "example.org",
+		Keys:    []*DNSKey{ksk, zsk},
+	}
+
+	// positive answer
+	rrs, counts, _ := serveSigner(t, signer, "WWW.example.org", TypeA, true)
+	if counts != [3]int{3, 0, 1} || rrs[2].typ != TypeRRSIG || rrs[3].typ != TypeOPT {
+		t.Fatalf("signed answer mismatch: counts=%v", counts)
+	}
+	verifyRRSIG(t, zsk, rrs[:2], rrs[2])
+
+	// signatures are cached
+	again, _, _ := serveSigner(t, signer, "www.example.org", TypeA, true)
+	if !slices.Equal(again[2].rdata, rrs[2].rdata) {
+		t.Errorf("signature of the same RRset shall be cached")
+	}
+
+	// no DO bit
+	_, counts, _ = serveSigner(t, signer, "www.example.org", TypeA, false)
+	if counts != [3]int{2, 0, 0} {
+		t.Errorf("unsigned answer mismatch: counts=%v", counts)
+	}
+
+	// DNSKEY signed by the KSK
+	rrs, counts, flags := serveSigner(t, signer, "example.org", TypeDNSKEY, true)
+	if counts != [3]int{3, 0, 1} || flags.AA() != 1 {
+		t.Fatalf("DNSKEY answer mismatch: counts=%v flags=%b", counts, flags)
+	}
+	verifyRRSIG(t, ksk, rrs[:2], rrs[2])
+
+	// NXDOMAIN becomes NOERROR with NXNAME
+	rrs, counts, flags = serveSigner(t, signer, "nothing.example.org", TypeA, true)
+	if flags.Rcode() != RcodeNoError || counts != [3]int{0, 4, 1} {
+		t.Fatalf("compact denial mismatch: rcode=%s counts=%v", flags.Rcode(), counts)
+	}
+	nsec := rrs[2]
+	if nsec.typ != TypeNSEC || nsec.ttl != 300 {
+		t.Fatalf("compact denial NSEC mismatch: %+v", nsec)
+	}
+	next := append([]byte{1, 0}, EncodeDomain(nil, "nothing.example.org")...)
+	if got, want := nsec.rdata, appendTypeBitmap(next, []Type{TypeRRSIG, TypeNSEC, TypeNXNAME}); !slices.Equal(got, want) {
+		t.Errorf("compact denial NSEC rdata got %x want %x", got, want)
+	}
+	verifyRRSIG(t, zsk, rrs[2:3], rrs[3])
+
+	// NODATA
+	rrs, counts, flags = serveSigner(t, signer, "www.example.org", TypeTXT, true)
+	if flags.Rcode() != RcodeNoError || counts != [3]int{0, 4, 1} || rrs[2].typ != TypeNSEC {
+		t.Fatalf("NODATA denial mismatch: rcode=%s counts=%v", flags.Rcode(), counts)
+	}
+	next = append([]byte{1, 0}, EncodeDomain(nil, "www.example.org")...)
+	if got, want := rrs[2].rdata, appendTypeBitmap(next, []Type{TypeA, TypeRRSIG, TypeNSEC}); !slices.Equal(got, want) {
+		t.Errorf("NODATA denial NSEC rdata got %x want %x", got, want)
+	}
+
+	// the probed types are cached by the name
+	calls := handler.calls.Load()
+	rrs, _, _ = serveSigner(t, signer, "www.example.org", TypeMX, true)
+	if got, want := rrs[2].rdata, appendTypeBitmap(next, []Type{TypeA, TypeRRSIG, TypeNSEC}); !slices.Equal(got, want) {
+		t.Errorf("NODATA denial NSEC rdata got %x want %x", got, want)
+	}
+	if n := handler.calls.Load() - calls; n != 1 {
+		t.Errorf("NODATA denial of a probed name calls the handler %d times, want 1", n)
+	}
+
+	// NODATA with the types of the zone
+	signer.Types = func(name string) []Type {
+		if name != "www.example.org" {
+			t.Errorf("ZoneSigner.Types called with %q", name)
+		}
+		return []Type{TypeAAAA, TypeTXT, TypeA}
+	}
+	rrs, _, _ = serveSigner(t, signer, "WWW.example.org", TypeTXT, true)
+	if got, want := rrs[2].rdata, appendTypeBitmap(next, []Type{TypeA, TypeAAAA, TypeRRSIG, TypeNSEC}); !slices.Equal(got, want) {
+		t.Errorf("NODATA denial NSEC rdata got %x want %x", got, want)
+	}
+
+	// out of zone
+	_, counts, _ = serveSigner(t, signer, "www.example.net", TypeA, true)
+	if counts != [3]int{0, 1, 0} {
+		t.Errorf("out of zone answer shall not be signed: counts=%v", counts)
+	}
+}
+
+// TestCountLabels counts the labels of RRSIG owners.
+func TestCountLabels(t *testing.T) {
+	cases := map[string]uint8{
+		"":                0,
+		"org":             1,
+		"www.example.org": 3,
+		"*.example.org":   2,
+	}
+	for name, want := range cases {
+		wire := []byte{0}
+		if name != "" {
+			wire = EncodeDomain(nil, name)
+		}
+		if got := countLabels(wire); got != want {
+			t.Errorf("countLabels(%q) got %d want %d", name, got, want)
+		}
+	}
+}
+
+// mockDNSSECZone answers the A records of hosts in zone, the DS records of its
+// secure children and referrals to its children without keys.
+type mockDNSSECZone struct {
+	zone     string
+	hosts    map[string]netip.Addr
+	children map[string][]*DNSKey
+}
+
+// ServeDNS answers the queries of the zone.
+func (h *mockDNSSECZone) ServeDNS(rw ResponseWriter, req *Message) {
+	domain := strings.ToLower(string(req.Domain))
+	for child, keys := range h.children {
+		switch {
+		case domain == child && req.Question.Type == TypeDS && keys != nil:
+			req.SetResponseHeader(RcodeNoError, uint16(len(keys)))
+			req.AppendDS(3600, keys)
+			_, _ = rw.Write(req.Raw)
+			return
+		case domain == child || strings.HasSuffix(domain, "."+child):
+			req.SetResponseHeader(RcodeNoError, 0)
+			appendMockAuthority(req, child, TypeNS)
+			_, _ = rw.Write(req.Raw)
+			return
+		}
+	}
+
+	addr, ok := h.hosts[domain]
+	switch {
+	case ok && req.Question.Type == TypeA:
+		req.SetResponseHeader(RcodeNoError, 1)
+		req.AppendHOST(300, []netip.Addr{addr})
+		_, _ = rw.Write(req.Raw)
+		return
+	case ok || domain == h.zone:
+		req.SetResponseHeader(RcodeNoError, 0)
+	default:
+		req.SetResponseHeader(RcodeNoError, 0)
+		req.Header.Flags |= Flags(RcodeNXDomain)
+		req.Raw[3] |= byte(RcodeNXDomain)
+	}
+	appendMockAuthority(req, h.zone, TypeSOA)
+	_, _ = rw.Write(req.Raw)
+}
+
+// mockDNSSECRouter sends a query to the closest zone of its name like a recursive
+// resolver, or to the parent zone for a DS query of a zone apex. It breaks the
+// signature of the answers of tamper.
+type mockDNSSECRouter struct {
+	zones  map[string]Handler
+	tamper string
+}
+
+// ServeDNS routes the query to a zone.
+func (r *mockDNSSECRouter) ServeDNS(rw ResponseWriter, req *Message) {
+	domain := strings.ToLower(string(req.Domain))
+	zone := domain
+	for {
+		if h, ok := r.zones[zone]; ok && (req.Question.Type != TypeDS || zone != domain || zone == "") {
+			if domain != r.tamper {
+				h.ServeDNS(rw, req)
+				return
+			}
+			mw := &MemResponseWriter{}
+			h.ServeDNS(mw, req)
+			// the last byte of the RRSIG before the OPT record
+			mw.Data[len(mw.Data)-12] ^= 0xff
+			_, _ = rw.Write(mw.Data)
+			return
+		}
+		if zone == "" {
+			break
+		}
+		if i := strings.IndexByte(zone, '.'); i >= 0 {
+			zone = zone[i+1:]
+		} else {
+			zone = ""
+		}
+	}
+	req.SetResponseHeader(RcodeRefused, 0)
+	_, _ = rw.Write(req.Raw)
+}
+
+// TestClientDNSSEC validates the answers of a signed hierarchy of the root, org
+// and example.org zones, and of the unsigned insecure.org zone.
+func TestClientDNSSEC(t *testing.T) {
+	generate := func(flags uint16, algorithm DNSSECAlgorithm) *DNSKey {
+		key, err := GenerateDNSKey(flags, algorithm)
+		if err != nil {
+			t.Fatalf("GenerateDNSKey return error: %+v", err)
+		}
+		return key
+	}
+	rootKeys := []*DNSKey{generate(257, DNSSECAlgorithmECDSAP256SHA256)}
+	orgKeys := []*DNSKey{generate(257, DNSSECAlgorithmED25519)}
+	exampleKeys := []*DNSKey{generate(257, DNSSECAlgorithmECDSAP256SHA256), generate(256, DNSSECAlgorithmECDSAP256SHA256)}
+
+	router := &mockDNSSECRouter{
+		zones: map[string]Handler{
+			"": &ZoneSigner{
+				Handler: &mockDNSSECZone{zone: "", children: map[string][]*DNSKey{"org": orgKeys}},
+				Zone:    ".",
+				Keys:    rootKeys,
+			},
+			"org": &ZoneSigner{
+				Handler: &mockDNSSECZone{zone: "org", children: map[string][]*DNSKey{"example.org": exampleKeys, "insecure.org": nil}},
+				Zone:    "org",
+				Keys:    orgKeys,
+			},
+			"example.org": &ZoneSigner{
+				Handler: &mockDNSSECZone{zone: "example.org", hosts: map[string]netip.Addr{
+					"www.example.org": netip.MustParseAddr("192.0.2.1"),
+					"bad.example.org": netip.MustParseAddr("192.0.2.2"),
+				}},
+				Zone: "example.org",
+				Keys: exampleKeys,
+			},
+			"insecure.org": &mockDNSSECZone{zone: "insecure.org", hosts: map[string]netip.Addr{
+				"www.insecure.org": netip.MustParseAddr("192.0.2.3"),
+			}},
+		},
+		tamper: "bad.example.org",
+	}
+
+	client := &Client{
+		Timeout: time.Second,
+		Dialer:  &MemDialer{Handler: router},
+		Validator: &DNSSECValidator{
+			TrustAnchors: []TrustAnchor{{Zone: ".", DS: rootKeys[0].AppendDS(nil, ".")}},
+		},
+	}
+
+	cases := []struct {
+		name   string
+		status DNSSECStatus
+		bogus  bool
+	}{
+		{"www.example.org", DNSSECSecure, false},
+		{"nothing.example.org", DNSSECSecure, false},
+		{"www.insecure.org", DNSSECInsecure, false},
+		{"bad.example.org", DNSSECBogus, true},
+	}
+
+	for _, c := range cases {
+		req, resp := AcquireMessage(), AcquireMessage()
+		req.SetRequestQuestion(c.name, TypeA, ClassINET)
+
+		var status DNSSECStatus
+		err := client.Exchange(WithDNSSECStatus(context.Background(), &status), req, resp)
+		switch {
+		case c.bogus && !errors.Is(err, ErrDNSSECBogus):
+			t.Errorf("%s shall be bogus, got error: %+v", c.name, err)
+		case !c.bogus && err != nil:
+			t.Errorf("%s exchange error: %+v", c.name, err)
+		case status != c.status:
+			t.Errorf("%s status got %s want %s", c.name, status, c.status)
+		case !c.bogus && resp.Header.Flags&0b0000000000100000 != 0 != (c.status == DNSSECSecure):
+			t.Errorf("%s AD bit mismatch: flags=%b", c.name, resp.Header.Flags)
+		}
+
+		ReleaseMessage(resp)
+		ReleaseMessage(req)
+	}
+
+	// a Message reused after a validating exchange does not carry CD.
+	req, resp := AcquireMessage(), AcquireMessage()
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+	if err := client.Exchange(context.Background(), req, resp); err != nil {
+		t.Errorf("www.example.org exchange error: %+v", err)
+	}
+	for _, m := range []*Message{req, resp} {
+		if m.Header.Flags&0b0000000000010000 != 0 || m.Raw[3]&0b00010000 != 0 {
+			t.Errorf("message has CD bit set after exchange: flags=%b raw=%x", m.Header.Flags, m.Raw[:4])
+		}
+	}
+	req.SetRequestQuestion("www.insecure.org", TypeA, ClassINET)
+	if req.Header.Flags&0b0000000000010000 != 0 || req.Raw[3]&0b00010000 != 0 {
+		t.Errorf("reused request has CD bit set: flags=%b raw=%x", req.Header.Flags, req.Raw[:4])
+	}
+	ReleaseMessage(resp)
+	ReleaseMessage(req)
+
+	var status DNSSECStatus
+	ips, err := client.LookupNetIP(WithDNSSECStatus(context.Background(), &status), "ip4", "www.example.org")
+	if err != nil || len(ips) != 1 || status != DNSSECSecure {
+		t.Errorf("LookupNetIP got ips=%v status=%s error=%+v", ips, status, err)
+	}
+
+	// an unrelated trust anchor
+	client.Validator = &DNSSECValidator{
+		TrustAnchors: []TrustAnchor{{Zone: ".", DS: orgKeys[0].AppendDS(nil, ".")}},
+	}
+	if _, err := client.LookupNetIP(context.Background(), "ip4", "www.example.org"); !errors.Is(err, ErrDNSSECBogus) {
+		t.Errorf("LookupNetIP with a wrong trust anchor shall be bogus, got error: %+v", err)
+	}
+}
+
+// TestNSEC3Hash checks the hashed owner names of RFC 5155 appendix A.
+func TestNSEC3Hash(t *testing.T) {
+	salt := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	cases := map[string]string{
+		"example":    "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example":  "35mthgpgcu1qg68fab165klnsnk3dpvl",
+		"ai.example": "gjeqe526plbf1g8mklp59enfd789njgi",
+	}
+	for name, want := range cases {
+		if got := nsec3Encoding.EncodeToString(nsec3Hash(EncodeDomain(nil, name), salt, 12)); got != want {
+			t.Errorf("nsec3Hash(%q) got %s want %s", name, got, want)
+		}
+	}
+}
+
+// TestDenyNSEC3 proves the nonexistence of names and types with a signed NSEC3 record.
+func TestDenyNSEC3(t *testing.T) {
+	key, err := GenerateDNSKey(257, DNSSECAlgorithmED25519)
+	if err != nil {
+		t.Fatalf("GenerateDNSKey return error: %+v", err)
+	}
+	zone := EncodeDomain(nil, "example")
+	z := &dnssecZone{name: zone, keys: []dnssecRR{{name: zone, typ: TypeDNSKEY, class: ClassINET, rdata: key.rdata}}}
+
+	salt := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	hash := nsec3Hash(zone, salt, 12)
+	nsec3 := func(flags byte) []dnssecRR {
+		// a single span from the apex around to itself covers every other name.
+		rdata := append([]byte{1, flags, 0, 12, byte(len(salt))}, salt...)
+		rdata = append(append(rdata, byte(len(hash))), hash...)
+		rdata = appendTypeBitmap(rdata, []Type{TypeNS, TypeSOA, TypeRRSIG, TypeDNSKEY, TypeNSEC3PARAM})
+		owner := nsec3Encoding.AppendEncode([]byte{32}, hash)
+		rr := dnssecRR{name: append(owner, zone...), typ: TypeNSEC3, class: ClassINET, ttl: 300, rdata: rdata}
+		now := uint32(time.Now().Unix())
+		rrsig, err := signRRset([]dnssecRR{rr}, key, zone, now-3600, now+3600)
+		if err != nil {
+			t.Fatalf("signRRset return error: %+v", err)
+		}
+		return []dnssecRR{rr, {name: rr.name, typ: TypeRRSIG, class: ClassINET, ttl: 300, rdata: rrsig}}
+	}
+
+	cases := []struct {
+		name  string
+		typ   Type
+		flags byte
+		want  dnssecDenial
+	}{
+		{"example", TypeMX, 0, denialNoData},
+		{"example", TypeSOA, 0, denialNone},
+		{"www.example", TypeA, 0, denialNXDomain},
+		{"www.example", TypeDS, 1, denialOptOut},
+	}
+	for _, c := range cases {
+		if got := deny(z, EncodeDomain(nil, c.name), c.typ, nsec3(c.flags), time.Now()); got != c.want {
+			t.Errorf("deny(%s %s) got %d want %d", c.name, c.typ, got, c.want)
+		}
+	}
+
+	// a broken signature proves nothing
+	rrs := nsec3(0)
+	rrs[1].rdata[len(rrs[1].rdata)-1] ^= 0xff
+	if got := deny(z, EncodeDomain(nil, "www.example"), TypeA, rrs, time.Now()); got != denialNone {
+		t.Errorf("deny with a broken signature got %d", got)
+	}
+}
+
+// TestVerifySignatureRSA verifies an RSASHA256 signature with the key in DNSKEY wire format.
+func TestVerifySignatureRSA(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey return error: %+v", err)
+	}
+	// RFC 3110 section 2: exponent length, exponent and modulus.
+	pub := append([]byte{3, 0x01, 0x00, 0x01}, priv.N.Bytes()...)
+
+	data := []byte("www.example.org. 3600 IN A 192.0.2.1")
+	hash := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatalf("rsa.SignPKCS1v15 return error: %+v", err)
+	}
+
+	if err := verifySignature(DNSSECAlgorithmRSASHA256, pub, data, sig); err != nil {
+		t.Errorf("verifySignature return error: %+v", err)
+	}
+	data[0] = 'W'
+	if err := verifySignature(DNSSECAlgorithmRSASHA256, pub, data, sig); err == nil {
+		t.Errorf("verifySignature of modified data shall fail")
+	}
+}
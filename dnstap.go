@@ -0,0 +1,455 @@
+package fastdns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dnstap logs the queries and responses of Server and Client as dnstap messages
+// to a Frame Streams receiver, see https://dnstap.info. The messages are written
+// by a goroutine, and dropped when its buffer is full or the receiver is down.
+//
+// The child processes of ForkServer connect to the receiver each, use a socket
+// instead of a file with ForkServer.
+type Dnstap struct {
+	// Network specifies the network of the receiver, "unix", "tcp" or "file".
+	// If not set, use "unix" as default.
+	Network string
+
+	// Address specifies the socket address or the file path of the receiver.
+	Address string
+
+	// Identity specifies the identity of the server in the messages.
+	Identity string
+
+	// Version specifies the version of the server in the messages.
+	Version string
+
+	// BufferSize limits the messages waiting to be written.
+	// If not set, use 4096 as default.
+	BufferSize int
+
+	// ReconnectInterval specifies the delay before reconnecting to the receiver.
+	// If not set, use 1 second as default.
+	ReconnectInterval time.Duration
+
+	// ErrorLog specifies an optional logger for the errors of the receiver.
+	// If nil, logging is disabled.
+	ErrorLog *slog.Logger
+
+	once      sync.Once
+	closeOnce sync.Once
+	frames    chan *dnstapFrame
+	done      chan struct{}
+	stopped   chan struct{}
+	sent      atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// the dnstap message types.
+const (
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// the dnstap socket protocols.
+const (
+	dnstapUDP = 1
+	dnstapTCP = 2
+)
+
+// the Frame Streams control frame types.
+const (
+	frameStreamAccept = 1
+	frameStreamStart  = 2
+	frameStreamStop   = 3
+	frameStreamReady  = 4
+	frameStreamFinish = 5
+)
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// dnstapFrame is a data frame of an encoded dnstap message.
+type dnstapFrame struct {
+	b   []byte
+	msg []byte
+}
+
+var dnstapFramePool = sync.Pool{
+	New: func() interface{} {
+		return &dnstapFrame{b: make([]byte, 0, 1024), msg: make([]byte, 0, 1024)}
+	},
+}
+
+// init fills the defaults and starts the writer goroutine.
+func (d *Dnstap) init() {
+	if d.Network == "" {
+		d.Network = "unix"
+	}
+	if d.BufferSize <= 0 {
+		d.BufferSize = 4096
+	}
+	if d.ReconnectInterval <= 0 {
+		d.ReconnectInterval = time.Second
+	}
+	d.frames = make(chan *dnstapFrame, d.BufferSize)
+	d.done = make(chan struct{})
+	d.stopped = make(chan struct{})
+	go d.run()
+}
+
+// Sent returns the messages written to the receiver.
+func (d *Dnstap) Sent() uint64 {
+	return d.sent.Load()
+}
+
+// Dropped returns the messages dropped because of a full buffer or a receiver failure.
+func (d *Dnstap) Dropped() uint64 {
+	return d.dropped.Load()
+}
+
+// Close writes the buffered messages, stops the stream and closes the receiver.
+func (d *Dnstap) Close() error {
+	d.once.Do(d.init)
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+	<-d.stopped
+	return nil
+}
+
+// log encodes a message of typ between queryAddr and responseAddr, and queues
+// it without blocking. The query or response is absent if its time is zero.
+func (d *Dnstap) log(typ, protocol uint64, queryAddr, responseAddr netip.AddrPort, queryTime time.Time, query []byte, responseTime time.Time, response []byte) {
+	d.once.Do(d.init)
+
+	f := dnstapFramePool.Get().(*dnstapFrame)
+
+	// Message
+	m := appendProtoUint(f.msg[:0], 1, typ)
+	switch {
+	case responseAddr.Addr().Unmap().Is4(), !responseAddr.IsValid() && queryAddr.Addr().Unmap().Is4():
+		m = appendProtoUint(m, 2, 1) // INET
+	case responseAddr.IsValid() || queryAddr.IsValid():
+		m = appendProtoUint(m, 2, 2) // INET6
+	}
+	if protocol != 0 {
+		m = appendProtoUint(m, 3, protocol)
+	}
+	if queryAddr.IsValid() {
+		m = appendProtoBytes(m, 4, queryAddr.Addr().Unmap().AsSlice())
+		m = appendProtoUint(m, 6, uint64(queryAddr.Port()))
+	}
+	if responseAddr.IsValid() {
+		m = appendProtoBytes(m, 5, responseAddr.Addr().Unmap().AsSlice())
+		m = appendProtoUint(m, 7, uint64(responseAddr.Port()))
+	}
+	if !queryTime.IsZero() {
+		m = appendProtoUint(m, 8, uint64(queryTime.Unix()))
+		m = appendProtoFixed32(m, 9, uint32(queryTime.Nanosecond()))
+	}
+	if query != nil {
+		m = appendProtoBytes(m, 10, query)
+	}
+	if !responseTime.IsZero() {
+		m = appendProtoUint(m, 12, uint64(responseTime.Unix()))
+		m = appendProtoFixed32(m, 13, uint32(responseTime.Nanosecond()))
+	}
+	if response != nil {
+		m = appendProtoBytes(m, 14, response)
+	}
+	f.msg = m
+
+	// Dnstap in a data frame
+	b := append(f.b[:0], 0, 0, 0, 0)
+	if d.Identity != "" {
+		b = appendProtoBytes(b, 1, []byte(d.Identity))
+	}
+	if d.Version != "" {
+		b = appendProtoBytes(b, 2, []byte(d.Version))
+	}
+	b = appendProtoBytes(b, 14, m)
+	b = appendProtoUint(b, 15, 1) // MESSAGE
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	f.b = b
+
+	select {
+	case d.frames <- f:
+	default:
+		d.dropped.Add(1)
+		dnstapFramePool.Put(f)
+	}
+}
+
+// run connects to the receiver and writes the messages until Close.
+func (d *Dnstap) run() {
+	defer close(d.stopped)
+
+	failing := false
+	for {
+		rw, bidirectional, err := d.open()
+		if err == nil {
+			failing = false
+			err = d.write(rw, bidirectional)
+			_ = rw.Close()
+			if err == nil {
+				return
+			}
+		}
+		if !failing && d.ErrorLog != nil {
+			d.ErrorLog.Error("dnstap receiver failed", "error", err, "network", d.Network, "address", d.Address)
+		}
+		failing = true
+
+		select {
+		case <-d.done:
+			return
+		case <-time.After(d.ReconnectInterval):
+		}
+	}
+}
+
+// open opens the receiver and starts a stream, the stream of a socket is bidirectional.
+func (d *Dnstap) open() (io.ReadWriteCloser, bool, error) {
+	if d.Network == "file" {
+		file, err := os.OpenFile(d.Address, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err = file.Write(appendFrameStreamControl(nil, frameStreamStart, true)); err != nil {
+			_ = file.Close()
+			return nil, false, err
+		}
+		return file, false, nil
+	}
+
+	conn, err := net.DialTimeout(d.Network, d.Address, 5*time.Second)
+	if err != nil {
+		return nil, false, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write(appendFrameStreamControl(nil, frameStreamReady, true)); err == nil {
+		var typ uint32
+		if typ, err = readFrameStreamControl(conn); err == nil && typ != frameStreamAccept {
+			err = errors.New("dnstap receiver does not accept the stream")
+		}
+	}
+	if err == nil {
+		_, err = conn.Write(appendFrameStreamControl(nil, frameStreamStart, true))
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, false, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, true, nil
+}
+
+// write writes the messages to the stream rw until it fails or Close, the
+// stream is stopped on Close. The messages are sent once they are flushed to rw,
+// and dropped if the flush fails.
+func (d *Dnstap) write(rw io.ReadWriter, bidirectional bool) error {
+	w := bufio.NewWriterSize(rw, 64*1024)
+	var pending uint64 // the messages buffered in w
+	flush := func() error {
+		err := w.Flush()
+		if err != nil {
+			d.dropped.Add(pending)
+		} else {
+			d.sent.Add(pending)
+		}
+		pending = 0
+		return err
+	}
+	// put buffers the message of f, w is flushed here rather than on its own so
+	// that the buffered messages are accounted.
+	put := func(f *dnstapFrame) error {
+		defer dnstapFramePool.Put(f)
+		if len(f.b) > w.Available() && w.Buffered() > 0 {
+			if err := flush(); err != nil {
+				d.dropped.Add(1)
+				return err
+			}
+		}
+		pending++
+		if _, err := w.Write(f.b); err != nil {
+			d.dropped.Add(pending)
+			pending = 0
+			return err
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case f := <-d.frames:
+			if err := put(f); err != nil {
+				return err
+			}
+			if len(d.frames) == 0 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-d.done:
+			for len(d.frames) > 0 {
+				if err := put(<-d.frames); err != nil {
+					// the remaining messages are lost with the receiver.
+					for len(d.frames) > 0 {
+						dnstapFramePool.Put(<-d.frames)
+						d.dropped.Add(1)
+					}
+					return nil
+				}
+			}
+			_, _ = w.Write(appendFrameStreamControl(nil, frameStreamStop, false))
+			if err := flush(); err != nil || !bidirectional {
+				return nil
+			}
+			if conn, ok := rw.(net.Conn); ok {
+				_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			}
+			_, _ = readFrameStreamControl(rw)
+			return nil
+		}
+	}
+}
+
+// appendFrameStreamControl appends a Frame Streams control frame of typ to b,
+// with the dnstap content type if contentType.
+func appendFrameStreamControl(b []byte, typ uint32, contentType bool) []byte {
+	n := 4
+	if contentType {
+		n += 8 + len(dnstapContentType)
+	}
+	b = binary.BigEndian.AppendUint32(b, 0) // escape
+	b = binary.BigEndian.AppendUint32(b, uint32(n))
+	b = binary.BigEndian.AppendUint32(b, typ)
+	if contentType {
+		b = binary.BigEndian.AppendUint32(b, 1) // CONTENT_TYPE
+		b = binary.BigEndian.AppendUint32(b, uint32(len(dnstapContentType)))
+		b = append(b, dnstapContentType...)
+	}
+	return b
+}
+
+// readFrameStreamControl reads a Frame Streams control frame from r and returns its type.
+func readFrameStreamControl(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	n := binary.BigEndian.Uint32(header[4:])
+	if binary.BigEndian.Uint32(header[:4]) != 0 || n < 4 || n > 512 {
+		return 0, errors.New("dnstap invalid control frame")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// appendProtoUint appends a varint field of protobuf to b.
+func appendProtoUint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// appendProtoFixed32 appends a fixed32 field of protobuf to b.
+func appendProtoFixed32(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+// appendProtoBytes appends a length-delimited field of protobuf to b.
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// withDnstap returns a handler logging the queries and responses of handler to
+// dnstap as CLIENT_QUERY and CLIENT_RESPONSE messages.
+func withDnstap(handler Handler, dnstap *Dnstap) Handler {
+	if dnstap == nil {
+		return handler
+	}
+	return &dnstapHandler{handler: handler, dnstap: dnstap}
+}
+
+type dnstapHandler struct {
+	handler Handler
+	dnstap  *Dnstap
+}
+
+var dnstapResponseWriterPool = sync.Pool{
+	New: func() interface{} {
+		return new(dnstapResponseWriter)
+	},
+}
+
+// ServeDNS logs req and serves it with a ResponseWriter logging the response.
+func (h *dnstapHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	now := time.Now()
+	h.dnstap.log(dnstapClientQuery, dnstapUDP, rw.RemoteAddr(), rw.LocalAddr(), now, req.Raw, time.Time{}, nil)
+
+	w := dnstapResponseWriterPool.Get().(*dnstapResponseWriter)
+	w.ResponseWriter = rw
+	w.dnstap = h.dnstap
+	w.queryTime = now
+
+	h.handler.ServeDNS(w, req)
+
+	w.ResponseWriter, w.dnstap = nil, nil
+	dnstapResponseWriterPool.Put(w)
+}
+
+type dnstapResponseWriter struct {
+	ResponseWriter
+	dnstap    *Dnstap
+	queryTime time.Time
+}
+
+// Write writes the response and logs it.
+func (rw *dnstapResponseWriter) Write(p []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(p)
+	if err == nil {
+		rw.dnstap.log(dnstapClientResponse, dnstapUDP, rw.RemoteAddr(), rw.LocalAddr(), rw.queryTime, nil, time.Now(), p)
+	}
+	return n, err
+}
+
+// dnstapConnAddrs returns the socket protocol and the addresses of conn.
+func dnstapConnAddrs(conn net.Conn) (protocol uint64, local, remote netip.AddrPort) {
+	type addrPort interface {
+		AddrPort() netip.AddrPort
+	}
+	if a, ok := conn.LocalAddr().(addrPort); ok {
+		local = a.AddrPort()
+	}
+	if a, ok := conn.RemoteAddr().(addrPort); ok {
+		remote = a.AddrPort()
+	}
+	switch a := conn.RemoteAddr(); {
+	case a == nil:
+	case a.Network() == "udp":
+		protocol = dnstapUDP
+	case a.Network() == "tcp":
+		protocol = dnstapTCP
+	}
+	return
+}
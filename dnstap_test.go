@@ -0,0 +1,272 @@
+package fastdns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// decodeDnstap decodes the fields of a protobuf message, the varint and fixed32
+// values are uint64 and the length-delimited values are []byte.
+func decodeDnstap(t *testing.T, b []byte) map[int]any {
+	fields := make(map[int]any)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid protobuf key in %x", b)
+		}
+		b = b[n:]
+		switch field := int(key >> 3); key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("invalid protobuf varint in %x", b)
+			}
+			fields[field], b = v, b[n:]
+		case 5:
+			fields[field], b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || int(size) > len(b)-n {
+				t.Fatalf("invalid protobuf length in %x", b)
+			}
+			fields[field], b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			t.Fatalf("unexpected protobuf wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+// readDnstapFrames reads the data frames of a stream from r until the STOP
+// control frame, the control frames are returned by their types.
+func readDnstapFrames(t *testing.T, r io.Reader) (controls []uint32, frames []map[int]any) {
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			t.Fatalf("read frame error: %+v", err)
+		}
+		n := binary.BigEndian.Uint32(header[:])
+		if n == 0 {
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(r, b); err != nil {
+				t.Fatalf("read control frame error: %+v", err)
+			}
+			b = make([]byte, binary.BigEndian.Uint32(b))
+			if _, err := io.ReadFull(r, b); err != nil {
+				t.Fatalf("read control frame error: %+v", err)
+			}
+			typ := binary.BigEndian.Uint32(b)
+			if typ == frameStreamStart && !bytes.Contains(b, []byte(dnstapContentType)) {
+				t.Errorf("START control frame %x has no content type", b)
+			}
+			if controls = append(controls, typ); typ == frameStreamStop {
+				return
+			}
+			continue
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatalf("read data frame error: %+v", err)
+		}
+		frames = append(frames, decodeDnstap(t, b))
+	}
+}
+
+// TestDnstapServer logs the queries and responses of a handler to a socket receiver.
+func TestDnstapServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("listen unix error: %+v", err)
+	}
+	defer ln.Close()
+
+	type result struct {
+		controls []uint32
+		frames   []map[int]any
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if typ, err := readFrameStreamControl(conn); err != nil || typ != frameStreamReady {
+			t.Errorf("read READY control frame = (%d, %+v)", typ, err)
+			return
+		}
+		_, _ = conn.Write(appendFrameStreamControl(nil, frameStreamAccept, true))
+		controls, frames := readDnstapFrames(t, conn)
+		_, _ = conn.Write(appendFrameStreamControl(nil, frameStreamFinish, false))
+		results <- result{controls, frames}
+	}()
+
+	dnstap := &Dnstap{Address: path, Identity: "ns1", Version: "fastdns"}
+	handler := withDnstap(&mockServerHandler{}, dnstap)
+
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+	query := append([]byte(nil), req.Raw...)
+
+	rw := &MemResponseWriter{
+		Raddr: netip.MustParseAddrPort("192.0.2.1:53000"),
+		Laddr: netip.MustParseAddrPort("[2001:db8::1]:53"),
+	}
+	handler.ServeDNS(rw, req)
+
+	// the messages are written once the receiver accepts the stream.
+	for i := 0; i < 100 && dnstap.Sent() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := dnstap.Close(); err != nil {
+		t.Fatalf("Dnstap.Close() error: %+v", err)
+	}
+
+	r := <-results
+	if len(r.controls) != 2 || r.controls[0] != frameStreamStart || r.controls[1] != frameStreamStop {
+		t.Errorf("control frames %v, want START and STOP", r.controls)
+	}
+	if len(r.frames) != 2 {
+		t.Fatalf("data frames %d, want 2", len(r.frames))
+	}
+	if got := dnstap.Dropped(); got != 0 {
+		t.Errorf("Dnstap.Dropped() = %d, want 0", got)
+	}
+
+	for i, typ := range []uint64{dnstapClientQuery, dnstapClientResponse} {
+		frame := r.frames[i]
+		if string(frame[1].([]byte)) != "ns1" || string(frame[2].([]byte)) != "fastdns" || frame[15] != uint64(1) {
+			t.Errorf("dnstap frame %d %v has no identity, version or type", i, frame)
+		}
+		m := decodeDnstap(t, frame[14].([]byte))
+		if m[1] != typ || m[3] != uint64(dnstapUDP) {
+			t.Errorf("dnstap message %d type %v protocol %v, want %d and udp", i, m[1], m[3], typ)
+		}
+		if !bytes.Equal(m[4].([]byte), []byte{192, 0, 2, 1}) || m[6] != uint64(53000) || m[7] != uint64(53) {
+			t.Errorf("dnstap message %d addresses %v", i, m)
+		}
+		if len(m[5].([]byte)) != 16 || m[2] != uint64(2) {
+			t.Errorf("dnstap message %d response address %x family %v, want ipv6", i, m[5], m[2])
+		}
+		if m[8] == nil {
+			t.Errorf("dnstap message %d has no query time", i)
+		}
+	}
+	if q := decodeDnstap(t, r.frames[0][14].([]byte)); !bytes.Equal(q[10].([]byte), query) {
+		t.Errorf("CLIENT_QUERY message %x, want %x", q[10], query)
+	}
+	if resp := decodeDnstap(t, r.frames[1][14].([]byte)); !bytes.Equal(resp[14].([]byte), rw.Data) || resp[12] == nil {
+		t.Errorf("CLIENT_RESPONSE message %x, want %x", resp[14], rw.Data)
+	}
+}
+
+// TestDnstapClient logs the exchanges of a client to a file receiver.
+func TestDnstapClient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	dnstap := &Dnstap{Network: "file", Address: path}
+	client := &Client{
+		Addr:    serveTestHandler(t, &mockServerHandler{}),
+		Timeout: time.Second,
+		Dnstap:  dnstap,
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+
+	if err := client.Exchange(context.Background(), req, resp); err != nil {
+		t.Fatalf("client.Exchange() error: %+v", err)
+	}
+	if err := dnstap.Close(); err != nil {
+		t.Fatalf("Dnstap.Close() error: %+v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("os.Open() error: %+v", err)
+	}
+	defer file.Close()
+
+	controls, frames := readDnstapFrames(t, file)
+	if len(controls) != 2 || controls[0] != frameStreamStart {
+		t.Errorf("control frames %v, want START and STOP", controls)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("data frames %d, want 2", len(frames))
+	}
+
+	query, response := decodeDnstap(t, frames[0][14].([]byte)), decodeDnstap(t, frames[1][14].([]byte))
+	if query[1] != uint64(dnstapForwarderQuery) || response[1] != uint64(dnstapForwarderResponse) {
+		t.Errorf("dnstap message types %v and %v, want FORWARDER_QUERY and FORWARDER_RESPONSE", query[1], response[1])
+	}
+	if !bytes.Equal(query[10].([]byte), req.Raw) || !bytes.Equal(response[14].([]byte), resp.Raw) {
+		t.Errorf("dnstap messages do not carry the exchanged query and response")
+	}
+	if addr := client.Addr; netip.AddrPortFrom(netip.AddrFrom4([4]byte(response[5].([]byte))), uint16(response[7].(uint64))).String() != addr {
+		t.Errorf("FORWARDER_RESPONSE response address %v:%v, want %s", response[5], response[7], addr)
+	}
+}
+
+// TestDnstapDropped counts the messages dropped while the receiver is down.
+func TestDnstapDropped(t *testing.T) {
+	dnstap := &Dnstap{
+		Address:           filepath.Join(t.TempDir(), "missing.sock"),
+		BufferSize:        1,
+		ReconnectInterval: time.Hour,
+	}
+	defer dnstap.Close()
+
+	addr := netip.MustParseAddrPort("127.0.0.1:53")
+	for i := 0; i < 10; i++ {
+		dnstap.log(dnstapClientQuery, dnstapUDP, addr, addr, time.Now(), []byte{1, 2, 3}, time.Time{}, nil)
+	}
+
+	if got := dnstap.Dropped(); got != 9 {
+		t.Errorf("Dnstap.Dropped() = %d, want 9", got)
+	}
+	if got := dnstap.Sent(); got != 0 {
+		t.Errorf("Dnstap.Sent() = %d, want 0", got)
+	}
+}
+
+// mockFailedStream fails all reads and writes.
+type mockFailedStream struct{}
+
+func (mockFailedStream) Read([]byte) (int, error)  { return 0, io.ErrClosedPipe }
+func (mockFailedStream) Write([]byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// TestDnstapFlush counts the messages as sent once they are flushed.
+func TestDnstapFlush(t *testing.T) {
+	for _, c := range []struct {
+		stream  io.ReadWriter
+		sent    uint64
+		dropped uint64
+	}{
+		{&bytes.Buffer{}, 3, 0},
+		{mockFailedStream{}, 0, 3},
+	} {
+		dnstap := &Dnstap{frames: make(chan *dnstapFrame, 3), done: make(chan struct{})}
+		for i := 0; i < 3; i++ {
+			f := dnstapFramePool.Get().(*dnstapFrame)
+			f.b = append(f.b[:0], 0, 0, 0, 3, 1, 2, 3)
+			dnstap.frames <- f
+		}
+		close(dnstap.done)
+
+		_ = dnstap.write(c.stream, false)
+		if sent, dropped := dnstap.Sent(), dnstap.Dropped(); sent != c.sent || dropped != c.dropped {
+			t.Errorf("Dnstap.write(%T) got sent=%d dropped=%d want sent=%d dropped=%d", c.stream, sent, dropped, c.sent, c.dropped)
+		}
+	}
+}
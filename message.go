@@ -141,7 +141,7 @@ func ParseMessage(dst *Message, payload []byte, copying bool) error {
 			break
 		}
 	}
-	if i == 0 || i+5 > len(payload) {
+	if len(payload) == 0 || i+5 > len(payload) {
 		return ErrInvalidQuestion
 	}
 	dst.Question.Name = payload[:i+1]
@@ -152,6 +152,11 @@ func ParseMessage(dst *Message, payload []byte, copying bool) error {
 	dst.Question.Type = Type(uint16(payload[2]) | uint16(payload[1])<<8)
 
 	// Domain
+	if i == 0 {
+		// the root domain
+		dst.Domain = dst.Domain[:0]
+		return nil
+	}
 	i = int(dst.Question.Name[0])
 	payload = append(dst.Domain[:0], dst.Question.Name[1:]...)
 	for i < len(payload) && payload[i] != 0 {
@@ -331,13 +336,14 @@ func (msg *Message) SetRequestQuestion(domain string, typ Type, class Class) {
 	// random head id
 	msg.Header.ID = uint16(cheaprandn(65536))
 
-	// QR = 0, RCODE = 0, RD = 1
+	// QR = 0, RD = 1, the other flags except Opcode are cleared, a pooled
+	// message may carry the flags of a response, E.g. AA, TC or CD.
 	//
 	//   0  1  2  3  4  5  6  7  8  9  A  B  C  D  E  F
 	// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
 	// |QR|   Opcode  |AA|TC|RD|RA|   Z    |   RCODE   |
 	// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
-	msg.Header.Flags &= 0b0111111111110000
+	msg.Header.Flags &= 0b0111100000000000
 	msg.Header.Flags |= 0b0000000100000000
 
 	msg.Header.QDCount = 1
@@ -370,6 +376,23 @@ func (msg *Message) SetRequestQuestion(domain string, typ Type, class Class) {
 	msg.Domain = append(msg.Domain[:0], domain...)
 }
 
+// setQuery primes the message with a query of the wire name, which unlike
+// SetRequestQuestion can be the root name.
+func (msg *Message) setQuery(name []byte, typ Type, flags Flags) error {
+	id := uint16(cheaprandn(65536))
+	msg.Raw = append(msg.Raw[:0],
+		// ID
+		byte(id>>8), byte(id),
+		// Flags
+		byte(flags>>8), byte(flags),
+		// QDCOUNT, ANCOUNT, NSCOUNT, ARCOUNT
+		0, 1, 0, 0, 0, 0, 0, 0,
+	)
+	msg.Raw = append(msg.Raw, name...)
+	msg.Raw = append(msg.Raw, byte(typ>>8), byte(typ), byte(ClassINET>>8), byte(ClassINET))
+	return ParseMessage(msg, msg.Raw, false)
+}
+
 // SetResponseHeader sets QR=1, RCODE=rcode, ANCount=ancount then updates Raw.
 func (msg *Message) SetResponseHeader(rcode Rcode, ancount uint16) {
 	// QR = 1, RCODE = rcode
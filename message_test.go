@@ -134,6 +134,31 @@ func TestMessageParseMessageOK(t *testing.T) {
 	}
 }
 
+// TestMessageParseMessageRoot parses a query of the root domain.
+func TestMessageParseMessageRoot(t *testing.T) {
+	raw := []byte{
+		0x00, 0x03, // Transaction ID
+		0x01, 0x00, // Flags: recursion desired
+		0x00, 0x01, // Questions
+		0x00, 0x00, // Answer RRs
+		0x00, 0x00, // Authority RRs
+		0x00, 0x00, // Additional RRs
+		0x00,       // Root
+		0x00, 0x30, // QTYPE DNSKEY
+		0x00, 0x01, // QCLASS IN
+	}
+
+	msg := AcquireMessage()
+	defer ReleaseMessage(msg)
+
+	if err := ParseMessage(msg, raw, true); err != nil {
+		t.Fatalf("ParseMessage(%x) error: %+v", raw, err)
+	}
+	if string(msg.Question.Name) != "\x00" || len(msg.Domain) != 0 || msg.Question.Type != TypeDNSKEY {
+		t.Errorf("ParseMessage(%x) got name=%q domain=%q type=%s", raw, msg.Question.Name, msg.Domain, msg.Question.Type)
+	}
+}
+
 // TestMessageParseMessageError validates parser failures for malformed inputs.
 func TestMessageParseMessageError(t *testing.T) {
 	var cases = []struct {
@@ -2,6 +2,7 @@ package fastdns
 
 import (
 	"net/netip"
+	"time"
 )
 
 // AsOptions converts an OPT record into message options.
@@ -31,8 +32,117 @@ const (
 	OptionCodeCOOKIE    OptionCode = 10
 	OptionCodeKeepalive OptionCode = 11
 	OptionCodePadding   OptionCode = 12
+	OptionCodeEDE       OptionCode = 15
+	OptionCodeClientTag OptionCode = 16
 )
 
+// ExtendedErrorCode denotes the INFO-CODE of an Extended DNS Error option.
+type ExtendedErrorCode uint16
+
+// Extended DNS Error Codes, see https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#extended-dns-error-codes
+const (
+	ExtendedErrorOther                       ExtendedErrorCode = 0  // Other Error                        [RFC8914]
+	ExtendedErrorUnsupportedDNSKEYAlgorithm  ExtendedErrorCode = 1  // Unsupported DNSKEY Algorithm       [RFC8914]
+	ExtendedErrorUnsupportedDSDigestType     ExtendedErrorCode = 2  // Unsupported DS Digest Type         [RFC8914]
+	ExtendedErrorStaleAnswer                 ExtendedErrorCode = 3  // Stale Answer                       [RFC8914]
+	ExtendedErrorForgedAnswer                ExtendedErrorCode = 4  // Forged Answer                      [RFC8914]
+	ExtendedErrorDNSSECIndeterminate         ExtendedErrorCode = 5  // DNSSEC Indeterminate               [RFC8914]
+	ExtendedErrorDNSSECBogus                 ExtendedErrorCode = 6  // DNSSEC Bogus                       [RFC8914]
+	ExtendedErrorSignatureExpired            ExtendedErrorCode = 7  // Signature Expired                  [RFC8914]
+	ExtendedErrorSignatureNotYetValid        ExtendedErrorCode = 8  // Signature Not Yet Valid            [RFC8914]
+	ExtendedErrorDNSKEYMissing               ExtendedErrorCode = 9  // DNSKEY Missing                     [RFC8914]
+	ExtendedErrorRRSIGsMissing               ExtendedErrorCode = 10 // RRSIGs Missing                     [RFC8914]
+	ExtendedErrorNoZoneKeyBitSet             ExtendedErrorCode = 11 // No Zone Key Bit Set                [RFC8914]
+	ExtendedErrorNSECMissing                 ExtendedErrorCode = 12 // NSEC Missing                       [RFC8914]
+	ExtendedErrorCachedError                 ExtendedErrorCode = 13 // Cached Error                       [RFC8914]
+	ExtendedErrorNotReady                    ExtendedErrorCode = 14 // Not Ready                          [RFC8914]
+	ExtendedErrorBlocked                     ExtendedErrorCode = 15 // Blocked                            [RFC8914]
+	ExtendedErrorCensored                    ExtendedErrorCode = 16 // Censored                           [RFC8914]
+	ExtendedErrorFiltered                    ExtendedErrorCode = 17 // Filtered                           [RFC8914]
+	ExtendedErrorProhibited                  ExtendedErrorCode = 18 // Prohibited                         [RFC8914]
+	ExtendedErrorStaleNXDomainAnswer         ExtendedErrorCode = 19 // Stale NXDomain Answer              [RFC8914]
+	ExtendedErrorNotAuthoritative            ExtendedErrorCode = 20 // Not Authoritative                  [RFC8914]
+	ExtendedErrorNotSupported                ExtendedErrorCode = 21 // Not Supported                      [RFC8914]
+	ExtendedErrorNoReachableAuthority        ExtendedErrorCode = 22 // No Reachable Authority             [RFC8914]
+	ExtendedErrorNetworkError                ExtendedErrorCode = 23 // Network Error                      [RFC8914]
+	ExtendedErrorInvalidData                 ExtendedErrorCode = 24 // Invalid Data                       [RFC8914]
+	ExtendedErrorSignatureExpiredBeforeValid ExtendedErrorCode = 25 // Signature Expired before Valid     [NLnet Labs]
+	ExtendedErrorTooEarly                    ExtendedErrorCode = 26 // Too Early                          [RFC9250]
+	ExtendedErrorUnsupportedNSEC3Iterations  ExtendedErrorCode = 27 // Unsupported NSEC3 Iterations Value [RFC9276]
+	ExtendedErrorUnableToConformToPolicy     ExtendedErrorCode = 28 // Unable to conform to policy        [draft-homburg-dnsop-codcp]
+	ExtendedErrorSynthesized                 ExtendedErrorCode = 29 // Synthesized                        [PowerDNS]
+	ExtendedErrorInvalidQueryType            ExtendedErrorCode = 30 // Invalid Query Type                 [RFC9824]
+)
+
+// String returns the canonical text form of the ExtendedErrorCode value.
+func (c ExtendedErrorCode) String() string {
+	switch c {
+	case ExtendedErrorOther:
+		return "Other Error"
+	case ExtendedErrorUnsupportedDNSKEYAlgorithm:
+		return "Unsupported DNSKEY Algorithm"
+	case ExtendedErrorUnsupportedDSDigestType:
+		return "Unsupported DS Digest Type"
+	case ExtendedErrorStaleAnswer:
+		return "Stale Answer"
+	case ExtendedErrorForgedAnswer:
+		return "Forged Answer"
+	case ExtendedErrorDNSSECIndeterminate:
+		return "DNSSEC Indeterminate"
+	case ExtendedErrorDNSSECBogus:
+		return "DNSSEC Bogus"
+	case ExtendedErrorSignatureExpired:
+		return "Signature Expired"
+	case ExtendedErrorSignatureNotYetValid:
+		return "Signature Not Yet Valid"
+	case ExtendedErrorDNSKEYMissing:
+		return "DNSKEY Missing"
+	case ExtendedErrorRRSIGsMissing:
+		return "RRSIGs Missing"
+	case ExtendedErrorNoZoneKeyBitSet:
+		return "No Zone Key Bit Set"
+	case ExtendedErrorNSECMissing:
+		return "NSEC Missing"
+	case ExtendedErrorCachedError:
+		return "Cached Error"
+	case ExtendedErrorNotReady:
+		return "Not Ready"
+	case ExtendedErrorBlocked:
+		return "Blocked"
+	case ExtendedErrorCensored:
+		return "Censored"
+	case ExtendedErrorFiltered:
+		return "Filtered"
+	case ExtendedErrorProhibited:
+		return "Prohibited"
+	case ExtendedErrorStaleNXDomainAnswer:
+		return "Stale NXDomain Answer"
+	case ExtendedErrorNotAuthoritative:
+		return "Not Authoritative"
+	case ExtendedErrorNotSupported:
+		return "Not Supported"
+	case ExtendedErrorNoReachableAuthority:
+		return "No Reachable Authority"
+	case ExtendedErrorNetworkError:
+		return "Network Error"
+	case ExtendedErrorInvalidData:
+		return "Invalid Data"
+	case ExtendedErrorSignatureExpiredBeforeValid:
+		return "Signature Expired before Valid"
+	case ExtendedErrorTooEarly:
+		return "Too Early"
+	case ExtendedErrorUnsupportedNSEC3Iterations:
+		return "Unsupported NSEC3 Iterations Value"
+	case ExtendedErrorUnableToConformToPolicy:
+		return "Unable to conform to policy"
+	case ExtendedErrorSynthesized:
+		return "Synthesized"
+	case ExtendedErrorInvalidQueryType:
+		return "Invalid Query Type"
+	}
+	return ""
+}
+
 type MessageOptions struct {
 	Type    Type
 	UDPSize uint16
@@ -138,6 +248,76 @@ func (o MessageOption) AsPadding(dst []byte) ([]byte, error) {
 	return append(dst, o.Data...), nil
 }
 
+// AsNSID decodes an NSID option payload, which is empty in queries.
+func (o MessageOption) AsNSID(dst []byte) ([]byte, error) {
+	if o.Code != OptionCodeNSID {
+		return nil, ErrInvalidOption
+	}
+	return append(dst, o.Data...), nil
+}
+
+// AsAlgorithms decodes the algorithm numbers of a DAU, DHU or N3U option.
+func (o MessageOption) AsAlgorithms(dst []byte) ([]byte, error) {
+	switch o.Code {
+	case OptionCodeDAU, OptionCodeDHU, OptionCodeN3U:
+		return append(dst, o.Data...), nil
+	}
+	return nil, ErrInvalidOption
+}
+
+// AsExpire decodes an EXPIRE option into the zone expire timer in seconds,
+// which is 0 for the empty option of queries.
+func (o MessageOption) AsExpire() (uint32, error) {
+	if o.Code != OptionCodeEXPIRE {
+		return 0, ErrInvalidOption
+	}
+	switch len(o.Data) {
+	case 0:
+		return 0, nil
+	case 4:
+		return uint32(o.Data[0])<<24 | uint32(o.Data[1])<<16 | uint32(o.Data[2])<<8 | uint32(o.Data[3]), nil
+	}
+	return 0, ErrInvalidOption
+}
+
+// AsKeepalive decodes an edns-tcp-keepalive option into the idle timeout,
+// which is 0 for the empty option of queries.
+func (o MessageOption) AsKeepalive() (time.Duration, error) {
+	if o.Code != OptionCodeKeepalive {
+		return 0, ErrInvalidOption
+	}
+	switch len(o.Data) {
+	case 0:
+		return 0, nil
+	case 2:
+		// TIMEOUT is in units of 100 milliseconds.
+		return time.Duration(uint16(o.Data[0])<<8|uint16(o.Data[1])) * 100 * time.Millisecond, nil
+	}
+	return 0, ErrInvalidOption
+}
+
+// AsClientTag decodes an edns-client-tag option.
+func (o MessageOption) AsClientTag() (uint16, error) {
+	if o.Code != OptionCodeClientTag || len(o.Data) != 2 {
+		return 0, ErrInvalidOption
+	}
+	return uint16(o.Data[0])<<8 | uint16(o.Data[1]), nil
+}
+
+// AsExtendedError decodes an Extended DNS Error option into its INFO-CODE and EXTRA-TEXT.
+func (o MessageOption) AsExtendedError() (ExtendedErrorCode, string, error) {
+	if o.Code != OptionCodeEDE || len(o.Data) < 2 {
+		return 0, "", ErrInvalidOption
+	}
+	code := ExtendedErrorCode(o.Data[0])<<8 | ExtendedErrorCode(o.Data[1])
+	text := o.Data[2:]
+	// EXTRA-TEXT is not NUL terminated, but tolerate the senders which do.
+	if n := len(text); n > 0 && text[n-1] == 0 {
+		text = text[:n-1]
+	}
+	return code, string(text), nil
+}
+
 // OptionsAppender constructs an EDNS options appender for the message.
 func (msg *Message) OptionsAppender() (moa MessageOptionsAppender, err error) {
 	return MessageOptionsAppender{msg: msg}, nil
@@ -165,6 +345,77 @@ func (a *MessageOptionsAppender) init() {
 	a.offset = len(a.msg.Raw) - 2
 }
 
+// appendOption appends the header of an option with the length, and leaves the
+// caller to append its payload.
+func (a *MessageOptionsAppender) appendOption(code OptionCode, length int) {
+	if a.offset == 0 {
+		a.init()
+	}
+	a.msg.Raw = append(a.msg.Raw,
+		byte(code>>8), byte(code), // Option Code
+		byte(length>>8), byte(length), // Option Length
+	)
+	length += (int(a.msg.Raw[a.offset])<<8 | int(a.msg.Raw[a.offset+1])) + 2 + 2
+	a.msg.Raw[a.offset] = byte(length >> 8)
+	a.msg.Raw[a.offset+1] = byte(length)
+}
+
+// AppendNSID adds an NSID option, the nsid is empty in queries.
+func (a *MessageOptionsAppender) AppendNSID(nsid string) {
+	a.appendOption(OptionCodeNSID, len(nsid))
+	a.msg.Raw = append(a.msg.Raw, nsid...)
+}
+
+// AppendDAU adds a DAU option with the DNSSEC algorithms understood by the client.
+func (a *MessageOptionsAppender) AppendDAU(algorithms []DNSSECAlgorithm) {
+	a.appendOption(OptionCodeDAU, len(algorithms))
+	for _, alg := range algorithms {
+		a.msg.Raw = append(a.msg.Raw, byte(alg))
+	}
+}
+
+// AppendDHU adds a DHU option with the DS hash algorithms understood by the client.
+func (a *MessageOptionsAppender) AppendDHU(algorithms []byte) {
+	a.appendOption(OptionCodeDHU, len(algorithms))
+	a.msg.Raw = append(a.msg.Raw, algorithms...)
+}
+
+// AppendN3U adds a N3U option with the NSEC3 hash algorithms understood by the client.
+func (a *MessageOptionsAppender) AppendN3U(algorithms []byte) {
+	a.appendOption(OptionCodeN3U, len(algorithms))
+	a.msg.Raw = append(a.msg.Raw, algorithms...)
+}
+
+// AppendExpire adds an EXPIRE option with the zone expire timer in seconds.
+// A zero expire adds the empty option of queries.
+func (a *MessageOptionsAppender) AppendExpire(expire uint32) {
+	if expire == 0 {
+		a.appendOption(OptionCodeEXPIRE, 0)
+		return
+	}
+	a.appendOption(OptionCodeEXPIRE, 4)
+	a.msg.Raw = append(a.msg.Raw, byte(expire>>24), byte(expire>>16), byte(expire>>8), byte(expire))
+}
+
+// AppendKeepalive adds an edns-tcp-keepalive option with the idle timeout,
+// which is rounded down to 100 milliseconds. A zero timeout adds the empty
+// option of queries.
+func (a *MessageOptionsAppender) AppendKeepalive(timeout time.Duration) {
+	if timeout == 0 {
+		a.appendOption(OptionCodeKeepalive, 0)
+		return
+	}
+	n := min(timeout/(100*time.Millisecond), 0xffff)
+	a.appendOption(OptionCodeKeepalive, 2)
+	a.msg.Raw = append(a.msg.Raw, byte(n>>8), byte(n))
+}
+
+// AppendClientTag adds an edns-client-tag option.
+func (a *MessageOptionsAppender) AppendClientTag(tag uint16) {
+	a.appendOption(OptionCodeClientTag, 2)
+	a.msg.Raw = append(a.msg.Raw, byte(tag>>8), byte(tag))
+}
+
 // AppendSubnet adds an ECS option for the given prefix.
 func (a *MessageOptionsAppender) AppendSubnet(prefix netip.Prefix) {
 	if a.offset == 0 {
@@ -217,6 +468,13 @@ func (a *MessageOptionsAppender) AppendCookie(cookie string) {
 	a.msg.Raw[a.offset+1] = byte(length)
 }
 
+// AppendExtendedError adds an Extended DNS Error option with the INFO-CODE and EXTRA-TEXT.
+func (a *MessageOptionsAppender) AppendExtendedError(code ExtendedErrorCode, text string) {
+	a.appendOption(OptionCodeEDE, 2+len(text))
+	a.msg.Raw = append(a.msg.Raw, byte(code>>8), byte(code)) // INFO-CODE
+	a.msg.Raw = append(a.msg.Raw, text...)                   // EXTRA-TEXT
+}
+
 // AppendPadding grows the message with a padding option.
 func (a *MessageOptionsAppender) AppendPadding(padding uint16) {
 	if padding == 0 || uint16(len(a.msg.Raw))%padding == 0 {
@@ -1,7 +1,10 @@
 package fastdns
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 // TestMessageParseMessageOptions parses an OPT record and decodes its options.
@@ -153,3 +156,151 @@ func TestMessageMessageOptionsAppendPadding(t *testing.T) {
 		t.Logf("msg.Header=%+v, msg.Domain=%s, len(msg.Raw)=%d\n", msg.Header, msg.Domain, len(msg.Raw))
 	}
 }
+
+// TestMessageOptionsAppendExtendedError appends Extended DNS Errors and decodes them back.
+func TestMessageOptionsAppendExtendedError(t *testing.T) {
+	var cases = []struct {
+		Code ExtendedErrorCode
+		Text string
+	}{
+		{ExtendedErrorBlocked, "blocked by policy"},
+		{ExtendedErrorNetworkError, ""},
+		{ExtendedErrorInvalidQueryType, "ANY"},
+	}
+
+	msg := AcquireMessage()
+	defer ReleaseMessage(msg)
+
+	msg.SetRequestQuestion("phus.lu", TypeA, ClassINET)
+	msg.SetResponseHeader(RcodeNoError, 0)
+
+	moa, err := msg.OptionsAppender()
+	if err != nil {
+		t.Errorf("msg.OptionsAppender() error: %+v\n", err)
+	}
+	for _, c := range cases {
+		moa.AppendExtendedError(c.Code, c.Text)
+	}
+
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+
+	if err := ParseMessage(resp, msg.Raw, true); err != nil {
+		t.Fatalf("ParseMessage(%x) error: %+v\n", msg.Raw, err)
+	}
+
+	var index int
+	records := resp.Records()
+	for records.Next() {
+		record := records.Item()
+		if record.Type != TypeOPT {
+			continue
+		}
+		options, err := record.AsOptions()
+		if err != nil {
+			t.Errorf("msg.Records().AsOptions() error: %+v\n", err)
+		}
+		for options.Next() {
+			code, text, err := options.Item().AsExtendedError()
+			if err != nil {
+				t.Errorf("msg.Records().AsOptions().Item().AsExtendedError() error: %+v", err)
+				continue
+			}
+			if index >= len(cases) || code != cases[index].Code || text != cases[index].Text {
+				t.Errorf("msg.Records().AsOptions().Item().AsExtendedError() got code=%s text=%#v", code, text)
+			}
+			index++
+		}
+		if err := options.Err(); err != nil {
+			t.Errorf("msg.Records().AsOptions().Err() error: %+v", err)
+		}
+	}
+	if index != len(cases) {
+		t.Errorf("msg.Records() got %d extended errors, want %d", index, len(cases))
+	}
+
+	if _, _, err := (MessageOption{Code: OptionCodeEDE, Data: []byte{0}}).AsExtendedError(); err != ErrInvalidOption {
+		t.Errorf("AsExtendedError() of a short option shall fail, got %+v", err)
+	}
+	if s := ExtendedErrorDNSSECBogus.String(); s != "DNSSEC Bogus" {
+		t.Errorf("ExtendedErrorDNSSECBogus.String() got %s", s)
+	}
+}
+
+// TestMessageOptionsAppendOptions appends every option and decodes them back.
+func TestMessageOptionsAppendOptions(t *testing.T) {
+	msg := AcquireMessage()
+	defer ReleaseMessage(msg)
+
+	msg.SetRequestQuestion("phus.lu", TypeA, ClassINET)
+
+	moa, err := msg.OptionsAppender()
+	if err != nil {
+		t.Errorf("msg.OptionsAppender() error: %+v\n", err)
+	}
+	moa.AppendNSID("ns1")
+	moa.AppendDAU([]DNSSECAlgorithm{DNSSECAlgorithmECDSAP256SHA256, DNSSECAlgorithmED25519})
+	moa.AppendDHU([]byte{2})
+	moa.AppendN3U([]byte{1})
+	moa.AppendExpire(86400)
+	moa.AppendExpire(0)
+	moa.AppendKeepalive(30 * time.Second)
+	moa.AppendKeepalive(0)
+	moa.AppendClientTag(0x1234)
+
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+
+	if err := ParseMessage(resp, msg.Raw, true); err != nil {
+		t.Fatalf("ParseMessage(%x) error: %+v\n", msg.Raw, err)
+	}
+
+	var got []string
+	records := resp.Records()
+	for records.Next() {
+		record := records.Item()
+		if record.Type != TypeOPT {
+			continue
+		}
+		options, err := record.AsOptions()
+		if err != nil {
+			t.Errorf("msg.Records().AsOptions() error: %+v\n", err)
+		}
+		for options.Next() {
+			option := options.Item()
+			var v any
+			switch option.Code {
+			case OptionCodeNSID:
+				v, err = option.AsNSID(nil)
+				v = string(v.([]byte))
+			case OptionCodeDAU, OptionCodeDHU, OptionCodeN3U:
+				v, err = option.AsAlgorithms(nil)
+			case OptionCodeEXPIRE:
+				v, err = option.AsExpire()
+			case OptionCodeKeepalive:
+				v, err = option.AsKeepalive()
+			case OptionCodeClientTag:
+				v, err = option.AsClientTag()
+			}
+			if err != nil {
+				t.Errorf("msg.Records().AsOptions().Item() %d error: %+v", option.Code, err)
+			}
+			got = append(got, fmt.Sprintf("%d=%v", option.Code, v))
+		}
+		if err := options.Err(); err != nil {
+			t.Errorf("msg.Records().AsOptions().Err() error: %+v", err)
+		}
+	}
+
+	want := []string{"3=ns1", "5=[13 15]", "6=[2]", "7=[1]", "9=86400", "9=0", "11=30s", "11=0s", "16=4660"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("msg.Records().AsOptions() got %v want %v", got, want)
+	}
+
+	if _, err := (MessageOption{Code: OptionCodeEXPIRE, Data: []byte{1, 2}}).AsExpire(); err != ErrInvalidOption {
+		t.Errorf("AsExpire() of a malformed option shall fail, got %+v", err)
+	}
+	if _, err := (MessageOption{Code: OptionCodeNSID}).AsClientTag(); err != ErrInvalidOption {
+		t.Errorf("AsClientTag() of an NSID option shall fail, got %+v", err)
+	}
+}
@@ -0,0 +1,476 @@
+package fastdns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRecursionLimit is returned when a query needs more work than Recursor allows.
+	ErrRecursionLimit = errors.New("fastdns: recursion limit exceeded")
+	// ErrLameDelegation is returned when no name server of a zone answers for it.
+	ErrLameDelegation = errors.New("fastdns: lame delegation")
+
+	// ErrFixedDialer is returned when the Dialer of the Client of Recursor dials
+	// a fixed server instead of the name servers.
+	ErrFixedDialer = errors.New("fastdns: recursor dialer ignores the name server address")
+)
+
+// Recursor is an iterative resolver which answers queries by following the
+// referrals from the root servers, see RFC 1034 section 5.3.3. It can serve
+// as a Handler.
+type Recursor struct {
+	// Client sends the iterative queries, its Timeout, Retry and Dialer apply
+	// while its Addr is replaced by the addresses of the name servers. The
+	// Dialer must dial the addr passed to it, UDPDialer, TCPDialer and
+	// HTTPDialer dial a fixed server and fail with ErrFixedDialer.
+	// If not set, use a Client with 2 seconds timeout as default.
+	Client *Client
+
+	// Cache specifies an optional cache of the final responses.
+	Cache *Cache
+
+	// RootHints specifies the addresses of the root servers.
+	// If not set, use the addresses of a.root-servers.net to m.root-servers.net as default.
+	RootHints []netip.AddrPort
+
+	// IPv6 enables the IPv6 addresses of the name servers.
+	IPv6 bool
+
+	// DisableQNAMEMinimization sends the full query name to every zone instead
+	// of one more label at a time, see RFC 9156.
+	DisableQNAMEMinimization bool
+
+	// MaxQueries caps the number of queries sent to resolve a query, including
+	// the queries for glueless name servers and CNAME targets.
+	// If not set, use 64 as default.
+	MaxQueries int
+
+	// MaxDepth caps the nesting of glueless name server and CNAME resolutions.
+	// If not set, use 8 as default.
+	MaxDepth int
+
+	// Timeout caps the duration of a query served by ServeDNS.
+	// If not set, use 10 seconds as default.
+	Timeout time.Duration
+
+	// MaxCacheEntries limits the number of cached delegations.
+	// If not set, use 4096 as default.
+	MaxCacheEntries int
+
+	once   sync.Once
+	hints  []netip.AddrPort
+	cutsMu sync.Mutex
+	cuts   map[string]*recursorCut
+}
+
+// recursorCut is a cached delegation.
+type recursorCut struct {
+	servers []netip.AddrPort
+	expires time.Time
+}
+
+// recursorState counts the work done for a query.
+type recursorState struct {
+	queries int
+}
+
+// maxMinimizeSteps is the MAX_MINIMISE_COUNT of RFC 9156 section 2.3.
+const maxMinimizeSteps = 10
+
+// rootHints are the addresses of the root servers, see https://www.iana.org/domains/root/servers.
+var rootHints = func() (hints []netip.AddrPort) {
+	for _, s := range []string{
+		"198.41.0.4", "2001:503:ba3e::2:30", // a.root-servers.net
+		"170.247.170.2", "2801:1b8:10::b", // b.root-servers.net
+		"192.33.4.12", "2001:500:2::c", // c.root-servers.net
+		"199.7.91.13", "2001:500:2d::d", // d.root-servers.net
+		"192.203.230.10", "2001:500:a8::e", // e.root-servers.net
+		"192.5.5.241", "2001:500:2f::f", // f.root-servers.net
+		"192.112.36.4", "2001:500:12::d0d", // g.root-servers.net
+		"198.97.190.53", "2001:500:1::53", // h.root-servers.net
+		"192.36.148.17", "2001:7fe::53", // i.root-servers.net
+		"192.58.128.30", "2001:503:c27::2:30", // j.root-servers.net
+		"193.0.14.129", "2001:7fd::1", // k.root-servers.net
+		"199.7.83.42", "2001:500:9f::42", // l.root-servers.net
+		"202.12.27.33", "2001:dc3::35", // m.root-servers.net
+	} {
+		hints = append(hints, netip.AddrPortFrom(netip.MustParseAddr(s), 53))
+	}
+	return
+}()
+
+// init fills the defaults.
+func (r *Recursor) init() {
+	if r.Client == nil {
+		r.Client = &Client{Timeout: 2 * time.Second}
+	}
+	if r.MaxQueries == 0 {
+		r.MaxQueries = 64
+	}
+	if r.MaxDepth == 0 {
+		r.MaxDepth = 8
+	}
+	if r.Timeout == 0 {
+		r.Timeout = 10 * time.Second
+	}
+	if r.MaxCacheEntries == 0 {
+		r.MaxCacheEntries = 4096
+	}
+	hints := r.RootHints
+	if len(hints) == 0 {
+		hints = rootHints
+	}
+	for _, addr := range hints {
+		if r.IPv6 || !addr.Addr().Is6() {
+			r.hints = append(r.hints, addr)
+		}
+	}
+	r.cuts = make(map[string]*recursorCut)
+}
+
+// ServeDNS answers req by resolving it iteratively, or with SERVFAIL on failures.
+func (r *Recursor) ServeDNS(rw ResponseWriter, req *Message) {
+	r.once.Do(r.init)
+
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+
+	if err := r.Exchange(ctx, req, resp); err != nil {
+		Error(rw, req, RcodeServFail)
+		return
+	}
+
+	_, _ = rw.Write(resp.Raw)
+}
+
+// Exchange resolves the question of req iteratively and unmarshals the response into resp.
+func (r *Recursor) Exchange(ctx context.Context, req, resp *Message) error {
+	r.once.Do(r.init)
+
+	switch r.Client.Dialer.(type) {
+	case *UDPDialer, *TCPDialer, *HTTPDialer:
+		return ErrFixedDialer
+	}
+
+	if r.Cache != nil && r.Cache.get(req, resp, nil) {
+		return nil
+	}
+
+	var buf [256]byte
+	qname := appendLowerName(buf[:0], req.Question.Name)
+
+	var st recursorState
+	rcode, answers, authority, err := r.resolve(ctx, &st, qname, req.Question.Type, 0)
+	if err != nil {
+		return err
+	}
+
+	// QR, RD and RA
+	flags := 0b1000000010000000 | req.Header.Flags&0b0000000100000000 | Flags(rcode)
+	resp.Raw = append(resp.Raw[:0],
+		// ID
+		req.Raw[0], req.Raw[1],
+		// Flags
+		byte(flags>>8), byte(flags),
+		// QDCOUNT, ANCOUNT, NSCOUNT, ARCOUNT
+		0, 1, byte(len(answers)>>8), byte(len(answers)), byte(len(authority)>>8), byte(len(authority)), 0, 0,
+	)
+	resp.Raw = append(resp.Raw, req.Question.Name...)
+	resp.Raw = append(resp.Raw, byte(req.Question.Type>>8), byte(req.Question.Type), byte(req.Question.Class>>8), byte(req.Question.Class))
+	for i := range answers {
+		resp.Raw = appendOwnerRR(resp.Raw, &answers[i], qname)
+	}
+	for i := range authority {
+		resp.Raw = appendOwnerRR(resp.Raw, &authority[i], qname)
+	}
+
+	if err := ParseMessage(resp, resp.Raw, false); err != nil {
+		return err
+	}
+
+	if r.Cache != nil {
+		r.Cache.Set(resp)
+	}
+
+	return nil
+}
+
+// resolve resolves the wire name and typ from the closest known zone cut, and
+// returns the rcode with the answer and authority records within the bailiwick
+// of the servers which sent them.
+func (r *Recursor) resolve(ctx context.Context, st *recursorState, name []byte, typ Type, depth int) (Rcode, []dnssecRR, []dnssecRR, error) {
+	if depth > r.MaxDepth {
+		return RcodeServFail, nil, nil, ErrRecursionLimit
+	}
+
+	zone, servers := r.closest(name, time.Now())
+	// known is the longest ancestor of name which is not a zone cut below zone.
+	known, steps := zone, 0
+
+	for {
+		qname, qtype := name, typ
+		if !r.DisableQNAMEMinimization && len(known) < len(name) && steps < maxMinimizeSteps {
+			// reveal one more label with the A type, see RFC 9156 section 2.1.
+			qname, qtype = name, TypeA
+			for countLabels(qname) > countLabels(known)+1 {
+				qname = qname[qname[0]+1:]
+			}
+			steps++
+		}
+		minimized := len(qname) < len(name)
+
+		rrs, counts, rcode, aa, err := r.query(ctx, st, zone, servers, qname, qtype)
+		if err != nil {
+			return RcodeServFail, nil, nil, err
+		}
+		answers := rrs[:counts[0]]
+		authority := rrs[counts[0] : counts[0]+counts[1]]
+
+		if cut := referral(zone, qname, answers, authority, rcode, aa); cut != nil {
+			servers, err = r.delegation(ctx, st, zone, cut, authority, rrs[counts[0]+counts[1]:], depth)
+			if err != nil {
+				return RcodeServFail, nil, nil, err
+			}
+			zone, known = cut, cut
+			continue
+		}
+
+		answers, authority = inBailiwick(answers, zone), inBailiwick(authority, zone)
+
+		if minimized {
+			if rcode == RcodeNXDomain {
+				// nothing exists below a nonexistent name, see RFC 8020.
+				return rcode, nil, authority, nil
+			}
+			known = qname
+			continue
+		}
+
+		if rcode == RcodeNoError && typ != TypeCNAME && typ != TypeANY {
+			// chase the CNAME target which is outside of the answer.
+			target := name
+			for i := 0; i < len(answers); i++ {
+				next := target
+				for _, rr := range answers {
+					if rr.typ == TypeCNAME && bytes.Equal(rr.name, target) {
+						next = appendLowerName(nil, rr.rdata)
+						break
+					}
+				}
+				if bytes.Equal(next, target) {
+					break
+				}
+				target = next
+			}
+			found := false
+			for _, rr := range answers {
+				if rr.typ == typ && bytes.Equal(rr.name, target) {
+					found = true
+					break
+				}
+			}
+			if !found && !bytes.Equal(target, name) {
+				rcode, more, authority, err := r.resolve(ctx, st, target, typ, depth+1)
+				return rcode, append(answers, more...), authority, err
+			}
+		}
+
+		return rcode, answers, authority, nil
+	}
+}
+
+// query sends the query of qname and qtype to the servers of zone in turn until
+// one of them answers, and returns the records of the response.
+func (r *Recursor) query(ctx context.Context, st *recursorState, zone []byte, servers []netip.AddrPort, qname []byte, qtype Type) (rrs []dnssecRR, counts [3]int, rcode Rcode, aa byte, err error) {
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(resp)
+	defer ReleaseMessage(req)
+
+	err = ErrLameDelegation
+	start := int(cheaprandn(uint32(len(servers))))
+	for i := range servers {
+		if st.queries >= r.MaxQueries {
+			return nil, counts, RcodeServFail, 0, ErrRecursionLimit
+		}
+		st.queries++
+
+		if err = req.setQuery(qname, qtype, 0); err != nil {
+			return nil, counts, RcodeServFail, 0, err
+		}
+		roa, _ := req.OptionsAppender()
+		roa.init()
+
+		server := servers[(start+i)%len(servers)].String()
+		if err = r.Client.exchangeOnce(context.WithValue(ctx, clientServerContextKey, server), req, resp, nil); err != nil {
+			if ctx.Err() != nil {
+				return nil, counts, RcodeServFail, 0, err
+			}
+			continue
+		}
+
+		if resp.Header.ID != req.Header.ID || resp.Header.Flags.TC() != 0 || resp.Question.Type != qtype ||
+			!bytes.EqualFold(resp.Question.Name, req.Question.Name) {
+			err = ErrInvalidAnswer
+			continue
+		}
+
+		rcode, aa = resp.Header.Flags.Rcode(), resp.Header.Flags.AA()
+		if rcode != RcodeNoError && rcode != RcodeNXDomain {
+			err = ErrLameDelegation
+			continue
+		}
+
+		if rrs, counts, err = parseDNSSECRRs(rrs[:0], resp.Raw); err != nil {
+			continue
+		}
+
+		if lame(zone, qname, rrs, counts, rcode, aa) {
+			err = ErrLameDelegation
+			continue
+		}
+
+		return rrs, counts, rcode, aa, nil
+	}
+
+	return nil, counts, RcodeServFail, 0, err
+}
+
+// delegation returns the addresses of the name servers of cut from the glue
+// within the bailiwick of zone, or by resolving the names of the name servers.
+func (r *Recursor) delegation(ctx context.Context, st *recursorState, zone, cut []byte, authority, additional []dnssecRR, depth int) ([]netip.AddrPort, error) {
+	var names [][]byte
+	ttl := uint32(86400)
+	for _, rr := range authority {
+		if rr.typ == TypeNS && bytes.Equal(rr.name, cut) {
+			names = append(names, appendLowerName(nil, rr.rdata))
+			ttl = min(ttl, rr.ttl)
+		}
+	}
+
+	var servers []netip.AddrPort
+	for _, ns := range names {
+		// the glue of a name server outside of zone may be forged.
+		if !isSubdomain(ns, zone) {
+			continue
+		}
+		for _, rr := range additional {
+			if bytes.Equal(rr.name, ns) {
+				servers = r.appendServer(servers, rr)
+			}
+		}
+	}
+
+	for _, ns := range names {
+		if len(servers) != 0 {
+			break
+		}
+		// a name server within cut without glue is unreachable.
+		if isSubdomain(ns, cut) {
+			continue
+		}
+		_, answers, _, err := r.resolve(ctx, st, ns, TypeA, depth+1)
+		if errors.Is(err, ErrRecursionLimit) || ctx.Err() != nil {
+			return nil, err
+		}
+		for _, rr := range answers {
+			servers = r.appendServer(servers, rr)
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, ErrLameDelegation
+	}
+
+	r.store(cut, &recursorCut{servers: servers, expires: time.Now().Add(time.Duration(ttl) * time.Second)})
+
+	return servers, nil
+}
+
+// appendServer appends the address of the A or AAAA record rr to servers.
+func (r *Recursor) appendServer(servers []netip.AddrPort, rr dnssecRR) []netip.AddrPort {
+	switch {
+	case rr.typ == TypeA && len(rr.rdata) == 4:
+		return append(servers, netip.AddrPortFrom(netip.AddrFrom4([4]byte(rr.rdata)), 53))
+	case rr.typ == TypeAAAA && len(rr.rdata) == 16 && r.IPv6:
+		return append(servers, netip.AddrPortFrom(netip.AddrFrom16([16]byte(rr.rdata)), 53))
+	}
+	return servers
+}
+
+// closest returns the closest cached zone cut enclosing the wire name and its name servers.
+func (r *Recursor) closest(name []byte, now time.Time) ([]byte, []netip.AddrPort) {
+	r.cutsMu.Lock()
+	defer r.cutsMu.Unlock()
+
+	for ; len(name) > 1; name = name[name[0]+1:] {
+		if cut := r.cuts[b2s(name)]; cut != nil && now.Before(cut.expires) {
+			return name, cut.servers
+		}
+	}
+	return name, r.hints
+}
+
+// store caches the delegation of the wire name.
+func (r *Recursor) store(name []byte, cut *recursorCut) {
+	r.cutsMu.Lock()
+	defer r.cutsMu.Unlock()
+
+	if len(r.cuts) >= r.MaxCacheEntries {
+		for k := range r.cuts {
+			if len(r.cuts) < r.MaxCacheEntries {
+				break
+			}
+			delete(r.cuts, k)
+		}
+	}
+	r.cuts[string(name)] = cut
+}
+
+// referral returns the zone cut of a referral from the servers of zone for
+// qname, which must be below zone and enclose qname.
+func referral(zone, qname []byte, answers, authority []dnssecRR, rcode Rcode, aa byte) (cut []byte) {
+	if rcode != RcodeNoError || aa != 0 || len(answers) != 0 {
+		return nil
+	}
+	for _, rr := range authority {
+		if rr.typ == TypeNS && len(rr.name) > len(cut) && len(rr.name) > len(zone) &&
+			isSubdomain(qname, rr.name) && isSubdomain(rr.name, zone) {
+			cut = rr.name
+		}
+	}
+	return cut
+}
+
+// lame reports whether a response of the servers of zone neither answers nor
+// denies qname nor refers to a child zone.
+func lame(zone, qname []byte, rrs []dnssecRR, counts [3]int, rcode Rcode, aa byte) bool {
+	if rcode == RcodeNXDomain || aa != 0 || counts[0] != 0 {
+		return false
+	}
+	authority := rrs[counts[0] : counts[0]+counts[1]]
+	for _, rr := range authority {
+		if rr.typ == TypeSOA && isSubdomain(rr.name, zone) {
+			return false
+		}
+	}
+	return referral(zone, qname, nil, authority, rcode, aa) == nil
+}
+
+// inBailiwick returns the records of rrs owned by zone or its descendants.
+func inBailiwick(rrs []dnssecRR, zone []byte) []dnssecRR {
+	out := rrs[:0:0]
+	for _, rr := range rrs {
+		if isSubdomain(rr.name, zone) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
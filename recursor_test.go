@@ -0,0 +1,249 @@
+package fastdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockAuthorityHandler is an authoritative server of the recursor tests. It refers
+// the children in delegations with the glue addresses, answers the A records
+// of hosts and the CNAME records of cnames, and adds an out-of-zone record to
+// the answers if spoof is set.
+type mockAuthorityHandler struct {
+	delegations map[string][]string
+	glue        map[string]string
+	hosts       map[string]string
+	cnames      map[string]string
+	spoof       bool
+
+	mu      sync.Mutex
+	queries []string
+}
+
+// seen returns a copy of the queried names.
+func (h *mockAuthorityHandler) seen() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.queries)
+}
+
+// ServeDNS answers the queries of the zones.
+func (h *mockAuthorityHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	domain := strings.ToLower(string(req.Domain))
+	h.mu.Lock()
+	h.queries = append(h.queries, domain)
+	h.mu.Unlock()
+
+	var answers, authority, additional []dnssecRR
+	rr := func(name string, typ Type, rdata []byte) dnssecRR {
+		return dnssecRR{name: EncodeDomain(nil, name), typ: typ, class: ClassINET, ttl: 300, rdata: rdata}
+	}
+	a := func(name, addr string) dnssecRR {
+		b := netip.MustParseAddr(addr).As4()
+		return rr(name, TypeA, b[:])
+	}
+
+	rcode, aa := RcodeNoError, true
+	switch {
+	case h.cnames[domain] != "":
+		answers = append(answers, rr(domain, TypeCNAME, EncodeDomain(nil, h.cnames[domain])))
+	case h.hosts[domain] != "":
+		if req.Question.Type == TypeA {
+			answers = append(answers, a(domain, h.hosts[domain]))
+			if h.spoof {
+				answers = append(answers, a("www.other.net", "6.6.6.6"))
+			}
+		}
+	default:
+		for child, nss := range h.delegations {
+			if domain == child || strings.HasSuffix(domain, "."+child) {
+				aa = false
+				for _, ns := range nss {
+					authority = append(authority, rr(child, TypeNS, EncodeDomain(nil, ns)))
+					if addr := h.glue[ns]; addr != "" {
+						additional = append(additional, a(ns, addr))
+					}
+				}
+			}
+		}
+		if aa {
+			rcode = RcodeNXDomain
+			for name := range h.hosts {
+				if strings.HasSuffix(name, "."+domain) {
+					rcode = RcodeNoError
+				}
+			}
+		}
+	}
+
+	flags := 0b1000000000000000 | Flags(rcode)
+	if aa {
+		flags |= 0b0000010000000000
+	}
+	resp := append(req.Raw[:0:0], req.Raw[0], req.Raw[1], byte(flags>>8), byte(flags),
+		0, 1, 0, byte(len(answers)), 0, byte(len(authority)), 0, byte(len(additional)))
+	resp = append(resp, req.Question.Name...)
+	resp = append(resp, byte(req.Question.Type>>8), byte(req.Question.Type), 0, byte(ClassINET))
+	for _, rrs := range [][]dnssecRR{answers, authority, additional} {
+		for i := range rrs {
+			resp = appendRR(resp, &rrs[i])
+		}
+	}
+	_, _ = rw.Write(resp)
+}
+
+// mockMapDialer dials the local servers standing in for the addresses of port 53.
+type mockMapDialer struct {
+	addrs map[string]string
+}
+
+// DialContext dials the local server of addr.
+func (d *mockMapDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	local, ok := d.addrs[addr]
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("unreachable " + addr)}
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, local)
+}
+
+// Put closes the connection.
+func (d *mockMapDialer) Put(conn net.Conn) {
+	_ = conn.Close()
+}
+
+// TestRecursor resolves names through a hierarchy of local root, TLD and authoritative servers.
+func TestRecursor(t *testing.T) {
+	root := &mockAuthorityHandler{
+		delegations: map[string][]string{"org": {"ns.nic.org"}},
+		glue:        map[string]string{"ns.nic.org": "192.0.2.2"},
+	}
+	tld := &mockAuthorityHandler{
+		delegations: map[string][]string{
+			"example.org":  {"ns1.example.org"},
+			"glueless.org": {"ns2.example.org"},
+			"loop.org":     {"ns.loop.org"},
+		},
+		glue:  map[string]string{"ns1.example.org": "192.0.2.3"},
+		hosts: map[string]string{"ns.evil.org": "192.0.2.4"},
+	}
+	auth := &mockAuthorityHandler{
+		// the glue of ns.evil.org is outside of the bailiwick of example.org.
+		delegations: map[string][]string{"sub.example.org": {"ns.evil.org"}},
+		glue:        map[string]string{"ns.evil.org": "6.6.6.6"},
+		hosts: map[string]string{
+			"www.example.org":  "192.0.2.10",
+			"ns2.example.org":  "192.0.2.3",
+			"www.glueless.org": "192.0.2.11",
+		},
+		cnames: map[string]string{"alias.example.org": "www.glueless.org"},
+		spoof:  true,
+	}
+	sub := &mockAuthorityHandler{
+		hosts: map[string]string{"www.sub.example.org": "192.0.2.12"},
+	}
+
+	dialer := &mockMapDialer{addrs: map[string]string{
+		"192.0.2.1:53": serveTestHandler(t, root),
+		"192.0.2.2:53": serveTestHandler(t, tld),
+		"192.0.2.3:53": serveTestHandler(t, auth),
+		"192.0.2.4:53": serveTestHandler(t, sub),
+	}}
+
+	recursor := &Recursor{
+		Client:    &Client{Timeout: time.Second, Dialer: dialer},
+		RootHints: []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:53")},
+	}
+
+	cases := []struct {
+		name  string
+		rcode Rcode
+		addrs []string
+	}{
+		{"www.example.org", RcodeNoError, []string{"192.0.2.10"}},
+		{"alias.example.org", RcodeNoError, []string{"192.0.2.11"}},
+		{"www.sub.example.org", RcodeNoError, []string{"192.0.2.12"}},
+		{"nothing.example.org", RcodeNXDomain, nil},
+		{"a.b.nothing.example.org", RcodeNXDomain, nil},
+	}
+
+	for _, c := range cases {
+		req, resp := AcquireMessage(), AcquireMessage()
+		req.SetRequestQuestion(c.name, TypeA, ClassINET)
+
+		if err := recursor.Exchange(context.Background(), req, resp); err != nil {
+			t.Errorf("Recursor resolve %s error: %+v", c.name, err)
+		} else {
+			var addrs []string
+			for records := resp.Records(); records.Next(); {
+				if r := records.Item(); r.Type == TypeA {
+					addrs = append(addrs, netip.AddrFrom4([4]byte(r.Data)).String())
+				}
+			}
+			if rcode := resp.Header.Flags.Rcode(); rcode != c.rcode || !slices.Equal(addrs, c.addrs) {
+				t.Errorf("Recursor resolve %s got rcode=%d addrs=%v want rcode=%d addrs=%v", c.name, rcode, addrs, c.rcode, c.addrs)
+			}
+		}
+
+		ReleaseMessage(resp)
+		ReleaseMessage(req)
+	}
+
+	// QNAME minimization
+	for _, q := range root.seen() {
+		if q != "org" {
+			t.Errorf("root server shall only see the minimized name org, got %s", q)
+		}
+	}
+	if queries := tld.seen(); slices.Contains(queries, "www.example.org") {
+		t.Errorf("TLD server shall not see the full name, got %v", queries)
+	}
+
+	// a dialer of a fixed server
+	fixed := &Recursor{
+		Client:    &Client{Dialer: &UDPDialer{Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}},
+		RootHints: recursor.RootHints,
+	}
+	req, resp := AcquireMessage(), AcquireMessage()
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+	if err := fixed.Exchange(context.Background(), req, resp); !errors.Is(err, ErrFixedDialer) {
+		t.Errorf("Recursor with a fixed dialer shall fail with ErrFixedDialer, got %+v", err)
+	}
+	ReleaseMessage(resp)
+	ReleaseMessage(req)
+
+	// a delegation to a name server below itself without glue
+	req, resp = AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(resp)
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion("www.loop.org", TypeA, ClassINET)
+	if err := recursor.Exchange(context.Background(), req, resp); !errors.Is(err, ErrLameDelegation) {
+		t.Errorf("Recursor resolve www.loop.org shall fail with lame delegation, got %+v", err)
+	}
+
+	// work limit
+	limited := &Recursor{
+		Client:     recursor.Client,
+		RootHints:  recursor.RootHints,
+		MaxQueries: 2,
+	}
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+	if err := limited.Exchange(context.Background(), req, resp); !errors.Is(err, ErrRecursionLimit) {
+		t.Errorf("Recursor with MaxQueries=2 shall fail with recursion limit, got %+v", err)
+	}
+
+	// as a Handler
+	client := &Client{Addr: serveTestHandler(t, recursor), Timeout: time.Second}
+	ips, err := client.LookupNetIP(context.Background(), "ip4", "www.sub.example.org")
+	if err != nil || len(ips) != 1 || ips[0] != netip.MustParseAddr("192.0.2.12") {
+		t.Errorf("Recursor handler lookup got ips=%v error=%+v", ips, err)
+	}
+}
@@ -34,6 +34,33 @@ type Server struct {
 	// The maximum number of concurrent clients the server may serve.
 	Concurrency int
 
+	// NSID specifies the name server identifier answered to the queries with
+	// an NSID option, see RFC 5001. If empty, the NSID option is ignored.
+	NSID string
+
+	// Cookie specifies an optional ServerCookie answering the DNS Cookies of queries.
+	Cookie *ServerCookie
+
+	// RateLimit specifies an optional ResponseRateLimit of the responses, the
+	// limited responses are counted if Stats implements RateLimitStats.
+	RateLimit *ResponseRateLimit
+
+	// Access specifies an optional AccessControl of the queries, the denied
+	// queries are counted if Stats implements AccessStats.
+	Access *AccessControl
+
+	// Overload specifies an optional LoadShedding of the queries which find all
+	// workers busy, they are dropped if not set. The shed queries are counted if
+	// Stats implements OverloadStats.
+	Overload *LoadShedding
+
+	// Dnstap specifies an optional Dnstap logging the queries and responses.
+	Dnstap *Dnstap
+
+	// Supervision specifies an optional Supervision of the workers.
+	// If not set, use the defaults of Supervision.
+	Supervision *Supervision
+
 	// Index indicates the index of Server instances.
 	index int
 }
@@ -55,7 +82,7 @@ func (s *Server) ListenAndServe(addr string) error {
 
 	// s.ErrorLog.Printf("server-%d pid-%d serving dns on %s", s.Index(), os.Getpid(), conn.LocalAddr())
 
-	return serve(conn, s.Handler, s.Stats, s.ErrorLog, s.Concurrency)
+	return serve(conn, withDnstap(withNSID(withCookie(withRateLimit(s.Handler, s.RateLimit, s.Stats), s.Cookie), s.NSID), s.Dnstap), s.Stats, s.ErrorLog, s.Concurrency, s.Access, s.Overload, s.RateLimit)
 }
 
 // Serve serves DNS requests from the given UDP addr.
@@ -63,7 +90,7 @@ func (s *Server) Serve(conn *net.UDPConn) error {
 	if s.MaxProcs > 1 {
 		return errors.New("Server.MaxProcs cannot large than 1 when using Serve")
 	}
-	return serve(conn, s.Handler, s.Stats, s.ErrorLog, s.Concurrency)
+	return serve(conn, withDnstap(withNSID(withCookie(withRateLimit(s.Handler, s.RateLimit, s.Stats), s.Cookie), s.NSID), s.Dnstap), s.Stats, s.ErrorLog, s.Concurrency, s.Access, s.Overload, s.RateLimit)
 }
 
 // Index indicates the index of Server instances.
@@ -72,11 +99,12 @@ func (s *Server) Index() (index int) {
 	return
 }
 
-// spawn starts worker processes and restarts them when they exit.
+// spawn starts worker processes and restarts them with backoff when they exit.
 func (s *Server) spawn(addr string, maxProcs int) (err error) {
 	type racer struct {
-		index int
-		err   error
+		index   int
+		started time.Time
+		err     error
 	}
 
 	if maxProcs == 0 {
@@ -86,53 +114,68 @@ func (s *Server) spawn(addr string, maxProcs int) (err error) {
 		maxProcs = 1
 	}
 
+	sv := s.Supervision.supervisor()
 	ch := make(chan racer, maxProcs)
-
-	// create multiple receive worker for performance
-	for i := 1; i <= maxProcs; i++ {
-		go func(index int) {
+	restartCh := make(chan int, maxProcs)
+	// done stops the pending restarts once the supervisor returns.
+	done := make(chan struct{})
+	defer close(done)
+
+	start := func(index int) {
+		sv.event(WorkerEvent{Type: WorkerStart, Index: index})
+		go func(started time.Time) {
 			server := &Server{
 				Handler:     s.Handler,
 				Stats:       s.Stats,
 				ErrorLog:    s.ErrorLog,
 				MaxProcs:    s.MaxProcs,
 				Concurrency: s.Concurrency,
+				NSID:        s.NSID,
+				Cookie:      s.Cookie,
+				RateLimit:   s.RateLimit,
+				Access:      s.Access,
+				Overload:    s.Overload,
+				Dnstap:      s.Dnstap,
 				index:       index,
 			}
 			err := server.ListenAndServe(addr)
-			ch <- racer{index, err}
-		}(i)
+			ch <- racer{index, started, err}
+		}(time.Now())
 	}
 
-	var exited int
-	for sig := range ch {
-		if s.ErrorLog != nil {
-			s.ErrorLog.Error("server one of the child workers exited", "error", sig.err)
-		}
+	// create multiple receive worker for performance
+	for i := 1; i <= maxProcs; i++ {
+		start(i)
+	}
 
-		if exited++; exited > 200 {
-			if s.ErrorLog != nil {
-				s.ErrorLog.Error("server child workers exit too many times", "count", exited)
+	for {
+		select {
+		case index := <-restartCh:
+			start(index)
+		case sig := <-ch:
+			delay, ok := sv.crashed(sig.index, sig.started, time.Now())
+			if !ok {
+				if s.ErrorLog != nil {
+					s.ErrorLog.Error("server child workers exit too many times", "count", len(sv.crashes), "window", sv.CrashWindow)
+				}
+				sv.event(WorkerEvent{Type: WorkerGiveUp, Index: sig.index, Err: sig.err})
+				err = errors.New("server child workers exit too many times")
+				return
 			}
-			err = errors.New("server child workers exit too many times")
-			break
-		}
 
-		go func(index int) {
-			server := &Server{
-				Handler:     s.Handler,
-				Stats:       s.Stats,
-				ErrorLog:    s.ErrorLog,
-				MaxProcs:    s.MaxProcs,
-				Concurrency: s.Concurrency,
-				index:       index,
+			if s.ErrorLog != nil {
+				s.ErrorLog.Error("server one of the child workers exited", "error", sig.err, "index", sig.index, "backoff", delay)
 			}
-			err := server.ListenAndServe(addr)
-			ch <- racer{index, err}
-		}(sig.index)
+			sv.event(WorkerEvent{Type: WorkerExit, Index: sig.index, Err: sig.err, Backoff: delay})
+
+			time.AfterFunc(delay, func() {
+				select {
+				case restartCh <- sig.index:
+				case <-done:
+				}
+			})
+		}
 	}
-
-	return
 }
 
 type udpCtx struct {
@@ -140,6 +183,7 @@ type udpCtx struct {
 	req     *Message
 	handler Handler
 	stats   Stats
+	access  *AccessControl
 }
 
 var udpCtxPool = &sync.Pool{
@@ -154,7 +198,7 @@ var udpCtxPool = &sync.Pool{
 }
 
 // serve reads UDP packets and dispatches them to the worker pool.
-func serve(conn *net.UDPConn, handler Handler, stats Stats, logger *slog.Logger, concurrency int) error {
+func serve(conn *net.UDPConn, handler Handler, stats Stats, logger *slog.Logger, concurrency int, access *AccessControl, shedding *LoadShedding, limit *ResponseRateLimit) error {
 	if concurrency == 0 {
 		concurrency = 256 * 1024
 	}
@@ -168,6 +212,23 @@ func serve(conn *net.UDPConn, handler Handler, stats Stats, logger *slog.Logger,
 	}
 	pool.Start()
 
+	shedder := &shedder{shedding: shedding, access: access}
+	shedder.stats, _ = stats.(OverloadStats)
+	shedder.accessStats, _ = stats.(AccessStats)
+	if shedding != nil {
+		shedder.answer = withRateLimit(&shedHandler{shedding: shedding}, limit, stats)
+	}
+	if shedding != nil && shedding.reserve(concurrency) > 0 {
+		shedder.pool = &workerPool{
+			WorkerFunc:            serveCtx,
+			MaxWorkersCount:       shedding.reserve(concurrency),
+			LogAllErrors:          false,
+			MaxIdleWorkerDuration: 2 * time.Minute,
+			Logger:                logger,
+		}
+		shedder.pool.Start()
+	}
+
 	for {
 		ctx := udpCtxPool.Get().(*udpCtx)
 
@@ -183,14 +244,18 @@ func serve(conn *net.UDPConn, handler Handler, stats Stats, logger *slog.Logger,
 		ctx.req.Raw = ctx.req.Raw[:n]
 		ctx.rw.Conn = conn
 		ctx.rw.AddrPort = addrPort
+		ctx.rw.Response = ResponseInfo{}
 
 		ctx.handler = handler
 		ctx.stats = stats
+		ctx.access = access
 
 		ok := pool.Serve(ctx)
 
-		if !ok {
-			udpCtxPool.Put(ctx)
+		if !ok && shedder.shed(ctx) != OverloadPriority && logger != nil {
+			if count, warn := shedder.warn(time.Now()); warn {
+				logger.Warn("server workers are busy, shedding queries", "count", count, "concurrency", concurrency, "local_addr", conn.LocalAddr())
+			}
 		}
 	}
 }
@@ -204,15 +269,33 @@ func serveCtx(ctx *udpCtx) error {
 
 	rw, req := ctx.rw, ctx.req
 
+	action := AccessAllow
+	if ctx.access != nil {
+		var exceeded bool
+		action, exceeded = ctx.access.check(rw.AddrPort.Addr())
+		if s, ok := ctx.stats.(AccessStats); ok && action != AccessAllow {
+			s.UpdateAccessStats(rw.AddrPort, action, exceeded)
+		}
+		if action == AccessDrop {
+			udpCtxPool.Put(ctx)
+			return nil
+		}
+	}
+
 	err := ParseMessage(req, req.Raw, false)
-	if err != nil {
+	switch {
+	case err != nil:
 		req.SetResponseHeader(RcodeFormErr, 0)
 		_, _ = rw.Write(req.Raw)
-	} else {
+	case action == AccessRefuse:
+		Error(rw, req, RcodeRefused)
+	default:
 		ctx.handler.ServeDNS(rw, req)
 	}
 
-	if ctx.stats != nil {
+	if s, ok := ctx.stats.(ResponseStats); ok {
+		s.UpdateResponseStats(rw.RemoteAddr(), req, rw.Response, time.Since(start))
+	} else if ctx.stats != nil {
 		ctx.stats.UpdateStats(rw.RemoteAddr(), req, time.Since(start))
 	}
 
@@ -226,3 +309,158 @@ func Error(rw ResponseWriter, req *Message, rcode Rcode) {
 	req.SetResponseHeader(rcode, 0)
 	_, _ = rw.Write(req.Raw)
 }
+
+// withNSID returns a handler answering the NSID option of queries with nsid.
+func withNSID(handler Handler, nsid string) Handler {
+	if nsid == "" {
+		return handler
+	}
+	return &nsidHandler{handler: handler, nsid: []byte(nsid)}
+}
+
+type nsidHandler struct {
+	handler Handler
+	nsid    []byte
+}
+
+// ServeDNS serves req with a ResponseWriter adding the NSID option if req asks for it.
+func (h *nsidHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	if _, ok := lookupOption(req, OptionCodeNSID); !ok {
+		h.handler.ServeDNS(rw, req)
+		return
+	}
+	h.handler.ServeDNS(&nsidResponseWriter{ResponseWriter: rw, nsid: h.nsid}, req)
+}
+
+type nsidResponseWriter struct {
+	ResponseWriter
+	nsid []byte
+	buf  []byte
+}
+
+// Write adds the NSID option to the response then writes it.
+func (rw *nsidResponseWriter) Write(p []byte) (int, error) {
+	var err error
+	rw.buf, err = appendResponseOption(rw.buf[:0], p, OptionCodeNSID, rw.nsid)
+	if err != nil {
+		return rw.ResponseWriter.Write(p)
+	}
+	if _, err = rw.ResponseWriter.Write(rw.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// lookupOption returns the first option of code in the OPT record of msg.
+func lookupOption(msg *Message, code OptionCode) (MessageOption, bool) {
+	if msg.Header.ARCount == 0 {
+		return MessageOption{}, false
+	}
+	records := msg.Records()
+	for records.Next() {
+		record := records.Item()
+		if record.Type != TypeOPT {
+			continue
+		}
+		options, err := record.AsOptions()
+		if err != nil {
+			break
+		}
+		for options.Next() {
+			if option := options.Item(); option.Code == code {
+				return option, true
+			}
+		}
+	}
+	return MessageOption{}, false
+}
+
+// questionEnd returns the offset following the question section of the message p.
+func questionEnd(p []byte) (int, error) {
+	if len(p) < 12 {
+		return 0, ErrInvalidHeader
+	}
+	var buf [256]byte
+	var err error
+	offset := 12
+	for i := int(p[4])<<8 | int(p[5]); i > 0; i-- {
+		if _, offset, err = appendName(buf[:0], p, offset, false); err != nil {
+			return 0, err
+		}
+		if offset += 4; offset > len(p) {
+			return 0, ErrInvalidQuestion
+		}
+	}
+	return offset, nil
+}
+
+// appendQuestion appends the header and question of the message p to dst, with
+// the counts of the other sections cleared.
+func appendQuestion(dst, p []byte) ([]byte, error) {
+	offset, err := questionEnd(p)
+	if err != nil {
+		return dst, err
+	}
+	start := len(dst)
+	dst = append(dst, p[:offset]...)
+	// ANCOUNT, NSCOUNT and ARCOUNT
+	clear(dst[start+6 : start+12])
+	return dst, nil
+}
+
+// appendResponseOption appends the response p to dst with the option appended to
+// its OPT record, which is added if p has none.
+func appendResponseOption(dst, p []byte, code OptionCode, data []byte) ([]byte, error) {
+	offset, err := questionEnd(p)
+	if err != nil {
+		return dst, err
+	}
+
+	var buf [256]byte
+	opt := -1
+	count := (int(p[6])<<8 | int(p[7])) + (int(p[8])<<8 | int(p[9])) + (int(p[10])<<8 | int(p[11]))
+	for i := 0; i < count; i++ {
+		if _, offset, err = appendName(buf[:0], p, offset, false); err != nil {
+			return dst, err
+		}
+		if offset+10 > len(p) {
+			return dst, ErrInvalidAnswer
+		}
+		if Type(p[offset])<<8|Type(p[offset+1]) == TypeOPT {
+			opt = offset + 8
+		}
+		offset += 10 + (int(p[offset+8])<<8 | int(p[offset+9]))
+	}
+	if offset != len(p) || (opt >= 0 && opt+2+(int(p[opt])<<8|int(p[opt+1])) != len(p)) {
+		// the OPT record shall be the last record to be extended in place.
+		return dst, ErrInvalidAnswer
+	}
+
+	start := len(dst)
+	dst = append(dst, p...)
+	if opt < 0 {
+		arcount := int(p[10])<<8 | int(p[11]) + 1
+		dst[start+10], dst[start+11] = byte(arcount>>8), byte(arcount)
+		dst = appendOPT(dst, 0)
+		opt = len(p) + 9
+	}
+	length := int(dst[start+opt])<<8 | int(dst[start+opt+1]) + 4 + len(data)
+	dst[start+opt], dst[start+opt+1] = byte(length>>8), byte(length)
+	dst = append(dst, byte(code>>8), byte(code), byte(len(data)>>8), byte(len(data)))
+	dst = append(dst, data...)
+
+	return dst, nil
+}
+
+// appendOPT appends an OPT record without options and with the upper 8 bits of rcode.
+func appendOPT(dst []byte, rcode Rcode) []byte {
+	return append(dst,
+		0x00,       // Name
+		0x00, 0x29, // OPT
+		byte(MaxUDPSize>>8), byte(MaxUDPSize), // UDP payload size: MaxUDPSize
+		byte(rcode>>4), // Extended RCODE
+		0x00,           // EDNS0 version
+		0x00, 0x00,     // Z flags
+		0x00, 0x00, // Data Length: 0
+	)
+}
@@ -0,0 +1,186 @@
+package fastdns
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessAction is the action taken on a query by AccessControl.
+type AccessAction byte
+
+const (
+	AccessAllow  AccessAction = 0 // the query is served
+	AccessRefuse AccessAction = 1 // the query is answered with REFUSED
+	AccessDrop   AccessAction = 2 // the query is dropped silently
+)
+
+// String returns the canonical text form of the AccessAction value.
+func (a AccessAction) String() string {
+	switch a {
+	case AccessAllow:
+		return "allow"
+	case AccessRefuse:
+		return "refuse"
+	case AccessDrop:
+		return "drop"
+	}
+	return ""
+}
+
+// AccessRule is a rule of AccessControl for the queries from a source prefix.
+type AccessRule struct {
+	// Prefix specifies the source prefix of the queries.
+	Prefix netip.Prefix
+
+	// Action specifies the action on the queries.
+	Action AccessAction
+
+	// QPS limits the allowed queries per second from the whole Prefix.
+	// If not set, the queries are not limited.
+	QPS int
+
+	// Burst specifies the queries allowed at once before QPS applies.
+	// If not set, use QPS as default.
+	Burst int
+}
+
+// AccessControl filters the queries by their source address before they are
+// served, the rule of the longest prefix matching the source applies.
+type AccessControl struct {
+	// Rules specifies the initial rules, use Reload to replace them at runtime.
+	Rules []AccessRule
+
+	// Default specifies the action on the queries which match no rule.
+	// If not set, use AccessAllow as default.
+	Default AccessAction
+
+	// Exceeded specifies the action on the queries exceeding the QPS of their rule.
+	// If not set, use AccessDrop as default.
+	Exceeded AccessAction
+
+	once  sync.Once
+	table atomic.Pointer[accessTable]
+}
+
+// accessTable is the compiled rules, which are indexed by the masked prefix
+// per prefix length.
+type accessTable struct {
+	ipv4, ipv6 []accessLevel
+}
+
+// accessLevel holds the rules of a prefix length.
+type accessLevel struct {
+	bits  int
+	rules map[netip.Prefix]*accessEntry
+}
+
+type accessEntry struct {
+	action AccessAction
+	// interval and tolerance of the generic cell rate algorithm in nanoseconds.
+	interval  int64
+	tolerance int64
+	// tat is the theoretical arrival time of the next query in unix nanoseconds.
+	tat atomic.Int64
+}
+
+// init compiles Rules.
+func (a *AccessControl) init() {
+	if a.Exceeded == AccessAllow {
+		a.Exceeded = AccessDrop
+	}
+	if a.table.Load() == nil {
+		a.table.Store(compileAccessRules(a.Rules))
+	}
+}
+
+// Reload replaces the rules atomically, the queries being checked see either
+// the previous or the new rules, and the QPS of the new rules start afresh.
+func (a *AccessControl) Reload(rules []AccessRule) {
+	a.once.Do(a.init)
+	a.table.Store(compileAccessRules(rules))
+}
+
+// compileAccessRules indexes the rules by prefix length, the longest first.
+func compileAccessRules(rules []AccessRule) *accessTable {
+	table := new(accessTable)
+	for _, rule := range rules {
+		if !rule.Prefix.IsValid() {
+			continue
+		}
+		prefix := rule.Prefix.Masked()
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), max(prefix.Bits()-96, 0)).Masked()
+		}
+
+		levels := &table.ipv6
+		if prefix.Addr().Is4() {
+			levels = &table.ipv4
+		}
+		i := slices.IndexFunc(*levels, func(level accessLevel) bool { return level.bits == prefix.Bits() })
+		if i < 0 {
+			*levels = append(*levels, accessLevel{bits: prefix.Bits(), rules: make(map[netip.Prefix]*accessEntry)})
+			i = len(*levels) - 1
+		}
+
+		entry := &accessEntry{action: rule.Action}
+		if rule.QPS > 0 {
+			burst := rule.Burst
+			if burst <= 0 {
+				burst = rule.QPS
+			}
+			entry.interval = int64(time.Second) / int64(rule.QPS)
+			entry.tolerance = entry.interval * int64(burst-1)
+		}
+		(*levels)[i].rules[prefix] = entry
+	}
+	for _, levels := range [][]accessLevel{table.ipv4, table.ipv6} {
+		slices.SortFunc(levels, func(a, b accessLevel) int { return b.bits - a.bits })
+	}
+	return table
+}
+
+// check returns the action on a query from addr, and whether it is taken
+// because of exceeding the QPS.
+func (a *AccessControl) check(addr netip.Addr) (AccessAction, bool) {
+	a.once.Do(a.init)
+
+	table := a.table.Load()
+	levels := table.ipv6
+	if addr = addr.Unmap(); addr.Is4() {
+		levels = table.ipv4
+	}
+
+	for i := range levels {
+		prefix, _ := addr.Prefix(levels[i].bits)
+		entry, ok := levels[i].rules[prefix]
+		if !ok {
+			continue
+		}
+		if entry.action != AccessAllow || entry.interval == 0 {
+			return entry.action, false
+		}
+		if !entry.allow(time.Now().UnixNano()) {
+			return a.Exceeded, true
+		}
+		return AccessAllow, false
+	}
+
+	return a.Default, false
+}
+
+// allow reports whether a query at now conforms to the rate of the entry.
+func (e *accessEntry) allow(now int64) bool {
+	for {
+		old := e.tat.Load()
+		tat := max(old, now)
+		if tat-now > e.tolerance {
+			return false
+		}
+		if e.tat.CompareAndSwap(old, tat+e.interval) {
+			return true
+		}
+	}
+}
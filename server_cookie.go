@@ -0,0 +1,282 @@
+package fastdns
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"math/bits"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServerCookie generates and validates the server cookies of DNS Cookies, see
+// RFC 7873, with the interoperable SipHash-2-4 construction of RFC 9018.
+type ServerCookie struct {
+	// Secret specifies the SipHash-2-4 key of the server cookies, it shall be
+	// shared by the servers of an anycast set or of a ForkServer.
+	// If not set, use a random key as default.
+	Secret [16]byte
+
+	// Overlap specifies how long the server cookies of the previous secret stay
+	// valid after Rotate.
+	// If not set, use 1 hour as default.
+	Overlap time.Duration
+
+	// RequireSize requires a valid server cookie for the responses larger than
+	// RequireSize bytes, which are replaced by a BADCOOKIE response to the queries
+	// with a client cookie, or a truncated response to the others.
+	// If not set, responses of any size are answered.
+	RequireSize int
+
+	once    sync.Once
+	mu      sync.Mutex
+	secrets atomic.Pointer[cookieSecrets]
+}
+
+// cookieSecrets are the current secret and the previous one valid until expires.
+type cookieSecrets struct {
+	current  [16]byte
+	previous [16]byte
+	expires  int64
+}
+
+// init fills the defaults.
+func (c *ServerCookie) init() {
+	if c.Overlap == 0 {
+		c.Overlap = time.Hour
+	}
+	secret := c.Secret
+	if secret == ([16]byte{}) {
+		_, _ = rand.Read(secret[:])
+	}
+	c.secrets.Store(&cookieSecrets{current: secret})
+}
+
+// Rotate replaces the secret of the server cookies, the server cookies of the
+// previous secret are accepted for Overlap.
+func (c *ServerCookie) Rotate(secret [16]byte) {
+	c.once.Do(c.init)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.secrets.Store(&cookieSecrets{
+		current:  secret,
+		previous: c.secrets.Load().current,
+		expires:  time.Now().Add(c.Overlap).Unix(),
+	})
+}
+
+// appendCookie appends the client cookie with a server cookie for the addr to
+// dst, which is the server cookie of the option if it is still fresh. It reports
+// whether the server cookie of the option is valid.
+func (c *ServerCookie) appendCookie(dst, option []byte, addr netip.Addr, now time.Time) ([]byte, bool) {
+	c.once.Do(c.init)
+
+	secrets := c.secrets.Load()
+	timestamp := uint32(now.Unix())
+	client, server := option[:8], option[8:]
+
+	// RFC 9018 section 4.3, the server cookie is valid for 1 hour, tolerates 5
+	// minutes of clock skew, and is regenerated after half an hour.
+	valid, fresh := false, false
+	if len(server) == 16 && server[0] == 1 {
+		ts := uint32(server[4])<<24 | uint32(server[5])<<16 | uint32(server[6])<<8 | uint32(server[7])
+		if age := int32(timestamp - ts); age >= -300 && age <= 3600 {
+			var buf [24]byte
+			switch {
+			case subtle.ConstantTimeCompare(appendServerCookie(buf[:0], &secrets.current, client, addr, ts), server) == 1:
+				valid, fresh = true, age <= 1800
+			case now.Unix() < secrets.expires:
+				valid = subtle.ConstantTimeCompare(appendServerCookie(buf[:0], &secrets.previous, client, addr, ts), server) == 1
+			}
+		}
+	}
+
+	dst = append(dst, client...)
+	if fresh {
+		return append(dst, server...), valid
+	}
+	return appendServerCookie(dst, &secrets.current, client, addr, timestamp), valid
+}
+
+// appendServerCookie appends the server cookie of RFC 9018 section 4.2 to dst.
+func appendServerCookie(dst []byte, secret *[16]byte, client []byte, addr netip.Addr, timestamp uint32) []byte {
+	// Version, Reserved and Timestamp
+	header := [8]byte{1, 0, 0, 0, byte(timestamp >> 24), byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp)}
+
+	var buf [8 + 8 + 16]byte
+	b := append(append(buf[:0], client...), header[:]...)
+	if addr = addr.Unmap(); addr.Is4() {
+		ip := addr.As4()
+		b = append(b, ip[:]...)
+	} else {
+		ip := addr.As16()
+		b = append(b, ip[:]...)
+	}
+
+	hash := siphash24(secret, b)
+	return append(append(dst, header[:]...),
+		byte(hash), byte(hash>>8), byte(hash>>16), byte(hash>>24),
+		byte(hash>>32), byte(hash>>40), byte(hash>>48), byte(hash>>56),
+	)
+}
+
+// siphash24 returns the SipHash-2-4 of p with the key.
+func siphash24(key *[16]byte, p []byte) uint64 {
+	k0 := uint64(key[0]) | uint64(key[1])<<8 | uint64(key[2])<<16 | uint64(key[3])<<24 |
+		uint64(key[4])<<32 | uint64(key[5])<<40 | uint64(key[6])<<48 | uint64(key[7])<<56
+	k1 := uint64(key[8]) | uint64(key[9])<<8 | uint64(key[10])<<16 | uint64(key[11])<<24 |
+		uint64(key[12])<<32 | uint64(key[13])<<40 | uint64(key[14])<<48 | uint64(key[15])<<56
+
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	m := uint64(len(p)) << 56
+	for ; len(p) >= 8; p = p[8:] {
+		w := uint64(p[0]) | uint64(p[1])<<8 | uint64(p[2])<<16 | uint64(p[3])<<24 |
+			uint64(p[4])<<32 | uint64(p[5])<<40 | uint64(p[6])<<48 | uint64(p[7])<<56
+		v3 ^= w
+		round()
+		round()
+		v0 ^= w
+	}
+	for i, b := range p {
+		m |= uint64(b) << (8 * i)
+	}
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// withCookie returns a handler answering the DNS Cookies of queries with cookie.
+func withCookie(handler Handler, cookie *ServerCookie) Handler {
+	if cookie == nil {
+		return handler
+	}
+	return &cookieHandler{handler: handler, cookie: cookie}
+}
+
+type cookieHandler struct {
+	handler Handler
+	cookie  *ServerCookie
+}
+
+var cookieResponseWriterPool = sync.Pool{
+	New: func() interface{} {
+		return &cookieResponseWriter{
+			cookie: make([]byte, 0, 40),
+			buf:    make([]byte, 0, MaxUDPSize),
+		}
+	},
+}
+
+// ServeDNS serves req with a ResponseWriter adding the server cookie to the
+// response, and enforcing RequireSize.
+func (h *cookieHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	option, ok := lookupOption(req, OptionCodeCOOKIE)
+	if !ok && h.cookie.RequireSize == 0 {
+		h.handler.ServeDNS(rw, req)
+		return
+	}
+	if n := len(option.Data); ok && (n < 8 || (n > 8 && n < 16) || n > 40) {
+		// RFC 7873 section 5.2.2, a malformed COOKIE option
+		Error(rw, req, RcodeFormErr)
+		return
+	}
+
+	w := cookieResponseWriterPool.Get().(*cookieResponseWriter)
+	w.ResponseWriter = rw
+	w.limit = h.cookie.RequireSize
+	w.cookie, w.valid = w.cookie[:0], false
+	if ok {
+		w.cookie, w.valid = h.cookie.appendCookie(w.cookie, option.Data, rw.RemoteAddr().Addr(), time.Now())
+	}
+
+	h.handler.ServeDNS(w, req)
+
+	w.ResponseWriter = nil
+	cookieResponseWriterPool.Put(w)
+}
+
+type cookieResponseWriter struct {
+	ResponseWriter
+	cookie []byte
+	valid  bool
+	limit  int
+	buf    []byte
+}
+
+// Write adds the cookie to the response then writes it, or writes a BADCOOKIE
+// or truncated response instead of a large response without a valid server cookie.
+func (rw *cookieResponseWriter) Write(p []byte) (int, error) {
+	var err error
+	switch {
+	case !rw.valid && rw.limit > 0 && len(p) > rw.limit:
+		rw.buf, err = appendCookieError(rw.buf[:0], p, rw.cookie)
+	case len(rw.cookie) != 0:
+		rw.buf, err = appendResponseOption(rw.buf[:0], p, OptionCodeCOOKIE, rw.cookie)
+	default:
+		return rw.ResponseWriter.Write(p)
+	}
+	if err != nil {
+		return rw.ResponseWriter.Write(p)
+	}
+	if _, err = rw.ResponseWriter.Write(rw.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// appendCookieError appends the header and question of the response p to dst,
+// as a BADCOOKIE response with the cookie if it is set, otherwise as a truncated
+// response.
+func appendCookieError(dst, p, cookie []byte) ([]byte, error) {
+	start := len(dst)
+	dst, err := appendQuestion(dst, p)
+	if err != nil {
+		return dst, err
+	}
+
+	if len(cookie) == 0 {
+		// TC
+		dst[start+2] |= 0b00000010
+		return dst, nil
+	}
+
+	// RCODE
+	dst[start+3] = dst[start+3]&0b11110000 | byte(RcodeBADCOOKIE&0b1111)
+	// ARCOUNT
+	dst[start+11] = 1
+	dst = appendOPT(dst, RcodeBADCOOKIE)
+	dst[len(dst)-2], dst[len(dst)-1] = 0, byte(4+len(cookie))
+	dst = append(dst, 0x00, byte(OptionCodeCOOKIE), 0x00, byte(len(cookie)))
+	dst = append(dst, cookie...)
+
+	return dst, nil
+}
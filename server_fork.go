@@ -3,13 +3,23 @@ package fastdns
 import (
 	"errors"
 	"log/slog"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // ForkServer implements a prefork DNS server.
+//
+// The parent process creates the listening sockets, or takes them from systemd
+// socket activation, and passes them to the child processes. On Linux, SIGHUP
+// restarts the child processes one by one onto the current binary, and SIGUSR2
+// re-executes the parent process which takes over the sockets.
 type ForkServer struct {
 	// handler to invoke
 	Handler Handler
@@ -31,6 +41,40 @@ type ForkServer struct {
 
 	// The maximum number of concurrent clients the server may serve.
 	Concurrency int
+
+	// NSID specifies the name server identifier answered to the queries with
+	// an NSID option, see RFC 5001. If empty, the NSID option is ignored.
+	NSID string
+
+	// Cookie specifies an optional ServerCookie answering the DNS Cookies of queries.
+	Cookie *ServerCookie
+
+	// RateLimit specifies an optional ResponseRateLimit of the responses, the
+	// limited responses are counted if Stats implements RateLimitStats.
+	RateLimit *ResponseRateLimit
+
+	// Access specifies an optional AccessControl of the queries, the denied
+	// queries are counted if Stats implements AccessStats.
+	Access *AccessControl
+
+	// Overload specifies an optional LoadShedding of the queries which find all
+	// workers busy, they are dropped if not set. The shed queries are counted if
+	// Stats implements OverloadStats.
+	Overload *LoadShedding
+
+	// Dnstap specifies an optional Dnstap logging the queries and responses.
+	Dnstap *Dnstap
+
+	// Supervision specifies an optional Supervision of the child processes.
+	// If not set, use the defaults of Supervision.
+	Supervision *Supervision
+
+	// StatsInterval specifies how often the child processes publish the metrics
+	// of Stats to the parent process, see AppendOpenMetrics.
+	// If not set, use 1 second as default.
+	StatsInterval time.Duration
+
+	stats forkStats
 }
 
 // ListenAndServe serves DNS requests from the given UDP addr.
@@ -49,8 +93,14 @@ func (s *ForkServer) ListenAndServe(addr string) error {
 		}
 	}
 
-	// so_reuseport listen for performance
-	conn, err := listen("udp", addr)
+	// the socket created by the master process, or so_reuseport listen for performance
+	var conn *net.UDPConn
+	var err error
+	if fd, _ := strconv.Atoi(os.Getenv("FASTDNS_CHILD_LISTEN_FD")); fd > 0 {
+		conn, err = fileConn(os.NewFile(uintptr(fd), "socket"))
+	} else {
+		conn, err = listen("udp", addr)
+	}
 	if err != nil {
 		if s.ErrorLog != nil {
 			s.ErrorLog.Error("forkserver set listen on addr failed", "error", err, "index", s.Index(), "addr", addr)
@@ -60,7 +110,33 @@ func (s *ForkServer) ListenAndServe(addr string) error {
 
 	// s.ErrorLog.Printf("forkserver-%d pid-%d serving dns on %s", s.Index(), os.Getpid(), conn.LocalAddr())
 
-	return serve(conn, s.Handler, s.Stats, s.ErrorLog, s.Concurrency)
+	sv := s.Supervision.supervisor()
+	if fd, _ := strconv.Atoi(os.Getenv("FASTDNS_CHILD_PING_FD")); fd > 0 {
+		go s.watchParent(os.NewFile(uintptr(fd), "ping"), sv.PingInterval, sv.PingTimeout)
+	}
+
+	if fd, _ := strconv.Atoi(os.Getenv("FASTDNS_CHILD_STATS_FD")); fd > 0 {
+		// the metrics are the pings of the child process.
+		interval := s.StatsInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		interval = min(interval, sv.PingInterval)
+		go func(w *os.File) {
+			// the parent process is gone if the write fails.
+			_ = publishStats(w, s.Stats, interval)
+			_ = w.Close()
+		}(os.NewFile(uintptr(fd), "stats"))
+	}
+
+	return serve(conn, withDnstap(withNSID(withCookie(withRateLimit(s.Handler, s.RateLimit, s.Stats), s.Cookie), s.NSID), s.Dnstap), s.Stats, s.ErrorLog, s.Concurrency, s.Access, s.Overload, s.RateLimit)
+}
+
+// AppendOpenMetrics appends the metrics published by the child processes to dst
+// in the parent process, the samples summed over the children are followed by
+// the samples of each child labeled with child, and the restarts of the children.
+func (s *ForkServer) AppendOpenMetrics(dst []byte) []byte {
+	return s.stats.AppendOpenMetrics(dst)
 }
 
 // Index indicates the index of Server instances.
@@ -69,17 +145,96 @@ func (s *ForkServer) Index() (index int) {
 	return
 }
 
-// fork launches a child process with the provided worker index.
-func fork(index int) (*exec.Cmd, error) {
+// forkProc is a child process of a ForkServer.
+type forkProc struct {
+	cmd       *exec.Cmd
+	index     int
+	started   time.Time
+	seen      atomic.Int64 // the unix nanoseconds of the last metrics
+	ping      *os.File
+	unhealthy bool
+}
+
+// fork launches a child process with the provided worker index, which serves
+// the socket and publishes its metrics to stats, ready is called once the
+// child process is serving.
+func fork(index int, socket *os.File, stats *forkStats, ready func(pid int)) (*forkProc, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	defer pr.Close()
+
 	/* #nosec G204 */
 	cmd := exec.Command(os.Args[0], os.Args[1:]...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Env = append([]string{"FASTDNS_CHILD_INDEX=" + strconv.Itoa(index)}, os.Environ()...)
-	return cmd, cmd.Start()
+	cmd.ExtraFiles = []*os.File{w, socket, pr}
+	cmd.Env = forkEnv(os.Environ(),
+		"FASTDNS_CHILD_INDEX="+strconv.Itoa(index),
+		"FASTDNS_CHILD_STATS_FD=3",
+		"FASTDNS_CHILD_LISTEN_FD=4",
+		"FASTDNS_CHILD_PING_FD=5",
+	)
+	if err = cmd.Start(); err != nil {
+		_ = r.Close()
+		_ = pw.Close()
+		return nil, err
+	}
+
+	p := &forkProc{cmd: cmd, index: index, started: time.Now(), ping: pw}
+	pid := cmd.Process.Pid
+	stats.started(index, pid)
+	go func() {
+		_ = stats.read(pid, r, func() {
+			if p.seen.Swap(time.Now().UnixNano()) == 0 {
+				ready(pid)
+			}
+		})
+		_ = r.Close()
+	}()
+
+	return p, nil
+}
+
+// watchParent exits the child process once the pings of the parent process
+// from r stop for timeout, or r is closed by the exit of the parent process.
+func (s *ForkServer) watchParent(r *os.File, interval, timeout time.Duration) {
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	go func() {
+		b := make([]byte, 64)
+		for {
+			if _, err := r.Read(b); err != nil {
+				if s.ErrorLog != nil {
+					s.ErrorLog.Error("forkserver parent process is gone, exiting", "error", err, "index", s.Index())
+				}
+				os.Exit(1)
+			}
+			last.Store(time.Now().UnixNano())
+		}
+	}()
+
+	for range time.Tick(interval) {
+		if d := time.Duration(time.Now().UnixNano() - last.Load()); d > timeout {
+			if s.ErrorLog != nil {
+				s.ErrorLog.Error("forkserver parent process missed the pings, exiting", "index", s.Index(), "duration", d)
+			}
+			os.Exit(1)
+		}
+	}
 }
 
-// fork supervises child processes and restarts them as needed.
+// fork supervises child processes and restarts them with backoff, it rolls the
+// child processes onto a new binary one by one on SIGHUP, and re-executes the
+// master process on SIGUSR2 then stops its child processes.
 func (s *ForkServer) fork(addr string, maxProcs int) (err error) {
 	type racer struct {
 		index int
@@ -94,55 +249,255 @@ func (s *ForkServer) fork(addr string, maxProcs int) (err error) {
 		maxProcs = 1
 	}
 
+	sockets, err := forkSockets(addr, maxProcs)
+	if err != nil {
+		if s.ErrorLog != nil {
+			s.ErrorLog.Error("forkserver set listen on addr failed", "error", err, "addr", addr)
+		}
+		return
+	}
+	defer closeFiles(sockets)
+
+	sv := s.Supervision.supervisor()
 	ch := make(chan racer, maxProcs)
-	childs := make(map[int]*exec.Cmd)
+	restartCh := make(chan racer, 2*maxProcs) // the delayed restarts of the crashed child processes
+	done := make(chan struct{})               // stops the pending restarts once the master returns
+	defer close(done)
+	readyCh := make(chan int, 2*maxProcs)
+	procs := make(map[int]*forkProc)
+	pids := make(map[int]int)     // the serving child process of an index
+	retired := make(map[int]bool) // the child processes being stopped by a roll
+	ready := func(pid int) {
+		select {
+		case readyCh <- pid:
+		default:
+		}
+	}
 
 	defer func() {
-		for _, proc := range childs {
-			_ = proc.Process.Kill()
+		for _, p := range procs {
+			_ = p.cmd.Process.Kill()
+			_ = p.ping.Close()
 		}
 	}()
 
+	start := func(index int) (int, error) {
+		p, err := fork(index, sockets[(index-1)%len(sockets)], &s.stats, ready)
+		if err != nil {
+			return 0, err
+		}
+		pid := p.cmd.Process.Pid
+		procs[pid] = p
+		sv.event(WorkerEvent{Type: WorkerStart, Index: index, Pid: pid})
+		go func() {
+			ch <- racer{index, pid, p.cmd.Wait()}
+		}()
+		return pid, nil
+	}
+
 	for i := 1; i <= maxProcs; i++ {
-		var cmd *exec.Cmd
-		if cmd, err = fork(i); err != nil {
+		var pid int
+		if pid, err = start(i); err != nil {
 			if s.ErrorLog != nil {
 				s.ErrorLog.Error("forkserver failed to start a child process", "error", err)
 			}
 			return
 		}
+		pids[i] = pid
+	}
 
-		childs[cmd.Process.Pid] = cmd
-		go func(index int) {
-			ch <- racer{index, cmd.Process.Pid, cmd.Wait()}
-		}(i)
+	sigs := make(chan os.Signal, 1)
+	reload, reexec := forkSignals()
+	if reload != nil {
+		signal.Notify(sigs, reload, reexec)
+		defer signal.Stop(sigs)
 	}
 
-	var exited int
-	for sig := range ch {
-		delete(childs, sig.pid)
+	ticker := time.NewTicker(sv.PingInterval)
+	defer ticker.Stop()
 
-		if s.ErrorLog != nil {
-			s.ErrorLog.Error("forkserver one of the child processes exited", "error", err)
-		}
+	// the master process started by a previous master is ready once all child
+	// processes are serving.
+	var masterReady *os.File
+	if fd, _ := strconv.Atoi(os.Getenv("FASTDNS_MASTER_READY_FD")); fd > 0 {
+		masterReady = os.NewFile(uintptr(fd), "ready")
+		defer masterReady.Close()
+	}
+	serving := 0
 
-		if exited++; exited > 200 {
+	// rolling holds the indexes to roll, the roll of rolling[0] is in progress
+	// from rollingPid to its replacement rollingNewPid.
+	var rolling []int
+	var rollingPid, rollingNewPid int
+	roll := func() {
+		if len(rolling) == 0 {
+			rollingPid, rollingNewPid = 0, 0
 			if s.ErrorLog != nil {
-				s.ErrorLog.Error("forkserver child workers exit too many times", "count", exited)
+				s.ErrorLog.Info("forkserver rolled the child processes")
 			}
-			err = errors.New("forkserver child workers exit too many times")
-			break
+			return
 		}
-
-		var cmd *exec.Cmd
-		if cmd, err = fork(sig.index); err != nil {
-			break
+		index := rolling[0]
+		pid, err := start(index)
+		if err != nil {
+			if s.ErrorLog != nil {
+				s.ErrorLog.Error("forkserver failed to start a child process", "error", err, "index", index)
+			}
+			rolling, rollingPid, rollingNewPid = nil, 0, 0
+			return
 		}
-		childs[cmd.Process.Pid] = cmd
-		go func(index int) {
-			ch <- racer{index, cmd.Process.Pid, cmd.Wait()}
-		}(sig.index)
+		rollingPid, rollingNewPid = pids[index], pid
 	}
 
-	return
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			for pid, p := range procs {
+				_, _ = p.ping.Write([]byte{1})
+				seen := p.started
+				if ns := p.seen.Load(); ns != 0 {
+					seen = time.Unix(0, ns)
+				}
+				if d := now.Sub(seen); !p.unhealthy && d > sv.PingTimeout {
+					p.unhealthy = true
+					if s.ErrorLog != nil {
+						s.ErrorLog.Error("forkserver child process missed the pings, killing", "index", p.index, "pid", pid, "duration", d)
+					}
+					sv.event(WorkerEvent{Type: WorkerUnhealthy, Index: p.index, Pid: pid})
+					_ = p.cmd.Process.Kill()
+				}
+			}
+			continue
+		case pid := <-readyCh:
+			if masterReady != nil && serving < maxProcs {
+				if serving++; serving == maxProcs {
+					_, _ = masterReady.Write([]byte{1})
+					_ = masterReady.Close()
+					masterReady = nil
+				}
+			}
+			if pid != rollingNewPid || rollingPid == 0 {
+				continue
+			}
+			// the replacement is serving, stop the previous child process.
+			index := rolling[0]
+			pids[index] = pid
+			if p := procs[rollingPid]; p != nil {
+				retired[rollingPid] = true
+				_ = p.cmd.Process.Signal(syscall.SIGTERM)
+			} else {
+				rolling = rolling[1:]
+				roll()
+			}
+			continue
+		case sig := <-sigs:
+			switch sig {
+			case reload:
+				if len(rolling) > 0 {
+					continue
+				}
+				if s.ErrorLog != nil {
+					s.ErrorLog.Info("forkserver rolling the child processes", "signal", sig)
+				}
+				for i := 1; i <= maxProcs; i++ {
+					rolling = append(rolling, i)
+				}
+				roll()
+			case reexec:
+				if s.ErrorLog != nil {
+					s.ErrorLog.Info("forkserver re-executing the master process", "signal", sig)
+				}
+				if err := forkMaster(sockets); err != nil {
+					if s.ErrorLog != nil {
+						s.ErrorLog.Error("forkserver failed to re-execute the master process", "error", err)
+					}
+					continue
+				}
+				// the new master process serves the sockets with its child processes,
+				// stop the child processes gracefully, the deferred cleanup kills the
+				// ones which outlive PingTimeout.
+				for pid, p := range procs {
+					retired[pid] = true
+					_ = p.cmd.Process.Signal(syscall.SIGTERM)
+				}
+				timeout := time.After(sv.PingTimeout)
+				for len(procs) > 0 {
+					select {
+					case sig := <-ch:
+						if p := procs[sig.pid]; p != nil {
+							delete(procs, sig.pid)
+							_ = p.ping.Close()
+						}
+						sv.event(WorkerEvent{Type: WorkerRetire, Index: sig.index, Pid: sig.pid, Err: sig.err})
+					case <-timeout:
+						return nil
+					}
+				}
+				return nil
+			}
+			continue
+		case r := <-restartCh:
+			// the index may be served by a roll during the backoff.
+			if r.pid != pids[r.index] && r.pid != rollingNewPid {
+				continue
+			}
+			var pid int
+			if pid, err = start(r.index); err != nil {
+				if s.ErrorLog != nil {
+					s.ErrorLog.Error("forkserver failed to start a child process", "error", err, "index", r.index)
+				}
+				return
+			}
+			switch r.pid {
+			case pids[r.index]:
+				pids[r.index] = pid
+			case rollingNewPid:
+				rollingNewPid = pid
+			}
+		case sig := <-ch:
+			p := procs[sig.pid]
+			delete(procs, sig.pid)
+			_ = p.ping.Close()
+
+			if retired[sig.pid] {
+				delete(retired, sig.pid)
+				sv.event(WorkerEvent{Type: WorkerRetire, Index: sig.index, Pid: sig.pid, Err: sig.err})
+				if sig.pid == rollingPid {
+					rolling = rolling[1:]
+					roll()
+				}
+				continue
+			}
+			s.stats.exited(sig.index, sig.pid)
+
+			e := exitEvent(sig.index, sig.pid, p.cmd.ProcessState, sig.err)
+			delay, ok := sv.crashed(sig.index, p.started, time.Now())
+			if !ok {
+				if s.ErrorLog != nil {
+					s.ErrorLog.Error("forkserver child workers exit too many times", "count", len(sv.crashes), "window", sv.CrashWindow)
+				}
+				sv.event(WorkerEvent{Type: WorkerGiveUp, Index: sig.index, Pid: sig.pid, Err: e.Err})
+				err = errors.New("forkserver child workers exit too many times")
+				return
+			}
+			e.Backoff = delay
+
+			if s.ErrorLog != nil {
+				s.ErrorLog.Error("forkserver one of the child processes exited", "error", e.Err, "index", e.Index, "pid", e.Pid, "exit_code", e.ExitCode, "signal", e.Signal, "backoff", e.Backoff)
+			}
+			sv.event(e)
+
+			// the replacement of a rolled child process is on the way.
+			if sig.pid == rollingPid {
+				continue
+			}
+			time.AfterFunc(delay, func() {
+				select {
+				case restartCh <- sig:
+				case <-done:
+				}
+			})
+		}
+	}
 }
@@ -0,0 +1,167 @@
+package fastdns
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// forkMasterTimeout limits the wait of a master process for its re-executed
+// successor to serve.
+const forkMasterTimeout = 30 * time.Second
+
+// forkSockets returns n listening sockets on addr for the child processes. The
+// sockets are inherited from a previous master process, or passed by systemd
+// socket activation, or bound with so_reuseport.
+func forkSockets(addr string, n int) ([]*os.File, error) {
+	if env := os.Getenv("FASTDNS_LISTEN_FDS"); env != "" {
+		var fds []int
+		for _, s := range strings.Split(env, ",") {
+			fd, err := strconv.Atoi(s)
+			if err != nil || fd < 3 {
+				return nil, errors.New("forkserver invalid FASTDNS_LISTEN_FDS: " + env)
+			}
+			fds = append(fds, fd)
+		}
+		var sockets []*os.File
+		for _, fd := range fds {
+			socket, err := socketFile(os.NewFile(uintptr(fd), "socket"))
+			if err != nil {
+				closeFiles(sockets)
+				return nil, err
+			}
+			sockets = append(sockets, socket)
+		}
+		return sockets, nil
+	}
+
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		// systemd passes the sockets from fd 3, the non udp sockets are skipped.
+		n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		var sockets []*os.File
+		for fd := 3; fd < 3+n; fd++ {
+			if socket, err := socketFile(os.NewFile(uintptr(fd), "socket")); err == nil {
+				sockets = append(sockets, socket)
+			}
+		}
+		if len(sockets) == 0 {
+			return nil, errors.New("forkserver no udp sockets in LISTEN_FDS")
+		}
+		return sockets, nil
+	}
+
+	sockets := make([]*os.File, 0, n)
+	for range n {
+		conn, err := listen("udp", addr)
+		if err != nil {
+			closeFiles(sockets)
+			return nil, err
+		}
+		// the other sockets share the port picked for the first one.
+		if len(sockets) == 0 {
+			addr = conn.LocalAddr().String()
+		}
+		socket, err := conn.File()
+		_ = conn.Close()
+		if err != nil {
+			closeFiles(sockets)
+			return nil, err
+		}
+		sockets = append(sockets, socket)
+	}
+	return sockets, nil
+}
+
+// socketFile returns a close-on-exec duplicate of the udp socket f, f is closed.
+func socketFile(f *os.File) (*os.File, error) {
+	conn, err := fileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.File()
+}
+
+// fileConn returns the udp connection of the socket f, f is closed.
+func fileConn(f *os.File) (*net.UDPConn, error) {
+	defer f.Close()
+
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := conn.(*net.UDPConn); ok {
+		return c, nil
+	}
+	_ = conn.Close()
+	return nil, errors.New("forkserver socket is not udp: " + f.Name())
+}
+
+// closeFiles closes the files.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
+
+// forkEnv returns environ with vars prepended, the variables passing the
+// sockets and pipes of the current process are removed.
+func forkEnv(environ []string, vars ...string) []string {
+	env := make([]string, 0, len(vars)+len(environ))
+	env = append(env, vars...)
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, "FASTDNS_") ||
+			strings.HasPrefix(kv, "LISTEN_PID=") ||
+			strings.HasPrefix(kv, "LISTEN_FDS=") ||
+			strings.HasPrefix(kv, "LISTEN_FDNAMES=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// forkMaster re-executes the master process with the sockets, and waits for the
+// new master process to serve them with its child processes.
+func forkMaster(sockets []*os.File) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	fds := make([]string, len(sockets))
+	for i := range sockets {
+		fds[i] = strconv.Itoa(4 + i)
+	}
+
+	/* #nosec G204 */
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append([]*os.File{w}, sockets...)
+	cmd.Env = forkEnv(os.Environ(),
+		"FASTDNS_MASTER_READY_FD=3",
+		"FASTDNS_LISTEN_FDS="+strings.Join(fds, ","),
+	)
+	err = cmd.Start()
+	_ = w.Close()
+	if err != nil {
+		return err
+	}
+
+	_ = r.SetReadDeadline(time.Now().Add(forkMasterTimeout))
+	var b [1]byte
+	if _, err = r.Read(b[:]); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return errors.New("forkserver new master process is not ready: " + err.Error())
+	}
+
+	return cmd.Process.Release()
+}
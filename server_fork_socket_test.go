@@ -0,0 +1,117 @@
+//go:build linux
+
+package fastdns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestForkServerSockets(t *testing.T) {
+	t.Setenv("FASTDNS_LISTEN_FDS", "")
+	t.Setenv("LISTEN_PID", "")
+
+	n := 2
+	sockets, err := forkSockets("127.0.0.1:0", n)
+	if err != nil {
+		t.Fatalf("forkSockets() error: %+v", err)
+	}
+	defer closeFiles(sockets)
+	if len(sockets) != n {
+		t.Fatalf("forkSockets() returns %d sockets, want %d", len(sockets), n)
+	}
+
+	var addrs []string
+	for _, socket := range sockets {
+		conn, err := fileConn(socket)
+		if err != nil {
+			t.Fatalf("fileConn() error: %+v", err)
+		}
+		addrs = append(addrs, conn.LocalAddr().String())
+		_ = conn.Close()
+	}
+	if addrs[0] != addrs[len(addrs)-1] {
+		t.Errorf("forkSockets() sockets listen on %v, want the same address", addrs)
+	}
+
+	// the sockets inherited from a previous master process.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenUDP() error: %+v", err)
+	}
+	defer conn.Close()
+	file, err := conn.File()
+	if err != nil {
+		t.Fatalf("conn.File() error: %+v", err)
+	}
+	// forkSockets takes the ownership of the inherited fd.
+	fd, err := syscall.Dup(int(file.Fd()))
+	_ = file.Close()
+	if err != nil {
+		t.Fatalf("syscall.Dup() error: %+v", err)
+	}
+	t.Setenv("FASTDNS_LISTEN_FDS", strconv.Itoa(fd))
+
+	sockets, err = forkSockets("", n)
+	if err != nil {
+		t.Fatalf("forkSockets() error: %+v", err)
+	}
+	if len(sockets) != 1 {
+		t.Fatalf("forkSockets() returns %d sockets, want 1", len(sockets))
+	}
+	inherited, err := fileConn(sockets[0])
+	if err != nil {
+		t.Fatalf("fileConn() error: %+v", err)
+	}
+	defer inherited.Close()
+	if got, want := inherited.LocalAddr().String(), conn.LocalAddr().String(); got != want {
+		t.Errorf("inherited socket listens on %s, want %s", got, want)
+	}
+
+	t.Setenv("FASTDNS_LISTEN_FDS", strconv.Itoa(fd)+",x")
+	if _, err = forkSockets("", n); err == nil {
+		t.Errorf("forkSockets() with invalid FASTDNS_LISTEN_FDS returns no error")
+	}
+}
+
+func TestForkEnv(t *testing.T) {
+	env := forkEnv([]string{
+		"HOME=/root",
+		"FASTDNS_CHILD_INDEX=1",
+		"FASTDNS_LISTEN_FDS=4,5",
+		"LISTEN_PID=1",
+		"LISTEN_FDS=2",
+		"LISTEN_FDNAMES=dns",
+		"LISTEN_ADDR=:53",
+	}, "FASTDNS_CHILD_INDEX=2")
+
+	want := []string{"FASTDNS_CHILD_INDEX=2", "HOME=/root", "LISTEN_ADDR=:53"}
+	if fmt.Sprint(env) != fmt.Sprint(want) {
+		t.Errorf("forkEnv() = %v, want %v", env, want)
+	}
+}
+
+func TestForkExitEvent(t *testing.T) {
+	cases := []struct {
+		script   string
+		exitCode int
+		signal   os.Signal
+	}{
+		{"exit 3", 3, nil},
+		{"kill -9 $$", -1, syscall.SIGKILL},
+	}
+
+	for _, c := range cases {
+		cmd := exec.Command("sh", "-c", c.script)
+		err := cmd.Run()
+		e := exitEvent(1, 100, cmd.ProcessState, err)
+		if e.Type != WorkerExit || e.ExitCode != c.exitCode || e.Signal != c.signal || e.Err == nil {
+			t.Errorf("exitEvent(%q) = %+v, want exit code %d and signal %v", c.script, e, c.exitCode, c.signal)
+		}
+	}
+}
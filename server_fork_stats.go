@@ -0,0 +1,441 @@
+package fastdns
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// forkStats holds the metrics published by the child processes of a ForkServer.
+type forkStats struct {
+	mu         sync.Mutex
+	children   map[int]*forkChild
+	publishers map[int]*forkPublisher
+	seq        uint64
+}
+
+// forkChild is the index of the child processes, which are replaced by their
+// restarts and rolls.
+type forkChild struct {
+	pid      int
+	running  bool
+	restarts uint64
+	base     []byte // the counters of the exited child processes
+}
+
+// forkPublisher is a child process publishing its metrics.
+type forkPublisher struct {
+	index   int
+	seq     uint64
+	metrics []byte
+}
+
+// maxForkStatsSize limits the size of the metrics published by a child process.
+const maxForkStatsSize = 16 << 20
+
+// child returns the child of index, fs.mu must be held.
+func (fs *forkStats) child(index int) *forkChild {
+	if fs.children == nil {
+		fs.children = make(map[int]*forkChild)
+	}
+	c := fs.children[index]
+	if c == nil {
+		c = new(forkChild)
+		fs.children[index] = c
+	}
+	return c
+}
+
+// started records the child process pid of index.
+func (fs *forkStats) started(index, pid int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	c := fs.child(index)
+	c.pid, c.running = pid, true
+	if fs.publishers == nil {
+		fs.publishers = make(map[int]*forkPublisher)
+	}
+	fs.seq++
+	fs.publishers[pid] = &forkPublisher{index: index, seq: fs.seq}
+}
+
+// exited records the crash of the child process pid of index, which is restarted.
+func (fs *forkStats) exited(index, pid int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	c := fs.child(index)
+	if c.pid == pid {
+		c.running = false
+	}
+	c.restarts++
+}
+
+// publishStats writes the metrics of stats to w every interval until the write
+// fails, the frames without metrics of a nil stats tell the child is alive.
+func publishStats(w io.Writer, stats Stats, interval time.Duration) error {
+	var b []byte
+	for {
+		b = append(b[:0], 0, 0, 0, 0)
+		if stats != nil {
+			b = stats.AppendOpenMetrics(b)
+		}
+		n := len(b) - 4
+		b[0], b[1], b[2], b[3] = byte(n>>24), byte(n>>16), byte(n>>8), byte(n)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		time.Sleep(interval)
+	}
+}
+
+// read reads the metrics published by the child process pid from r until it
+// fails, seen is called on every metrics. The counters of the last metrics are
+// kept as the base of the successors of the child process.
+func (fs *forkStats) read(pid int, r io.Reader, seen func()) error {
+	defer func() {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+
+		if p := fs.publishers[pid]; p != nil {
+			delete(fs.publishers, pid)
+			c := fs.child(p.index)
+			c.base = mergeForkMetrics(nil, [][]byte{c.base, p.metrics}, true)
+		}
+	}()
+
+	var header [4]byte
+	var b []byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		n := int(header[0])<<24 | int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		if n > maxForkStatsSize {
+			return errors.New("forkserver child stats too large")
+		}
+		b = slices.Grow(b[:0], n)[:n]
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+
+		fs.mu.Lock()
+		if p := fs.publishers[pid]; p != nil {
+			p.metrics, b = b, p.metrics
+		}
+		fs.mu.Unlock()
+
+		if seen != nil {
+			seen()
+		}
+	}
+}
+
+// forkSum is the sum of the values of a sample.
+type forkSum struct {
+	sum   uint64
+	fsum  float64
+	float bool
+}
+
+// add adds the text value to the sum.
+func (s *forkSum) add(value []byte) {
+	if n, err := strconv.ParseUint(string(value), 10, 64); err == nil && !s.float {
+		s.sum += n
+	} else if f, err := strconv.ParseFloat(string(value), 64); err == nil {
+		if !s.float {
+			s.fsum, s.float = float64(s.sum), true
+		}
+		s.fsum += f
+	}
+}
+
+// appendValue appends the text value of the sum to dst.
+func (s *forkSum) appendValue(dst []byte) []byte {
+	if s.float {
+		return strconv.AppendFloat(dst, s.fsum, 'g', -1, 64)
+	}
+	return strconv.AppendUint(dst, s.sum, 10)
+}
+
+// mergeForkMetrics appends the metrics of the successive child processes of an
+// index to dst. The samples of the counters, histograms and summaries are summed,
+// the other samples are taken from the last metrics, or dropped if cumulative.
+func mergeForkMetrics(dst []byte, metrics [][]byte, cumulative bool) []byte {
+	type sample struct {
+		forkSum
+		key   []byte
+		value []byte
+		n     int
+	}
+	type family struct {
+		comments   [][]byte
+		cumulative bool
+		samples    []*sample
+	}
+
+	var families []*family
+	byName := make(map[string]*family)
+	byKey := make(map[string]*sample)
+	eof := false
+
+	for _, m := range metrics {
+		f := byName[""]
+		for len(m) > 0 {
+			var line []byte
+			if j := bytes.IndexByte(m, '\n'); j >= 0 {
+				line, m = m[:j], m[j+1:]
+			} else {
+				line, m = m, nil
+			}
+
+			switch {
+			case len(line) == 0:
+				continue
+			case string(line) == "# EOF":
+				eof = true
+				continue
+			case line[0] == '#':
+				fields := bytes.SplitN(line, []byte(" "), 4)
+				if len(fields) < 3 {
+					continue
+				}
+				name := string(fields[2])
+				if f = byName[name]; f == nil {
+					f = &family{}
+					byName[name] = f
+					families = append(families, f)
+				}
+				if !slices.ContainsFunc(f.comments, func(c []byte) bool { return bytes.Equal(c, line) }) {
+					f.comments = append(f.comments, line)
+				}
+				if len(fields) == 4 && string(fields[1]) == "TYPE" {
+					switch string(fields[3]) {
+					case "counter", "histogram", "summary":
+						f.cumulative = true
+					}
+				}
+				continue
+			}
+
+			j := bytes.LastIndexByte(line, ' ')
+			if j < 0 {
+				continue
+			}
+			key, value := line[:j], line[j+1:]
+			if f == nil {
+				f = &family{}
+				byName[""] = f
+				families = append(families, f)
+			}
+			s := byKey[string(key)]
+			if s == nil {
+				s = &sample{key: key}
+				byKey[string(key)] = s
+				f.samples = append(f.samples, s)
+			}
+			if !f.cumulative {
+				s.forkSum, s.n = forkSum{}, 0
+			}
+			s.add(value)
+			s.value, s.n = value, s.n+1
+		}
+	}
+
+	for _, f := range families {
+		if cumulative && !f.cumulative {
+			continue
+		}
+		for _, comment := range f.comments {
+			dst = append(append(dst, comment...), '\n')
+		}
+		for _, s := range f.samples {
+			dst = append(append(dst, s.key...), ' ')
+			if s.n == 1 {
+				dst = append(dst, s.value...)
+			} else {
+				dst = s.appendValue(dst)
+			}
+			dst = append(dst, '\n')
+		}
+	}
+	if eof && !cumulative {
+		dst = append(dst, "# EOF\n"...)
+	}
+	return dst
+}
+
+// forkFamily is a metric family of the merged metrics.
+type forkFamily struct {
+	comments [][]byte
+	series   []*forkSeries
+}
+
+// forkSeries is a series of the merged metrics.
+type forkSeries struct {
+	forkSum
+	name   []byte
+	labels []byte
+	values [][]byte // per child, nil if absent
+}
+
+// AppendOpenMetrics appends the metrics published by the child processes to dst
+// in the parent process. The samples summed over the children are followed by
+// the samples of each child labeled with child, and the restarts of the children.
+// The counters of a child carry on over its restarts and rolls.
+func (fs *forkStats) AppendOpenMetrics(dst []byte) []byte {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	indexes := make([]int, 0, len(fs.children))
+	for index := range fs.children {
+		indexes = append(indexes, index)
+	}
+	slices.Sort(indexes)
+
+	// the child processes of an index overlap during a roll.
+	publishers := make([]*forkPublisher, 0, len(fs.publishers))
+	for _, p := range fs.publishers {
+		publishers = append(publishers, p)
+	}
+	slices.SortFunc(publishers, func(a, b *forkPublisher) int { return cmp.Compare(a.seq, b.seq) })
+
+	var families []*forkFamily
+	byName := make(map[string]*forkFamily)
+	bySeries := make(map[string]*forkSeries)
+	eof := false
+
+	for i, index := range indexes {
+		family := byName[""]
+		sources := [][]byte{fs.children[index].base}
+		for _, p := range publishers {
+			if p.index == index {
+				sources = append(sources, p.metrics)
+			}
+		}
+		metrics := mergeForkMetrics(nil, sources, false)
+		for len(metrics) > 0 {
+			var line []byte
+			if j := bytes.IndexByte(metrics, '\n'); j >= 0 {
+				line, metrics = metrics[:j], metrics[j+1:]
+			} else {
+				line, metrics = metrics, nil
+			}
+
+			switch {
+			case len(line) == 0:
+				continue
+			case string(line) == "# EOF":
+				eof = true
+				continue
+			case line[0] == '#':
+				// "# HELP name ..." or "# TYPE name ..." starts a family.
+				fields := bytes.SplitN(line, []byte(" "), 4)
+				if len(fields) < 3 {
+					continue
+				}
+				name := string(fields[2])
+				if family = byName[name]; family == nil {
+					family = &forkFamily{}
+					byName[name] = family
+					families = append(families, family)
+				}
+				if !slices.ContainsFunc(family.comments, func(c []byte) bool { return bytes.Equal(c, line) }) {
+					family.comments = append(family.comments, line)
+				}
+				continue
+			}
+
+			j := bytes.LastIndexByte(line, ' ')
+			if j < 0 {
+				continue
+			}
+			key, value := line[:j], line[j+1:]
+			if family == nil {
+				family = &forkFamily{}
+				byName[""] = family
+				families = append(families, family)
+			}
+
+			s := bySeries[string(key)]
+			if s == nil {
+				s = &forkSeries{name: key, values: make([][]byte, len(indexes))}
+				if k := bytes.IndexByte(key, '{'); k >= 0 {
+					s.name, s.labels = key[:k], key[k+1:len(key)-1]
+				}
+				bySeries[string(key)] = s
+				family.series = append(family.series, s)
+			}
+			s.values[i] = value
+			s.add(value)
+		}
+	}
+
+	for _, family := range families {
+		for _, comment := range family.comments {
+			dst = append(append(dst, comment...), '\n')
+		}
+		for _, s := range family.series {
+			dst = appendForkSample(dst, s.name, s.labels, "", nil)
+			dst = append(s.appendValue(dst), '\n')
+			for i, value := range s.values {
+				if value != nil {
+					dst = appendForkSample(dst, s.name, s.labels, "child", strconv.AppendInt(nil, int64(indexes[i]), 10))
+					dst = append(append(dst, value...), '\n')
+				}
+			}
+		}
+	}
+
+	dst = append(dst, "# HELP dns_forkserver_child_restarts Counter of the restarts of the child processes.\n"...)
+	dst = append(dst, "# TYPE dns_forkserver_child_restarts counter\n"...)
+	for _, index := range indexes {
+		dst = append(dst, `dns_forkserver_child_restarts_total{child="`...)
+		dst = strconv.AppendInt(dst, int64(index), 10)
+		dst = append(dst, `"} `...)
+		dst = strconv.AppendUint(dst, fs.children[index].restarts, 10)
+		dst = append(dst, '\n')
+	}
+	dst = append(dst, "# HELP dns_forkserver_child_up Whether the child process is running.\n"...)
+	dst = append(dst, "# TYPE dns_forkserver_child_up gauge\n"...)
+	for _, index := range indexes {
+		c := fs.children[index]
+		dst = append(dst, `dns_forkserver_child_up{child="`...)
+		dst = strconv.AppendInt(dst, int64(index), 10)
+		dst = append(dst, `",pid="`...)
+		dst = strconv.AppendInt(dst, int64(c.pid), 10)
+		if c.running {
+			dst = append(dst, "\"} 1\n"...)
+		} else {
+			dst = append(dst, "\"} 0\n"...)
+		}
+	}
+
+	if eof {
+		dst = append(dst, "# EOF\n"...)
+	}
+	return dst
+}
+
+// appendForkSample appends the name and labels of a sample with an optional
+// extra label to dst, followed by a space.
+func appendForkSample(dst, name, labels []byte, label string, value []byte) []byte {
+	dst = append(dst, name...)
+	if len(labels) == 0 && label == "" {
+		return append(dst, ' ')
+	}
+	dst = append(append(dst, '{'), labels...)
+	if label != "" {
+		if len(labels) != 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(append(append(append(dst, label...), '=', '"'), value...), '"')
+	}
+	return append(dst, '}', ' ')
+}
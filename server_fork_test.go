@@ -0,0 +1,327 @@
+//go:build linux
+
+package fastdns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain runs the master and child processes of the ForkServer tests, which
+// re-execute the test binary.
+func TestMain(m *testing.M) {
+	// a child process crashes at start once the file FORKSERVER_TEST_CRASH exists,
+	// unless its pid is listed in the file.
+	if path := os.Getenv("FORKSERVER_TEST_CRASH"); path != "" && os.Getenv("FASTDNS_CHILD_INDEX") != "" {
+		data, err := os.ReadFile(path)
+		if err == nil && !slices.Contains(strings.Fields(string(data)), strconv.Itoa(os.Getpid())) && os.Remove(path) == nil {
+			os.Exit(3)
+		}
+	}
+	if addr := os.Getenv("FORKSERVER_TEST_ADDR"); addr != "" {
+		os.Exit(runForkTestServer(addr))
+	}
+	os.Exit(m.Run())
+}
+
+// runForkTestServer serves addr with a ForkServer of 2 child processes, the
+// master process prints the worker events to stdout.
+func runForkTestServer(addr string) int {
+	s := &ForkServer{
+		Handler:  &mockRetryHandler{},
+		MaxProcs: 2,
+		Supervision: &Supervision{
+			MinBackoff: 200 * time.Millisecond,
+			OnEvent: func(e WorkerEvent) {
+				fmt.Printf("forkserver-event %d %s %d %d %d\n", os.Getpid(), e.Type, e.Index, e.Pid, e.Backoff)
+			},
+		},
+	}
+	if err := s.ListenAndServe(addr); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// forkTestEvent is a worker event printed by a master process.
+type forkTestEvent struct {
+	master  int
+	typ     string
+	index   int
+	pid     int
+	backoff time.Duration
+	time    time.Time
+}
+
+// forkTestMaster is a master process of runForkTestServer.
+type forkTestMaster struct {
+	cmd    *exec.Cmd
+	addr   string
+	events chan forkTestEvent
+}
+
+// startForkTestMaster starts a master process serving a free port.
+func startForkTestMaster(t *testing.T, env ...string) *forkTestMaster {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp error: %+v", err)
+	}
+	addr := conn.LocalAddr().String()
+	_ = conn.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe() error: %+v", err)
+	}
+	defer w.Close()
+
+	m := &forkTestMaster{
+		cmd:    exec.Command(os.Args[0]),
+		addr:   addr,
+		events: make(chan forkTestEvent, 64),
+	}
+	m.cmd.Stdout = w
+	m.cmd.Stderr = os.Stderr
+	m.cmd.Env = forkEnv(os.Environ(), append(env, "FORKSERVER_TEST_ADDR="+addr)...)
+	if err := m.cmd.Start(); err != nil {
+		_ = r.Close()
+		t.Fatalf("start master process error: %+v", err)
+	}
+
+	var masters sync.Map
+	masters.Store(m.cmd.Process.Pid, true)
+	t.Cleanup(func() {
+		// the child processes exit once the pings of their master stop.
+		masters.Range(func(pid, _ any) bool {
+			_ = syscall.Kill(pid.(int), syscall.SIGKILL)
+			return true
+		})
+		_ = m.cmd.Wait()
+		_ = r.Close()
+	})
+
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 6 || fields[0] != "forkserver-event" {
+				continue
+			}
+			e := forkTestEvent{typ: fields[2], time: time.Now()}
+			e.master, _ = strconv.Atoi(fields[1])
+			e.index, _ = strconv.Atoi(fields[3])
+			e.pid, _ = strconv.Atoi(fields[4])
+			backoff, _ := strconv.ParseInt(fields[5], 10, 64)
+			e.backoff = time.Duration(backoff)
+			masters.Store(e.master, true)
+			m.events <- e
+		}
+		close(m.events)
+	}()
+
+	return m
+}
+
+// next returns the next worker event.
+func (m *forkTestMaster) next(t *testing.T) forkTestEvent {
+	t.Helper()
+
+	select {
+	case e, ok := <-m.events:
+		if !ok {
+			t.Fatalf("master process exited")
+		}
+		return e
+	case <-time.After(15 * time.Second):
+		t.Fatalf("no worker event in 15 seconds")
+	}
+	return forkTestEvent{}
+}
+
+// started returns the pids of the child processes by their indexes once all
+// child processes are started and serving.
+func (m *forkTestMaster) started(t *testing.T) map[int]int {
+	t.Helper()
+
+	pids := make(map[int]int)
+	for len(pids) < 2 {
+		if e := m.next(t); e.typ == WorkerStart.String() {
+			pids[e.index] = e.pid
+		}
+	}
+
+	client := &Client{Addr: m.addr, Timeout: 100 * time.Millisecond}
+	for i := 0; ; i++ {
+		_, err := client.LookupNetIP(context.Background(), "ip4", "example.org")
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("master process is not serving: %+v", err)
+		}
+	}
+	return pids
+}
+
+// query queries the master process until stop, and counts the failed queries.
+func (m *forkTestMaster) query(stop chan struct{}) *atomic.Int32 {
+	failures := new(atomic.Int32)
+	client := &Client{
+		Addr:    m.addr,
+		Timeout: 200 * time.Millisecond,
+		Retry:   &RetryPolicy{MaxAttempts: 3},
+	}
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			if _, err := client.LookupNetIP(context.Background(), "ip4", "example.org"); err != nil {
+				failures.Add(1)
+			}
+		}
+	}()
+	return failures
+}
+
+// TestForkServerRoll rolls the child processes one by one on SIGHUP.
+func TestForkServerRoll(t *testing.T) {
+	m := startForkTestMaster(t)
+	pids := m.started(t)
+
+	stop := make(chan struct{})
+	failures := m.query(stop)
+	defer close(stop)
+
+	if err := m.cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("signal SIGHUP error: %+v", err)
+	}
+
+	// every index is replaced once, and retired after its replacement started.
+	var got []string
+	for len(got) < 4 {
+		e := m.next(t)
+		got = append(got, fmt.Sprintf("%s %d", e.typ, e.index))
+		switch e.typ {
+		case WorkerStart.String():
+			if e.pid == pids[e.index] {
+				t.Errorf("child process %d of index %d is started again", e.pid, e.index)
+			}
+		case WorkerRetire.String():
+			if e.pid != pids[e.index] {
+				t.Errorf("retired child process %d of index %d, want %d", e.pid, e.index, pids[e.index])
+			}
+		}
+	}
+	if want := []string{"start 1", "retire 1", "start 2", "retire 2"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("rolling events got %v want %v", got, want)
+	}
+
+	select {
+	case e := <-m.events:
+		t.Errorf("unexpected worker event after the roll: %+v", e)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if n := failures.Load(); n != 0 {
+		t.Errorf("%d queries failed during the roll", n)
+	}
+}
+
+// TestForkServerReexec re-executes the master process on SIGUSR2, which stops
+// its child processes gracefully.
+func TestForkServerReexec(t *testing.T) {
+	m := startForkTestMaster(t)
+	pids := m.started(t)
+	master := m.cmd.Process.Pid
+
+	if err := m.cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatalf("signal SIGUSR2 error: %+v", err)
+	}
+
+	started, retired := 0, 0
+	for started < 2 || retired < 2 {
+		e := m.next(t)
+		switch {
+		case e.master != master && e.typ == WorkerStart.String():
+			started++
+		case e.master == master && e.typ == WorkerRetire.String():
+			if e.pid != pids[e.index] {
+				t.Errorf("retired child process %d of index %d, want %d", e.pid, e.index, pids[e.index])
+			}
+			retired++
+		default:
+			t.Errorf("unexpected worker event: %+v", e)
+		}
+	}
+
+	if err := m.cmd.Wait(); err != nil {
+		t.Errorf("previous master process exit error: %+v", err)
+	}
+	client := &Client{Addr: m.addr, Timeout: time.Second}
+	if _, err := client.LookupNetIP(context.Background(), "ip4", "example.org"); err != nil {
+		t.Errorf("new master process is not serving: %+v", err)
+	}
+}
+
+// TestForkServerRollCrash restarts a child process crashing in the middle of a
+// roll after backoff, and carries on the roll.
+func TestForkServerRollCrash(t *testing.T) {
+	crash := filepath.Join(t.TempDir(), "crash")
+	m := startForkTestMaster(t, "FORKSERVER_TEST_CRASH="+crash)
+	pids := m.started(t)
+
+	// the current child processes may still be starting.
+	if err := os.WriteFile(crash, fmt.Appendf(nil, "%d %d", pids[1], pids[2]), 0644); err != nil {
+		t.Fatalf("os.WriteFile() error: %+v", err)
+	}
+	if err := m.cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("signal SIGHUP error: %+v", err)
+	}
+
+	var events []forkTestEvent
+	var got []string
+	for len(got) < 6 {
+		e := m.next(t)
+		events = append(events, e)
+		got = append(got, fmt.Sprintf("%s %d", e.typ, e.index))
+	}
+	if want := []string{"start 1", "exit 1", "start 1", "retire 1", "start 2", "retire 2"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("rolling events got %v want %v", got, want)
+	}
+
+	crashed, exit, restarted := events[0], events[1], events[2]
+	if exit.pid != crashed.pid || crashed.pid == pids[1] {
+		t.Errorf("exit of child process %d, want the replacement %d", exit.pid, crashed.pid)
+	}
+	if exit.backoff != 200*time.Millisecond {
+		t.Errorf("crashed child process backoff got %s want 200ms", exit.backoff)
+	}
+	if d := restarted.time.Sub(exit.time); d < exit.backoff/2 {
+		t.Errorf("crashed child process restarted after %s, want %s", d, exit.backoff)
+	}
+	if retired := events[3]; retired.pid != pids[1] {
+		t.Errorf("retired child process %d of index 1, want %d", retired.pid, pids[1])
+	}
+
+	client := &Client{Addr: m.addr, Timeout: time.Second}
+	if _, err := client.LookupNetIP(context.Background(), "ip4", "example.org"); err != nil {
+		t.Errorf("master process is not serving after the roll: %+v", err)
+	}
+}
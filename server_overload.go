@@ -0,0 +1,186 @@
+package fastdns
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// LoadShedding answers the queries which find all workers of the server busy,
+// instead of dropping them silently, and serves the priority queries with a
+// reserve of workers.
+type LoadShedding struct {
+	// Rcode specifies the rcode answered to the shed queries, e.g. RcodeRefused.
+	// If not set, use RcodeServFail as default.
+	Rcode Rcode
+
+	// Drop drops the shed queries silently instead of answering them.
+	Drop bool
+
+	// PriorityClients specifies the client prefixes whose queries are priority.
+	PriorityClients []netip.Prefix
+
+	// PriorityZones specifies the zones whose queries are priority.
+	PriorityZones []string
+
+	// Reserve specifies the workers reserved to the priority queries, which are
+	// in addition to the Concurrency of the server.
+	// If not set, use 1/16 of the Concurrency as default.
+	Reserve int
+
+	// LogInterval limits the warnings of the shed queries to ErrorLog to one per LogInterval.
+	// If not set, use 1 second as default.
+	LogInterval time.Duration
+
+	once  sync.Once
+	zones [][]byte
+}
+
+// OverloadAction is the action taken on a query which finds all workers busy.
+type OverloadAction byte
+
+const (
+	OverloadAnswer   OverloadAction = 1 // the query is answered with the shedding rcode
+	OverloadDrop     OverloadAction = 2 // the query is dropped
+	OverloadPriority OverloadAction = 3 // the query is served by the reserved workers
+)
+
+// String returns the canonical text form of the OverloadAction value.
+func (a OverloadAction) String() string {
+	switch a {
+	case OverloadAnswer:
+		return "answer"
+	case OverloadDrop:
+		return "drop"
+	case OverloadPriority:
+		return "priority"
+	}
+	return ""
+}
+
+// init fills the defaults and encodes the zones.
+func (l *LoadShedding) init() {
+	if l.Rcode == RcodeNoError {
+		l.Rcode = RcodeServFail
+	}
+	if l.LogInterval <= 0 {
+		l.LogInterval = time.Second
+	}
+	for _, zone := range l.PriorityZones {
+		l.zones = append(l.zones, encodeZone(zone))
+	}
+}
+
+// reserve returns the reserved workers of a server with concurrency.
+func (l *LoadShedding) reserve(concurrency int) int {
+	if len(l.PriorityClients) == 0 && len(l.PriorityZones) == 0 {
+		return 0
+	}
+	if l.Reserve > 0 {
+		return l.Reserve
+	}
+	return max(concurrency/16, 1)
+}
+
+// priority reports whether the query of req from addr is priority, req is
+// parsed if the zones are checked.
+func (l *LoadShedding) priority(addr netip.Addr, req *Message) bool {
+	addr = addr.Unmap()
+	for _, prefix := range l.PriorityClients {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	if len(l.zones) == 0 || ParseMessage(req, req.Raw, false) != nil {
+		return false
+	}
+	var buf [256]byte
+	name := append(buf[:0], req.Question.Name...)
+	lowerASCII(name)
+	for _, zone := range l.zones {
+		if isSubdomain(name, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// shedder accounts the queries finding all workers busy on a listener, it
+// is only used by the reader goroutine.
+type shedder struct {
+	shedding    *LoadShedding
+	pool        *workerPool
+	access      *AccessControl
+	answer      Handler
+	stats       OverloadStats
+	accessStats AccessStats
+	last        time.Time
+	count       int
+}
+
+// shed handles ctx which found all workers busy, and returns the action on it.
+// The ctx is returned to the pool unless it is served by the reserved workers.
+// The queries denied by the access control are dropped, and the answers go
+// through the response rate limit.
+func (s *shedder) shed(ctx *udpCtx) OverloadAction {
+	action := OverloadDrop
+	if l := s.shedding; l != nil {
+		l.once.Do(l.init)
+		switch {
+		case s.pool != nil && l.priority(ctx.rw.AddrPort.Addr(), ctx.req) && s.pool.Serve(ctx):
+			action = OverloadPriority
+		case !l.Drop && s.allow(ctx) && ParseMessage(ctx.req, ctx.req.Raw, false) == nil:
+			action = OverloadAnswer
+		}
+	}
+
+	if s.stats != nil {
+		s.stats.UpdateOverloadStats(ctx.rw.AddrPort, action)
+	}
+	if action == OverloadAnswer {
+		s.answer.ServeDNS(ctx.rw, ctx.req)
+	}
+
+	if action != OverloadPriority {
+		s.count++
+		udpCtxPool.Put(ctx)
+	}
+	return action
+}
+
+// allow reports whether the access control allows answering the query of ctx.
+func (s *shedder) allow(ctx *udpCtx) bool {
+	if s.access == nil {
+		return true
+	}
+	action, exceeded := s.access.check(ctx.rw.AddrPort.Addr())
+	if action != AccessAllow && s.accessStats != nil {
+		s.accessStats.UpdateAccessStats(ctx.rw.AddrPort, action, exceeded)
+	}
+	return action == AccessAllow
+}
+
+// shedHandler answers the shed queries with the rcode of shedding.
+type shedHandler struct {
+	shedding *LoadShedding
+}
+
+// ServeDNS answers req with the shedding rcode.
+func (h *shedHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	Error(rw, req, h.shedding.Rcode)
+}
+
+// warn reports whether a warning of the shed queries is due at now, and
+// returns the queries shed since the last warning.
+func (s *shedder) warn(now time.Time) (int, bool) {
+	interval := time.Second
+	if s.shedding != nil {
+		interval = s.shedding.LogInterval
+	}
+	if s.count == 0 || now.Sub(s.last) < interval {
+		return 0, false
+	}
+	count := s.count
+	s.last, s.count = now, 0
+	return count, true
+}
@@ -0,0 +1,301 @@
+package fastdns
+
+import (
+	"hash/maphash"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ResponseRateLimit limits the rate of identical responses to a client network
+// to blunt the reflection attacks, after the Response Rate Limiting of BIND.
+// The responses are identical when they answer the same question with the
+// same rcode, the NXDOMAIN responses and the referrals are identical when they
+// come from the same zone or delegation. The responses to the queries with a
+// valid server cookie of ServerCookie are not limited, their source addresses
+// are not spoofed.
+type ResponseRateLimit struct {
+	// ResponsesPerSecond specifies the rate of identical responses allowed to a client network.
+	// If not set, use 5 as default.
+	ResponsesPerSecond int
+
+	// Window specifies how long the excess responses are accounted, a flood has
+	// to stop for Window before its responses are answered again.
+	// If not set, use 15 seconds as default.
+	Window time.Duration
+
+	// Slip answers every Slip-th limited response with a truncated response which
+	// asks a legitimate client to retry over TCP, the others are dropped. A
+	// negative Slip drops all limited responses.
+	// If not set, use 2 as default.
+	Slip int
+
+	// IPv4PrefixLength specifies the client network of IPv4 clients.
+	// If not set, use 24 as default.
+	IPv4PrefixLength int
+
+	// IPv6PrefixLength specifies the client network of IPv6 clients.
+	// If not set, use 56 as default.
+	IPv6PrefixLength int
+
+	// Exempt specifies the client prefixes which are not limited.
+	Exempt []netip.Prefix
+
+	// MaxEntries limits the number of tracked response flows.
+	// If not set, use 65536 as default.
+	MaxEntries int
+
+	once   sync.Once
+	seed   maphash.Seed
+	shards [rateLimitShardCount]rateLimitShard
+}
+
+const rateLimitShardCount = 64
+
+type rateLimitShard struct {
+	mu      sync.Mutex
+	buckets []rateLimitBucket
+}
+
+// rateLimitBucket is the token bucket of a response flow.
+type rateLimitBucket struct {
+	key    uint64
+	tokens float64
+	last   int64
+	slips  int
+}
+
+// RateLimitAction is the action taken on a limited response.
+type RateLimitAction byte
+
+const (
+	RateLimitDrop RateLimitAction = 1 // the response is dropped
+	RateLimitSlip RateLimitAction = 2 // the response is replaced by a truncated response
+)
+
+// String returns the canonical text form of the RateLimitAction value.
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitSlip:
+		return "slip"
+	}
+	return ""
+}
+
+// init fills the defaults and allocates the buckets.
+func (l *ResponseRateLimit) init() {
+	if l.ResponsesPerSecond == 0 {
+		l.ResponsesPerSecond = 5
+	}
+	if l.Window == 0 {
+		l.Window = 15 * time.Second
+	}
+	if l.Slip == 0 {
+		l.Slip = 2
+	}
+	if l.IPv4PrefixLength == 0 {
+		l.IPv4PrefixLength = 24
+	}
+	if l.IPv6PrefixLength == 0 {
+		l.IPv6PrefixLength = 56
+	}
+	if l.MaxEntries <= 0 {
+		l.MaxEntries = 65536
+	}
+	l.seed = maphash.MakeSeed()
+	for i := range l.shards {
+		l.shards[i].buckets = make([]rateLimitBucket, max(l.MaxEntries/rateLimitShardCount, 1))
+	}
+}
+
+// exempt reports whether addr is in the exempt prefixes.
+func (l *ResponseRateLimit) exempt(addr netip.Addr) bool {
+	for _, prefix := range l.Exempt {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// hash returns the hash of the client network of addr and the response p to req.
+// The NXDOMAIN responses and the referrals are keyed by the owner of the SOA or
+// NS record of their authority sections instead of the question, as BIND does,
+// so that the floods of random names share a flow.
+func (l *ResponseRateLimit) hash(addr netip.Addr, req *Message, p []byte) uint64 {
+	var buf [16 + 264]byte
+	b := buf[:0]
+	if addr = addr.Unmap(); addr.Is4() {
+		prefix, _ := addr.Prefix(l.IPv4PrefixLength)
+		ip := prefix.Addr().As4()
+		b = append(b, ip[:]...)
+	} else {
+		prefix, _ := addr.Prefix(l.IPv6PrefixLength)
+		ip := prefix.Addr().As16()
+		b = append(b, ip[:]...)
+	}
+	if owner, ok := appendAuthorityOwner(b, p); ok {
+		return maphash.Bytes(l.seed, owner)
+	}
+	return maphash.Bytes(l.seed, appendCacheKey(b, req))
+}
+
+// appendAuthorityOwner appends the lowercase owner of the SOA record of the
+// NXDOMAIN response p, or of the NS record of the referral p to dst.
+func appendAuthorityOwner(dst, p []byte) ([]byte, bool) {
+	rcode := Rcode(p[3] & 0b1111)
+	ancount := int(p[6])<<8 | int(p[7])
+	if rcode != RcodeNXDomain && (rcode != RcodeNoError || ancount != 0) {
+		return dst, false
+	}
+	offset, err := questionEnd(p)
+	if err != nil {
+		return dst, false
+	}
+	for i := 0; i < ancount+(int(p[8])<<8|int(p[9])); i++ {
+		start := offset
+		if offset, err = skipName(p, offset); err != nil || offset+10 > len(p) {
+			return dst, false
+		}
+		typ := Type(p[offset])<<8 | Type(p[offset+1])
+		offset += 10 + (int(p[offset+8])<<8 | int(p[offset+9]))
+		if i < ancount {
+			continue
+		}
+		switch {
+		case typ == TypeSOA && rcode == RcodeNoError:
+			// a NODATA response is keyed by its question.
+			return dst, false
+		case typ == TypeSOA || typ == TypeNS && rcode == RcodeNoError:
+			if dst, _, err = appendName(append(dst, 0), p, start, true); err != nil {
+				return dst, false
+			}
+			return append(dst, byte(typ>>8), byte(typ)), true
+		}
+	}
+	return dst, false
+}
+
+// limit accounts a response of the flow hash with rcode at now, and returns the
+// action on it, which is 0 if the response is allowed.
+func (l *ResponseRateLimit) limit(hash uint64, rcode Rcode, now time.Time) RateLimitAction {
+	// mix the rcode into the key, the zero key marks the unused buckets.
+	key := (hash ^ uint64(rcode)*0x9e3779b97f4a7c15) | 1
+
+	shard := &l.shards[key%rateLimitShardCount]
+	rate := float64(l.ResponsesPerSecond)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	b := &shard.buckets[(key/rateLimitShardCount)%uint64(len(shard.buckets))]
+	if b.key != key {
+		// a new flow replaces the colliding one.
+		*b = rateLimitBucket{key: key, tokens: rate, last: now.UnixNano()}
+	}
+
+	// refill the bucket up to the rate, the debt is floored at Window.
+	b.tokens = min(b.tokens+float64(now.UnixNano()-b.last)/float64(time.Second)*rate, rate)
+	b.last = now.UnixNano()
+	b.tokens = max(b.tokens-1, -rate*l.Window.Seconds())
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	if l.Slip > 0 {
+		if b.slips++; b.slips >= l.Slip {
+			b.slips = 0
+			return RateLimitSlip
+		}
+	}
+	return RateLimitDrop
+}
+
+// withRateLimit returns a handler limiting the responses of handler with limit,
+// and counting the limited responses in stats.
+func withRateLimit(handler Handler, limit *ResponseRateLimit, stats Stats) Handler {
+	if limit == nil {
+		return handler
+	}
+	h := &rateLimitHandler{handler: handler, limit: limit}
+	h.stats, _ = stats.(RateLimitStats)
+	return h
+}
+
+type rateLimitHandler struct {
+	handler Handler
+	limit   *ResponseRateLimit
+	stats   RateLimitStats
+}
+
+var rateLimitResponseWriterPool = sync.Pool{
+	New: func() interface{} {
+		return &rateLimitResponseWriter{buf: make([]byte, 0, 512)}
+	},
+}
+
+// ServeDNS serves req with a ResponseWriter applying the rate limit to the response.
+func (h *rateLimitHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	h.limit.once.Do(h.limit.init)
+
+	addr := rw.RemoteAddr()
+	if h.limit.exempt(addr.Addr()) {
+		h.handler.ServeDNS(rw, req)
+		return
+	}
+	if cw, _ := rw.(*cookieResponseWriter); cw != nil && cw.valid {
+		h.handler.ServeDNS(rw, req)
+		return
+	}
+
+	w := rateLimitResponseWriterPool.Get().(*rateLimitResponseWriter)
+	w.ResponseWriter = rw
+	w.handler = h
+	w.req = req
+
+	h.handler.ServeDNS(w, req)
+
+	w.ResponseWriter, w.handler, w.req = nil, nil, nil
+	rateLimitResponseWriterPool.Put(w)
+}
+
+type rateLimitResponseWriter struct {
+	ResponseWriter
+	handler *rateLimitHandler
+	req     *Message
+	buf     []byte
+}
+
+// Write writes the response, or a truncated response instead, or drops it
+// according to the rate limit.
+func (rw *rateLimitResponseWriter) Write(p []byte) (int, error) {
+	if len(p) < 12 {
+		return rw.ResponseWriter.Write(p)
+	}
+
+	hash := rw.handler.limit.hash(rw.RemoteAddr().Addr(), rw.req, p)
+	action := rw.handler.limit.limit(hash, Rcode(p[3]&0b1111), time.Now())
+	if action != 0 && rw.handler.stats != nil {
+		rw.handler.stats.UpdateRateLimitStats(rw.RemoteAddr(), action)
+	}
+
+	switch action {
+	case RateLimitDrop:
+		return len(p), nil
+	case RateLimitSlip:
+		var err error
+		if rw.buf, err = appendQuestion(rw.buf[:0], p); err != nil {
+			return len(p), nil
+		}
+		// TC
+		rw.buf[2] |= 0b00000010
+		if _, err = rw.ResponseWriter.Write(rw.buf); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	return rw.ResponseWriter.Write(p)
+}
@@ -0,0 +1,186 @@
+package fastdns
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Supervision controls how Server restarts its workers and ForkServer restarts
+// its child processes.
+type Supervision struct {
+	// MinBackoff specifies the delay before restarting a worker which crashed,
+	// it doubles on every consecutive crash of the worker.
+	// If not set, use 100 milliseconds as default.
+	MinBackoff time.Duration
+
+	// MaxBackoff limits the delay before restarting a worker, a worker which
+	// crashes after running longer than MaxBackoff is restarted after MinBackoff.
+	// If not set, use 10 seconds as default.
+	MaxBackoff time.Duration
+
+	// MaxCrashes limits the crashes of all workers within CrashWindow, the server
+	// gives up and returns an error once it is exceeded.
+	// If not set, use 200 as default.
+	MaxCrashes int
+
+	// CrashWindow specifies the sliding window of MaxCrashes.
+	// If not set, use 10 minutes as default.
+	CrashWindow time.Duration
+
+	// PingInterval specifies how often the parent process and the child processes
+	// of ForkServer ping each other.
+	// If not set, use 1 second as default.
+	PingInterval time.Duration
+
+	// PingTimeout specifies how long the pings may be missed, a silent child
+	// process is killed and restarted, and a child process of a silent parent
+	// process exits.
+	// If not set, use 10 seconds as default.
+	PingTimeout time.Duration
+
+	// OnEvent specifies an optional hook observing the lifecycle events of the
+	// workers, it is called by the supervising goroutine and should not block.
+	OnEvent func(event WorkerEvent)
+
+	once sync.Once
+}
+
+// WorkerEventType is the type of a WorkerEvent.
+type WorkerEventType byte
+
+const (
+	WorkerStart     WorkerEventType = 1 // the worker is started
+	WorkerExit      WorkerEventType = 2 // the worker crashed, it is restarted after Backoff
+	WorkerRetire    WorkerEventType = 3 // the child process exited after being replaced by a roll
+	WorkerUnhealthy WorkerEventType = 4 // the child process missed the pings, it is killed
+	WorkerGiveUp    WorkerEventType = 5 // the workers crashed too many times, the server gives up
+)
+
+// String returns the canonical text form of the WorkerEventType value.
+func (t WorkerEventType) String() string {
+	switch t {
+	case WorkerStart:
+		return "start"
+	case WorkerExit:
+		return "exit"
+	case WorkerRetire:
+		return "retire"
+	case WorkerUnhealthy:
+		return "unhealthy"
+	case WorkerGiveUp:
+		return "giveup"
+	}
+	return ""
+}
+
+// WorkerEvent is a lifecycle event of a worker of Server or a child process of ForkServer.
+type WorkerEvent struct {
+	// Type is the type of the event.
+	Type WorkerEventType
+
+	// Index is the index of the worker.
+	Index int
+
+	// Pid is the pid of the child process, it is 0 for the workers of Server.
+	Pid int
+
+	// Err is the error of the exit.
+	Err error
+
+	// ExitCode is the exit code of the child process, it is -1 if the child
+	// process is killed by a signal.
+	ExitCode int
+
+	// Signal is the signal which killed the child process.
+	Signal os.Signal
+
+	// Backoff is the delay before restarting the crashed worker.
+	Backoff time.Duration
+}
+
+// init fills the defaults.
+func (s *Supervision) init() {
+	if s.MinBackoff <= 0 {
+		s.MinBackoff = 100 * time.Millisecond
+	}
+	if s.MaxBackoff <= 0 {
+		s.MaxBackoff = 10 * time.Second
+	}
+	if s.MaxCrashes <= 0 {
+		s.MaxCrashes = 200
+	}
+	if s.CrashWindow <= 0 {
+		s.CrashWindow = 10 * time.Minute
+	}
+	if s.PingInterval <= 0 {
+		s.PingInterval = time.Second
+	}
+	if s.PingTimeout <= 0 {
+		s.PingTimeout = 10 * time.Second
+	}
+}
+
+// supervisor returns a supervisor with the defaults of a nil Supervision.
+func (s *Supervision) supervisor() *supervisor {
+	if s == nil {
+		s = &Supervision{}
+	}
+	s.once.Do(s.init)
+	return &supervisor{Supervision: s, backoff: make(map[int]time.Duration)}
+}
+
+// supervisor accounts the crashes of the workers of a server, it is only used
+// by the supervising goroutine.
+type supervisor struct {
+	*Supervision
+	crashes []time.Time
+	backoff map[int]time.Duration
+}
+
+// crashed accounts a crash at now of the worker of index which started at
+// started, and returns the delay before restarting it, or false if the crash
+// budget is exhausted.
+func (s *supervisor) crashed(index int, started, now time.Time) (time.Duration, bool) {
+	i := 0
+	for i < len(s.crashes) && now.Sub(s.crashes[i]) >= s.CrashWindow {
+		i++
+	}
+	s.crashes = append(s.crashes[i:], now)
+	if len(s.crashes) > s.MaxCrashes {
+		return 0, false
+	}
+
+	delay := s.backoff[index]
+	if delay == 0 || now.Sub(started) > s.MaxBackoff {
+		delay = s.MinBackoff
+	} else {
+		delay = min(2*delay, s.MaxBackoff)
+	}
+	s.backoff[index] = delay
+	return delay, true
+}
+
+// event calls OnEvent with e.
+func (s *supervisor) event(e WorkerEvent) {
+	if s.OnEvent != nil {
+		s.OnEvent(e)
+	}
+}
+
+// exitEvent returns the event of a child process which exited with err.
+func exitEvent(index, pid int, state *os.ProcessState, err error) WorkerEvent {
+	e := WorkerEvent{Type: WorkerExit, Index: index, Pid: pid, Err: err, ExitCode: -1}
+	if state != nil {
+		e.ExitCode = state.ExitCode()
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			e.Signal = ws.Signal()
+		}
+	}
+	if e.Err == nil {
+		e.Err = errors.New("forkserver child process exited")
+	}
+	return e
+}
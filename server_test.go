@@ -3,11 +3,15 @@ package fastdns
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/netip"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -373,3 +377,932 @@ func BenchmarkServerHandlerTXT(b *testing.B) {
 		_, _ = rw.Write(req.Raw)
 	}
 }
+
+// TestServerNSID answers the NSID option of queries with the configured identifier.
+func TestServerNSID(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp error: %+v", err)
+	}
+	defer conn.Close()
+
+	s := &Server{
+		Handler:  &mockServerHandler{},
+		MaxProcs: 1,
+		NSID:     "ns1.fastdns",
+	}
+	go func() {
+		_ = s.Serve(conn)
+	}()
+
+	client := &Client{Addr: conn.LocalAddr().String(), Timeout: time.Second}
+
+	for _, c := range []struct {
+		ctx  context.Context
+		nsid string
+	}{
+		{context.Background(), ""},
+		{WithClientNSID(context.Background()), "ns1.fastdns"},
+		{WithClientNSID(WithClientTag(WithClientSubnet(context.Background(), netip.MustParsePrefix("1.2.3.0/24")), 42)), "ns1.fastdns"},
+	} {
+		req, resp := AcquireMessage(), AcquireMessage()
+		req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+		if err := client.Exchange(c.ctx, req, resp); err != nil {
+			t.Fatalf("client.Exchange() error: %+v", err)
+		}
+
+		var nsid []byte
+		records := resp.Records()
+		for records.Next() {
+			record := records.Item()
+			if record.Type != TypeOPT {
+				continue
+			}
+			options, _ := record.AsOptions()
+			for options.Next() {
+				if option := options.Item(); option.Code == OptionCodeNSID {
+					nsid, _ = option.AsNSID(nsid)
+				}
+			}
+		}
+		if err := records.Err(); err != nil {
+			t.Errorf("resp.Records() error: %+v", err)
+		}
+		if resp.Header.ANCount != 1 || string(nsid) != c.nsid {
+			t.Errorf("client.Exchange() got ancount=%d nsid=%#v want nsid=%#v", resp.Header.ANCount, string(nsid), c.nsid)
+		}
+
+		ReleaseMessage(resp)
+		ReleaseMessage(req)
+	}
+
+	// extends the OPT record of the response in place
+	msg := AcquireMessage()
+	defer ReleaseMessage(msg)
+
+	msg.SetRequestQuestion("example.org", TypeA, ClassINET)
+	moa, _ := msg.OptionsAppender()
+	moa.AppendCookie("01234567")
+
+	data, err := appendResponseOption(nil, msg.Raw, OptionCodeNSID, []byte("ns1"))
+	if err != nil {
+		t.Fatalf("appendResponseOption() error: %+v", err)
+	}
+	if err := ParseMessage(msg, data, true); err != nil || msg.Header.ARCount != 1 {
+		t.Fatalf("ParseMessage(%x) arcount=%d error: %+v", data, msg.Header.ARCount, err)
+	}
+	var codes []OptionCode
+	records := msg.Records()
+	for records.Next() {
+		record := records.Item()
+		options, _ := record.AsOptions()
+		for options.Next() {
+			codes = append(codes, options.Item().Code)
+		}
+	}
+	if len(codes) != 2 || codes[0] != OptionCodeCOOKIE || codes[1] != OptionCodeNSID {
+		t.Errorf("appendResponseOption() got options %v", codes)
+	}
+}
+
+// TestSipHash24 checks the SipHash-2-4 reference vectors.
+func TestSipHash24(t *testing.T) {
+	var key [16]byte
+	var msg []byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := 0; i < 15; i++ {
+		msg = append(msg, byte(i))
+	}
+
+	if h := siphash24(&key, nil); h != 0x726fdb47dd0e0e31 {
+		t.Errorf("siphash24(\"\") got %x", h)
+	}
+	if h := siphash24(&key, msg[:8]); h != 0x93f5f5799a932462 {
+		t.Errorf("siphash24(%x) got %x", msg[:8], h)
+	}
+	if h := siphash24(&key, msg); h != 0xa129ca6149be45e5 {
+		t.Errorf("siphash24(%x) got %x", msg, h)
+	}
+}
+
+type mockCookieHandler struct{}
+
+// ServeDNS answers 16 host records to large.example.org and 1 to the others.
+func (h *mockCookieHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	var ips []netip.Addr
+	if string(req.Domain) == "large.example.org" {
+		for i := 0; i < 16; i++ {
+			ips = append(ips, netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}))
+		}
+	} else {
+		ips = append(ips, netip.AddrFrom4([4]byte{10, 0, 0, 1}))
+	}
+	req.SetResponseHeader(RcodeNoError, uint16(len(ips)))
+	req.AppendHOST(300, ips)
+	_, _ = rw.Write(req.Raw)
+}
+
+// TestServerCookie answers DNS Cookies and requires valid server cookies for large responses.
+func TestServerCookie(t *testing.T) {
+	// RFC 9018 appendix A.1
+	secret := [16]byte{0xe5, 0xe9, 0x73, 0xe5, 0xa6, 0xb2, 0xa4, 0x3f, 0x48, 0xe7, 0xdc, 0x84, 0x9e, 0x37, 0xbf, 0xcf}
+	client := []byte{0x24, 0x64, 0xc4, 0xab, 0xcf, 0x10, 0xc9, 0x57}
+	cookie := appendServerCookie(nil, &secret, client, netip.MustParseAddr("198.51.100.100"), 1559731985)
+	if fmt.Sprintf("%x", cookie) != "010000005cf79f111f8130c3eee29480" {
+		t.Errorf("appendServerCookie() got %x", cookie)
+	}
+
+	sc := &ServerCookie{Secret: secret, RequireSize: 100}
+	handler := withCookie(&mockCookieHandler{}, sc)
+
+	exchange := func(domain string, cookie []byte) (resp *Message, rcode Rcode, option []byte) {
+		req := AcquireMessage()
+		defer ReleaseMessage(req)
+		req.SetRequestQuestion(domain, TypeA, ClassINET)
+		if cookie != nil {
+			moa, _ := req.OptionsAppender()
+			moa.AppendCookie(string(cookie))
+		}
+
+		rw := &MemResponseWriter{Raddr: netip.MustParseAddrPort("198.51.100.100:53000")}
+		handler.ServeDNS(rw, req)
+
+		resp = AcquireMessage()
+		if err := ParseMessage(resp, rw.Data, true); err != nil {
+			t.Fatalf("ParseMessage(%x) error: %+v", rw.Data, err)
+		}
+		rcode = resp.Header.Flags.Rcode()
+		records := resp.Records()
+		for records.Next() {
+			record := records.Item()
+			if record.Type != TypeOPT {
+				continue
+			}
+			options, _ := record.AsOptions()
+			rcode |= options.Rcode << 4
+			for options.Next() {
+				if item := options.Item(); item.Code == OptionCodeCOOKIE {
+					option, _ = item.AsCookie(nil)
+				}
+			}
+		}
+		return
+	}
+
+	// a client cookie learns a server cookie
+	resp, rcode, option := exchange("small.example.org", client)
+	if rcode != RcodeNoError || resp.Header.ANCount != 1 || len(option) != 24 || string(option[:8]) != string(client) {
+		t.Fatalf("small query got rcode=%s ancount=%d cookie=%x", rcode, resp.Header.ANCount, option)
+	}
+	ReleaseMessage(resp)
+	learned := option
+
+	// a large response requires a valid server cookie
+	resp, rcode, option = exchange("large.example.org", client)
+	if rcode != RcodeBADCOOKIE || resp.Header.ANCount != 0 || len(option) != 24 {
+		t.Errorf("large query with client cookie got rcode=%s ancount=%d cookie=%x", rcode, resp.Header.ANCount, option)
+	}
+	ReleaseMessage(resp)
+
+	resp, _, _ = exchange("large.example.org", nil)
+	if resp.Header.Flags.TC() == 0 || resp.Header.ANCount != 0 {
+		t.Errorf("large query without cookie got tc=%d ancount=%d", resp.Header.Flags.TC(), resp.Header.ANCount)
+	}
+	ReleaseMessage(resp)
+
+	resp, rcode, option = exchange("large.example.org", learned)
+	if rcode != RcodeNoError || resp.Header.ANCount != 16 || string(option) != string(learned) {
+		t.Errorf("large query with server cookie got rcode=%s ancount=%d cookie=%x", rcode, resp.Header.ANCount, option)
+	}
+	ReleaseMessage(resp)
+
+	// an expired server cookie
+	expired := appendServerCookie(append([]byte(nil), client...), &secret, client, netip.MustParseAddr("198.51.100.100"), uint32(time.Now().Unix())-3700)
+	resp, rcode, _ = exchange("large.example.org", expired)
+	if rcode != RcodeBADCOOKIE {
+		t.Errorf("large query with expired server cookie got rcode=%s", rcode)
+	}
+	ReleaseMessage(resp)
+
+	// the previous secret is accepted within the overlap after rotation
+	sc.Rotate([16]byte{1, 2, 3, 4})
+	resp, rcode, option = exchange("large.example.org", learned)
+	if rcode != RcodeNoError || len(option) != 24 || string(option) == string(learned) {
+		t.Errorf("large query with previous server cookie got rcode=%s cookie=%x", rcode, option)
+	}
+	ReleaseMessage(resp)
+
+	sc.secrets.Load().expires = time.Now().Unix()
+	resp, rcode, _ = exchange("large.example.org", learned)
+	if rcode != RcodeBADCOOKIE {
+		t.Errorf("large query with retired server cookie got rcode=%s", rcode)
+	}
+	ReleaseMessage(resp)
+
+	// a malformed cookie
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("small.example.org", TypeA, ClassINET)
+	moa, _ := req.OptionsAppender()
+	moa.AppendCookie("0123456789")
+	rw := &MemResponseWriter{}
+	handler.ServeDNS(rw, req)
+	if len(rw.Data) < 4 || Rcode(rw.Data[3]&0b1111) != RcodeFormErr {
+		t.Errorf("query with malformed cookie got %x", rw.Data)
+	}
+}
+
+// TestServerRateLimit limits the identical responses to a client network.
+func TestServerRateLimit(t *testing.T) {
+	stats := &CoreStats{}
+	limit := &ResponseRateLimit{
+		ResponsesPerSecond: 2,
+		Exempt:             []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+	handler := withRateLimit(&mockCookieHandler{}, limit, stats)
+
+	// serve returns the answer count of the response, or -1 for a truncated response and -2 for no response.
+	serve := func(addr, domain string) int {
+		req := AcquireMessage()
+		defer ReleaseMessage(req)
+		req.SetRequestQuestion(domain, TypeA, ClassINET)
+
+		rw := &MemResponseWriter{Raddr: netip.AddrPortFrom(netip.MustParseAddr(addr), 53000)}
+		handler.ServeDNS(rw, req)
+
+		if len(rw.Data) == 0 {
+			return -2
+		}
+		// not pooled, a pooled message keeps the TC flag into the next request.
+		resp := new(Message)
+		if err := ParseMessage(resp, rw.Data, true); err != nil {
+			t.Fatalf("ParseMessage(%x) error: %+v", rw.Data, err)
+		}
+		if resp.Header.Flags.TC() != 0 {
+			return -1
+		}
+		return int(resp.Header.ANCount)
+	}
+
+	var got []int
+	for i := 0; i < 8; i++ {
+		got = append(got, serve("192.0.2.1", "www.example.org"))
+	}
+	if want := []int{1, 1, -2, -1, -2, -1, -2, -1}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("identical responses got %v want %v", got, want)
+	}
+
+	for _, c := range []struct {
+		addr   string
+		domain string
+		answer int
+	}{
+		{"192.0.2.77", "www.example.org", -2},  // the same /24
+		{"192.0.3.1", "www.example.org", 1},    // another /24
+		{"192.0.2.1", "mail.example.org", 1},   // another response
+		{"10.1.1.1", "www.example.org", 1},     // exempt
+		{"10.1.1.1", "www.example.org", 1},     // exempt
+		{"10.1.1.1", "www.example.org", 1},     // exempt
+		{"2001:db8::1", "www.example.org", 1},  // IPv6 /56
+		{"2001:db8::2", "www.example.org", 1},  // IPv6 /56
+		{"2001:db8::3", "www.example.org", -2}, // IPv6 /56
+	} {
+		if answer := serve(c.addr, c.domain); answer != c.answer {
+			t.Errorf("response of %s to %s got %d want %d", c.domain, c.addr, answer, c.answer)
+		}
+	}
+
+	if stats.ResponseRateLimitedTotal_DROP != 5 || stats.ResponseRateLimitedTotal_SLIP != 3 {
+		t.Errorf("rate limited stats got drop=%d slip=%d", stats.ResponseRateLimitedTotal_DROP, stats.ResponseRateLimitedTotal_SLIP)
+	}
+	if metrics := string(stats.AppendOpenMetrics(nil)); !strings.Contains(metrics, `dns_response_rate_limited_total{server="",zone="",action="slip"} 3`) {
+		t.Errorf("AppendOpenMetrics() got %s", metrics)
+	}
+
+	// the bucket refills over time
+	now := time.Now()
+	for i, want := range []RateLimitAction{0, 0, RateLimitDrop, RateLimitSlip} {
+		if action := limit.limit(42, RcodeNoError, now); action != want {
+			t.Errorf("limit() #%d got %s want %s", i, action, want)
+		}
+	}
+	if action := limit.limit(42, RcodeNoError, now.Add(1500*time.Millisecond)); action != 0 {
+		t.Errorf("limit() after 1.5 seconds got %s", action)
+	}
+	if action := limit.limit(42, RcodeNXDomain, now.Add(time.Second)); action != 0 {
+		t.Errorf("limit() of another rcode got %s", action)
+	}
+}
+
+// mockDelegationHandler answers NXDOMAIN for the names of example.org and
+// refers the names of child.example.org to their name servers.
+type mockDelegationHandler struct{}
+
+// ServeDNS answers an NXDOMAIN response or a referral.
+func (h *mockDelegationHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	req.SetResponseHeader(RcodeNoError, 0)
+	if strings.HasSuffix(string(req.Domain), ".child.example.org") {
+		appendMockAuthority(req, "child.example.org", TypeNS)
+	} else {
+		req.Header.Flags |= Flags(RcodeNXDomain)
+		req.Raw[3] |= byte(RcodeNXDomain)
+		appendMockAuthority(req, "example.org", TypeSOA)
+	}
+	_, _ = rw.Write(req.Raw)
+}
+
+// TestServerRateLimitZone limits the NXDOMAIN responses and the referrals of
+// random names by their zone.
+func TestServerRateLimitZone(t *testing.T) {
+	limit := &ResponseRateLimit{ResponsesPerSecond: 2, Slip: -1}
+	handler := withRateLimit(&mockDelegationHandler{}, limit, nil)
+
+	for _, zone := range []string{"example.org", "child.example.org"} {
+		var got []bool
+		for i := 0; i < 4; i++ {
+			req := AcquireMessage()
+			req.SetRequestQuestion(fmt.Sprintf("random%d.%s", i, zone), TypeA, ClassINET)
+			rw := &MemResponseWriter{Raddr: netip.MustParseAddrPort("192.0.2.1:53000")}
+			handler.ServeDNS(rw, req)
+			ReleaseMessage(req)
+			got = append(got, len(rw.Data) != 0)
+		}
+		if want := []bool{true, true, false, false}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("responses of random names of %s got %v want %v", zone, got, want)
+		}
+	}
+}
+
+// TestServerRateLimitCookie does not limit the responses to the queries with a
+// valid server cookie.
+func TestServerRateLimitCookie(t *testing.T) {
+	limit := &ResponseRateLimit{ResponsesPerSecond: 2, Slip: -1}
+	handler := withCookie(withRateLimit(&mockCookieHandler{}, limit, nil), &ServerCookie{Secret: [16]byte{1, 2, 3, 4}})
+
+	// serve returns whether the query with cookie is answered, and the cookie of the response.
+	serve := func(cookie []byte) (bool, []byte) {
+		req := AcquireMessage()
+		defer ReleaseMessage(req)
+		req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+		moa, _ := req.OptionsAppender()
+		moa.AppendCookie(string(cookie))
+
+		rw := &MemResponseWriter{Raddr: netip.MustParseAddrPort("192.0.2.1:53000")}
+		handler.ServeDNS(rw, req)
+		if len(rw.Data) == 0 {
+			return false, nil
+		}
+
+		resp := new(Message)
+		if err := ParseMessage(resp, rw.Data, true); err != nil {
+			t.Fatalf("ParseMessage(%x) error: %+v", rw.Data, err)
+		}
+		var option []byte
+		records := resp.Records()
+		for records.Next() {
+			if record := records.Item(); record.Type == TypeOPT {
+				options, _ := record.AsOptions()
+				for options.Next() {
+					if item := options.Item(); item.Code == OptionCodeCOOKIE {
+						option, _ = item.AsCookie(nil)
+					}
+				}
+			}
+		}
+		return true, option
+	}
+
+	client := []byte{0x24, 0x64, 0xc4, 0xab, 0xcf, 0x10, 0xc9, 0x57}
+	_, learned := serve(client)
+	if len(learned) != 24 {
+		t.Fatalf("query with client cookie got server cookie %x", learned)
+	}
+
+	var got []bool
+	for i := 0; i < 3; i++ {
+		answered, _ := serve(client)
+		got = append(got, answered)
+	}
+	for i := 0; i < 3; i++ {
+		answered, _ := serve(learned)
+		got = append(got, answered)
+	}
+	if want := []bool{true, false, false, true, true, true}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("responses with client cookie and server cookie got %v want %v", got, want)
+	}
+}
+
+// TestServerAccessControl refuses, drops and rate limits the queries by their source prefix.
+func TestServerAccessControl(t *testing.T) {
+	access := &AccessControl{
+		Rules: []AccessRule{
+			{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Action: AccessRefuse},
+			{Prefix: netip.MustParsePrefix("192.0.2.128/25"), Action: AccessAllow},
+			{Prefix: netip.MustParsePrefix("192.0.2.200/32"), Action: AccessDrop},
+			{Prefix: netip.MustParsePrefix("2001:db8::/32"), Action: AccessAllow, QPS: 1, Burst: 2},
+		},
+		Default: AccessRefuse,
+	}
+
+	for _, c := range []struct {
+		addr     string
+		action   AccessAction
+		exceeded bool
+	}{
+		{"192.0.2.1", AccessRefuse, false},
+		{"192.0.2.129", AccessAllow, false},
+		{"192.0.2.200", AccessDrop, false},
+		{"::ffff:192.0.2.200", AccessDrop, false},
+		{"198.51.100.1", AccessRefuse, false},
+		{"2001:db8::1", AccessAllow, false},
+		{"2001:db8::2", AccessAllow, false},
+		{"2001:db8::3", AccessDrop, true},
+		{"2001:db9::1", AccessRefuse, false},
+	} {
+		if action, exceeded := access.check(netip.MustParseAddr(c.addr)); action != c.action || exceeded != c.exceeded {
+			t.Errorf("check(%s) got action=%s exceeded=%v want action=%s exceeded=%v", c.addr, action, exceeded, c.action, c.exceeded)
+		}
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp error: %+v", err)
+	}
+	defer conn.Close()
+
+	stats := &CoreStats{}
+	s := &Server{
+		Handler:  &mockServerHandler{},
+		Stats:    stats,
+		MaxProcs: 1,
+		Access: &AccessControl{
+			Rules: []AccessRule{{Prefix: netip.MustParsePrefix("127.0.0.0/8"), Action: AccessRefuse}},
+		},
+	}
+	go func() {
+		_ = s.Serve(conn)
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial udp error: %+v", err)
+	}
+	defer client.Close()
+
+	// exchange returns the rcode of the response, or -1 for no response.
+	exchange := func() int {
+		req := AcquireMessage()
+		defer ReleaseMessage(req)
+
+		req.SetRequestQuestion("example.org", TypeA, ClassINET)
+		if _, err := client.Write(req.Raw); err != nil {
+			t.Fatalf("write udp error: %+v", err)
+		}
+		// the refused responses carry no question, read them raw.
+		var buf [512]byte
+		_ = client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := client.Read(buf[:])
+		if err != nil || n < 12 {
+			return -1
+		}
+		return int(buf[3] & 0b1111)
+	}
+
+	if rcode := exchange(); rcode != int(RcodeRefused) {
+		t.Errorf("refused query got rcode %d", rcode)
+	}
+
+	s.Access.Reload([]AccessRule{
+		{Prefix: netip.MustParsePrefix("127.0.0.0/8"), Action: AccessAllow},
+		{Prefix: netip.MustParsePrefix("127.0.0.1/32"), Action: AccessDrop},
+	})
+	if rcode := exchange(); rcode != -1 {
+		t.Errorf("dropped query got rcode %d", rcode)
+	}
+
+	s.Access.Reload([]AccessRule{
+		{Prefix: netip.MustParsePrefix("127.0.0.0/8"), Action: AccessAllow, QPS: 1, Burst: 2},
+	})
+	var got []int
+	for i := 0; i < 3; i++ {
+		got = append(got, exchange())
+	}
+	if want := []int{0, 0, -1}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("rate limited queries got %v want %v", got, want)
+	}
+
+	refused, dropped, exceeded := atomic.LoadUint64(&stats.RequestRefusedTotal_ACL), atomic.LoadUint64(&stats.RequestDroppedTotal_ACL), atomic.LoadUint64(&stats.RequestDroppedTotal_QPS)
+	if refused != 1 || dropped != 1 || exceeded != 1 {
+		t.Errorf("access stats got refused=%d dropped=%d exceeded=%d", refused, dropped, exceeded)
+	}
+	if metrics := string(stats.AppendOpenMetrics(nil)); !strings.Contains(metrics, `dns_request_dropped_total{server="",zone="",reason="qps"} 1`) {
+		t.Errorf("AppendOpenMetrics() got %s", metrics)
+	}
+}
+
+// mockBlockingHandler blocks the queries of slow.example.org until release is closed.
+type mockBlockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+// ServeDNS answers the queries, blocking the slow ones.
+func (h *mockBlockingHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	if string(req.Domain) == "slow.example.org" {
+		h.started <- struct{}{}
+		<-h.release
+	}
+	req.SetResponseHeader(RcodeNoError, 1)
+	req.AppendHOST(600, []netip.Addr{netip.AddrFrom4([4]byte{1, 1, 1, 1})})
+	_, _ = rw.Write(req.Raw)
+}
+
+// TestServerLoadShedding answers the queries finding all workers busy, and serves the priority ones.
+func TestServerLoadShedding(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp error: %+v", err)
+	}
+	defer conn.Close()
+
+	var logs strings.Builder
+	var mu sync.Mutex
+	handler := &mockBlockingHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+	stats := &CoreStats{}
+	s := &Server{
+		Handler:     handler,
+		Stats:       stats,
+		ErrorLog:    slog.New(slog.NewTextHandler(&lockedWriter{w: &logs, mu: &mu}, nil)),
+		MaxProcs:    1,
+		Concurrency: 1,
+		Overload: &LoadShedding{
+			Rcode:         RcodeRefused,
+			PriorityZones: []string{"Priority.Example.ORG."},
+			LogInterval:   time.Hour,
+		},
+	}
+	go func() {
+		_ = s.Serve(conn)
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial udp error: %+v", err)
+	}
+	defer client.Close()
+
+	send := func(domain string) {
+		req := AcquireMessage()
+		defer ReleaseMessage(req)
+		req.SetRequestQuestion(domain, TypeA, ClassINET)
+		if _, err := client.Write(req.Raw); err != nil {
+			t.Fatalf("write udp error: %+v", err)
+		}
+	}
+	// recv returns the domain and rcode of the next response.
+	recv := func() (string, int) {
+		var buf [512]byte
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(buf[:])
+		if err != nil || n < 12 {
+			return "", -1
+		}
+		resp := new(Message)
+		if ParseMessage(resp, buf[:n], true) != nil {
+			return "", int(buf[3] & 0b1111)
+		}
+		return string(resp.Domain), int(resp.Header.Flags.Rcode())
+	}
+
+	// the only worker is busy with the slow query.
+	send("slow.example.org")
+	<-handler.started
+
+	send("www.example.org")
+	if _, rcode := recv(); rcode != int(RcodeRefused) {
+		t.Errorf("shed query got rcode %d", rcode)
+	}
+	send("www.priority.example.org")
+	if domain, rcode := recv(); domain != "www.priority.example.org" || rcode != int(RcodeNoError) {
+		t.Errorf("priority query got domain=%s rcode=%d", domain, rcode)
+	}
+	send("www.example.org")
+	if _, rcode := recv(); rcode != int(RcodeRefused) {
+		t.Errorf("shed query got rcode %d", rcode)
+	}
+
+	close(handler.release)
+	if domain, rcode := recv(); domain != "slow.example.org" || rcode != int(RcodeNoError) {
+		t.Errorf("slow query got domain=%s rcode=%d", domain, rcode)
+	}
+
+	answer, priority, drop := atomic.LoadUint64(&stats.RequestOverloadTotal_ANSWER), atomic.LoadUint64(&stats.RequestOverloadTotal_PRIORITY), atomic.LoadUint64(&stats.RequestOverloadTotal_DROP)
+	if answer != 2 || priority != 1 || drop != 0 {
+		t.Errorf("overload stats got answer=%d priority=%d drop=%d", answer, priority, drop)
+	}
+
+	// the warnings are limited to one per LogInterval.
+	mu.Lock()
+	defer mu.Unlock()
+	if n := strings.Count(logs.String(), "shedding queries"); n != 1 {
+		t.Errorf("ErrorLog got %d warnings: %s", n, logs.String())
+	}
+}
+
+// TestServerLoadSheddingDenied drops the shed queries denied by the access
+// control, and limits the shed answers with the response rate limit.
+func TestServerLoadSheddingDenied(t *testing.T) {
+	cases := []struct {
+		name   string
+		access *AccessControl
+		limit  *ResponseRateLimit
+		rcodes []int
+	}{
+		{
+			// the slow query takes the only allowed query.
+			name: "access",
+			access: &AccessControl{Rules: []AccessRule{
+				{Prefix: netip.MustParsePrefix("127.0.0.1/32"), QPS: 1, Burst: 1},
+			}},
+			rcodes: []int{-1, -1},
+		},
+		{
+			name:   "ratelimit",
+			limit:  &ResponseRateLimit{ResponsesPerSecond: 1, Slip: -1},
+			rcodes: []int{int(RcodeRefused), -1},
+		},
+	}
+
+	for _, c := range cases {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("listen udp error: %+v", err)
+		}
+		defer conn.Close()
+
+		handler := &mockBlockingHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+		s := &Server{
+			Handler:     handler,
+			MaxProcs:    1,
+			Concurrency: 1,
+			Access:      c.access,
+			RateLimit:   c.limit,
+			Overload:    &LoadShedding{Rcode: RcodeRefused},
+		}
+		go func() {
+			_ = s.Serve(conn)
+		}()
+
+		client, err := net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("dial udp error: %+v", err)
+		}
+		defer client.Close()
+
+		send := func(domain string) {
+			req := AcquireMessage()
+			defer ReleaseMessage(req)
+			req.SetRequestQuestion(domain, TypeA, ClassINET)
+			if _, err := client.Write(req.Raw); err != nil {
+				t.Fatalf("write udp error: %+v", err)
+			}
+		}
+		recv := func() int {
+			var buf [512]byte
+			_ = client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if n, err := client.Read(buf[:]); err != nil || n < 12 {
+				return -1
+			}
+			return int(buf[3] & 0b1111)
+		}
+
+		send("slow.example.org")
+		<-handler.started
+		for i, want := range c.rcodes {
+			send("www.example.org")
+			if rcode := recv(); rcode != want {
+				t.Errorf("%s: shed query %d got rcode %d, want %d", c.name, i, rcode, want)
+			}
+		}
+		close(handler.release)
+	}
+}
+
+// lockedWriter serializes the writes to w.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+// Write writes p to w under the lock.
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// mockProxyHandler answers the queries with a message of its own, leaving the request untouched.
+type mockProxyHandler struct{}
+
+// ServeDNS writes an NXDOMAIN response built in a separate message.
+func (h *mockProxyHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+
+	resp.Raw = append(resp.Raw[:0], req.Raw...)
+	resp.Raw[2] |= 0b10000000
+	resp.Raw[3] = resp.Raw[3]&0b11110000 | byte(RcodeNXDomain)
+	resp.Raw = append(resp.Raw, make([]byte, 100)...)
+	_, _ = rw.Write(resp.Raw)
+}
+
+// TestServerResponseStats records the rcode and size of the response written by the handler.
+func TestServerResponseStats(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp error: %+v", err)
+	}
+	defer conn.Close()
+
+	stats := &CoreStats{}
+	go func() {
+		_ = (&Server{Handler: &mockProxyHandler{}, Stats: stats, MaxProcs: 1}).Serve(conn)
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial udp error: %+v", err)
+	}
+	defer client.Close()
+
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	if _, err := client.Write(req.Raw); err != nil {
+		t.Fatalf("write udp error: %+v", err)
+	}
+
+	var buf [512]byte
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf[:])
+	if err != nil {
+		t.Fatalf("read udp error: %+v", err)
+	}
+	// the stats are updated after the response is written.
+	for i := 0; i < 100 && atomic.LoadUint64(&stats.ResponseSizeBytesCount) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	nxdomain, noerror, size := atomic.LoadUint64(&stats.ResponseRcodeCountTotal_NXDOMAIN), atomic.LoadUint64(&stats.ResponseRcodeCountTotal_NOERROR), atomic.LoadUint64(&stats.ResponseSizeBytesSum)
+	if nxdomain != 1 || noerror != 0 || size != uint64(n) || n != len(req.Raw)+100 {
+		t.Errorf("response stats got nxdomain=%d noerror=%d size=%d want size=%d", nxdomain, noerror, size, n)
+	}
+}
+
+// TestForkServerStats merges the metrics published by the child processes.
+func TestForkServerStats(t *testing.T) {
+	s := &ForkServer{}
+
+	addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 12345)
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+
+	// publish starts the child process pid of index, which serves queries.
+	publish := func(index, pid, queries int) (*os.File, chan struct{}) {
+		stats := &Metrics{}
+		for i := 0; i < queries; i++ {
+			stats.UpdateResponseStats(addr, req, ResponseInfo{Size: 100}, time.Millisecond)
+		}
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("os.Pipe() error: %+v", err)
+		}
+		t.Cleanup(func() { _ = w.Close() })
+
+		s.stats.started(index, pid)
+		go func() {
+			_ = publishStats(w, stats, 10*time.Millisecond)
+		}()
+		done := make(chan struct{})
+		go func() {
+			_ = s.stats.read(pid, r, nil)
+			_ = r.Close()
+			close(done)
+		}()
+		return w, done
+	}
+
+	publish(1, 1001, 2)
+	w, done := publish(2, 1002, 3)
+	time.Sleep(50 * time.Millisecond)
+
+	// the counters of the crashed child process carry on over its restart.
+	_ = w.Close()
+	<-done
+	s.stats.exited(2, 1002)
+	publish(2, 2002, 1)
+
+	// the replacement of a child process overlaps it during a roll.
+	publish(1, 3001, 1)
+
+	var metrics string
+	for i := 0; i < 100; i++ {
+		if metrics = string(s.AppendOpenMetrics(nil)); strings.Contains(metrics, `type="A"} 7`+"\n") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, line := range []string{
+		"# TYPE dns_requests counter",
+		`dns_requests_total{server="",proto="",zone=".",type="A"} 7`,
+		`dns_requests_total{server="",proto="",zone=".",type="A",child="1"} 3`,
+		`dns_requests_total{server="",proto="",zone=".",type="A",child="2"} 4`,
+		`dns_request_duration_seconds_sum{server="",proto="",zone="."} 0.007`,
+		`dns_forkserver_child_restarts_total{child="2"} 1`,
+		`dns_forkserver_child_up{child="1",pid="3001"} 1`,
+		`dns_forkserver_child_up{child="2",pid="2002"} 1`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("ForkServer.AppendOpenMetrics() shall contain %s", line)
+		}
+	}
+	if strings.Count(metrics, "# TYPE dns_requests counter") != 1 || !strings.HasSuffix(metrics, "\n# EOF\n") {
+		t.Errorf("ForkServer.AppendOpenMetrics() got %s", metrics)
+	}
+}
+
+func TestSupervisorCrashed(t *testing.T) {
+	sv := (&Supervision{
+		MinBackoff:  time.Second,
+		MaxBackoff:  4 * time.Second,
+		MaxCrashes:  5,
+		CrashWindow: time.Minute,
+	}).supervisor()
+
+	now := time.Now()
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		delay, ok := sv.crashed(1, now, now.Add(time.Duration(i)*time.Second))
+		if !ok || delay != want {
+			t.Errorf("crash %d of worker 1 returns (%v, %v), want (%v, true)", i, delay, ok, want)
+		}
+	}
+
+	// a worker which ran longer than MaxBackoff starts over.
+	if delay, ok := sv.crashed(1, now, now.Add(10*time.Second)); !ok || delay != time.Second {
+		t.Errorf("crash of a stable worker returns (%v, %v), want (1s, true)", delay, ok)
+	}
+
+	// the budget of 5 crashes per minute is exhausted.
+	if _, ok := sv.crashed(2, now, now.Add(20*time.Second)); ok {
+		t.Errorf("crash over the budget returns ok")
+	}
+
+	// the crashes slide out of the window.
+	if delay, ok := sv.crashed(2, now, now.Add(2*time.Minute)); !ok || delay != time.Second {
+		t.Errorf("crash after the window returns (%v, %v), want (1s, true)", delay, ok)
+	}
+}
+
+func TestServerSupervision(t *testing.T) {
+	var events []WorkerEvent
+	s := &Server{
+		Handler:  &mockServerHandler{},
+		MaxProcs: 1,
+		Supervision: &Supervision{
+			MinBackoff: time.Millisecond,
+			MaxCrashes: 3,
+			OnEvent: func(event WorkerEvent) {
+				events = append(events, event)
+			},
+		},
+	}
+
+	// the workers fail to listen on an invalid address.
+	if err := s.ListenAndServe("127.0.0.1:-1"); err == nil {
+		t.Fatalf("ListenAndServe() returns no error")
+	}
+
+	var types []string
+	var backoffs []time.Duration
+	for _, e := range events {
+		types = append(types, e.Type.String())
+		if e.Type == WorkerExit {
+			backoffs = append(backoffs, e.Backoff)
+			if e.Index != 1 || e.Err == nil {
+				t.Errorf("exit event %+v, want index 1 and an error", e)
+			}
+		}
+	}
+	if got, want := strings.Join(types, ","), "start,exit,start,exit,start,exit,start,giveup"; got != want {
+		t.Errorf("events %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(backoffs), "[1ms 2ms 4ms]"; got != want {
+		t.Errorf("backoffs %s, want %s", got, want)
+	}
+}
@@ -12,7 +12,47 @@ type Stats interface {
 	AppendOpenMetrics(dst []byte) []byte
 }
 
+// ResponseStats is implemented by the Stats which record the response written
+// by the handler, instead of deriving it from the request, the server calls
+// UpdateResponseStats in place of UpdateStats.
+type ResponseStats interface {
+	UpdateResponseStats(addr netip.AddrPort, req *Message, resp ResponseInfo, duration time.Duration)
+}
+
+// RateLimitStats is implemented by the Stats which count the responses limited
+// by ResponseRateLimit.
+type RateLimitStats interface {
+	UpdateRateLimitStats(addr netip.AddrPort, action RateLimitAction)
+}
+
+// AccessStats is implemented by the Stats which count the queries denied by
+// AccessControl, exceeded reports whether the QPS of the rule is exceeded.
+type AccessStats interface {
+	UpdateAccessStats(addr netip.AddrPort, action AccessAction, exceeded bool)
+}
+
+// OverloadStats is implemented by the Stats which count the queries finding
+// all workers of the server busy.
+type OverloadStats interface {
+	UpdateOverloadStats(addr netip.AddrPort, action OverloadAction)
+}
+
+// CacheStats is implemented by the Stats which count the events of a Cache.
+type CacheStats interface {
+	UpdateCacheStats(event CacheEvent)
+}
+
+// UpstreamStats is implemented by the Stats which record the exchanges of a
+// Client with the upstream server addr, resp is only valid if err is nil.
+type UpstreamStats interface {
+	UpdateUpstreamStats(addr string, resp *Message, duration time.Duration, err error)
+}
+
 var _ Stats = (*CoreStats)(nil)
+var _ ResponseStats = (*CoreStats)(nil)
+var _ RateLimitStats = (*CoreStats)(nil)
+var _ AccessStats = (*CoreStats)(nil)
+var _ OverloadStats = (*CoreStats)(nil)
 
 type CoreStats struct {
 	RequestCountTotal uint64
@@ -76,6 +116,8 @@ type CoreStats struct {
 	ResponseRcodeCountTotal_NOTAUTH  uint64
 	ResponseRcodeCountTotal_NOTZONE  uint64
 
+	ResponseTruncatedTotal uint64
+
 	ResponseSizeBytesBucket_0     uint64
 	ResponseSizeBytesBucket_100   uint64
 	ResponseSizeBytesBucket_200   uint64
@@ -94,11 +136,45 @@ type CoreStats struct {
 	ResponseSizeBytesSum          uint64
 	ResponseSizeBytesCount        uint64
 
+	ResponseRateLimitedTotal_DROP uint64
+	ResponseRateLimitedTotal_SLIP uint64
+
+	RequestRefusedTotal_ACL uint64
+	RequestRefusedTotal_QPS uint64
+	RequestDroppedTotal_ACL uint64
+	RequestDroppedTotal_QPS uint64
+
+	RequestOverloadTotal_ANSWER   uint64
+	RequestOverloadTotal_DROP     uint64
+	RequestOverloadTotal_PRIORITY uint64
+
 	Prefix, Family, Proto, Server, Zone string
 }
 
 // UpdateStats records the request metrics derived from the message and timing data.
 func (s *CoreStats) UpdateStats(addr netip.AddrPort, msg *Message, duration time.Duration) {
+	s.updateRequestStats(msg, duration)
+	s.updateResponseStats(msg.Header.Flags.Rcode(), len(msg.Raw))
+}
+
+// UpdateResponseStats records the request metrics and the metrics of the
+// response written by the handler.
+func (s *CoreStats) UpdateResponseStats(addr netip.AddrPort, req *Message, resp ResponseInfo, duration time.Duration) {
+	s.updateRequestStats(req, duration)
+	if resp.Size == 0 {
+		// no response, which is counted in the zero size bucket only.
+		atomic.AddUint64(&s.ResponseSizeBytesBucket_0, 1)
+		atomic.AddUint64(&s.ResponseSizeBytesCount, 1)
+		return
+	}
+	if resp.TC {
+		atomic.AddUint64(&s.ResponseTruncatedTotal, 1)
+	}
+	s.updateResponseStats(resp.Rcode, resp.Size)
+}
+
+// updateRequestStats records the duration, size and type of the request msg.
+func (s *CoreStats) updateRequestStats(msg *Message, duration time.Duration) {
 	atomic.AddUint64(&s.RequestCountTotal, 1)
 	// request seconds
 	switch {
@@ -199,8 +275,12 @@ func (s *CoreStats) UpdateStats(addr netip.AddrPort, msg *Message, duration time
 		atomic.AddUint64(&s.RequestTypeCountTotal_SRV, 1)
 	}
 
+}
+
+// updateResponseStats records the rcode and size of a response.
+func (s *CoreStats) updateResponseStats(rcode Rcode, size int) {
 	// response rcode
-	switch msg.Header.Flags.Rcode() {
+	switch rcode {
 	case RcodeNoError:
 		atomic.AddUint64(&s.ResponseRcodeCountTotal_NOERROR, 1)
 	case RcodeFormErr:
@@ -224,7 +304,6 @@ func (s *CoreStats) UpdateStats(addr netip.AddrPort, msg *Message, duration time
 	}
 
 	// response size
-	size = len(msg.Raw)
 	switch {
 	case size == 0:
 		atomic.AddUint64(&s.ResponseSizeBytesBucket_0, 1)
@@ -261,6 +340,42 @@ func (s *CoreStats) UpdateStats(addr netip.AddrPort, msg *Message, duration time
 	atomic.AddUint64(&s.ResponseSizeBytesCount, 1)
 }
 
+// UpdateRateLimitStats records a response limited by ResponseRateLimit.
+func (s *CoreStats) UpdateRateLimitStats(addr netip.AddrPort, action RateLimitAction) {
+	switch action {
+	case RateLimitDrop:
+		atomic.AddUint64(&s.ResponseRateLimitedTotal_DROP, 1)
+	case RateLimitSlip:
+		atomic.AddUint64(&s.ResponseRateLimitedTotal_SLIP, 1)
+	}
+}
+
+// UpdateAccessStats records a query denied by AccessControl.
+func (s *CoreStats) UpdateAccessStats(addr netip.AddrPort, action AccessAction, exceeded bool) {
+	switch {
+	case action == AccessRefuse && !exceeded:
+		atomic.AddUint64(&s.RequestRefusedTotal_ACL, 1)
+	case action == AccessRefuse && exceeded:
+		atomic.AddUint64(&s.RequestRefusedTotal_QPS, 1)
+	case action == AccessDrop && !exceeded:
+		atomic.AddUint64(&s.RequestDroppedTotal_ACL, 1)
+	case action == AccessDrop && exceeded:
+		atomic.AddUint64(&s.RequestDroppedTotal_QPS, 1)
+	}
+}
+
+// UpdateOverloadStats records a query finding all workers busy.
+func (s *CoreStats) UpdateOverloadStats(addr netip.AddrPort, action OverloadAction) {
+	switch action {
+	case OverloadAnswer:
+		atomic.AddUint64(&s.RequestOverloadTotal_ANSWER, 1)
+	case OverloadDrop:
+		atomic.AddUint64(&s.RequestOverloadTotal_DROP, 1)
+	case OverloadPriority:
+		atomic.AddUint64(&s.RequestOverloadTotal_PRIORITY, 1)
+	}
+}
+
 // AppendOpenMetrics appends Prometheus-formatted metrics to dst.
 func (s *CoreStats) AppendOpenMetrics(dst []byte) []byte {
 	b := appendablebytes(dst)
@@ -321,6 +436,7 @@ func (s *CoreStats) AppendOpenMetrics(dst []byte) []byte {
 	b = b.Str(s.Prefix).Str(`dns_response_rcode_count_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",rcode="XRRSET"} `).Uint64(&s.ResponseRcodeCountTotal_XRRSET).Line()
 	b = b.Str(s.Prefix).Str(`dns_response_rcode_count_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",rcode="NOTAUTH"} `).Uint64(&s.ResponseRcodeCountTotal_NOTAUTH).Line()
 	b = b.Str(s.Prefix).Str(`dns_response_rcode_count_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",rcode="NOTZONE"} `).Uint64(&s.ResponseRcodeCountTotal_NOTZONE).Line()
+	b = b.Str(s.Prefix).Str(`dns_response_truncated_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`"} `).Uint64(&s.ResponseTruncatedTotal).Line()
 	b = b.Str(s.Prefix).Str(`dns_response_size_bytes_bucket{proto="`).Str(s.Proto).Str(`",server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",le="0"} `).Uint64(&s.ResponseSizeBytesBucket_0).Line()
 	b = b.Str(s.Prefix).Str(`dns_response_size_bytes_bucket{proto="`).Str(s.Proto).Str(`",server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",le="100"} `).Uint64(&s.ResponseSizeBytesBucket_100).Line()
 	b = b.Str(s.Prefix).Str(`dns_response_size_bytes_bucket{proto="`).Str(s.Proto).Str(`",server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",le="200"} `).Uint64(&s.ResponseSizeBytesBucket_200).Line()
@@ -338,6 +454,15 @@ func (s *CoreStats) AppendOpenMetrics(dst []byte) []byte {
 	b = b.Str(s.Prefix).Str(`dns_response_size_bytes_bucket{proto="`).Str(s.Proto).Str(`",server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",le="+Inf"} `).Uint64(&s.ResponseSizeBytesBucket_Inf).Line()
 	b = b.Str(s.Prefix).Str(`dns_response_size_bytes_sum{proto="`).Str(s.Proto).Str(`",server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`"} `).Uint64(&s.ResponseSizeBytesSum).Line()
 	b = b.Str(s.Prefix).Str(`dns_response_size_bytes_count{proto="`).Str(s.Proto).Str(`",server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`"} `).Uint64(&s.ResponseSizeBytesCount).Line()
+	b = b.Str(s.Prefix).Str(`dns_response_rate_limited_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",action="drop"} `).Uint64(&s.ResponseRateLimitedTotal_DROP).Line()
+	b = b.Str(s.Prefix).Str(`dns_response_rate_limited_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",action="slip"} `).Uint64(&s.ResponseRateLimitedTotal_SLIP).Line()
+	b = b.Str(s.Prefix).Str(`dns_request_refused_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",reason="acl"} `).Uint64(&s.RequestRefusedTotal_ACL).Line()
+	b = b.Str(s.Prefix).Str(`dns_request_refused_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",reason="qps"} `).Uint64(&s.RequestRefusedTotal_QPS).Line()
+	b = b.Str(s.Prefix).Str(`dns_request_dropped_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",reason="acl"} `).Uint64(&s.RequestDroppedTotal_ACL).Line()
+	b = b.Str(s.Prefix).Str(`dns_request_dropped_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",reason="qps"} `).Uint64(&s.RequestDroppedTotal_QPS).Line()
+	b = b.Str(s.Prefix).Str(`dns_request_overload_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",action="answer"} `).Uint64(&s.RequestOverloadTotal_ANSWER).Line()
+	b = b.Str(s.Prefix).Str(`dns_request_overload_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",action="drop"} `).Uint64(&s.RequestOverloadTotal_DROP).Line()
+	b = b.Str(s.Prefix).Str(`dns_request_overload_total{server="`).Str(s.Server).Str(`",zone="`).Str(s.Zone).Str(`",action="priority"} `).Uint64(&s.RequestOverloadTotal_PRIORITY).Line()
 
 	return b
 }
@@ -0,0 +1,591 @@
+package fastdns
+
+import (
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a Stats of a set of listeners, which labels the metrics by listener,
+// protocol, zone, query type and rcode, and appends them in the OpenMetrics text
+// format. Metrics also implements CacheStats for a Cache and UpstreamStats for
+// a Client.
+//
+// The metrics are updated with atomic operations and without allocations, only
+// the first exchange with an upstream server allocates its metrics.
+type Metrics struct {
+	// Prefix specifies the prefix of the metric names, E.g. "coredns_".
+	Prefix string
+
+	// Zones specifies the zones whose queries are counted apart, a query is
+	// labeled by the longest zone it is in, or "." if none.
+	Zones []string
+
+	once      sync.Once
+	zones     [][]byte
+	zoneNames []string
+
+	mu        sync.Mutex
+	listeners atomic.Pointer[[]*ListenerMetrics]
+	direct    atomic.Pointer[ListenerMetrics]
+	upstreams atomic.Pointer[map[string]*upstreamMetrics]
+	cache     [CacheEvict + 1]uint64
+}
+
+// ListenerMetrics is the Stats of a listener of Metrics, see Metrics.Listener.
+type ListenerMetrics struct {
+	metrics     *Metrics
+	server      string
+	proto       string
+	zones       []zoneMetrics
+	rateLimited [RateLimitSlip + 1]uint64
+	refused     [2]uint64 // acl, qps
+	dropped     [2]uint64 // acl, qps
+	overload    [OverloadPriority + 1]uint64
+}
+
+// metricsTypes is the number of query types counted apart, the others are
+// counted as OTHER.
+const metricsTypes = 512
+
+// metricsRcodes is the number of extended response codes counted apart, up to
+// BADCOOKIE, the others are counted as OTHER.
+const metricsRcodes = 24
+
+type zoneMetrics struct {
+	requests     [metricsTypes + 1]uint64
+	responses    [metricsRcodes + 1]uint64
+	truncated    uint64
+	duration     histogram
+	requestSize  histogram
+	responseSize histogram
+}
+
+// maxUpstreams limits the upstream servers counted apart, the others are
+// counted as "other".
+const maxUpstreams = 256
+
+type upstreamMetrics struct {
+	requests  uint64
+	errors    uint64
+	responses [16]uint64
+	duration  histogram
+}
+
+// histogram counts the observations per bucket, the last bucket is +Inf.
+type histogram struct {
+	buckets [17]uint64
+	sum     uint64
+	count   uint64
+}
+
+var (
+	durationBuckets = []uint64{
+		uint64(250 * time.Microsecond), uint64(500 * time.Microsecond),
+		uint64(1 * time.Millisecond), uint64(2 * time.Millisecond), uint64(4 * time.Millisecond), uint64(8 * time.Millisecond),
+		uint64(16 * time.Millisecond), uint64(32 * time.Millisecond), uint64(64 * time.Millisecond), uint64(128 * time.Millisecond),
+		uint64(256 * time.Millisecond), uint64(512 * time.Millisecond), uint64(1024 * time.Millisecond), uint64(2048 * time.Millisecond),
+		uint64(4096 * time.Millisecond), uint64(8192 * time.Millisecond),
+	}
+	sizeBuckets = []uint64{0, 100, 200, 300, 400, 511, 1023, 2047, 4095, 8291, 16000, 32000, 48000, 64000}
+)
+
+// observe counts v in the first bucket of bounds holding it.
+func (h *histogram) observe(bounds []uint64, v uint64) {
+	i := 0
+	for i < len(bounds) && v > bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddUint64(&h.sum, v)
+	atomic.AddUint64(&h.count, 1)
+}
+
+// init encodes the zones, the longest first.
+func (m *Metrics) init() {
+	for _, zone := range m.Zones {
+		m.zones = append(m.zones, encodeZone(zone))
+	}
+	slices.SortStableFunc(m.zones, func(a, b []byte) int { return len(b) - len(a) })
+	for _, zone := range m.zones {
+		m.zoneNames = append(m.zoneNames, zoneName(zone))
+	}
+	m.zoneNames = append(m.zoneNames, ".")
+}
+
+// zoneName returns the text form of the wire zone with the trailing dot.
+func zoneName(zone []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(zone) && zone[i] != 0; i += int(zone[i]) + 1 {
+		sb.Write(zone[i+1 : i+1+int(zone[i])])
+		sb.WriteByte('.')
+	}
+	if sb.Len() == 0 {
+		return "."
+	}
+	return sb.String()
+}
+
+// Listener returns the Stats of the listener server with the protocol proto,
+// E.g. m.Listener("dns://:53", "udp"), the same labels return the same Stats.
+func (m *Metrics) Listener(server, proto string) *ListenerMetrics {
+	m.once.Do(m.init)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var listeners []*ListenerMetrics
+	if p := m.listeners.Load(); p != nil {
+		listeners = *p
+	}
+	for _, l := range listeners {
+		if l.server == server && l.proto == proto {
+			return l
+		}
+	}
+
+	l := &ListenerMetrics{
+		metrics: m,
+		server:  server,
+		proto:   proto,
+		zones:   make([]zoneMetrics, len(m.zoneNames)),
+	}
+	listeners = append(slices.Clip(listeners), l)
+	m.listeners.Store(&listeners)
+	return l
+}
+
+// listener returns the Stats of the updates made on m directly.
+func (m *Metrics) listener() *ListenerMetrics {
+	if l := m.direct.Load(); l != nil {
+		return l
+	}
+	l := m.Listener("", "")
+	m.direct.Store(l)
+	return l
+}
+
+// UpdateStats records the request metrics of a listener without labels.
+func (m *Metrics) UpdateStats(addr netip.AddrPort, msg *Message, duration time.Duration) {
+	m.listener().UpdateStats(addr, msg, duration)
+}
+
+// UpdateResponseStats records the request and response metrics of a listener without labels.
+func (m *Metrics) UpdateResponseStats(addr netip.AddrPort, req *Message, resp ResponseInfo, duration time.Duration) {
+	m.listener().UpdateResponseStats(addr, req, resp, duration)
+}
+
+// UpdateRateLimitStats records a limited response of a listener without labels.
+func (m *Metrics) UpdateRateLimitStats(addr netip.AddrPort, action RateLimitAction) {
+	m.listener().UpdateRateLimitStats(addr, action)
+}
+
+// UpdateAccessStats records a denied query of a listener without labels.
+func (m *Metrics) UpdateAccessStats(addr netip.AddrPort, action AccessAction, exceeded bool) {
+	m.listener().UpdateAccessStats(addr, action, exceeded)
+}
+
+// UpdateOverloadStats records a query finding all workers busy of a listener without labels.
+func (m *Metrics) UpdateOverloadStats(addr netip.AddrPort, action OverloadAction) {
+	m.listener().UpdateOverloadStats(addr, action)
+}
+
+// UpdateCacheStats records an event of a Cache.
+func (m *Metrics) UpdateCacheStats(event CacheEvent) {
+	if event <= CacheEvict {
+		atomic.AddUint64(&m.cache[event], 1)
+	}
+}
+
+// UpdateUpstreamStats records an exchange of a Client with the upstream server addr.
+func (m *Metrics) UpdateUpstreamStats(addr string, resp *Message, duration time.Duration, err error) {
+	u := m.upstream(addr)
+	atomic.AddUint64(&u.requests, 1)
+	if err != nil {
+		atomic.AddUint64(&u.errors, 1)
+	} else {
+		atomic.AddUint64(&u.responses[resp.Header.Flags.Rcode()&0b1111], 1)
+	}
+	u.duration.observe(durationBuckets, uint64(duration))
+}
+
+// upstream returns the metrics of the upstream server addr.
+func (m *Metrics) upstream(addr string) *upstreamMetrics {
+	var upstreams map[string]*upstreamMetrics
+	if p := m.upstreams.Load(); p != nil {
+		upstreams = *p
+	}
+	if u := upstreams[addr]; u != nil {
+		return u
+	}
+	if len(upstreams) >= maxUpstreams {
+		addr = "other"
+		if u := upstreams[addr]; u != nil {
+			return u
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p := m.upstreams.Load(); p != nil {
+		upstreams = *p
+	}
+	if u := upstreams[addr]; u != nil {
+		return u
+	}
+	u := new(upstreamMetrics)
+	clone := maps.Clone(upstreams)
+	if clone == nil {
+		clone = make(map[string]*upstreamMetrics)
+	}
+	clone[addr] = u
+	m.upstreams.Store(&clone)
+	return u
+}
+
+var _ Stats = (*Metrics)(nil)
+var _ ResponseStats = (*Metrics)(nil)
+var _ RateLimitStats = (*Metrics)(nil)
+var _ AccessStats = (*Metrics)(nil)
+var _ OverloadStats = (*Metrics)(nil)
+var _ CacheStats = (*Metrics)(nil)
+var _ UpstreamStats = (*Metrics)(nil)
+
+var _ Stats = (*ListenerMetrics)(nil)
+var _ ResponseStats = (*ListenerMetrics)(nil)
+var _ RateLimitStats = (*ListenerMetrics)(nil)
+var _ AccessStats = (*ListenerMetrics)(nil)
+var _ OverloadStats = (*ListenerMetrics)(nil)
+
+// zone returns the metrics of the longest zone msg is in.
+func (l *ListenerMetrics) zone(msg *Message) *zoneMetrics {
+	zones := l.metrics.zones
+	if len(zones) == 0 || len(msg.Question.Name) > 256 {
+		return &l.zones[len(l.zones)-1]
+	}
+	var buf [256]byte
+	name := append(buf[:0], msg.Question.Name...)
+	lowerASCII(name)
+	for i, zone := range zones {
+		if isSubdomain(name, zone) {
+			return &l.zones[i]
+		}
+	}
+	return &l.zones[len(l.zones)-1]
+}
+
+// updateRequest records the type, duration and size of the request msg in z.
+func (z *zoneMetrics) updateRequest(msg *Message, duration time.Duration) {
+	typ := int(msg.Question.Type)
+	if typ >= metricsTypes {
+		typ = metricsTypes
+	}
+	atomic.AddUint64(&z.requests[typ], 1)
+	z.duration.observe(durationBuckets, uint64(duration))
+	z.requestSize.observe(sizeBuckets, uint64(12+len(msg.Question.Name)+4))
+}
+
+// UpdateStats records the request metrics derived from the message and timing data.
+func (l *ListenerMetrics) UpdateStats(addr netip.AddrPort, msg *Message, duration time.Duration) {
+	z := l.zone(msg)
+	z.updateRequest(msg, duration)
+	atomic.AddUint64(&z.responses[msg.Header.Flags.Rcode()&0b1111], 1)
+	z.responseSize.observe(sizeBuckets, uint64(len(msg.Raw)))
+}
+
+// UpdateResponseStats records the request metrics and the metrics of the
+// response written by the handler.
+func (l *ListenerMetrics) UpdateResponseStats(addr netip.AddrPort, req *Message, resp ResponseInfo, duration time.Duration) {
+	z := l.zone(req)
+	z.updateRequest(req, duration)
+	if resp.Size != 0 {
+		atomic.AddUint64(&z.responses[min(resp.Rcode, metricsRcodes)], 1)
+		if resp.TC {
+			atomic.AddUint64(&z.truncated, 1)
+		}
+	}
+	z.responseSize.observe(sizeBuckets, uint64(resp.Size))
+}
+
+// UpdateRateLimitStats records a response limited by ResponseRateLimit.
+func (l *ListenerMetrics) UpdateRateLimitStats(addr netip.AddrPort, action RateLimitAction) {
+	if action <= RateLimitSlip {
+		atomic.AddUint64(&l.rateLimited[action], 1)
+	}
+}
+
+// UpdateAccessStats records a query denied by AccessControl.
+func (l *ListenerMetrics) UpdateAccessStats(addr netip.AddrPort, action AccessAction, exceeded bool) {
+	i := 0
+	if exceeded {
+		i = 1
+	}
+	switch action {
+	case AccessRefuse:
+		atomic.AddUint64(&l.refused[i], 1)
+	case AccessDrop:
+		atomic.AddUint64(&l.dropped[i], 1)
+	}
+}
+
+// UpdateOverloadStats records a query finding all workers busy.
+func (l *ListenerMetrics) UpdateOverloadStats(addr netip.AddrPort, action OverloadAction) {
+	if action <= OverloadPriority {
+		atomic.AddUint64(&l.overload[action], 1)
+	}
+}
+
+// AppendOpenMetrics appends the metrics of all listeners of the Metrics to dst,
+// so they are exposed once for the set of listeners.
+func (l *ListenerMetrics) AppendOpenMetrics(dst []byte) []byte {
+	return l.metrics.AppendOpenMetrics(dst)
+}
+
+// AppendOpenMetrics appends the metrics in the OpenMetrics text format to dst,
+// including the HELP and TYPE lines of the metric families and the EOF line.
+func (m *Metrics) AppendOpenMetrics(dst []byte) []byte {
+	m.once.Do(m.init)
+
+	var listeners []*ListenerMetrics
+	if p := m.listeners.Load(); p != nil {
+		listeners = *p
+	}
+	var upstreams []string
+	var upstreamMap map[string]*upstreamMetrics
+	if p := m.upstreams.Load(); p != nil {
+		upstreamMap = *p
+		for addr := range upstreamMap {
+			upstreams = append(upstreams, addr)
+		}
+		slices.Sort(upstreams)
+	}
+
+	w := &metricsWriter{b: dst, prefix: m.Prefix}
+
+	w.family("dns_requests", "counter", "Counter of DNS requests per listener, zone and type.")
+	for _, l := range listeners {
+		for i := range l.zones {
+			for typ := range l.zones[i].requests {
+				if n := atomic.LoadUint64(&l.zones[i].requests[typ]); n != 0 {
+					w.sample("dns_requests_total").label("server", l.server).label("proto", l.proto).label("zone", m.zoneNames[i]).label("type", typeLabel(typ)).value(n)
+				}
+			}
+		}
+	}
+
+	w.family("dns_responses", "counter", "Counter of DNS responses per listener, zone and rcode.")
+	for _, l := range listeners {
+		for i := range l.zones {
+			for rcode := range l.zones[i].responses {
+				if n := atomic.LoadUint64(&l.zones[i].responses[rcode]); n != 0 {
+					w.sample("dns_responses_total").label("server", l.server).label("proto", l.proto).label("zone", m.zoneNames[i]).label("rcode", rcodeLabel(rcode)).value(n)
+				}
+			}
+		}
+	}
+
+	w.family("dns_responses_truncated", "counter", "Counter of truncated DNS responses per listener and zone.")
+	for _, l := range listeners {
+		for i := range l.zones {
+			w.sample("dns_responses_truncated_total").label("server", l.server).label("proto", l.proto).label("zone", m.zoneNames[i]).value(atomic.LoadUint64(&l.zones[i].truncated))
+		}
+	}
+
+	for _, h := range []struct {
+		name, help string
+		bounds     []uint64
+		scale      float64
+		histogram  func(z *zoneMetrics) *histogram
+	}{
+		{"dns_request_duration_seconds", "Histogram of the time each request took.", durationBuckets, 1e-9, func(z *zoneMetrics) *histogram { return &z.duration }},
+		{"dns_request_size_bytes", "Histogram of the size of the requests.", sizeBuckets, 1, func(z *zoneMetrics) *histogram { return &z.requestSize }},
+		{"dns_response_size_bytes", "Histogram of the size of the responses.", sizeBuckets, 1, func(z *zoneMetrics) *histogram { return &z.responseSize }},
+	} {
+		w.family(h.name, "histogram", h.help)
+		for _, l := range listeners {
+			for i := range l.zones {
+				w.histogram(h.name, h.histogram(&l.zones[i]), h.bounds, h.scale, "server", l.server, "proto", l.proto, "zone", m.zoneNames[i])
+			}
+		}
+	}
+
+	w.family("dns_response_rate_limited", "counter", "Counter of DNS responses limited by the response rate limit.")
+	for _, l := range listeners {
+		for _, action := range []RateLimitAction{RateLimitDrop, RateLimitSlip} {
+			w.sample("dns_response_rate_limited_total").label("server", l.server).label("proto", l.proto).label("action", action.String()).value(atomic.LoadUint64(&l.rateLimited[action]))
+		}
+	}
+
+	for _, f := range []struct {
+		name, help string
+		counters   func(l *ListenerMetrics) *[2]uint64
+	}{
+		{"dns_requests_refused", "Counter of DNS requests refused by the access control.", func(l *ListenerMetrics) *[2]uint64 { return &l.refused }},
+		{"dns_requests_dropped", "Counter of DNS requests dropped by the access control.", func(l *ListenerMetrics) *[2]uint64 { return &l.dropped }},
+	} {
+		w.family(f.name, "counter", f.help)
+		for _, l := range listeners {
+			for i, reason := range []string{"acl", "qps"} {
+				w.sample(f.name+"_total").label("server", l.server).label("proto", l.proto).label("reason", reason).value(atomic.LoadUint64(&f.counters(l)[i]))
+			}
+		}
+	}
+
+	w.family("dns_requests_overload", "counter", "Counter of DNS requests finding all workers busy.")
+	for _, l := range listeners {
+		for _, action := range []OverloadAction{OverloadAnswer, OverloadDrop, OverloadPriority} {
+			w.sample("dns_requests_overload_total").label("server", l.server).label("proto", l.proto).label("action", action.String()).value(atomic.LoadUint64(&l.overload[action]))
+		}
+	}
+
+	w.family("dns_cache_events", "counter", "Counter of the lookups, refreshes and evictions of the cache.")
+	for _, event := range []CacheEvent{CacheHit, CacheStale, CacheMiss, CacheRefresh, CacheEvict} {
+		w.sample("dns_cache_events_total").label("event", event.String()).value(atomic.LoadUint64(&m.cache[event]))
+	}
+
+	w.family("dns_upstream_requests", "counter", "Counter of requests made per upstream server.")
+	for _, addr := range upstreams {
+		w.sample("dns_upstream_requests_total").label("to", addr).value(atomic.LoadUint64(&upstreamMap[addr].requests))
+	}
+	w.family("dns_upstream_responses", "counter", "Counter of responses received per upstream server and rcode.")
+	for _, addr := range upstreams {
+		for rcode := range upstreamMap[addr].responses {
+			if n := atomic.LoadUint64(&upstreamMap[addr].responses[rcode]); n != 0 {
+				w.sample("dns_upstream_responses_total").label("to", addr).label("rcode", rcodeLabel(rcode)).value(n)
+			}
+		}
+	}
+	w.family("dns_upstream_errors", "counter", "Counter of failed exchanges per upstream server.")
+	for _, addr := range upstreams {
+		w.sample("dns_upstream_errors_total").label("to", addr).value(atomic.LoadUint64(&upstreamMap[addr].errors))
+	}
+	w.family("dns_upstream_request_duration_seconds", "histogram", "Histogram of the time each upstream exchange took.")
+	for _, addr := range upstreams {
+		w.histogram("dns_upstream_request_duration_seconds", &upstreamMap[addr].duration, durationBuckets, 1e-9, "to", addr)
+	}
+
+	w.b = append(w.b, "# EOF\n"...)
+	return w.b
+}
+
+// typeLabel returns the label of the query type index of zoneMetrics.requests.
+func typeLabel(typ int) string {
+	if typ == metricsTypes {
+		return "OTHER"
+	}
+	if s := Type(typ).String(); s != "" {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(typ)
+}
+
+// rcodeLabel returns the label of the rcode, E.g. NXDOMAIN.
+func rcodeLabel(rcode int) string {
+	if rcode == metricsRcodes {
+		return "OTHER"
+	}
+	if s := Rcode(rcode).String(); s != "" {
+		return strings.ToUpper(s)
+	}
+	return "RCODE" + strconv.Itoa(rcode)
+}
+
+// metricsWriter appends the samples of metric families in the OpenMetrics text format.
+type metricsWriter struct {
+	b      []byte
+	prefix string
+	labels bool
+}
+
+// family appends the HELP and TYPE lines of the metric family name.
+func (w *metricsWriter) family(name, typ, help string) {
+	w.b = append(append(append(w.b, "# HELP "...), w.prefix...), name...)
+	w.b = append(append(append(w.b, ' '), help...), '\n')
+	w.b = append(append(append(w.b, "# TYPE "...), w.prefix...), name...)
+	w.b = append(append(append(w.b, ' '), typ...), '\n')
+}
+
+// sample starts a sample of the metric name.
+func (w *metricsWriter) sample(name string) *metricsWriter {
+	w.b = append(append(w.b, w.prefix...), name...)
+	w.labels = false
+	return w
+}
+
+// label appends a label of the sample.
+func (w *metricsWriter) label(name, value string) *metricsWriter {
+	if w.labels {
+		w.b = append(w.b, ',')
+	} else {
+		w.b = append(w.b, '{')
+		w.labels = true
+	}
+	w.b = append(append(w.b, name...), '=', '"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '"':
+			w.b = append(w.b, '\\', c)
+		case '\n':
+			w.b = append(w.b, '\\', 'n')
+		default:
+			w.b = append(w.b, c)
+		}
+	}
+	w.b = append(w.b, '"')
+	return w
+}
+
+// value appends the value of the sample and ends the line.
+func (w *metricsWriter) value(n uint64) {
+	if w.labels {
+		w.b = append(w.b, '}')
+	}
+	w.b = strconv.AppendUint(append(w.b, ' '), n, 10)
+	w.b = append(w.b, '\n')
+}
+
+// float appends the value of the sample and ends the line.
+func (w *metricsWriter) float(f float64) {
+	if w.labels {
+		w.b = append(w.b, '}')
+	}
+	w.b = strconv.AppendFloat(append(w.b, ' '), f, 'g', -1, 64)
+	w.b = append(w.b, '\n')
+}
+
+// histogram appends the buckets, sum and count samples of h with the label pairs,
+// the bounds and sum are multiplied by scale.
+func (w *metricsWriter) histogram(name string, h *histogram, bounds []uint64, scale float64, labels ...string) {
+	var cumulative uint64
+	for i := 0; i <= len(bounds); i++ {
+		cumulative += atomic.LoadUint64(&h.buckets[i])
+		w.sample(name + "_bucket")
+		for j := 0; j < len(labels); j += 2 {
+			w.label(labels[j], labels[j+1])
+		}
+		if i < len(bounds) {
+			w.label("le", strconv.FormatFloat(float64(bounds[i])*scale, 'g', -1, 64))
+		} else {
+			w.label("le", "+Inf")
+		}
+		w.value(cumulative)
+	}
+
+	w.sample(name + "_sum")
+	for j := 0; j < len(labels); j += 2 {
+		w.label(labels[j], labels[j+1])
+	}
+	w.float(float64(atomic.LoadUint64(&h.sum)) * scale)
+
+	w.sample(name + "_count")
+	for j := 0; j < len(labels); j += 2 {
+		w.label(labels[j], labels[j+1])
+	}
+	w.value(cumulative)
+}
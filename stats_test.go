@@ -1,7 +1,9 @@
 package fastdns
 
 import (
+	"context"
 	"net/netip"
+	"strings"
 	"testing"
 	"time"
 )
@@ -121,3 +123,122 @@ func BenchmarkServerAppendOpenMetrics(b *testing.B) {
 		stats.AppendOpenMetrics(buf[:0])
 	}
 }
+
+// TestMetrics labels the metrics by listener, zone, type and rcode, and appends them in the OpenMetrics format.
+func TestMetrics(t *testing.T) {
+	m := &Metrics{Prefix: "coredns_", Zones: []string{"example.org", "Sub.Example.ORG."}}
+	udp, tcp := m.Listener("dns://:53", "udp"), m.Listener("dns://:53", "tcp")
+	if m.Listener("dns://:53", "udp") != udp {
+		t.Errorf("Listener() shall return the same Stats for the same labels")
+	}
+
+	addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 12345)
+	for _, c := range []struct {
+		stats  *ListenerMetrics
+		domain string
+		typ    Type
+		resp   ResponseInfo
+	}{
+		{udp, "www.example.org", TypeA, ResponseInfo{Size: 100, Rcode: RcodeNoError, ANCount: 1}},
+		{udp, "www.sub.example.org", TypeHTTPS, ResponseInfo{Size: 600, Rcode: RcodeNXDomain, TC: true}},
+		{udp, "www.example.net", TypeCAA, ResponseInfo{Size: 30, Rcode: RcodeRefused}},
+		{tcp, "www.example.org", Type(1000), ResponseInfo{Size: 50, Rcode: 12}},
+		{tcp, "www.example.org", TypeA, ResponseInfo{Size: 40, Rcode: RcodeBADCOOKIE}},
+		{tcp, "www.example.org", TypeA, ResponseInfo{}},
+	} {
+		req := AcquireMessage()
+		req.SetRequestQuestion(c.domain, c.typ, ClassINET)
+		c.stats.UpdateResponseStats(addr, req, c.resp, 3*time.Millisecond)
+		ReleaseMessage(req)
+	}
+	udp.UpdateRateLimitStats(addr, RateLimitSlip)
+	tcp.UpdateAccessStats(addr, AccessRefuse, true)
+	m.UpdateOverloadStats(addr, OverloadDrop)
+
+	cache := &Cache{Stats: m}
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(resp)
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+	if cache.Get(req, resp) {
+		t.Errorf("Cache.Get() shall miss")
+	}
+	resp.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+	resp.SetResponseHeader(RcodeNoError, 1)
+	resp.AppendHOST(300, []netip.Addr{netip.AddrFrom4([4]byte{1, 1, 1, 1})})
+	cache.Set(resp)
+	if !cache.Get(req, resp) {
+		t.Errorf("Cache.Get() shall hit")
+	}
+
+	m.UpdateUpstreamStats("192.0.2.53:53", resp, 20*time.Millisecond, nil)
+	m.UpdateUpstreamStats("192.0.2.53:53", nil, time.Second, context.DeadlineExceeded)
+
+	metrics := string(m.AppendOpenMetrics(nil))
+	for _, line := range []string{
+		"# HELP coredns_dns_requests Counter of DNS requests per listener, zone and type.",
+		"# TYPE coredns_dns_requests counter",
+		`coredns_dns_requests_total{server="dns://:53",proto="udp",zone="example.org.",type="A"} 1`,
+		`coredns_dns_requests_total{server="dns://:53",proto="udp",zone="sub.example.org.",type="HTTPS"} 1`,
+		`coredns_dns_requests_total{server="dns://:53",proto="udp",zone=".",type="CAA"} 1`,
+		`coredns_dns_requests_total{server="dns://:53",proto="tcp",zone="example.org.",type="OTHER"} 1`,
+		`coredns_dns_requests_total{server="dns://:53",proto="tcp",zone="example.org.",type="A"} 2`,
+		`coredns_dns_responses_total{server="dns://:53",proto="udp",zone="sub.example.org.",rcode="NXDOMAIN"} 1`,
+		`coredns_dns_responses_total{server="dns://:53",proto="tcp",zone="example.org.",rcode="RCODE12"} 1`,
+		`coredns_dns_responses_total{server="dns://:53",proto="tcp",zone="example.org.",rcode="BADCOOKIE"} 1`,
+		`coredns_dns_responses_truncated_total{server="dns://:53",proto="udp",zone="sub.example.org."} 1`,
+		"# TYPE coredns_dns_request_duration_seconds histogram",
+		`coredns_dns_request_duration_seconds_bucket{server="dns://:53",proto="udp",zone="example.org.",le="0.002"} 0`,
+		`coredns_dns_request_duration_seconds_bucket{server="dns://:53",proto="udp",zone="example.org.",le="0.004"} 1`,
+		`coredns_dns_request_duration_seconds_bucket{server="dns://:53",proto="udp",zone="example.org.",le="+Inf"} 1`,
+		`coredns_dns_request_duration_seconds_sum{server="dns://:53",proto="udp",zone="example.org."} 0.003`,
+		`coredns_dns_response_size_bytes_bucket{server="dns://:53",proto="tcp",zone="example.org.",le="0"} 1`,
+		`coredns_dns_response_size_bytes_count{server="dns://:53",proto="tcp",zone="example.org."} 3`,
+		`coredns_dns_response_rate_limited_total{server="dns://:53",proto="udp",action="slip"} 1`,
+		`coredns_dns_requests_refused_total{server="dns://:53",proto="tcp",reason="qps"} 1`,
+		`coredns_dns_requests_overload_total{server="",proto="",action="drop"} 1`,
+		`coredns_dns_cache_events_total{event="hit"} 1`,
+		`coredns_dns_cache_events_total{event="miss"} 1`,
+		`coredns_dns_upstream_requests_total{to="192.0.2.53:53"} 2`,
+		`coredns_dns_upstream_responses_total{to="192.0.2.53:53",rcode="NOERROR"} 1`,
+		`coredns_dns_upstream_errors_total{to="192.0.2.53:53"} 1`,
+		`coredns_dns_upstream_request_duration_seconds_count{to="192.0.2.53:53"} 2`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("AppendOpenMetrics() shall contain %s", line)
+		}
+	}
+	if !strings.HasSuffix(metrics, "\n# EOF\n") {
+		t.Errorf("AppendOpenMetrics() shall end with # EOF")
+	}
+	if string(udp.AppendOpenMetrics(nil)) != metrics {
+		t.Errorf("ListenerMetrics.AppendOpenMetrics() shall append the metrics of all listeners")
+	}
+
+	// the updates do not allocate.
+	if n := testing.AllocsPerRun(100, func() {
+		udp.UpdateResponseStats(addr, req, ResponseInfo{Size: 100}, time.Millisecond)
+		m.UpdateUpstreamStats("192.0.2.53:53", resp, time.Millisecond, nil)
+		m.UpdateCacheStats(CacheHit)
+	}); n != 0 {
+		t.Errorf("Metrics updates got %v allocations", n)
+	}
+}
+
+// BenchmarkMetricsUpdateResponseStats measures the labeled bookkeeping for incoming requests.
+func BenchmarkMetricsUpdateResponseStats(b *testing.B) {
+	stats := (&Metrics{Zones: []string{"example.org", "example.net"}}).Listener("dns://:53", "udp")
+
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+
+	addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 12345)
+	resp := ResponseInfo{Size: 100, Rcode: RcodeNoError, ANCount: 1}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stats.UpdateResponseStats(addr, req, resp, time.Millisecond)
+	}
+}
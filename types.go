@@ -309,6 +309,7 @@ const (
 	TypeLP         Type = 107
 	TypeEUI48      Type = 108
 	TypeEUI64      Type = 109
+	TypeNXNAME     Type = 128 // Compact denial of existence, RFC 9824
 	TypeURI        Type = 256
 	TypeCAA        Type = 257
 	TypeAVC        Type = 258
@@ -469,6 +470,8 @@ func (t Type) String() string {
 		return "EUI48"
 	case TypeEUI64:
 		return "EUI64"
+	case TypeNXNAME:
+		return "NXNAME"
 	case TypeURI:
 		return "URI"
 	case TypeCAA:
@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"os"
 	"runtime"
 	"syscall"
 	"unsafe"
@@ -30,6 +31,12 @@ func listen(network, address string) (*net.UDPConn, error) {
 	return conn.(*net.UDPConn), nil
 }
 
+// forkSignals returns the signals which roll the child processes and re-execute
+// the master process of a ForkServer.
+func forkSignals() (reload, reexec os.Signal) {
+	return syscall.SIGHUP, syscall.SIGUSR2
+}
+
 // taskset applies a CPU affinity mask to the current process.
 func taskset(cpu int) error {
 	const SYS_SCHED_SETAFFINITY = 203
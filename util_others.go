@@ -5,6 +5,7 @@ package fastdns
 import (
 	"errors"
 	"net"
+	"os"
 )
 
 // listen resolves the UDP address and binds a socket on non-Linux systems.
@@ -17,6 +18,11 @@ func listen(network, address string) (*net.UDPConn, error) {
 	return net.ListenUDP(network, laddr)
 }
 
+// forkSignals reports that the ForkServer signals are unavailable on this platform.
+func forkSignals() (reload, reexec os.Signal) {
+	return nil, nil
+}
+
 // taskset reports that CPU affinity control is unavailable on this platform.
 func taskset(cpu int) error {
 	return errors.New("not implemented")
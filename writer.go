@@ -41,9 +41,60 @@ func (rw *MemResponseWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
+// ResponseInfo describes a response written through a ResponseWriter.
+type ResponseInfo struct {
+	// Size is the size of the response in bytes, 0 if no response is written.
+	Size int
+
+	// Rcode is the rcode of the response, extended by the OPT record if any.
+	Rcode Rcode
+
+	// ANCount is the answer count of the response.
+	ANCount uint16
+
+	// TC reports whether the response is truncated.
+	TC bool
+}
+
+// Parse fills ri from the response p, a short p is recorded by its size only.
+func (ri *ResponseInfo) Parse(p []byte) {
+	*ri = ResponseInfo{Size: len(p)}
+	if len(p) < 12 {
+		return
+	}
+	ri.Rcode = Rcode(p[3] & 0b1111)
+	if p[10] != 0 || p[11] != 0 {
+		// the upper 8 bits of an extended rcode, E.g. BADCOOKIE.
+		ri.Rcode |= Rcode(responseExtendedRcode(p)) << 4
+	}
+	ri.ANCount = uint16(p[6])<<8 | uint16(p[7])
+	ri.TC = p[2]&0b00000010 != 0
+}
+
+// responseExtendedRcode returns the upper 8 bits of the extended rcode in the
+// OPT record of the response p, or 0 if p has no OPT record.
+func responseExtendedRcode(p []byte) byte {
+	offset, err := questionEnd(p)
+	if err != nil {
+		return 0
+	}
+	count := (int(p[6])<<8 | int(p[7])) + (int(p[8])<<8 | int(p[9])) + (int(p[10])<<8 | int(p[11]))
+	for i := 0; i < count; i++ {
+		if offset, err = skipName(p, offset); err != nil || offset+10 > len(p) {
+			return 0
+		}
+		if Type(p[offset])<<8|Type(p[offset+1]) == TypeOPT {
+			return p[offset+4]
+		}
+		offset += 10 + (int(p[offset+8])<<8 | int(p[offset+9]))
+	}
+	return 0
+}
+
 type udpResponseWriter struct {
 	Conn     *net.UDPConn
 	AddrPort netip.AddrPort
+	Response ResponseInfo
 }
 
 // RemoteAddr returns the remote UDP address for the response writer.
@@ -59,5 +110,8 @@ func (rw *udpResponseWriter) LocalAddr() netip.AddrPort {
 // Write sends the DNS response payload to the remote client.
 func (rw *udpResponseWriter) Write(p []byte) (n int, err error) {
 	n, _, err = rw.Conn.WriteMsgUDPAddrPort(p, nil, rw.AddrPort)
+	if err == nil {
+		rw.Response.Parse(p)
+	}
 	return
 }
@@ -50,3 +50,25 @@ func TestResponseWriterMem(t *testing.T) {
 		t.Errorf("response writer return error local address: %+v", s)
 	}
 }
+
+// TestResponseInfoParse reads the size, extended rcode, answer count and TC flag of responses.
+func TestResponseInfoParse(t *testing.T) {
+	for _, c := range []struct {
+		payload []byte
+		info    ResponseInfo
+	}{
+		{nil, ResponseInfo{}},
+		{[]byte("short"), ResponseInfo{Size: 5}},
+		{[]byte{0x12, 0x34, 0x81, 0x83, 0, 1, 0, 0, 0, 1, 0, 0}, ResponseInfo{Size: 12, Rcode: RcodeNXDomain}},
+		{[]byte{0x12, 0x34, 0x83, 0x80, 0, 1, 0, 2, 0, 0, 0, 0}, ResponseInfo{Size: 12, ANCount: 2, TC: true}},
+		// BADCOOKIE, 23 = 1<<4 | 7 extended by the OPT record.
+		{[]byte{0x12, 0x34, 0x81, 0x87, 0, 1, 0, 0, 0, 0, 0, 1, 1, 'a', 0, 0, 1, 0, 1, 0, 0, 41, 4, 0, 1, 0, 0, 0, 0, 0}, ResponseInfo{Size: 30, Rcode: RcodeBADCOOKIE}},
+		{[]byte{0x12, 0x34, 0x81, 0x82, 0, 1, 0, 0, 0, 0, 0, 1, 1, 'a', 0, 0, 1, 0, 1, 0, 0, 41, 4, 0, 0, 0, 0, 0, 0, 0}, ResponseInfo{Size: 30, Rcode: RcodeServFail}},
+	} {
+		var info ResponseInfo
+		info.Parse(c.payload)
+		if info != c.info {
+			t.Errorf("ResponseInfo.Parse(%x) got %+v want %+v", c.payload, info, c.info)
+		}
+	}
+}